@@ -0,0 +1,307 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// adminUsers are the members of the admin group, configured with the environment variable adminUsers
+var adminUsers = map[string]bool{}
+
+// AdminBucket bucket as listed for administrators
+type AdminBucket struct {
+	SAGEBucket
+	FileCount int64 `json:"file_count"`
+	Size      int64 `json:"size"`
+}
+
+// AdminAction entry of the admin audit log
+type AdminAction struct {
+	ID      int64      `json:"id"`
+	Time    *time.Time `json:"time,omitempty"`
+	Admin   string     `json:"admin"`
+	Action  string     `json:"action"`
+	Bucket  string     `json:"bucket,omitempty"`
+	Details string     `json:"details,omitempty"`
+}
+
+// parseAdminUsers parses a comma-separated list of usernames
+func parseAdminUsers(list string) (users map[string]bool) {
+	users = map[string]bool{}
+	for _, u := range strings.Split(list, ",") {
+		u = strings.TrimSpace(u)
+		if u != "" {
+			users[u] = true
+		}
+	}
+	return
+}
+
+func isAdmin(username string) bool {
+	return username != "" && adminUsers[username]
+}
+
+// recordAdminAction writes an entry to the admin audit log, bucketID may be empty
+func recordAdminAction(admin string, action string, bucketID string, details string) (err error) {
+
+	log.Printf("admin action (admin: %s, action: %s, bucket: %s): %s", admin, action, bucketID, details)
+
+	db, err := sql.Open("mysql", mysqlDSN)
+	if err != nil {
+		err = fmt.Errorf("Unable to connect to database: %v", err)
+		return
+	}
+	defer db.Close()
+
+	var bucketArg interface{}
+	if bucketID != "" {
+		bucketArg = bucketID
+	}
+
+	insertQueryStr := "INSERT INTO AdminActions (admin, action, bucket, details) VALUES ( ?, ?, UUID_TO_BIN(?), ? ) ;"
+	_, err = db.Exec(insertQueryStr, admin, action, bucketArg, details)
+	if err != nil {
+		err = fmt.Errorf("Recording admin action failed: %s", err.Error())
+		return
+	}
+	return
+}
+
+// listAdminActions returns the most recent entries of the audit log, optionally only for one bucket
+func listAdminActions(bucketID string, limit int64) (actions []*AdminAction, err error) {
+
+	db, err := sql.Open("mysql", mysqlDSN)
+	if err != nil {
+		err = fmt.Errorf("Unable to connect to database: %v", err)
+		return
+	}
+	defer db.Close()
+
+	queryStr := "SELECT id, time, admin, action, IFNULL(BIN_TO_UUID(bucket), ''), details FROM AdminActions"
+	queryArgs := []interface{}{}
+	if bucketID != "" {
+		queryStr += " WHERE bucket=UUID_TO_BIN(?)"
+		queryArgs = append(queryArgs, bucketID)
+	}
+	queryStr += " ORDER BY id DESC LIMIT ? ;"
+	queryArgs = append(queryArgs, limit)
+
+	rows, err := db.Query(queryStr, queryArgs...)
+	if err != nil {
+		err = fmt.Errorf("db.Query returned: %s (%s)", err.Error(), queryStr)
+		return
+	}
+	defer rows.Close()
+
+	actions = []*AdminAction{}
+	for rows.Next() {
+		a := new(AdminAction)
+		err = rows.Scan(&a.ID, &a.Time, &a.Admin, &a.Action, &a.Bucket, &a.Details)
+		if err != nil {
+			err = fmt.Errorf("(listAdminActions) Could not parse row: %s", err.Error())
+			return
+		}
+		actions = append(actions, a)
+	}
+	return
+}
+
+// adminMW has to run after authMW, it rejects all users that are not in the admin group
+func adminMW(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+
+	vars := mux.Vars(r)
+	username := vars["username"]
+
+	if !isAdmin(username) {
+		respondJSONError(w, deniedStatus(username), "Administrator access required (%s)", username)
+		return
+	}
+
+	next(w, r)
+}
+
+// GET /admin/buckets lists all buckets with owner and size
+func adminListBuckets(w http.ResponseWriter, r *http.Request) {
+
+	vars := mux.Vars(r)
+	username := vars["username"]
+
+	buckets, err := listAllSageBuckets()
+	if err != nil {
+		respondJSONError(w, errorStatus(err, http.StatusInternalServerError), "error getting list of buckets: %s", err.Error())
+		return
+	}
+
+	withSizes := true
+	if _, ok := r.URL.Query()["sizes"]; ok {
+		withSizes, _ = getQueryFieldBool(r, "sizes")
+	}
+
+	err = recordAdminAction(username, "list_buckets", "", "")
+	if err != nil {
+		respondError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	result := []*AdminBucket{}
+	for _, b := range buckets {
+		ab := &AdminBucket{SAGEBucket: *b}
+		if withSizes {
+			ab.FileCount, ab.Size, err = getSageBucketSize(b.ID)
+			if err != nil {
+				respondJSONError(w, errorStatus(err, http.StatusInternalServerError), "error getting size of bucket %s: %s", b.ID, err.Error())
+				return
+			}
+		}
+		result = append(result, ab)
+	}
+
+	respondJSON(w, http.StatusOK, result)
+}
+
+// GET /admin/buckets/{bucket}/permissions
+func adminGetPermissions(w http.ResponseWriter, r *http.Request) {
+
+	vars := mux.Vars(r)
+	username := vars["username"]
+	sageBucketID := vars["bucket"]
+
+	_, err := GetSageBucket(sageBucketID)
+	if err != nil {
+		respondError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	err = recordAdminAction(username, "get_permissions", sageBucketID, "")
+	if err != nil {
+		respondError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	permissions, err := ListBucketPermissions(sageBucketID)
+	if err != nil {
+		respondError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, permissions)
+}
+
+// PUT /admin/buckets/{bucket}/permissions adds a grant, unlike the user endpoint this may also change the owner's grants
+func adminPutPermission(w http.ResponseWriter, r *http.Request) {
+
+	vars := mux.Vars(r)
+	username := vars["username"]
+	sageBucketID := vars["bucket"]
+
+	_, err := GetSageBucket(sageBucketID)
+	if err != nil {
+		respondError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	var newPerm SAGEBucketPermission
+	err = json.NewDecoder(r.Body).Decode(&newPerm)
+	if err != nil {
+		respondJSONError(w, http.StatusBadRequest, "Could not parse json: %s", err.Error())
+		return
+	}
+
+	err = validateNewPermission(&newPerm)
+	if err != nil {
+		respondJSONError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	details := fmt.Sprintf("%s:%s:%s prefix=%q", newPerm.GranteeType, newPerm.Grantee, newPerm.Permission, newPerm.Prefix)
+	err = recordAdminAction(username, "put_permission", sageBucketID, details)
+	if err != nil {
+		respondError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	err = addBucketPermission(sageBucketID, &newPerm)
+	if err != nil {
+		respondError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, newPerm)
+}
+
+// DELETE /admin/buckets/{bucket}/permissions?grantee=<granteeType>:<grantee>[:<permission>]
+func adminDeletePermission(w http.ResponseWriter, r *http.Request) {
+
+	vars := mux.Vars(r)
+	username := vars["username"]
+	sageBucketID := vars["bucket"]
+
+	_, err := GetSageBucket(sageBucketID)
+	if err != nil {
+		respondError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	values := r.URL.Query()
+	grantees := values["grantee"]
+	if len(grantees) == 0 {
+		respondJSONError(w, http.StatusUnprocessableEntity, "query field \"grantee\" missing")
+		return
+	}
+
+	deletePrefix := ""
+	_, hasDeletePrefix := values["prefix"]
+	if hasDeletePrefix {
+		deletePrefix = aclKey(values.Get("prefix"))
+	}
+
+	dr := DeleteRespsonse{}
+	dr.Deleted = []string{}
+	for _, spec := range grantees {
+		granteeType, grantee, deletePermission := parseGranteeSpec(spec)
+
+		err = recordAdminAction(username, "delete_permission", sageBucketID, fmt.Sprintf("%s prefix=%q", spec, deletePrefix))
+		if err != nil {
+			respondError(w, err, http.StatusInternalServerError)
+			return
+		}
+
+		deletedNumber, err := removeBucketPermission(sageBucketID, granteeType, grantee, deletePermission, deletePrefix, hasDeletePrefix)
+		if err != nil {
+			respondError(w, err, http.StatusInternalServerError)
+			return
+		}
+		if deletedNumber > 0 {
+			dr.Deleted = append(dr.Deleted, spec)
+		}
+	}
+
+	respondJSON(w, http.StatusOK, dr)
+}
+
+// GET /admin/audit?bucket=<id>&limit=<n>
+func adminListActions(w http.ResponseWriter, r *http.Request) {
+
+	bucketID, _ := getQueryField(r, "bucket")
+
+	limit, err := getQueryFieldInt64(r, "limit", 100)
+	if err != nil {
+		respondJSONError(w, http.StatusBadRequest, "error parsing query field limit: %s", err.Error())
+		return
+	}
+
+	actions, err := listAdminActions(bucketID, limit)
+	if err != nil {
+		respondError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, actions)
+}
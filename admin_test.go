@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdminAccess(t *testing.T) {
+
+	testuser := "testuser"
+	adminuser := "adminuser"
+	adminUsers[adminuser] = true
+	defer delete(adminUsers, adminuser)
+
+	newBucket, err := createSageBucket(testuser, "training-data", "testing-bucket1", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bucketID := newBucket.ID
+
+	err = CreateFile(t, bucketID, testuser, "file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// non-admin users cannot use admin endpoints
+	req, err := http.NewRequest("GET", "/api/v1/admin/buckets?sizes=false", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Add("Authorization", "sage user:"+testuser)
+	rr := httptest.NewRecorder()
+	mainRouter.ServeHTTP(rr, req)
+	if rr.Code == http.StatusOK {
+		t.Fatalf("non-admin was able to list all buckets")
+	}
+
+	// admin lists all buckets
+	req, err = http.NewRequest("GET", "/api/v1/admin/buckets", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Add("Authorization", "sage user:"+adminuser)
+	rr = httptest.NewRecorder()
+	mainRouter.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v (%s)", rr.Code, http.StatusOK, rr.Body.String())
+	}
+
+	buckets := []*AdminBucket{}
+	err = json.Unmarshal(rr.Body.Bytes(), &buckets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, b := range buckets {
+		if b.ID == bucketID {
+			found = true
+			if b.Owner != testuser {
+				t.Errorf("wrong owner, expected %s, got %s", testuser, b.Owner)
+			}
+			if b.FileCount != 1 || b.Size != int64(len("test-data")) {
+				t.Errorf("wrong size, got %d files, %d bytes", b.FileCount, b.Size)
+			}
+		}
+	}
+	if !found {
+		t.Fatalf("bucket %s not in admin bucket list", bucketID)
+	}
+
+	// admin bypasses bucket permissions
+	req, err = http.NewRequest("GET", fmt.Sprintf("/api/v1/objects/%s/file.txt", bucketID), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Add("Authorization", "sage user:"+adminuser)
+	rr = httptest.NewRecorder()
+	mainRouter.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v (%s)", rr.Code, http.StatusOK, rr.Body.String())
+	}
+
+	actions, err := listAdminActions(bucketID, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(actions) == 0 || actions[0].Admin != adminuser || actions[0].Action != "bypass:"+string(actionReadObject) {
+		t.Fatalf("admin download was not recorded: %v", actions)
+	}
+}
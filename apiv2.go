@@ -0,0 +1,490 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Restructured API, served alongside v1 below /api/v2. Bucket metadata, permissions and files are separate
+// resources with JSON request bodies, nothing depends on query strings without value or on trailing slashes.
+//
+// GET|POST          /buckets
+// GET|PATCH         /buckets/{bucket}/metadata
+// DELETE            /buckets/{bucket}
+// GET|PUT|DELETE    /buckets/{bucket}/permissions
+// GET|HEAD|PUT|DELETE /files/{bucket}/{path...}
+
+const apiV2Prefix = "/api/v2"
+
+// BucketCreation request body of POST /api/v2/buckets
+type BucketCreation struct {
+	Name     string `json:"name"`
+	DataType string `json:"type"`
+	Public   bool   `json:"public"`
+}
+
+// BucketMetadataUpdate request body of PATCH /api/v2/buckets/{bucket}/metadata, fields not set are not modified
+type BucketMetadataUpdate struct {
+	Name *string `json:"name"`
+}
+
+// PermissionRemoval request body of DELETE /api/v2/buckets/{bucket}/permissions
+type PermissionRemoval struct {
+	GranteeType string  `json:"granteeType"`
+	Grantee     string  `json:"grantee"`
+	Permission  string  `json:"permission,omitempty"` // optional, otherwise all permissions of the grantee are removed
+	Prefix      *string `json:"prefix,omitempty"`     // optional, otherwise the grants for all prefixes are removed
+}
+
+// decodeJSONBody rejects unknown fields, typos must not be silently ignored
+func decodeJSONBody(r *http.Request, v interface{}) (err error) {
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(v)
+	if err != nil {
+		err = fmt.Errorf("Could not parse json: %s", err.Error())
+		return
+	}
+	return
+}
+
+// getV2Bucket returns the bucket of the {bucket} path variable
+func getV2Bucket(r *http.Request) (bucket SAGEBucket, statusCode int, err error) {
+
+	sageBucketID := mux.Vars(r)["bucket"]
+	if len(sageBucketID) != 36 {
+		statusCode = http.StatusNotFound
+		err = fmt.Errorf("Bucket %s not found", sageBucketID)
+		return
+	}
+
+	bucket, err = GetSageBucket(sageBucketID)
+	if err != nil {
+		statusCode = errorStatus(err, http.StatusInternalServerError)
+		return
+	}
+	return
+}
+
+// checkV2BucketAccess returns the bucket if the user is allowed to perform action on it
+func checkV2BucketAccess(r *http.Request, action bucketAction) (bucket SAGEBucket, statusCode int, err error) {
+
+	bucket, statusCode, err = getV2Bucket(r)
+	if err != nil {
+		return
+	}
+
+	username := mux.Vars(r)["username"]
+	allowed, err := userIsAllowed(username, bucket.ID, action, "")
+	if err != nil {
+		statusCode = errorStatus(err, http.StatusInternalServerError)
+		return
+	}
+	if !allowed {
+		statusCode = deniedStatus(username)
+		err = fmt.Errorf("Access to bucket denied (%s, %s)", username, bucket.ID)
+		return
+	}
+	return
+}
+
+// GET /api/v2/buckets?owner=<owner>&name=<name>
+func v2ListBuckets(w http.ResponseWriter, r *http.Request) {
+
+	username := mux.Vars(r)["username"]
+	query := r.URL.Query()
+
+	buckets, err := listSageBuckets(username, query.Get("owner"), query.Get("name"))
+	if err != nil {
+		respondJSONError(w, errorStatus(err, http.StatusInternalServerError), "error getting list of buckets: %s", err.Error())
+		return
+	}
+
+	respondJSON(w, http.StatusOK, buckets)
+}
+
+// POST /api/v2/buckets  body: {"name": "...", "type": "training-data", "public": false}
+func v2CreateBucket(w http.ResponseWriter, r *http.Request) {
+
+	username := mux.Vars(r)["username"]
+	if username == "" {
+		respondJSONError(w, http.StatusUnauthorized, "Creating buckets requires authentication")
+		return
+	}
+
+	creation := &BucketCreation{}
+	err := decodeJSONBody(r, creation)
+	if err != nil {
+		respondJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if _, ok := validDataTypes[creation.DataType]; !ok {
+		respondJSONError(w, http.StatusUnprocessableEntity, "Data type \"%s\" not supported", creation.DataType)
+		return
+	}
+
+	bucket, err := createSageBucket(username, creation.DataType, creation.Name, creation.Public)
+	if err != nil {
+		respondJSONError(w, errorStatus(err, http.StatusInternalServerError), "bucket creation failed: %s", err.Error())
+		return
+	}
+
+	respondJSON(w, http.StatusCreated, bucket)
+}
+
+// GET /api/v2/buckets/{bucket}/metadata
+func v2GetBucketMetadata(w http.ResponseWriter, r *http.Request) {
+
+	bucket, statusCode, err := checkV2BucketAccess(r, actionListObjects)
+	if err != nil {
+		respondJSONError(w, statusCode, err.Error())
+		return
+	}
+
+	respondJSON(w, http.StatusOK, bucket)
+}
+
+// PATCH /api/v2/buckets/{bucket}/metadata  body: {"name": "..."}
+func v2PatchBucketMetadata(w http.ResponseWriter, r *http.Request) {
+
+	bucket, statusCode, err := checkV2BucketAccess(r, actionPatchMetadata)
+	if err != nil {
+		respondJSONError(w, statusCode, err.Error())
+		return
+	}
+
+	update := &BucketMetadataUpdate{}
+	err = decodeJSONBody(r, update)
+	if err != nil {
+		respondJSONError(w, http.StatusBadRequest, fmt.Sprintf("%s (the owner is changed with a transfer)", err.Error()))
+		return
+	}
+
+	if update.Name != nil {
+		err = updateSageBucketName(bucket.ID, *update.Name)
+		if err != nil {
+			respondError(w, err, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	bucket, err = GetSageBucket(bucket.ID)
+	if err != nil {
+		respondError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, bucket)
+}
+
+// DELETE /api/v2/buckets/{bucket} deletes the bucket with all files
+func v2DeleteBucket(w http.ResponseWriter, r *http.Request) {
+
+	bucket, statusCode, err := checkV2BucketAccess(r, actionDeleteBucket)
+	if err != nil {
+		respondJSONError(w, statusCode, err.Error())
+		return
+	}
+
+	err = deleteSageBucket(bucket.ID)
+	if err != nil {
+		respondError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("bucket %s deleted by %s", bucket.ID, mux.Vars(r)["username"])
+	respondJSON(w, http.StatusOK, &DeleteRespsonse{Deleted: []string{bucket.ID}})
+}
+
+// GET /api/v2/buckets/{bucket}/permissions
+func v2GetPermissions(w http.ResponseWriter, r *http.Request) {
+
+	bucket, statusCode, err := checkV2BucketAccess(r, actionReadACL)
+	if err != nil {
+		respondJSONError(w, statusCode, err.Error())
+		return
+	}
+
+	permissions, err := ListBucketPermissions(bucket.ID)
+	if err != nil {
+		respondError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, permissions)
+}
+
+// PUT /api/v2/buckets/{bucket}/permissions  body: {"granteeType": "USER", "grantee": "...", "permission": "READ"}
+func v2PutPermission(w http.ResponseWriter, r *http.Request) {
+
+	bucket, statusCode, err := checkV2BucketAccess(r, actionWriteACL)
+	if err != nil {
+		respondJSONError(w, statusCode, err.Error())
+		return
+	}
+
+	newPerm := &SAGEBucketPermission{}
+	err = decodeJSONBody(r, newPerm)
+	if err != nil {
+		respondJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	statusCode, err = grantBucketPermission(bucket.ID, newPerm)
+	if err != nil {
+		respondJSONError(w, statusCode, err.Error())
+		return
+	}
+
+	respondJSON(w, http.StatusOK, newPerm)
+}
+
+// DELETE /api/v2/buckets/{bucket}/permissions  body: {"granteeType": "USER", "grantee": "...", "permission": "READ", "prefix": "..."}
+func v2DeletePermission(w http.ResponseWriter, r *http.Request) {
+
+	bucket, statusCode, err := checkV2BucketAccess(r, actionWriteACL)
+	if err != nil {
+		respondJSONError(w, statusCode, err.Error())
+		return
+	}
+
+	removal := &PermissionRemoval{}
+	err = decodeJSONBody(r, removal)
+	if err != nil {
+		respondJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if removal.GranteeType == "" || removal.Grantee == "" {
+		respondJSONError(w, http.StatusUnprocessableEntity, "granteeType and grantee are required")
+		return
+	}
+
+	if bucket.Owner == removal.Grantee {
+		respondJSONError(w, http.StatusUnprocessableEntity, "You cannot change your own permissons.")
+		return
+	}
+
+	prefix := ""
+	if removal.Prefix != nil {
+		prefix = aclKey(*removal.Prefix)
+	}
+
+	deletedNumber, err := removeBucketPermission(bucket.ID, removal.GranteeType, removal.Grantee, removal.Permission, prefix, removal.Prefix != nil)
+	if err != nil {
+		respondError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	dr := DeleteRespsonse{Deleted: []string{}}
+	if deletedNumber > 0 {
+		if removal.Permission == "" {
+			dr.Deleted = append(dr.Deleted, removal.GranteeType+":"+removal.Grantee)
+		} else {
+			dr.Deleted = append(dr.Deleted, removal.GranteeType+":"+removal.Grantee+":"+removal.Permission)
+		}
+	}
+
+	respondJSON(w, http.StatusOK, dr)
+}
+
+// getV2FilePath returns the SAGE path of /api/v2/files/{bucket}/{path...}, "/" for the bucket itself
+func getV2FilePath(r *http.Request, sageBucketID string) (sagePath string) {
+	sagePath = strings.TrimPrefix(r.URL.Path, apiV2Prefix+"/files/"+sageBucketID)
+	if sagePath == "" {
+		sagePath = "/"
+	}
+	return
+}
+
+// allowsAnyOnPath is checked before a path is resolved, so that users without access to a path
+// cannot tell existing files and folders from missing ones. Folder paths may lack the trailing /, so
+// the path is checked as file and as folder, listing also matches grants on prefixes below the path.
+func allowsAnyOnPath(access *bucketAccess, sagePath string, actions ...bucketAction) bool {
+	key := strings.TrimSuffix(aclKey(sagePath), "/")
+	for _, action := range actions {
+		if access.allows(action, key) || (key != "" && access.allows(action, key+"/")) {
+			return true
+		}
+	}
+	return false
+}
+
+// GET|HEAD /api/v2/files/{bucket}/{path...} downloads a file or lists a folder, the trailing / of folders is optional.
+// Folder query: recursive=true, limit=<n>, continuation_token=<token>, archive=zip|tar.gz
+func v2GetFile(w http.ResponseWriter, r *http.Request) {
+
+	username := mux.Vars(r)["username"]
+
+	bucket, statusCode, err := getV2Bucket(r)
+	if err != nil {
+		respondJSONError(w, statusCode, err.Error())
+		return
+	}
+
+	sagePath := getV2FilePath(r, bucket.ID)
+
+	access, err := getBucketAccess(username, bucket.ID)
+	if err != nil {
+		respondError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if !allowsAnyOnPath(access, sagePath, actionReadObject, actionListObjects) {
+		respondJSONError(w, deniedStatus(username), "Read access to %s denied", sagePath)
+		return
+	}
+
+	res, err := resolveSageResource(bucket.ID, sagePath)
+	if err != nil {
+		respondError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if res == nil {
+		respondJSONError(w, http.StatusNotFound, "%s not found", sagePath)
+		return
+	}
+
+	if !res.isFolder() {
+		if !access.allows(actionReadObject, aclKey(res.sagePath)) {
+			respondJSONError(w, deniedStatus(username), "Read access to %s denied", res.sagePath)
+			return
+		}
+		downloadSageObject(w, r, bucket.ID, res.sagePath)
+		return
+	}
+
+	if !access.allows(actionListObjects, aclKey(res.sagePath)) {
+		respondJSONError(w, deniedStatus(username), "List access to %s denied", res.sagePath)
+		return
+	}
+
+	if _, ok := r.URL.Query()["archive"]; ok {
+		downloadFolderArchive(w, r, username, bucket.ID, res.sagePath)
+		return
+	}
+
+	recursive, _ := getQueryFieldBool(r, "recursive")
+	continuationToken := r.URL.Query().Get("continuation_token")
+	limit, err := getQueryFieldInt64(r, "limit", 0)
+	if err != nil {
+		respondJSONError(w, http.StatusBadRequest, "error parsing query field limit: %s", err.Error())
+		return
+	}
+
+	respondFolderListing(w, r, access, bucket.ID, res.sagePath, recursive, limit, continuationToken)
+}
+
+// PUT /api/v2/files/{bucket}/{path...} stores the request body as file, a path ending with / creates an empty folder
+func v2PutFile(w http.ResponseWriter, r *http.Request) {
+
+	username := mux.Vars(r)["username"]
+
+	bucket, statusCode, err := getV2Bucket(r)
+	if err != nil {
+		respondJSONError(w, statusCode, err.Error())
+		return
+	}
+
+	sagePath := getV2FilePath(r, bucket.ID)
+	if sagePath == "/" {
+		respondJSONError(w, http.StatusBadRequest, "path of the file is missing")
+		return
+	}
+
+	allowed, err := userIsAllowed(username, bucket.ID, actionWriteObject, aclKey(sagePath))
+	if err != nil {
+		respondError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if !allowed {
+		respondJSONError(w, deniedStatus(username), "Write access to %s denied", sagePath)
+		return
+	}
+
+	if strings.HasSuffix(sagePath, "/") {
+		_, err = putSageFolderMarker(bucket.ID, sagePath, username)
+		if err != nil {
+			respondError(w, err, http.StatusInternalServerError)
+			return
+		}
+		respondJSON(w, http.StatusOK, &SageFile{Bucket: bucket.ID, Key: aclKey(sagePath)})
+		return
+	}
+
+	uploadRawObject(w, r, username, bucket.ID, sagePath)
+}
+
+// DELETE /api/v2/files/{bucket}/{path...} deletes a file. Folders are only deleted with recursive=true,
+// the response lists deleted files and the files the user was not allowed to delete.
+func v2DeleteFile(w http.ResponseWriter, r *http.Request) {
+
+	username := mux.Vars(r)["username"]
+
+	bucket, statusCode, err := getV2Bucket(r)
+	if err != nil {
+		respondJSONError(w, statusCode, err.Error())
+		return
+	}
+
+	sagePath := getV2FilePath(r, bucket.ID)
+	if sagePath == "/" {
+		respondJSONError(w, http.StatusBadRequest, "use DELETE %s/buckets/%s to delete the bucket", apiV2Prefix, bucket.ID)
+		return
+	}
+
+	access, err := getBucketAccess(username, bucket.ID)
+	if err != nil {
+		respondError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if !allowsAnyOnPath(access, sagePath, actionDeleteObject, actionListObjects) {
+		respondJSONError(w, deniedStatus(username), "Delete access to %s denied", sagePath)
+		return
+	}
+
+	res, err := resolveSageResource(bucket.ID, sagePath)
+	if err != nil {
+		respondError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if res == nil {
+		respondJSONError(w, http.StatusNotFound, "%s not found", sagePath)
+		return
+	}
+
+	if !res.isFolder() {
+		if !access.allows(actionDeleteObject, aclKey(res.sagePath)) {
+			respondJSONError(w, deniedStatus(username), "Delete access to %s denied", res.sagePath)
+			return
+		}
+		deleted, err := deleteSAGEFiles(bucket.ID, []string{res.sagePath})
+		if err != nil {
+			respondJSONError(w, errorStatus(err, http.StatusInternalServerError), "Deleting files failed: %s", err.Error())
+			return
+		}
+		respondJSON(w, http.StatusOK, &DeleteRespsonse{Deleted: deleted})
+		return
+	}
+
+	recursive, _ := getQueryFieldBool(r, "recursive")
+	if !recursive {
+		respondJSONError(w, http.StatusConflict, "%s is a folder, use recursive=true to delete it with all files", res.sagePath)
+		return
+	}
+
+	response := &BulkDeleteResponse{Bucket: bucket.ID, Deleted: []string{}}
+	statusCode, err = deleteFolder(access, bucket.ID, res.sagePath, response)
+	if err != nil {
+		respondJSONError(w, statusCode, err.Error())
+		return
+	}
+
+	log.Printf("recursive delete of %s/%s: %d deleted, %d failed", bucket.ID, res.sagePath, len(response.Deleted), len(response.Errors))
+	respondBulkDelete(w, response)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestAPIv2(t *testing.T) {
+
+	testuser := "testuser"
+
+	// unknown fields are rejected
+	expectStatus(t, testRequest(t, testuser, "POST", "/api/v2/buckets", strings.NewReader(`{"name": "testing-bucket1", "typ": "training-data"}`), nil), http.StatusBadRequest)
+
+	rr := testRequest(t, testuser, "POST", "/api/v2/buckets", strings.NewReader(`{"name": "testing-bucket1", "type": "training-data"}`), nil)
+	expectStatus(t, rr, http.StatusCreated)
+	bucket := &SAGEBucket{}
+	err := json.Unmarshal(rr.Body.Bytes(), bucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr = testRequest(t, testuser, "PATCH", "/api/v2/buckets/"+bucket.ID+"/metadata", strings.NewReader(`{"name": "testing-bucket2"}`), nil)
+	expectStatus(t, rr, http.StatusOK)
+	rr = testRequest(t, testuser, "GET", "/api/v2/buckets/"+bucket.ID+"/metadata", nil, nil)
+	expectStatus(t, rr, http.StatusOK)
+	json.Unmarshal(rr.Body.Bytes(), bucket)
+	if bucket.Name != "testing-bucket2" {
+		t.Fatalf("bucket was not renamed: %s", rr.Body.String())
+	}
+	expectStatus(t, testRequest(t, testuser, "PATCH", "/api/v2/buckets/"+bucket.ID+"/metadata", strings.NewReader(`{"owner": "otheruser"}`), nil), http.StatusBadRequest)
+
+	// permissions
+	expectStatus(t, testRequest(t, "otheruser", "GET", "/api/v2/buckets/"+bucket.ID+"/metadata", nil, nil), http.StatusForbidden)
+	expectStatus(t, testRequest(t, testuser, "PUT", "/api/v2/buckets/"+bucket.ID+"/permissions", strings.NewReader(`{"granteeType": "USER", "grantee": "otheruser", "permission": "READ"}`), nil), http.StatusOK)
+	expectStatus(t, testRequest(t, "otheruser", "GET", "/api/v2/buckets/"+bucket.ID+"/metadata", nil, nil), http.StatusOK)
+
+	rr = testRequest(t, testuser, "GET", "/api/v2/buckets/"+bucket.ID+"/permissions", nil, nil)
+	expectStatus(t, rr, http.StatusOK)
+	if !strings.Contains(rr.Body.String(), `"grantee": "otheruser"`) {
+		t.Fatalf("grant missing: %s", rr.Body.String())
+	}
+
+	rr = testRequest(t, testuser, "DELETE", "/api/v2/buckets/"+bucket.ID+"/permissions", strings.NewReader(`{"granteeType": "USER", "grantee": "otheruser"}`), nil)
+	expectStatus(t, rr, http.StatusOK)
+	if !strings.Contains(rr.Body.String(), "USER:otheruser") {
+		t.Fatalf("grant was not deleted: %s", rr.Body.String())
+	}
+	expectStatus(t, testRequest(t, "otheruser", "GET", "/api/v2/buckets/"+bucket.ID+"/metadata", nil, nil), http.StatusForbidden)
+
+	// files, the trailing / of folders is optional
+	expectStatus(t, testRequest(t, testuser, "PUT", "/api/v2/files/"+bucket.ID+"/data/a.txt", strings.NewReader("file a"), nil), http.StatusOK)
+
+	rr = testRequest(t, testuser, "GET", "/api/v2/files/"+bucket.ID+"/data/a.txt", nil, nil)
+	expectStatus(t, rr, http.StatusOK)
+	if rr.Body.String() != "file a" {
+		t.Fatalf("unexpected content: %s", rr.Body.String())
+	}
+
+	for _, folder := range []string{"data", "data/"} {
+		rr = testRequest(t, testuser, "GET", "/api/v2/files/"+bucket.ID+"/"+folder, nil, nil)
+		expectStatus(t, rr, http.StatusOK)
+		if !strings.Contains(rr.Body.String(), "a.txt") {
+			t.Fatalf("listing of %s is missing a.txt: %s", folder, rr.Body.String())
+		}
+	}
+
+	// users without access get the same response for existing and missing paths
+	for _, path := range []string{"data/a.txt", "data/missing.txt", "data", "missing"} {
+		expectStatus(t, testRequest(t, "otheruser", "GET", "/api/v2/files/"+bucket.ID+"/"+path, nil, nil), http.StatusForbidden)
+		expectStatus(t, testRequest(t, "otheruser", "DELETE", "/api/v2/files/"+bucket.ID+"/"+path, nil, nil), http.StatusForbidden)
+	}
+
+	expectStatus(t, testRequest(t, testuser, "DELETE", "/api/v2/files/"+bucket.ID+"/data", nil, nil), http.StatusConflict)
+	expectStatus(t, testRequest(t, testuser, "DELETE", "/api/v2/files/"+bucket.ID+"/data?recursive=true", nil, nil), http.StatusOK)
+	expectStatus(t, testRequest(t, testuser, "GET", "/api/v2/files/"+bucket.ID+"/data/a.txt", nil, nil), http.StatusNotFound)
+
+	expectStatus(t, testRequest(t, testuser, "DELETE", "/api/v2/buckets/"+bucket.ID, nil, nil), http.StatusOK)
+	expectStatus(t, testRequest(t, testuser, "GET", "/api/v2/buckets/"+bucket.ID+"/metadata", nil, nil), http.StatusNotFound)
+
+	// the grants are deleted with the bucket
+	permissions, err := ListBucketPermissions(bucket.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(permissions) != 0 {
+		t.Fatalf("%d permissions left after deleting the bucket", len(permissions))
+	}
+}
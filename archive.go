@@ -0,0 +1,176 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// archiveWriter writes the files of a folder archive one after the other
+type archiveWriter interface {
+	addFile(object *s3.Object, name string, body io.Reader) error
+	Close() error
+}
+
+type zipArchive struct {
+	zw *zip.Writer
+}
+
+func (a *zipArchive) addFile(object *s3.Object, name string, body io.Reader) (err error) {
+	fh := &zip.FileHeader{
+		Name:     name,
+		Method:   zip.Deflate,
+		Modified: aws.TimeValue(object.LastModified),
+	}
+	fh.SetMode(0644)
+	w, err := a.zw.CreateHeader(fh)
+	if err != nil {
+		return
+	}
+	err = copyDownload(w, body)
+	return
+}
+
+func (a *zipArchive) Close() error {
+	return a.zw.Close()
+}
+
+type tarGzArchive struct {
+	gz *gzip.Writer
+	tw *tar.Writer
+}
+
+func (a *tarGzArchive) addFile(object *s3.Object, name string, body io.Reader) (err error) {
+	size := aws.Int64Value(object.Size)
+	err = a.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     size,
+		Mode:     0644,
+		ModTime:  aws.TimeValue(object.LastModified),
+		Format:   tar.FormatPAX, // no limits on size and name length
+	})
+	if err != nil {
+		return
+	}
+	// the size in the header has to match exactly
+	err = copyDownload(a.tw, io.LimitReader(body, size))
+	return
+}
+
+func (a *tarGzArchive) Close() (err error) {
+	err = a.tw.Close()
+	if err != nil {
+		return
+	}
+	err = a.gz.Close()
+	return
+}
+
+// downloadFolderArchive streams all files below the folder that the user can read as zip or tar.gz archive.
+// Files are fetched one at a time and written directly to the response, nothing is buffered on disk.
+func downloadFolderArchive(w http.ResponseWriter, r *http.Request, username string, sageBucketID string, folder string) {
+
+	format, _ := getQueryField(r, "archive")
+
+	access, err := getBucketAccess(username, sageBucketID)
+	if err != nil {
+		respondError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	archiveName := path.Base(strings.TrimSuffix(folder, "/"))
+	if archiveName == "." || archiveName == "/" || archiveName == "" {
+		archiveName = sageBucketID
+	}
+
+	var archive archiveWriter
+	switch format {
+	case "zip":
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", "attachment; filename="+archiveName+".zip")
+		archive = &zipArchive{zw: zip.NewWriter(w)}
+	case "tar.gz", "tgz":
+		w.Header().Set("Content-Type", "application/gzip")
+		w.Header().Set("Content-Disposition", "attachment; filename="+archiveName+".tar.gz")
+		gz := gzip.NewWriter(w)
+		archive = &tarGzArchive{gz: gz, tw: tar.NewWriter(gz)}
+	default:
+		respondJSONError(w, http.StatusBadRequest, "archive must be \"zip\" or \"tar.gz\"")
+		return
+	}
+
+	s3BucketName := getS3BucketID(sageBucketID)
+	prefix := s3FolderPrefix(sageBucketID, folder)
+
+	// headers cannot be changed once the first file is written, later errors truncate the archive
+	started := false
+	fileCount := 0
+	var archiveErr error
+
+	err = svc.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(s3BucketName),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range page.Contents {
+			s3Key := aws.StringValue(object.Key)
+			if strings.HasSuffix(s3Key, "/") {
+				continue
+			}
+			sageKey := strings.TrimPrefix(s3Key, sageBucketID+"/")
+			if !access.allows(actionReadObject, sageKey) {
+				continue
+			}
+
+			out, err := svc.GetObject(&s3.GetObjectInput{
+				Bucket:  aws.String(s3BucketName),
+				Key:     aws.String(s3Key),
+				IfMatch: object.ETag,
+			})
+			if err != nil {
+				archiveErr = fmt.Errorf("svc.GetObject returned for %s: %s", sageKey, err.Error())
+				return false
+			}
+
+			if !started {
+				w.WriteHeader(http.StatusOK)
+				started = true
+			}
+			err = archive.addFile(object, strings.TrimPrefix(s3Key, prefix), out.Body)
+			out.Body.Close()
+			if err != nil {
+				archiveErr = fmt.Errorf("adding %s failed: %s", sageKey, err.Error())
+				return false
+			}
+			fileCount++
+		}
+		return true
+	})
+	if err == nil {
+		err = archiveErr
+	}
+	if err != nil {
+		if !started {
+			respondJSONError(w, http.StatusInternalServerError, "Error creating archive: %s", err.Error())
+			return
+		}
+		log.Printf("archive of %s/%s aborted: %s", sageBucketID, folder, err.Error())
+		return
+	}
+
+	err = archive.Close()
+	if err != nil {
+		log.Printf("archive of %s/%s aborted: %s", sageBucketID, folder, err.Error())
+		return
+	}
+	log.Printf("archive of %s/%s with %d files sent", sageBucketID, folder, fileCount)
+}
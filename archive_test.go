@@ -0,0 +1,105 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestFolderArchive(t *testing.T) {
+
+	testuser := "testuser"
+
+	newBucket, err := createSageBucket(testuser, "training-data", "testing-bucket1", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bucketID := newBucket.ID
+
+	files := map[string]string{
+		"data/a.txt":     "file a",
+		"data/sub/b.txt": "file b",
+		"other/c.txt":    "not in archive",
+	}
+	for key, content := range files {
+		err = putSageObject(bucketID, key, strings.NewReader(content), testuser, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected := "a.txt=file a,sub/b.txt=file b"
+
+	download := func(format string) []byte {
+		rr := testRequest(t, testuser, "GET", fmt.Sprintf("/api/v1/objects/%s/data/?archive=%s", bucketID, format), nil, nil)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("archive=%s returned %d: %s", format, rr.Code, rr.Body.String())
+		}
+		return rr.Body.Bytes()
+	}
+
+	// zip
+	data := download("zip")
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := []string{}
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, _ := ioutil.ReadAll(rc)
+		rc.Close()
+		entries = append(entries, f.Name+"="+string(content))
+	}
+	sort.Strings(entries)
+	if strings.Join(entries, ",") != expected {
+		t.Fatalf("unexpected zip entries %v", entries)
+	}
+
+	// tar.gz
+	data = download("tar.gz")
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gz)
+	entries = []string{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, _ := ioutil.ReadAll(tr)
+		entries = append(entries, hdr.Name+"="+string(content))
+	}
+	sort.Strings(entries)
+	if strings.Join(entries, ",") != expected {
+		t.Fatalf("unexpected tar entries %v", entries)
+	}
+
+	// other users cannot download the private folder
+	req, err := http.NewRequest("GET", fmt.Sprintf("/api/v1/objects/%s/data/?archive=zip", bucketID), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Add("Authorization", "sage user:otheruser")
+	rr := httptest.NewRecorder()
+	mainRouter.ServeHTTP(rr, req)
+	if rr.Code == http.StatusOK {
+		t.Fatalf("otheruser was able to download archive")
+	}
+}
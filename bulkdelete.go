@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// maxDeleteKeys maximum number of keys of one bulk delete request, same as one S3 DeleteObjects request
+const maxDeleteKeys = 1000
+
+// KeyError failure of one key of a bulk operation
+type KeyError struct {
+	Key   string    `json:"key"`
+	Error string    `json:"error"`
+	Code  errorCode `json:"code,omitempty"`
+}
+
+// BulkDeleteRequest body of POST /objects/{bucket}?delete
+type BulkDeleteRequest struct {
+	Keys []string `json:"keys"`
+}
+
+// BulkDeleteResponse per-key results of a bulk delete, with dry_run Deleted lists the keys that would be deleted
+type BulkDeleteResponse struct {
+	ErrorStruct `json:",inline"`
+	Bucket      string      `json:"bucket-id,omitempty"`
+	DryRun      bool        `json:"dry_run,omitempty"`
+	Deleted     []string    `json:"deleted"`
+	Errors      []*KeyError `json:"errors,omitempty"`
+}
+
+// deleteSAGEKeys deletes up to maxDeleteKeys keys with one request and reports failures per key.
+// Like S3, keys that do not exist count as deleted.
+func deleteSAGEKeys(sageBucketID string, keys []string) (deleted []string, failed []*KeyError, err error) {
+
+	objectIdentifiers := []*s3.ObjectIdentifier{}
+	for _, key := range keys {
+		objectIdentifiers = append(objectIdentifiers, &s3.ObjectIdentifier{Key: aws.String(sageBucketID + "/" + key)})
+	}
+
+	out, err := svc.DeleteObjects(&s3.DeleteObjectsInput{
+		Bucket: aws.String(getS3BucketID(sageBucketID)),
+		Delete: &s3.Delete{
+			Objects: objectIdentifiers,
+			Quiet:   aws.Bool(false),
+		},
+	})
+	if err != nil {
+		err = fmt.Errorf("svc.DeleteObjects returned: %s", err.Error())
+		return
+	}
+
+	for _, d := range out.Deleted {
+		deleted = append(deleted, strings.TrimPrefix(aws.StringValue(d.Key), sageBucketID+"/"))
+	}
+	for _, e := range out.Errors {
+		failed = append(failed, &KeyError{
+			Key:   strings.TrimPrefix(aws.StringValue(e.Key), sageBucketID+"/"),
+			Error: fmt.Sprintf("%s: %s", aws.StringValue(e.Code), aws.StringValue(e.Message)),
+			Code:  codeInternal,
+		})
+	}
+	return
+}
+
+// deleteAllowedKeys deletes the keys the user may delete (unless dryRun) and adds the results to the response
+func deleteAllowedKeys(access *bucketAccess, sageBucketID string, keys []string, dryRun bool, response *BulkDeleteResponse) (err error) {
+
+	allowed := []string{}
+	for _, key := range keys {
+		if !access.allows(actionDeleteObject, key) {
+			response.Errors = append(response.Errors, &KeyError{Key: key, Error: "Delete access denied", Code: codeForbidden})
+			continue
+		}
+		allowed = append(allowed, key)
+	}
+
+	if len(allowed) == 0 {
+		return
+	}
+	if dryRun {
+		response.Deleted = append(response.Deleted, allowed...)
+		return
+	}
+
+	deleted, failed, err := deleteSAGEKeys(sageBucketID, allowed)
+	if err != nil {
+		return
+	}
+	response.Deleted = append(response.Deleted, deleted...)
+	response.Errors = append(response.Errors, failed...)
+	return
+}
+
+// respondBulkDelete uses status 207 if some keys could not be deleted
+func respondBulkDelete(w http.ResponseWriter, response *BulkDeleteResponse) {
+	statusCode := http.StatusOK
+	if len(response.Errors) > 0 {
+		statusCode = http.StatusMultiStatus
+	}
+	respondJSON(w, statusCode, response)
+}
+
+// POST /objects/{bucket}?delete[&dry_run]   body: {"keys": ["a.txt", "folder/b.txt"]}
+func bulkDeleteRequest(w http.ResponseWriter, r *http.Request, username string, sageBucketID string) {
+
+	request := &BulkDeleteRequest{}
+	err := json.NewDecoder(r.Body).Decode(request)
+	if err != nil {
+		respondJSONError(w, http.StatusBadRequest, "Could not parse json: %s", err.Error())
+		return
+	}
+
+	if len(request.Keys) == 0 {
+		respondJSONError(w, http.StatusUnprocessableEntity, "keys missing")
+		return
+	}
+	if len(request.Keys) > maxDeleteKeys {
+		respondJSONError(w, http.StatusUnprocessableEntity, "At most %d keys can be deleted with one request", maxDeleteKeys)
+		return
+	}
+
+	keys := []string{}
+	for _, key := range request.Keys {
+		cleaned := aclKey(path.Clean("/" + key))
+		if cleaned == "" {
+			respondJSONError(w, http.StatusUnprocessableEntity, "Invalid key %q", key)
+			return
+		}
+		if strings.HasSuffix(key, "/") {
+			// folder marker, the content of the folder is not deleted
+			cleaned += "/"
+		}
+		keys = append(keys, cleaned)
+	}
+
+	access, err := getBucketAccess(username, sageBucketID)
+	if err != nil {
+		respondError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	_, dryRun := r.URL.Query()["dry_run"]
+	response := &BulkDeleteResponse{Bucket: sageBucketID, DryRun: dryRun, Deleted: []string{}}
+	err = deleteAllowedKeys(access, sageBucketID, keys, response.DryRun, response)
+	if err != nil {
+		respondJSONError(w, errorStatus(err, http.StatusInternalServerError), "Deleting files failed: %s", err.Error())
+		return
+	}
+
+	log.Printf("bulk delete in %s: %d deleted, %d failed (dry_run: %t)", sageBucketID, len(response.Deleted), len(response.Errors), response.DryRun)
+	respondBulkDelete(w, response)
+}
+
+// deleteFolder deletes the folder and all files below it that the user may delete, one listing page at a time
+func deleteFolder(access *bucketAccess, sageBucketID string, folder string, response *BulkDeleteResponse) (statusCode int, err error) {
+
+	folderKey := aclKey(folder)
+
+	continuationToken := ""
+	for {
+		var listObject *s3.ListObjectsV2Output
+		listObject, err = listSageBucketContent(sageBucketID, folder, true, maxDeleteKeys, "", continuationToken)
+		if err != nil {
+			statusCode = errorStatus(err, http.StatusInternalServerError)
+			return
+		}
+
+		keys := []string{}
+		for _, object := range listObject.Contents {
+			keys = append(keys, folderKey+aws.StringValue(object.Key))
+		}
+
+		err = deleteAllowedKeys(access, sageBucketID, keys, response.DryRun, response)
+		if err != nil {
+			statusCode = errorStatus(err, http.StatusInternalServerError)
+			err = fmt.Errorf("Deleting files failed (%d deleted before): %s", len(response.Deleted), err.Error())
+			return
+		}
+
+		if !aws.BoolValue(listObject.IsTruncated) {
+			return
+		}
+		continuationToken = aws.StringValue(listObject.NextContinuationToken)
+	}
+}
+
+// DELETE /objects/{bucket}/{folder}/?recursive[&dry_run] deletes the folder and all files below it
+func deleteFolderRequest(w http.ResponseWriter, r *http.Request, username string, sageBucketID string, folder string) {
+
+	if !strings.HasSuffix(folder, "/") {
+		respondJSONError(w, http.StatusBadRequest, "recursive deletes need a folder, the key has to end with /")
+		return
+	}
+
+	access, err := getBucketAccess(username, sageBucketID)
+	if err != nil {
+		respondError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	_, dryRun := r.URL.Query()["dry_run"]
+	response := &BulkDeleteResponse{Bucket: sageBucketID, DryRun: dryRun, Deleted: []string{}}
+
+	statusCode, err := deleteFolder(access, sageBucketID, folder, response)
+	if err != nil {
+		respondJSONError(w, statusCode, err.Error())
+		return
+	}
+
+	log.Printf("recursive delete of %s/%s: %d deleted, %d failed (dry_run: %t)", sageBucketID, folder, len(response.Deleted), len(response.Errors), response.DryRun)
+	respondBulkDelete(w, response)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestBulkDelete(t *testing.T) {
+
+	testuser := "testuser"
+
+	newBucket, err := createSageBucket(testuser, "training-data", "testing-bucket1", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bucketID := newBucket.ID
+
+	for _, key := range []string{"a.txt", "b.txt", "data/c.txt", "data/sub/d.txt", "other/e.txt"} {
+		err = putSageObject(bucketID, key, strings.NewReader("content of "+key), testuser, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// deleted returns the sorted keys of a bulk delete response
+	deleted := func(rr *httptest.ResponseRecorder) (response *BulkDeleteResponse, keys string) {
+		response = &BulkDeleteResponse{}
+		json.Unmarshal(rr.Body.Bytes(), response)
+		sort.Strings(response.Deleted)
+		keys = strings.Join(response.Deleted, ",")
+		return
+	}
+
+	exists := func(key string) bool {
+		return testRequest(t, testuser, "HEAD", fmt.Sprintf("/api/v1/objects/%s/%s", bucketID, key), nil, nil).Code == http.StatusOK
+	}
+
+	// dry run of a recursive delete lists the files but keeps them
+	rr := testRequest(t, testuser, "DELETE", fmt.Sprintf("/api/v1/objects/%s/data/?recursive&dry_run", bucketID), nil, nil)
+	if response, keys := deleted(rr); rr.Code != http.StatusOK || !response.DryRun || keys != "data/c.txt,data/sub/d.txt" {
+		t.Fatalf("dry run returned %d: %s", rr.Code, rr.Body.String())
+	}
+	if !exists("data/c.txt") {
+		t.Fatalf("dry run deleted data/c.txt")
+	}
+
+	// recursive=false and other parameters do not delete the folder content
+	for _, query := range []string{"recursive=false", "nonrecursive"} {
+		testRequest(t, testuser, "DELETE", fmt.Sprintf("/api/v1/objects/%s/data/?%s", bucketID, query), nil, nil)
+		if !exists("data/c.txt") || !exists("data/sub/d.txt") {
+			t.Fatalf("delete with ?%s removed the folder content", query)
+		}
+	}
+
+	rr = testRequest(t, testuser, "DELETE", fmt.Sprintf("/api/v1/objects/%s/data/?recursive", bucketID), nil, nil)
+	if _, keys := deleted(rr); rr.Code != http.StatusOK || keys != "data/c.txt,data/sub/d.txt" {
+		t.Fatalf("recursive delete returned %d: %s", rr.Code, rr.Body.String())
+	}
+	if exists("data/sub/d.txt") || !exists("other/e.txt") {
+		t.Fatalf("recursive delete removed the wrong files")
+	}
+
+	// key list
+	rr = testRequest(t, testuser, "POST", fmt.Sprintf("/api/v1/objects/%s?delete", bucketID), strings.NewReader(`{"keys": ["a.txt", "/b.txt"]}`), nil)
+	if _, keys := deleted(rr); rr.Code != http.StatusOK || keys != "a.txt,b.txt" {
+		t.Fatalf("bulk delete returned %d: %s", rr.Code, rr.Body.String())
+	}
+	if exists("a.txt") || exists("b.txt") {
+		t.Fatalf("bulk delete did not delete the files")
+	}
+
+	// other users get per-key errors
+	rr = testRequest(t, "otheruser", "POST", fmt.Sprintf("/api/v1/objects/%s?delete", bucketID), strings.NewReader(`{"keys": ["other/e.txt"]}`), nil)
+	if rr.Code != http.StatusMultiStatus || !exists("other/e.txt") {
+		t.Fatalf("otheruser delete returned %d: %s", rr.Code, rr.Body.String())
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// checksumSHA256Header optional client-supplied SHA-256 of an upload (hex or base64), also returned on download
+const checksumSHA256Header = "X-Sage-Checksum-SHA256"
+
+// checksumMD5Header MD5 of a file (hex), returned on download
+const checksumMD5Header = "X-Sage-Checksum-MD5"
+
+// headerGetter is implemented by http.Header and textproto.MIMEHeader
+type headerGetter interface {
+	Get(key string) string
+}
+
+// uploadChecksums computes MD5, SHA-256 and size of the data written to it
+type uploadChecksums struct {
+	md5    hash.Hash
+	sha256 hash.Hash
+	size   int64
+}
+
+func newUploadChecksums() *uploadChecksums {
+	return &uploadChecksums{md5: md5.New(), sha256: sha256.New()}
+}
+
+func (c *uploadChecksums) Write(p []byte) (int, error) {
+	c.md5.Write(p)
+	c.sha256.Write(p)
+	c.size += int64(len(p))
+	return len(p), nil
+}
+
+// metadata object metadata with the checksums, in addition to the owner
+func (c *uploadChecksums) metadata(username string) map[string]*string {
+	return map[string]*string{
+		"owner":  aws.String(username),
+		"md5":    aws.String(hex.EncodeToString(c.md5.Sum(nil))),
+		"sha256": aws.String(hex.EncodeToString(c.sha256.Sum(nil))),
+	}
+}
+
+// expectedChecksums client-supplied values, nil if not given
+type expectedChecksums struct {
+	md5    []byte
+	sha256 []byte
+	size   int64 // -1 if unknown
+}
+
+// parseExpectedChecksums reads Content-MD5 (base64) and X-Sage-Checksum-SHA256 (hex or base64)
+func parseExpectedChecksums(header headerGetter, size int64) (expected *expectedChecksums, err error) {
+
+	expected = &expectedChecksums{size: size}
+
+	if contentMD5 := header.Get("Content-MD5"); contentMD5 != "" {
+		expected.md5, err = base64.StdEncoding.DecodeString(contentMD5)
+		if err != nil || len(expected.md5) != md5.Size {
+			err = fmt.Errorf("Content-MD5 must be the base64-encoded MD5 digest of the body")
+			return
+		}
+	}
+
+	if checksum := header.Get(checksumSHA256Header); checksum != "" {
+		if len(checksum) == 2*sha256.Size {
+			expected.sha256, err = hex.DecodeString(checksum)
+		} else {
+			expected.sha256, err = base64.StdEncoding.DecodeString(checksum)
+		}
+		if err != nil || len(expected.sha256) != sha256.Size {
+			err = fmt.Errorf("%s must be the hex- or base64-encoded SHA-256 digest of the body", checksumSHA256Header)
+			return
+		}
+	}
+	return
+}
+
+// verify returns a description of the first mismatch, or an empty string
+func (expected *expectedChecksums) verify(c *uploadChecksums) string {
+	if expected.size >= 0 && c.size != expected.size {
+		return fmt.Sprintf("received %d bytes, Content-Length was %d", c.size, expected.size)
+	}
+	if expected.md5 != nil && !bytes.Equal(c.md5.Sum(nil), expected.md5) {
+		return "Content-MD5 does not match the received data"
+	}
+	if expected.sha256 != nil && !bytes.Equal(c.sha256.Sum(nil), expected.sha256) {
+		return checksumSHA256Header + " does not match the received data"
+	}
+	return ""
+}
+
+// objectChecksums extracts the checksums from the object metadata, the SDK capitalizes the keys
+func objectChecksums(metadata map[string]*string) (md5Hex string, sha256Hex string) {
+	for key, value := range metadata {
+		switch strings.ToLower(key) {
+		case "md5":
+			md5Hex = aws.StringValue(value)
+		case "sha256":
+			sha256Hex = aws.StringValue(value)
+		}
+	}
+	return
+}
+
+// listingWithChecksums folder listing with the SHA-256 checksums of the files, by key
+type listingWithChecksums struct {
+	*s3.ListObjectsV2Output
+	Checksums map[string]string `json:"Checksums"`
+}
+
+// listingChecksums gets the SHA-256 checksums of all files of a folder listing, files uploaded
+// without checksum are omitted
+func listingChecksums(sageBucketID string, folder string, listObject *s3.ListObjectsV2Output) (checksums map[string]string, err error) {
+
+	keys := []string{}
+	for _, object := range listObject.Contents {
+		keys = append(keys, aws.StringValue(object.Key))
+	}
+	heads, err := headListedFiles(sageBucketID, folder, keys)
+	if err != nil {
+		return
+	}
+
+	checksums = map[string]string{}
+	for key, head := range heads {
+		if _, sha256Hex := objectChecksums(head.Metadata); sha256Hex != "" {
+			checksums[key] = sha256Hex
+		}
+	}
+	return
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"testing"
+)
+
+func TestUploadChecksums(t *testing.T) {
+
+	testuser := "testuser"
+
+	newBucket, err := createSageBucket(testuser, "training-data", "testing-bucket1", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bucketID := newBucket.ID
+
+	content := []byte("checksum test data")
+	digest := sha256.Sum256(content)
+	sha256Hex := hex.EncodeToString(digest[:])
+
+	url := fmt.Sprintf("/api/v1/objects/%s/checksum/good.txt", bucketID)
+	rr := testRequest(t, testuser, "PUT", url, bytes.NewReader(content), map[string]string{checksumSHA256Header: sha256Hex})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("upload returned %d: %s", rr.Code, rr.Body.String())
+	}
+
+	rr = testRequest(t, testuser, "HEAD", url, nil, nil)
+	if rr.Header().Get(checksumSHA256Header) != sha256Hex {
+		t.Fatalf("expected %s header %s, got %q", checksumSHA256Header, sha256Hex, rr.Header().Get(checksumSHA256Header))
+	}
+	if rr.Header().Get(checksumMD5Header) == "" {
+		t.Fatalf("%s header missing", checksumMD5Header)
+	}
+
+	// mismatch, the object must not be stored
+	badURL := fmt.Sprintf("/api/v1/objects/%s/checksum/bad.txt", bucketID)
+	rr = testRequest(t, testuser, "PUT", badURL, bytes.NewReader([]byte("other data")), map[string]string{checksumSHA256Header: sha256Hex})
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("upload with wrong checksum returned %d: %s", rr.Code, rr.Body.String())
+	}
+	rr = testRequest(t, testuser, "HEAD", badURL, nil, nil)
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("rejected upload was stored (%d)", rr.Code)
+	}
+
+	// a rejected upload does not replace an existing file
+	rr = testRequest(t, testuser, "PUT", url, bytes.NewReader([]byte("other data")), map[string]string{checksumSHA256Header: sha256Hex})
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("upload with wrong checksum returned %d: %s", rr.Code, rr.Body.String())
+	}
+	rr = testRequest(t, testuser, "GET", url, nil, nil)
+	if rr.Code != http.StatusOK || rr.Body.String() != string(content) {
+		t.Fatalf("existing file was changed by a rejected upload (%d): %s", rr.Code, rr.Body.String())
+	}
+
+	// per-part checksum of a form upload
+	body := new(bytes.Buffer)
+	writer := multipart.NewWriter(body)
+	partHeader := textproto.MIMEHeader{}
+	partHeader.Set("Content-Disposition", `form-data; name="file"; filename="form.txt"`)
+	partHeader.Set(checksumSHA256Header, sha256Hex)
+	part, err := writer.CreatePart(partHeader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write([]byte("not the expected data"))
+	writer.Close()
+
+	url = fmt.Sprintf("/api/v1/objects/%s/checksum/", bucketID)
+	rr = testRequest(t, testuser, "PUT", url, bytes.NewReader(body.Bytes()), map[string]string{"Content-Type": writer.FormDataContentType()})
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("form upload with wrong checksum returned %d: %s", rr.Code, rr.Body.String())
+	}
+
+	rr = testRequest(t, testuser, "GET", url+"?checksums", nil, nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("listing returned %d: %s", rr.Code, rr.Body.String())
+	}
+	listing := FolderListing{}
+	err = json.Unmarshal(rr.Body.Bytes(), &listing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checksums := map[string]string{}
+	for _, file := range listing.Files {
+		if file.SHA256 != "" {
+			checksums[file.Key] = file.SHA256
+		}
+	}
+	if len(checksums) != 1 || checksums["good.txt"] != sha256Hex {
+		t.Fatalf("unexpected checksums %v", checksums)
+	}
+
+	// legacy format
+	rr = testRequest(t, testuser, "GET", url+"?checksums&format=legacy", nil, nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("legacy listing returned %d: %s", rr.Code, rr.Body.String())
+	}
+	legacyListing := struct {
+		Checksums map[string]string
+	}{}
+	err = json.Unmarshal(rr.Body.Bytes(), &legacyListing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(legacyListing.Checksums) != 1 || legacyListing.Checksums["good.txt"] != sha256Hex {
+		t.Fatalf("unexpected checksums %v", legacyListing.Checksums)
+	}
+}
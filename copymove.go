@@ -0,0 +1,300 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// copyListLimit number of keys processed per listing page, also the maximum of one DeleteObjects request
+const copyListLimit = 1000
+
+// ObjectCopy copy or move request and response
+type ObjectCopy struct {
+	ErrorStruct       `json:",inline"`
+	Bucket            string   `json:"bucket-id,omitempty"`
+	Key               string   `json:"key,omitempty"`
+	DestinationBucket string   `json:"destination_bucket,omitempty"` // default: same bucket
+	Destination       string   `json:"destination"`
+	Operation         string   `json:"operation,omitempty"` // copy or move
+	Created           []string `json:"created,omitempty"`
+	TotalSize         int64    `json:"total_size"`
+}
+
+// copySageObject copies one file with its content type and checksums, the copy is owned by username
+func copySageObject(srcBucketID string, srcKey string, dstBucketID string, dstKey string, username string) (size int64, err error) {
+
+	srcS3Key := path.Join(srcBucketID, srcKey)
+	dstS3Key := path.Join(dstBucketID, dstKey)
+	if strings.HasSuffix(srcKey, "/") {
+		// keep folder markers
+		srcS3Key += "/"
+		dstS3Key += "/"
+	}
+
+	head, err := copyS3ObjectWithMetadata(getS3BucketID(srcBucketID), srcS3Key, getS3BucketID(dstBucketID), dstS3Key, username)
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && (aerr.Code() == "NotFound" || aerr.Code() == s3.ErrCodeNoSuchKey) {
+			err = newSageError(codeNotFound, "File %s not found", srcKey)
+			return
+		}
+		err = fmt.Errorf("Copying %s failed: %s", srcKey, err.Error())
+		return
+	}
+	size = aws.Int64Value(head.ContentLength)
+	return
+}
+
+// copyS3ObjectWithMetadata copies an object with content type and metadata of the source, the owner is
+// replaced unless empty. head describes the source, HeadObject errors are returned unchanged.
+func copyS3ObjectWithMetadata(srcS3Bucket string, srcS3Key string, dstS3Bucket string, dstS3Key string, owner string) (head *s3.HeadObjectOutput, err error) {
+
+	head, err = svc.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(srcS3Bucket),
+		Key:    aws.String(srcS3Key),
+	})
+	if err != nil {
+		return
+	}
+
+	// the SDK capitalizes the metadata keys
+	metadata := map[string]*string{}
+	for key, value := range head.Metadata {
+		metadata[strings.ToLower(key)] = value
+	}
+	if owner != "" {
+		metadata["owner"] = aws.String(owner)
+	}
+
+	err = copyS3Object(srcS3Bucket, srcS3Key, dstS3Bucket, dstS3Key, aws.Int64Value(head.ContentLength), aws.StringValue(head.ContentType), metadata)
+	return
+}
+
+// copier copies or moves files from a source to a destination bucket and records the created keys
+type copier struct {
+	username    string
+	move        bool
+	srcBucketID string
+	dstBucketID string
+	srcAccess   *bucketAccess
+	dstAccess   *bucketAccess
+	result      *ObjectCopy
+}
+
+// copyFile checks the permissions of source and destination and copies, the source of a move is deleted by the caller
+func (c *copier) copyFile(srcKey string, dstKey string) (statusCode int, err error) {
+
+	if !c.srcAccess.allows(actionReadObject, aclKey(srcKey)) {
+		statusCode = deniedStatus(c.username)
+		err = fmt.Errorf("Read access to %s denied (%s, %s)", srcKey, c.username, c.srcBucketID)
+		return
+	}
+	if c.move && !c.srcAccess.allows(actionDeleteObject, aclKey(srcKey)) {
+		statusCode = deniedStatus(c.username)
+		err = fmt.Errorf("Delete access to %s denied (%s, %s)", srcKey, c.username, c.srcBucketID)
+		return
+	}
+	if !c.dstAccess.allows(actionWriteObject, aclKey(dstKey)) {
+		statusCode = deniedStatus(c.username)
+		err = fmt.Errorf("Write access to %s denied (%s, %s)", dstKey, c.username, c.dstBucketID)
+		return
+	}
+
+	size, err := copySageObject(c.srcBucketID, srcKey, c.dstBucketID, dstKey, c.username)
+	if err != nil {
+		statusCode = errorStatus(err, http.StatusInternalServerError)
+		return
+	}
+
+	c.result.Created = append(c.result.Created, aclKey(dstKey))
+	c.result.TotalSize += size
+	return
+}
+
+// copyFolder copies all files below srcFolder, one listing page at a time. For a move the
+// sources of each page are deleted once the page has been copied.
+func (c *copier) copyFolder(srcFolder string, dstFolder string) (statusCode int, err error) {
+
+	continuationToken := ""
+	for {
+		var listObject *s3.ListObjectsV2Output
+		listObject, err = listSageBucketContent(c.srcBucketID, srcFolder, true, copyListLimit, "", continuationToken)
+		if err != nil {
+			statusCode = errorStatus(err, http.StatusInternalServerError)
+			return
+		}
+
+		copied := []string{}
+		for _, object := range listObject.Contents {
+			relativeKey := aws.StringValue(object.Key)
+			srcKey := path.Join(srcFolder, relativeKey)
+			dstKey := path.Join(dstFolder, relativeKey)
+			if relativeKey == "" || strings.HasSuffix(relativeKey, "/") {
+				// folder marker, relativeKey is empty for the marker of the source folder itself
+				srcKey += "/"
+				dstKey += "/"
+			}
+			statusCode, err = c.copyFile(srcKey, dstKey)
+			if err != nil {
+				return
+			}
+			copied = append(copied, srcKey)
+		}
+
+		if c.move && len(copied) > 0 {
+			_, err = deleteSAGEFiles(c.srcBucketID, copied)
+			if err != nil {
+				statusCode = errorStatus(err, http.StatusInternalServerError)
+				return
+			}
+		}
+
+		if !aws.BoolValue(listObject.IsTruncated) {
+			return
+		}
+		continuationToken = aws.StringValue(listObject.NextContinuationToken)
+	}
+}
+
+// newCopier loads the permissions of the user in source and destination bucket
+func newCopier(username string, srcBucketID string, dstBucketID string, move bool, result *ObjectCopy) (c *copier, err error) {
+
+	srcAccess, err := getBucketAccess(username, srcBucketID)
+	if err != nil {
+		return
+	}
+	dstAccess := srcAccess
+	if dstBucketID != srcBucketID {
+		dstAccess, err = getBucketAccess(username, dstBucketID)
+		if err != nil {
+			return
+		}
+	}
+
+	c = &copier{
+		username:    username,
+		move:        move,
+		srcBucketID: srcBucketID,
+		dstBucketID: dstBucketID,
+		srcAccess:   srcAccess,
+		dstAccess:   dstAccess,
+		result:      result,
+	}
+	return
+}
+
+// run copies or moves a file, or a folder if srcKey ends with /
+func (c *copier) run(srcKey string, dstKey string) (statusCode int, err error) {
+
+	if strings.HasSuffix(srcKey, "/") {
+		return c.copyFolder(srcKey, dstKey)
+	}
+
+	statusCode, err = c.copyFile(srcKey, dstKey)
+	if err == nil && c.move {
+		_, err = deleteSAGEFiles(c.srcBucketID, []string{srcKey})
+		if err != nil {
+			statusCode = errorStatus(err, http.StatusInternalServerError)
+		}
+	}
+	return
+}
+
+// POST /objects/{bucket}/{key}?copy   body: {"destination": "new/key", "destination_bucket": "..."}
+// POST /objects/{bucket}/{key}?move
+// A key ending with / copies all files below that folder, the destination then has to be a folder as well.
+// A file copied to a destination ending with / keeps its filename.
+func copyObjectRequest(w http.ResponseWriter, r *http.Request, username string, sageBucketID string, sagePath string, move bool) {
+
+	request := &ObjectCopy{}
+	err := json.NewDecoder(r.Body).Decode(request)
+	if err != nil {
+		respondJSONError(w, http.StatusBadRequest, "Could not parse json: %s", err.Error())
+		return
+	}
+
+	result := &ObjectCopy{
+		Bucket:            sageBucketID,
+		Key:               aclKey(sagePath),
+		DestinationBucket: request.DestinationBucket,
+		Destination:       request.Destination,
+		Operation:         "copy",
+		Created:           []string{},
+	}
+	if move {
+		result.Operation = "move"
+	}
+	if result.DestinationBucket == "" {
+		result.DestinationBucket = sageBucketID
+	}
+
+	if sagePath == "" {
+		respondJSONError(w, http.StatusUnprocessableEntity, "Specify a file or folder to %s", result.Operation)
+		return
+	}
+
+	if result.DestinationBucket != sageBucketID {
+		if len(result.DestinationBucket) != 36 {
+			respondJSONError(w, http.StatusNotFound, "destination_bucket (%s) invalid", result.DestinationBucket)
+			return
+		}
+		_, err = GetSageBucket(result.DestinationBucket)
+		if err != nil {
+			respondError(w, err, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	isDirectory := strings.HasSuffix(sagePath, "/")
+
+	// like filenames of uploads the destination cannot leave the bucket
+	destination := path.Clean("/" + result.Destination)
+	destinationIsDirectory := result.Destination == "" || strings.HasSuffix(result.Destination, "/")
+	if destinationIsDirectory && destination != "/" {
+		destination += "/"
+	}
+
+	if isDirectory && !destinationIsDirectory {
+		respondJSONError(w, http.StatusUnprocessableEntity, "A folder can only be copied into a folder, the destination has to end with /")
+		return
+	}
+	if !isDirectory && destinationIsDirectory {
+		destination = path.Join(destination, path.Base(sagePath))
+	}
+
+	if result.DestinationBucket == sageBucketID {
+		if !isDirectory && destination == sagePath {
+			respondJSONError(w, http.StatusUnprocessableEntity, "Source and destination are identical")
+			return
+		}
+		if isDirectory && strings.HasPrefix(destination, sagePath) {
+			respondJSONError(w, http.StatusUnprocessableEntity, "A folder cannot be copied into itself")
+			return
+		}
+	}
+
+	c, err := newCopier(username, sageBucketID, result.DestinationBucket, move, result)
+	if err != nil {
+		respondError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	statusCode, err := c.run(sagePath, destination)
+	if err != nil {
+		log.Printf("%s of %s/%s failed after %d files: %s", result.Operation, sageBucketID, sagePath, len(result.Created), err.Error())
+		result.Error = err.Error()
+		result.Code = errorCodeForStatus(statusCode)
+		respondJSON(w, statusCode, result)
+		return
+	}
+
+	log.Printf("%s of %s/%s to %s/%s: %d files", result.Operation, sageBucketID, sagePath, result.DestinationBucket, destination, len(result.Created))
+	respondJSON(w, http.StatusOK, result)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestCopyMove(t *testing.T) {
+
+	testuser := "testuser"
+
+	newBucket, err := createSageBucket(testuser, "training-data", "testing-bucket1", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bucketID := newBucket.ID
+
+	otherBucket, err := createSageBucket(testuser, "training-data", "testing-bucket2", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for key, content := range map[string]string{
+		"data/a.txt":     "file a",
+		"data/sub/b.txt": "file b",
+	} {
+		err = putSageObject(bucketID, key, strings.NewReader(content), testuser, "text/plain")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// created returns the sorted keys created by a copy or move
+	created := func(rr *httptest.ResponseRecorder) string {
+		result := &ObjectCopy{}
+		json.Unmarshal(rr.Body.Bytes(), result)
+		sort.Strings(result.Created)
+		return strings.Join(result.Created, ",")
+	}
+
+	// copy a file into a folder, the filename is kept
+	rr := testRequest(t, testuser, "POST", fmt.Sprintf("/api/v1/objects/%s/data/a.txt?copy", bucketID), strings.NewReader(`{"destination": "copies/"}`), nil)
+	if rr.Code != http.StatusOK || created(rr) != "copies/a.txt" {
+		t.Fatalf("copy returned %d: %s", rr.Code, rr.Body.String())
+	}
+	rr = testRequest(t, testuser, "GET", fmt.Sprintf("/api/v1/objects/%s/copies/a.txt", bucketID), nil, nil)
+	if rr.Code != http.StatusOK || rr.Body.String() != "file a" {
+		t.Fatalf("copy has unexpected content (%d): %s", rr.Code, rr.Body.String())
+	}
+
+	// a folder cannot be copied into itself
+	rr = testRequest(t, testuser, "POST", fmt.Sprintf("/api/v1/objects/%s/data/?copy", bucketID), strings.NewReader(`{"destination": "data/sub/"}`), nil)
+	expectStatus(t, rr, http.StatusUnprocessableEntity)
+
+	// other users need read permission on the source
+	rr = testRequest(t, "otheruser", "POST", fmt.Sprintf("/api/v1/objects/%s/data/?copy", bucketID), strings.NewReader(`{"destination": "stolen/"}`), nil)
+	if rr.Code == http.StatusOK {
+		t.Fatalf("otheruser was able to copy")
+	}
+
+	// move a folder into another bucket
+	rr = testRequest(t, testuser, "POST", fmt.Sprintf("/api/v1/objects/%s/data/?move", bucketID), strings.NewReader(fmt.Sprintf(`{"destination_bucket": "%s", "destination": "moved/"}`, otherBucket.ID)), nil)
+	if rr.Code != http.StatusOK || created(rr) != "moved/a.txt,moved/sub/b.txt" {
+		t.Fatalf("move returned %d: %s", rr.Code, rr.Body.String())
+	}
+	rr = testRequest(t, testuser, "GET", fmt.Sprintf("/api/v1/objects/%s/moved/sub/b.txt", otherBucket.ID), nil, nil)
+	if rr.Code != http.StatusOK || rr.Body.String() != "file b" {
+		t.Fatalf("moved file has unexpected content (%d): %s", rr.Code, rr.Body.String())
+	}
+	rr = testRequest(t, testuser, "GET", fmt.Sprintf("/api/v1/objects/%s/data/sub/b.txt", bucketID), nil, nil)
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("source of move still exists (%d)", rr.Code)
+	}
+
+	// the marker of an empty folder is moved as well
+	_, err = putSageFolderMarker(bucketID, "empty", testuser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = testRequest(t, testuser, "POST", fmt.Sprintf("/api/v1/objects/%s/empty/?move", bucketID), strings.NewReader(`{"destination": "moved-empty/"}`), nil)
+	if rr.Code != http.StatusOK || created(rr) != "moved-empty/" {
+		t.Fatalf("move of empty folder returned %d: %s", rr.Code, rr.Body.String())
+	}
+	for folder, want := range map[string]bool{"empty/": false, "moved-empty/": true} {
+		res, err := resolveSageResource(bucketID, folder)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (res != nil) != want {
+			t.Fatalf("folder %s exists: %t, expected %t", folder, res != nil, want)
+		}
+	}
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// maxRanges limits the number of ranges of a multi-range request
+const maxRanges = 100
+
+// byteRange inclusive range of bytes
+type byteRange struct {
+	start int64
+	end   int64
+}
+
+func (br byteRange) length() int64 {
+	return br.end - br.start + 1
+}
+
+func (br byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", br.start, br.end, size)
+}
+
+func (br byteRange) s3Range() string {
+	return fmt.Sprintf("bytes=%d-%d", br.start, br.end)
+}
+
+// parseByteRanges parses a Range header, e.g. "bytes=0-99,200-,-50". Ranges beyond the end are
+// truncated, err is returned if the header is invalid or no range can be satisfied.
+func parseByteRanges(header string, size int64) (ranges []byteRange, err error) {
+
+	if !strings.HasPrefix(header, "bytes=") {
+		err = fmt.Errorf("only byte ranges are supported")
+		return
+	}
+
+	for _, spec := range strings.Split(strings.TrimPrefix(header, "bytes="), ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		dash := strings.Index(spec, "-")
+		if dash < 0 {
+			err = fmt.Errorf("invalid range %q", spec)
+			return
+		}
+		startStr, endStr := strings.TrimSpace(spec[:dash]), strings.TrimSpace(spec[dash+1:])
+
+		var br byteRange
+		if startStr == "" {
+			// suffix range, the last n bytes
+			var n int64
+			n, err = strconv.ParseInt(endStr, 10, 64)
+			if err != nil || n < 0 {
+				err = fmt.Errorf("invalid range %q", spec)
+				return
+			}
+			if n == 0 || size == 0 {
+				continue
+			}
+			if n > size {
+				n = size
+			}
+			br = byteRange{start: size - n, end: size - 1}
+		} else {
+			br.start, err = strconv.ParseInt(startStr, 10, 64)
+			if err != nil || br.start < 0 {
+				err = fmt.Errorf("invalid range %q", spec)
+				return
+			}
+			if br.start >= size {
+				continue
+			}
+			br.end = size - 1
+			if endStr != "" {
+				var end int64
+				end, err = strconv.ParseInt(endStr, 10, 64)
+				if err != nil || end < br.start {
+					err = fmt.Errorf("invalid range %q", spec)
+					return
+				}
+				if end < br.end {
+					br.end = end
+				}
+			}
+		}
+		ranges = append(ranges, br)
+	}
+
+	if len(ranges) == 0 {
+		err = fmt.Errorf("range not satisfiable")
+		return
+	}
+	if len(ranges) > maxRanges {
+		err = fmt.Errorf("more than %d ranges requested", maxRanges)
+		return
+	}
+	return
+}
+
+// etagMatches implements the weak comparison of If-None-Match
+func etagMatches(header string, etag string) bool {
+	if strings.TrimSpace(header) == "*" {
+		return true
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(header, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(candidate), "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// notModified evaluates If-None-Match and, if that is absent, If-Modified-Since
+func notModified(r *http.Request, etag string, lastModified time.Time) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		return etag != "" && etagMatches(inm, etag)
+	}
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" && !lastModified.IsZero() {
+		t, err := http.ParseTime(ims)
+		if err != nil {
+			return false
+		}
+		return !lastModified.Truncate(time.Second).After(t)
+	}
+	return false
+}
+
+// rangeApplies evaluates If-Range, a Range request for an outdated representation returns the whole object
+func rangeApplies(r *http.Request, etag string, lastModified time.Time) bool {
+	ir := r.Header.Get("If-Range")
+	if ir == "" {
+		return true
+	}
+	if strings.HasPrefix(ir, "\"") {
+		return ir == etag
+	}
+	t, err := http.ParseTime(ir)
+	return err == nil && lastModified.Truncate(time.Second).Equal(t)
+}
+
+// copyDownload streams the object content to the client and counts the bytes
+func copyDownload(w io.Writer, body io.Reader) (err error) {
+	buffer := make([]byte, 1024*1024)
+	for {
+		n, readErr := body.Read(buffer)
+		if n > 0 {
+			_, err = w.Write(buffer[:n])
+			if err != nil {
+				return
+			}
+			fileDownloadByteSize.Add(float64(n))
+		}
+		if readErr == io.EOF {
+			return
+		}
+		if readErr != nil {
+			err = readErr
+			return
+		}
+	}
+}
+
+// getObjectRange fetches the object, or a range of it if br is not nil. The ETag makes sure
+// that all requests of one download see the same version of the object.
+func getObjectRange(s3BucketID string, s3key string, etag string, br *byteRange) (out *s3.GetObjectOutput, err error) {
+	objectInput := &s3.GetObjectInput{
+		Bucket: aws.String(s3BucketID),
+		Key:    aws.String(s3key),
+	}
+	if etag != "" {
+		objectInput.IfMatch = aws.String(etag)
+	}
+	if br != nil {
+		objectInput.Range = aws.String(br.s3Range())
+	}
+	out, err = svc.GetObject(objectInput)
+	return
+}
+
+// downloadSageObject handles GET and HEAD requests of a file, including conditional and range requests
+func downloadSageObject(w http.ResponseWriter, r *http.Request, sageBucketID string, sagePath string) {
+
+	s3BucketID := getS3BucketID(sageBucketID) //s3BucketPrefix + sageBucketID[0:2]
+
+	s3key := path.Join(sageBucketID, sagePath)
+
+	sageFilename := path.Base(sagePath)
+	if sageFilename == "." || sageFilename == "/" {
+		respondJSONError(w, http.StatusBadRequest, "Invalid filename (%s)", sageFilename)
+		return
+	}
+
+	head, err := svc.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(s3BucketID),
+		Key:    aws.String(s3key),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && (aerr.Code() == "NotFound" || aerr.Code() == s3.ErrCodeNoSuchKey) {
+			respondJSONError(w, http.StatusNotFound, "File %s not found", sagePath)
+			return
+		}
+		respondJSONError(w, errorStatus(err, http.StatusInternalServerError), "Error getting data, svc.HeadObject returned: %s", err.Error())
+		return
+	}
+
+	size := aws.Int64Value(head.ContentLength)
+	etag := aws.StringValue(head.ETag)
+	lastModified := aws.TimeValue(head.LastModified)
+	contentType := aws.StringValue(head.ContentType)
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	header := w.Header()
+	header.Set("Accept-Ranges", "bytes")
+	if etag != "" {
+		header.Set("ETag", etag)
+	}
+	if !lastModified.IsZero() {
+		header.Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+	}
+	md5Hex, sha256Hex := objectChecksums(head.Metadata)
+	if md5Hex != "" {
+		header.Set(checksumMD5Header, md5Hex)
+	}
+	if sha256Hex != "" {
+		header.Set(checksumSHA256Header, sha256Hex)
+	}
+
+	if notModified(r, etag, lastModified) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	header.Set("Content-Disposition", "attachment; filename="+sageFilename)
+
+	var ranges []byteRange
+	if rangeHeader := r.Header.Get("Range"); rangeHeader != "" && rangeApplies(r, etag, lastModified) {
+		ranges, err = parseByteRanges(rangeHeader, size)
+		if err != nil {
+			header.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+			respondJSONError(w, http.StatusRequestedRangeNotSatisfiable, "Invalid Range header: %s", err.Error())
+			return
+		}
+	}
+
+	switch {
+	case len(ranges) == 0:
+		header.Set("Content-Type", contentType)
+		header.Set("Content-Length", strconv.FormatInt(size, 10))
+		if r.Method == http.MethodHead {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		out, err := getObjectRange(s3BucketID, s3key, etag, nil)
+		if err != nil {
+			respondJSONError(w, errorStatus(err, http.StatusInternalServerError), "Error getting data, svc.GetObject returned: %s", err.Error())
+			return
+		}
+		defer out.Body.Close()
+
+		w.WriteHeader(http.StatusOK)
+		copyDownload(w, out.Body)
+
+	case len(ranges) == 1:
+		br := ranges[0]
+		header.Set("Content-Type", contentType)
+		header.Set("Content-Range", br.contentRange(size))
+		header.Set("Content-Length", strconv.FormatInt(br.length(), 10))
+		if r.Method == http.MethodHead {
+			w.WriteHeader(http.StatusPartialContent)
+			return
+		}
+
+		out, err := getObjectRange(s3BucketID, s3key, etag, &br)
+		if err != nil {
+			respondJSONError(w, errorStatus(err, http.StatusInternalServerError), "Error getting data, svc.GetObject returned: %s", err.Error())
+			return
+		}
+		defer out.Body.Close()
+
+		w.WriteHeader(http.StatusPartialContent)
+		copyDownload(w, out.Body)
+
+	default:
+		// multipart/byteranges, the length is computed by rendering the part headers without content
+		partHeaders := make([]textproto.MIMEHeader, len(ranges))
+		counter := &countingWriter{}
+		mw := multipart.NewWriter(counter)
+		for i, br := range ranges {
+			partHeaders[i] = textproto.MIMEHeader{
+				"Content-Type":  {contentType},
+				"Content-Range": {br.contentRange(size)},
+			}
+			mw.CreatePart(partHeaders[i])
+			counter.n += br.length()
+		}
+		mw.Close()
+
+		header.Set("Content-Type", "multipart/byteranges; boundary="+mw.Boundary())
+		header.Set("Content-Length", strconv.FormatInt(counter.n, 10))
+		if r.Method == http.MethodHead {
+			w.WriteHeader(http.StatusPartialContent)
+			return
+		}
+
+		w.WriteHeader(http.StatusPartialContent)
+		bodyWriter := multipart.NewWriter(w)
+		bodyWriter.SetBoundary(mw.Boundary())
+		for i, br := range ranges {
+			part, err := bodyWriter.CreatePart(partHeaders[i])
+			if err != nil {
+				return
+			}
+			out, err := getObjectRange(s3BucketID, s3key, etag, &br)
+			if err != nil {
+				// headers are already sent, the client sees a truncated response
+				return
+			}
+			err = copyDownload(part, out.Body)
+			out.Body.Close()
+			if err != nil {
+				return
+			}
+		}
+		bodyWriter.Close()
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestParseByteRanges(t *testing.T) {
+
+	for _, tc := range []struct {
+		header   string
+		expected []byteRange
+		invalid  bool
+	}{
+		{"bytes=0-4", []byteRange{{0, 4}}, false},
+		{"bytes=5-", []byteRange{{5, 9}}, false},
+		{"bytes=-3", []byteRange{{7, 9}}, false},
+		{"bytes=8-100", []byteRange{{8, 9}}, false},
+		{"bytes=0-1, 4-5", []byteRange{{0, 1}, {4, 5}}, false},
+		{"bytes=10-", nil, true},
+		{"bytes=5-2", nil, true},
+		{"lines=0-1", nil, true},
+	} {
+		ranges, err := parseByteRanges(tc.header, 10)
+		if tc.invalid {
+			if err == nil {
+				t.Fatalf("%s: expected error", tc.header)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %s", tc.header, err.Error())
+		}
+		if fmt.Sprint(ranges) != fmt.Sprint(tc.expected) {
+			t.Fatalf("%s: got %v, want %v", tc.header, ranges, tc.expected)
+		}
+	}
+}
+
+func TestDownloadHeadersAndRanges(t *testing.T) {
+
+	testuser := "testuser"
+
+	newBucket, err := createSageBucket(testuser, "training-data", "testing-bucket1", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bucketID := newBucket.ID
+
+	err = putSageObject(bucketID, "range/test.txt", strings.NewReader("0123456789"), testuser, "text/plain")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	url := fmt.Sprintf("/api/v1/objects/%s/range/test.txt", bucketID)
+	rr := testRequest(t, testuser, "HEAD", url, nil, nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("HEAD returned %d: %s", rr.Code, rr.Body.String())
+	}
+	etag := rr.Header().Get("ETag")
+	lastModified := rr.Header().Get("Last-Modified")
+	if etag == "" || lastModified == "" {
+		t.Fatalf("ETag or Last-Modified missing")
+	}
+	if rr.Header().Get("Content-Length") != "10" || rr.Header().Get("Content-Type") != "text/plain" {
+		t.Fatalf("unexpected headers: %v", rr.Header())
+	}
+	if rr.Body.Len() != 0 {
+		t.Fatalf("HEAD returned a body")
+	}
+
+	rr = testRequest(t, testuser, "GET", url, nil, map[string]string{"Range": "bytes=2-4"})
+	if rr.Code != http.StatusPartialContent || rr.Body.String() != "234" {
+		t.Fatalf("range request returned %d: %q", rr.Code, rr.Body.String())
+	}
+	if rr.Header().Get("Content-Range") != "bytes 2-4/10" {
+		t.Fatalf("unexpected Content-Range %s", rr.Header().Get("Content-Range"))
+	}
+
+	rr = testRequest(t, testuser, "GET", url, nil, map[string]string{"Range": "bytes=0-1,-2"})
+	if rr.Code != http.StatusPartialContent {
+		t.Fatalf("multi-range request returned %d: %s", rr.Code, rr.Body.String())
+	}
+	mediaType, params, err := mime.ParseMediaType(rr.Header().Get("Content-Type"))
+	if err != nil || mediaType != "multipart/byteranges" {
+		t.Fatalf("unexpected Content-Type %s", rr.Header().Get("Content-Type"))
+	}
+	if rr.Header().Get("Content-Length") != fmt.Sprintf("%d", rr.Body.Len()) {
+		t.Fatalf("Content-Length %s does not match body length %d", rr.Header().Get("Content-Length"), rr.Body.Len())
+	}
+	mr := multipart.NewReader(rr.Body, params["boundary"])
+	parts := []string{}
+	for {
+		part, err := mr.NextPart()
+		if err != nil {
+			break
+		}
+		data, _ := ioutil.ReadAll(part)
+		parts = append(parts, string(data))
+	}
+	if strings.Join(parts, ",") != "01,89" {
+		t.Fatalf("unexpected parts %v", parts)
+	}
+
+	rr = testRequest(t, testuser, "GET", url, nil, map[string]string{"Range": "bytes=20-30"})
+	if rr.Code != http.StatusRequestedRangeNotSatisfiable {
+		t.Fatalf("unsatisfiable range returned %d", rr.Code)
+	}
+
+	rr = testRequest(t, testuser, "GET", url, nil, map[string]string{"If-None-Match": etag})
+	if rr.Code != http.StatusNotModified || rr.Body.Len() != 0 {
+		t.Fatalf("If-None-Match returned %d", rr.Code)
+	}
+
+	rr = testRequest(t, testuser, "GET", url, nil, map[string]string{"If-Modified-Since": lastModified})
+	if rr.Code != http.StatusNotModified {
+		t.Fatalf("If-Modified-Since returned %d", rr.Code)
+	}
+
+	rr = testRequest(t, testuser, "GET", url, nil, map[string]string{"If-None-Match": "\"other\""})
+	if rr.Code != http.StatusOK || rr.Body.String() != "0123456789" {
+		t.Fatalf("download returned %d: %q", rr.Code, rr.Body.String())
+	}
+
+	url = fmt.Sprintf("/api/v1/objects/%s/range/missing.txt", bucketID)
+	rr = testRequest(t, testuser, "GET", url, nil, nil)
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("missing file returned %d", rr.Code)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+// errorCode is the machine-readable class of an error, returned in the "code" field of error responses
+type errorCode string
+
+const (
+	codeBadRequest         errorCode = "bad_request"         // malformed request, e.g. invalid JSON
+	codeUnauthenticated    errorCode = "unauthenticated"     // token missing, invalid or expired
+	codeForbidden          errorCode = "forbidden"           // authenticated, but not allowed
+	codeNotFound           errorCode = "not_found"           // bucket, file or resource does not exist
+	codeConflict           errorCode = "conflict"            // conflicts with the current state, e.g. already exists
+	codeValidation         errorCode = "validation_failed"   // well-formed, but invalid values
+	codeBackendUnavailable errorCode = "backend_unavailable" // database, S3 or token service not reachable
+	codeInternal           errorCode = "internal_error"
+)
+
+var errorCodeStatus = map[errorCode]int{
+	codeBadRequest:         http.StatusBadRequest,
+	codeUnauthenticated:    http.StatusUnauthorized,
+	codeForbidden:          http.StatusForbidden,
+	codeNotFound:           http.StatusNotFound,
+	codeConflict:           http.StatusConflict,
+	codeValidation:         http.StatusUnprocessableEntity,
+	codeBackendUnavailable: http.StatusServiceUnavailable,
+	codeInternal:           http.StatusInternalServerError,
+}
+
+// SageError an error with code, functions return it to let handlers choose the response status
+type SageError struct {
+	Code    errorCode
+	Message string
+}
+
+func (e *SageError) Error() string {
+	return e.Message
+}
+
+func newSageError(code errorCode, format string, args ...interface{}) *SageError {
+	return &SageError{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// errorCodeForStatus is used for the code of responses that only have a status, statuses without a
+// code of their own use the snake case status text, e.g. method_not_allowed
+func errorCodeForStatus(statusCode int) errorCode {
+	for code, s := range errorCodeStatus {
+		if s == statusCode {
+			return code
+		}
+	}
+	return errorCode(strings.ReplaceAll(strings.ToLower(http.StatusText(statusCode)), " ", "_"))
+}
+
+// deniedStatus anonymous users are asked to authenticate (401), authenticated users are forbidden (403)
+func deniedStatus(username string) int {
+	if username == "" {
+		return http.StatusUnauthorized
+	}
+	return http.StatusForbidden
+}
+
+// isBackendUnavailable detects connection failures of database and S3. Most storage functions
+// format errors as strings, so the message is checked as well.
+func isBackendUnavailable(err error) bool {
+
+	var netErr net.Error
+	if errors.As(err, &netErr) || errors.Is(err, driver.ErrBadConn) {
+		return true
+	}
+	var aerr awserr.Error
+	if errors.As(err, &aerr) && aerr.Code() == request.ErrCodeRequestError {
+		return true
+	}
+
+	msg := err.Error()
+	for _, s := range []string{"connection refused", "no such host", "i/o timeout", "bad connection", "Unable to connect to database"} {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// errorStatus returns the status of a SageError, 503 for unreachable backends and fallback otherwise
+func errorStatus(err error, fallback int) int {
+
+	var sageErr *SageError
+	if errors.As(err, &sageErr) {
+		return errorCodeStatus[sageErr.Code]
+	}
+	if isBackendUnavailable(err) {
+		return http.StatusServiceUnavailable
+	}
+	return fallback
+}
+
+// respondError responds with the status of err, see errorStatus
+func respondError(w http.ResponseWriter, err error, fallback int) {
+	respondJSONError(w, errorStatus(err, fallback), "%s", err.Error())
+}
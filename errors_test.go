@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestErrorStatus(t *testing.T) {
+
+	notFound := newSageError(codeNotFound, "Bucket %s not found", "abc")
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{notFound, http.StatusNotFound},
+		{fmt.Errorf("wrapped: %w", notFound), http.StatusNotFound},
+		{newSageError(codeValidation, "invalid"), http.StatusUnprocessableEntity},
+		{fmt.Errorf("Unable to connect to database: %s", "dial tcp: connection refused"), http.StatusServiceUnavailable},
+		{errors.New("something else"), http.StatusInternalServerError},
+	}
+	for _, test := range tests {
+		if got := errorStatus(test.err, http.StatusInternalServerError); got != test.want {
+			t.Errorf("errorStatus(%q): got %d want %d", test.err.Error(), got, test.want)
+		}
+	}
+
+	if deniedStatus("") != http.StatusUnauthorized || deniedStatus("testuser") != http.StatusForbidden {
+		t.Errorf("deniedStatus: anonymous users have to get 401, others 403")
+	}
+
+	for statusCode, want := range map[int]errorCode{
+		http.StatusUnprocessableEntity: codeValidation,
+		http.StatusServiceUnavailable:  codeBackendUnavailable,
+		http.StatusMethodNotAllowed:    "method_not_allowed",
+	} {
+		if got := errorCodeForStatus(statusCode); got != want {
+			t.Errorf("errorCodeForStatus(%d): got %s want %s", statusCode, got, want)
+		}
+	}
+}
+
+func TestMissingBucketNotFound(t *testing.T) {
+
+	// a well-formed id of a bucket that does not exist
+	missing := "00000000-0000-4000-8000-000000000000"
+
+	for _, username := range []string{"", "otheruser", "testuser"} {
+		for _, req := range []struct{ method, url string }{
+			{"GET", "/api/v1/objects/" + missing},
+			{"GET", "/api/v1/objects/" + missing + "?permissions"},
+			{"PATCH", "/api/v1/objects/" + missing},
+			{"PUT", "/api/v1/objects/" + missing + "?permission"},
+			{"DELETE", "/api/v1/objects/" + missing},
+		} {
+			rr := testRequest(t, username, req.method, req.url, nil, nil)
+			if rr.Code != http.StatusNotFound {
+				t.Errorf("%s %s as %q: got %d want %d", req.method, req.url, username, rr.Code, http.StatusNotFound)
+			}
+		}
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+var (
+	extractMaxEntries = 10000           // files per archive
+	extractMaxSize    = int64(50 << 30) // total uncompressed size per archive
+)
+
+// ExtractSummary response of an upload with ?extract
+type ExtractSummary struct {
+	ErrorStruct `json:",inline"`
+	Bucket      string   `json:"bucket-id,omitempty"`
+	Created     []string `json:"created"`
+	Skipped     []string `json:"skipped,omitempty"` // directories, links and other non-regular entries
+	TotalSize   int64    `json:"total_size"`
+}
+
+// archiveExtractor stores the entries of an uploaded archive as individual objects below folder
+type archiveExtractor struct {
+	username     string
+	sageBucketID string
+	folder       string
+	access       *bucketAccess
+	summary      *ExtractSummary
+}
+
+// sanitizeEntryName maps an archive entry name to a key below the target folder, entries
+// cannot leave the folder ("../" is removed by cleaning the absolute path)
+func sanitizeEntryName(folder string, name string) (key string, err error) {
+	name = strings.Replace(name, "\\", "/", -1)
+	if strings.ContainsRune(name, 0) {
+		err = fmt.Errorf("invalid entry name %q", name)
+		return
+	}
+	cleaned := path.Clean("/" + name)
+	if cleaned == "/" {
+		err = fmt.Errorf("invalid entry name %q", name)
+		return
+	}
+	key = strings.TrimPrefix(path.Join(folder, cleaned), "/")
+	return
+}
+
+// addEntry uploads one file of the size declared in the archive, entries that exceed the remaining
+// size budget are refused before anything is stored
+func (e *archiveExtractor) addEntry(name string, size int64, body io.Reader) (statusCode int, err error) {
+
+	if len(e.summary.Created) >= extractMaxEntries {
+		statusCode = http.StatusRequestEntityTooLarge
+		err = fmt.Errorf("archive has more than %d files", extractMaxEntries)
+		return
+	}
+
+	key, err := sanitizeEntryName(e.folder, name)
+	if err != nil {
+		statusCode = http.StatusBadRequest
+		return
+	}
+
+	if !e.access.allows(actionWriteObject, key) {
+		statusCode = deniedStatus(e.username)
+		err = fmt.Errorf("Write access to %s denied (%s, %s)", key, e.username, e.sageBucketID)
+		return
+	}
+
+	remaining := extractMaxSize - e.summary.TotalSize
+	if size < 0 || size > remaining {
+		statusCode = http.StatusRequestEntityTooLarge
+		err = fmt.Errorf("archive content exceeds %d bytes", extractMaxSize)
+		return
+	}
+
+	contentType := mime.TypeByExtension(path.Ext(key))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	// one byte more than declared, content that does not match the declared size is rejected
+	// by putVerifiedSageObject before it is stored
+	limited := io.LimitReader(body, size+1)
+	statusCode, err = putVerifiedSageObject(e.sageBucketID, key, limited, e.username, contentType, &expectedChecksums{size: size})
+	if err != nil {
+		return
+	}
+
+	e.summary.TotalSize += size
+	e.summary.Created = append(e.summary.Created, key)
+	fileUploadCounter.Inc()
+	return
+}
+
+// extractTar reads a tar stream, gzip compression is detected automatically
+func (e *archiveExtractor) extractTar(body io.Reader) (statusCode int, err error) {
+
+	br := bufio.NewReader(body)
+	var reader io.Reader = br
+	if magic, _ := br.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, gzErr := gzip.NewReader(br)
+		if gzErr != nil {
+			statusCode = http.StatusBadRequest
+			err = fmt.Errorf("invalid gzip data: %s", gzErr.Error())
+			return
+		}
+		defer gz.Close()
+		reader = gz
+	}
+
+	tr := tar.NewReader(reader)
+	for {
+		var hdr *tar.Header
+		hdr, err = tr.Next()
+		if err == io.EOF {
+			err = nil
+			return
+		}
+		if err != nil {
+			statusCode = http.StatusBadRequest
+			err = fmt.Errorf("invalid tar archive: %s", err.Error())
+			return
+		}
+
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			if hdr.Typeflag != tar.TypeDir {
+				e.summary.Skipped = append(e.summary.Skipped, hdr.Name)
+			}
+			continue
+		}
+
+		statusCode, err = e.addEntry(hdr.Name, hdr.Size, tr)
+		if err != nil {
+			return
+		}
+	}
+}
+
+// extractZip needs random access to the central directory at the end of the archive, the
+// upload is spooled to a temporary file first
+func (e *archiveExtractor) extractZip(body io.Reader) (statusCode int, err error) {
+
+	tmpFile, err := ioutil.TempFile("", "sage-extract-")
+	if err != nil {
+		statusCode = http.StatusInternalServerError
+		err = fmt.Errorf("ioutil.TempFile returned: %s", err.Error())
+		return
+	}
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+
+	bodyReader := &errorRecordingReader{r: body}
+	size, err := io.Copy(tmpFile, io.LimitReader(bodyReader, extractMaxSize+1))
+	if bodyReader.err != nil {
+		statusCode = http.StatusBadRequest
+		err = fmt.Errorf("reading archive failed: %s", bodyReader.err.Error())
+		return
+	}
+	if err != nil {
+		statusCode = http.StatusInternalServerError
+		err = fmt.Errorf("writing archive to temporary file failed: %s", err.Error())
+		return
+	}
+	if size > extractMaxSize {
+		statusCode = http.StatusRequestEntityTooLarge
+		err = fmt.Errorf("archive exceeds %d bytes", extractMaxSize)
+		return
+	}
+
+	zr, err := zip.NewReader(tmpFile, size)
+	if err != nil {
+		statusCode = http.StatusBadRequest
+		err = fmt.Errorf("invalid zip archive: %s", err.Error())
+		return
+	}
+
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		if !f.Mode().IsRegular() {
+			e.summary.Skipped = append(e.summary.Skipped, f.Name)
+			continue
+		}
+
+		var rc io.ReadCloser
+		rc, err = f.Open()
+		if err != nil {
+			statusCode = http.StatusBadRequest
+			err = fmt.Errorf("invalid zip entry %s: %s", f.Name, err.Error())
+			return
+		}
+		size := int64(-1)
+		if f.UncompressedSize64 <= uint64(extractMaxSize) {
+			size = int64(f.UncompressedSize64)
+		}
+		statusCode, err = e.addEntry(f.Name, size, rc)
+		rc.Close()
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// PUT /objects/{bucket}/{folder}/?extract=tar|zip, the archive is the request body or the first part
+// of a multipart/form-data request. Objects created before an error are kept and listed in the response.
+func extractArchiveRequest(w http.ResponseWriter, r *http.Request, username string, sageBucketID string, folder string) {
+
+	format, _ := getQueryField(r, "extract")
+	if format != "tar" && format != "zip" {
+		respondJSONError(w, http.StatusBadRequest, "extract must be \"tar\" or \"zip\"")
+		return
+	}
+
+	access, err := getBucketAccess(username, sageBucketID)
+	if err != nil {
+		respondError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	var body io.Reader = r.Body
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if strings.HasPrefix(mediaType, "multipart/") {
+		mReader, err := r.MultipartReader()
+		if err != nil {
+			respondJSONError(w, http.StatusBadRequest, "MultipartReader returned: %s", err.Error())
+			return
+		}
+		part, err := mReader.NextPart()
+		if err != nil {
+			respondJSONError(w, http.StatusBadRequest, "reading archive part failed: %s", err.Error())
+			return
+		}
+		defer part.Close()
+		body = part
+	}
+
+	summary := &ExtractSummary{Bucket: sageBucketID, Created: []string{}}
+	e := &archiveExtractor{username: username, sageBucketID: sageBucketID, folder: folder, access: access, summary: summary}
+
+	var statusCode int
+	if format == "zip" {
+		statusCode, err = e.extractZip(body)
+	} else {
+		statusCode, err = e.extractTar(body)
+	}
+	if err != nil {
+		log.Printf("extraction into %s/%s failed after %d files: %s", sageBucketID, folder, len(summary.Created), err.Error())
+		summary.Error = err.Error()
+		summary.Code = errorCodeForStatus(statusCode)
+		respondJSON(w, statusCode, summary)
+		return
+	}
+
+	log.Printf("extracted %d files (%d bytes) into %s/%s", len(summary.Created), summary.TotalSize, sageBucketID, folder)
+	respondJSON(w, http.StatusOK, summary)
+}
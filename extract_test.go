@@ -0,0 +1,153 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestSanitizeEntryName(t *testing.T) {
+
+	for name, expected := range map[string]string{
+		"a.txt":              "data/a.txt",
+		"./sub/b.txt":        "data/sub/b.txt",
+		"../../etc/passwd":   "data/etc/passwd",
+		"/abs/c.txt":         "data/abs/c.txt",
+		"sub\\..\\..\\d.txt": "data/d.txt",
+	} {
+		key, err := sanitizeEntryName("/data/", name)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err.Error())
+		}
+		if key != expected {
+			t.Fatalf("%s: expected %s, got %s", name, expected, key)
+		}
+	}
+
+	for _, name := range []string{"", ".", "..", "/"} {
+		_, err := sanitizeEntryName("/data/", name)
+		if err == nil {
+			t.Fatalf("%q should be rejected", name)
+		}
+	}
+}
+
+func TestExtractArchive(t *testing.T) {
+
+	testuser := "testuser"
+
+	newBucket, err := createSageBucket(testuser, "training-data", "testing-bucket1", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bucketID := newBucket.ID
+
+	extract := func(format string, body []byte) (summary *ExtractSummary) {
+		rr := testRequest(t, testuser, "PUT", fmt.Sprintf("/api/v1/objects/%s/data/?extract=%s", bucketID, format), bytes.NewReader(body), map[string]string{"Content-Type": "application/octet-stream"})
+		if rr.Code != http.StatusOK {
+			t.Fatalf("extract=%s returned %d: %s", format, rr.Code, rr.Body.String())
+		}
+		summary = &ExtractSummary{}
+		err := json.Unmarshal(rr.Body.Bytes(), summary)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(summary.Created)
+		return
+	}
+
+	// tar.gz with an entry that tries to leave the folder and a symlink
+	var tarData bytes.Buffer
+	gz := gzip.NewWriter(&tarData)
+	tw := tar.NewWriter(gz)
+	for name, content := range map[string]string{"a.txt": "file a", "../sub/b.txt": "file b"} {
+		tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: name, Size: int64(len(content)), Mode: 0644})
+		tw.Write([]byte(content))
+	}
+	tw.WriteHeader(&tar.Header{Typeflag: tar.TypeSymlink, Name: "link", Linkname: "/etc/passwd"})
+	tw.Close()
+	gz.Close()
+
+	summary := extract("tar", tarData.Bytes())
+	if strings.Join(summary.Created, ",") != "data/a.txt,data/sub/b.txt" {
+		t.Fatalf("unexpected keys %v", summary.Created)
+	}
+	if len(summary.Skipped) != 1 || summary.TotalSize != 12 {
+		t.Fatalf("unexpected summary %+v", summary)
+	}
+
+	// zip
+	var zipData bytes.Buffer
+	zw := zip.NewWriter(&zipData)
+	w, _ := zw.Create("zipped/c.txt")
+	w.Write([]byte("file c"))
+	zw.Close()
+
+	summary = extract("zip", zipData.Bytes())
+	if strings.Join(summary.Created, ",") != "data/zipped/c.txt" {
+		t.Fatalf("unexpected keys %v", summary.Created)
+	}
+
+	// the files are regular objects
+	req, err := http.NewRequest("GET", fmt.Sprintf("/api/v1/objects/%s/data/sub/b.txt", bucketID), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Add("Authorization", "sage user:"+testuser)
+	rr := httptest.NewRecorder()
+	mainRouter.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK || rr.Body.String() != "file b" {
+		t.Fatalf("download returned %d: %s", rr.Code, rr.Body.String())
+	}
+
+	// an entry exceeding the size limit is refused without replacing the existing file
+	var bigData bytes.Buffer
+	tw = tar.NewWriter(&bigData)
+	tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "sub/b.txt", Size: 16, Mode: 0644})
+	tw.Write([]byte("oversized file b"))
+	tw.Close()
+	extractMaxSize = 10
+	req, err = http.NewRequest("PUT", fmt.Sprintf("/api/v1/objects/%s/data/?extract=tar", bucketID), bytes.NewReader(bigData.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Add("Authorization", "sage user:"+testuser)
+	rr = httptest.NewRecorder()
+	mainRouter.ServeHTTP(rr, req)
+	extractMaxSize = int64(50 << 30)
+	if rr.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusRequestEntityTooLarge, rr.Code, rr.Body.String())
+	}
+	req, err = http.NewRequest("GET", fmt.Sprintf("/api/v1/objects/%s/data/sub/b.txt", bucketID), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Add("Authorization", "sage user:"+testuser)
+	rr = httptest.NewRecorder()
+	mainRouter.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK || rr.Body.String() != "file b" {
+		t.Fatalf("existing file was changed (%d): %s", rr.Code, rr.Body.String())
+	}
+
+	// the entry limit stops the extraction
+	extractMaxEntries = 1
+	defer func() { extractMaxEntries = 10000 }()
+	req, err = http.NewRequest("PUT", fmt.Sprintf("/api/v1/objects/%s/limited/?extract=tar", bucketID), bytes.NewReader(tarData.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Add("Authorization", "sage user:"+testuser)
+	rr = httptest.NewRecorder()
+	mainRouter.ServeHTTP(rr, req)
+	if rr.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusRequestEntityTooLarge, rr.Code, rr.Body.String())
+	}
+}
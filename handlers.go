@@ -1,13 +1,14 @@
 package main
 
 import (
-	"bufio"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"mime"
+	"mime/multipart"
 	"net/http"
 	"path"
 	"strconv"
@@ -15,16 +16,9 @@ import (
 	"time"
 
 	// "bytes"
-	// "mime/multipart"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/service/s3"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/gorilla/mux"
 
-	"database/sql"
-
-	"github.com/go-sql-driver/mysql"
 	_ "github.com/go-sql-driver/mysql"
 )
 
@@ -50,9 +44,11 @@ type SageFile struct {
 // SAGEBucketPermission _
 type SAGEBucketPermission struct {
 	ErrorStruct `json:",inline"`
-	GranteeType string `json:"granteeType,omitempty"`
-	Grantee     string `json:"grantee,omitempty"`
-	Permission  string `json:"permission,omitempty"`
+	GranteeType string     `json:"granteeType,omitempty"`
+	Grantee     string     `json:"grantee,omitempty"`
+	Permission  string     `json:"permission,omitempty"`
+	Prefix      string     `json:"prefix,omitempty"`  // optional, grant only applies to keys with this prefix
+	Expires     *time.Time `json:"expires,omitempty"` // optional, grant is ignored after this time
 }
 
 // DeleteRespsonse _
@@ -63,7 +59,24 @@ type DeleteRespsonse struct {
 
 // ErrorStruct _
 type ErrorStruct struct {
-	Error string `json:"error,omitempty"`
+	Error string    `json:"error,omitempty"`
+	Code  errorCode `json:"code,omitempty"` // machine-readable, see errors.go
+}
+
+// sageBucketExists responds with 404 and returns false if the bucket does not exist.
+// It has to run before any permission check, so that a missing bucket is not reported as 401/403.
+func sageBucketExists(w http.ResponseWriter, sageBucketID string) bool {
+	if len(sageBucketID) != 36 {
+		respondJSONError(w, http.StatusNotFound, "bucket id (%s) invalid (%d)", sageBucketID, len(sageBucketID))
+		return false
+	}
+
+	_, err := GetSageBucket(sageBucketID)
+	if err != nil {
+		respondError(w, err, http.StatusInternalServerError)
+		return false
+	}
+	return true
 }
 
 // getSageBucket
@@ -73,8 +86,7 @@ func getSageBucketGeneric(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 
 	sageBucketID := vars["bucket"]
-	if len(sageBucketID) != 36 {
-		respondJSONError(w, http.StatusInternalServerError, "bucket id (%s) invalid (%d)", sageBucketID, len(sageBucketID))
+	if !sageBucketExists(w, sageBucketID) {
 		return
 	}
 
@@ -99,19 +111,19 @@ func getSageBucketGeneric(w http.ResponseWriter, r *http.Request) {
 	//log.Printf("rawQuery: %s", rawQuery)
 	if sagePath == "" && strings.Contains(rawQuery, "permissions") {
 
-		allowed, err := userHasBucketPermission(username, sageBucketID, "READ_ACP")
+		allowed, err := userIsAllowed(username, sageBucketID, actionReadACL, "")
 		if err != nil {
-			respondJSONError(w, http.StatusBadRequest, err.Error())
+			respondError(w, err, http.StatusInternalServerError)
 			return
 		}
 		if !allowed {
-			respondJSONError(w, http.StatusUnauthorized, "Access to bucket permissions denied (%s, %s)", username, sageBucketID)
+			respondJSONError(w, deniedStatus(username), "Access to bucket permissions denied (%s, %s)", username, sageBucketID)
 			return
 		}
 
 		permissions, err := ListBucketPermissions(sageBucketID)
 		if err != nil {
-			respondJSONError(w, http.StatusBadRequest, err.Error())
+			respondError(w, err, http.StatusInternalServerError)
 			return
 		}
 
@@ -120,15 +132,45 @@ func getSageBucketGeneric(w http.ResponseWriter, r *http.Request) {
 
 	}
 
+	if sagePath == "" && strings.Contains(rawQuery, "policy") {
+		getBucketPolicyRequest(w, username, sageBucketID)
+		return
+	}
+
+	if sagePath == "" && strings.Contains(rawQuery, "transfer") {
+		getBucketTransferRequest(w, username, sageBucketID)
+		return
+	}
+
+	if sagePath == "" && strings.Contains(rawQuery, "uploads") {
+		listMultipartUploadsRequest(w, username, sageBucketID)
+		return
+	}
+
+	if sagePath == "" && strings.Contains(rawQuery, "snapshot") {
+		getSnapshotsRequest(w, r, username, sageBucketID)
+		return
+	}
+
+	if sagePath != "" && strings.Contains(rawQuery, "uploadid=") {
+		listPartsRequest(w, r, username, sageBucketID, sagePath)
+		return
+	}
+
 	// bucket of directory listing
 
-	allowed, err := userHasBucketPermission(username, sageBucketID, "READ")
+	readAction := actionReadObject
+	if sagePath == "" || strings.HasSuffix(sagePath, "/") {
+		readAction = actionListObjects
+	}
+
+	allowed, err := userIsAllowed(username, sageBucketID, readAction, aclKey(sagePath))
 	if err != nil {
-		respondJSONError(w, http.StatusBadRequest, err.Error())
+		respondError(w, err, http.StatusInternalServerError)
 		return
 	}
 	if !allowed {
-		respondJSONError(w, http.StatusUnauthorized, "Read access to bucket denied (username: \"%s\", sageBucketID: \"%s\")", username, sageBucketID)
+		respondJSONError(w, deniedStatus(username), "Read access to bucket denied (username: \"%s\", sageBucketID: \"%s\")", username, sageBucketID)
 		return
 	}
 
@@ -136,7 +178,7 @@ func getSageBucketGeneric(w http.ResponseWriter, r *http.Request) {
 		// bucket listing
 		bucket, err := GetSageBucket(sageBucketID)
 		if err != nil {
-			respondJSONError(w, http.StatusBadRequest, err.Error())
+			respondError(w, err, http.StatusInternalServerError)
 			return
 		}
 
@@ -147,6 +189,11 @@ func getSageBucketGeneric(w http.ResponseWriter, r *http.Request) {
 	// directory listing
 	if strings.HasSuffix(sagePath, "/") {
 
+		if strings.Contains(rawQuery, "archive=") {
+			downloadFolderArchive(w, r, username, sageBucketID, sagePath)
+			return
+		}
+
 		// _, sagePath, err := getSagePath(r.URL.Path)
 		// if err != nil {
 		// 	respondJSONError(w, http.StatusBadRequest, err.Error())
@@ -168,7 +215,7 @@ func getSageBucketGeneric(w http.ResponseWriter, r *http.Request) {
 
 		limit, err := getQueryFieldInt64(r, "limit", 0)
 		if err != nil {
-			respondJSONError(w, http.StatusInternalServerError, "error parsing query field limit: %s", err.Error())
+			respondJSONError(w, http.StatusBadRequest, "error parsing query field limit: %s", err.Error())
 			return
 		}
 
@@ -196,69 +243,19 @@ func getSageBucketGeneric(w http.ResponseWriter, r *http.Request) {
 			respondJSON(w, http.StatusOK, data)
 		}
 
-		listObject, err := listSageBucketContent(sageBucketID, sagePath, recursive, limit, "", continuationToken)
+		access, err := getBucketAccess(username, sageBucketID)
 		if err != nil {
-			respondJSONError(w, http.StatusInternalServerError, "error listing bucket contents (sageBucketID: %s, sagePath: %s): %s", sageBucketID, sagePath, err.Error())
+			respondError(w, err, http.StatusInternalServerError)
 			return
 		}
-		respondJSON(w, http.StatusOK, listObject)
-
-		return
-	}
-
-	// a file download
-
-	//uuidStr := vars["bucket"]
-	//sageKey := vars["key"]
-
-	// convert SAGE specifiers to S3 specifiers
-	//sageBucketID := s3BucketPrefix + sageBucketID[0:2]
 
-	s3BucketID := getS3BucketID(sageBucketID) //s3BucketPrefix + sageBucketID[0:2]
+		respondFolderListing(w, r, access, sageBucketID, sagePath, recursive, limit, continuationToken)
 
-	s3key := path.Join(sageBucketID, sagePath)
-
-	sageFilename := path.Base(sagePath)
-	if sageFilename == "." || sageFilename == "/" {
-		respondJSONError(w, http.StatusInternalServerError, "Invalid filename (%s)", sageFilename)
 		return
 	}
 
-	objectInput := s3.GetObjectInput{
-		Bucket: &s3BucketID,
-		Key:    &s3key,
-	}
-
-	out, err := svc.GetObject(&objectInput)
-	if err != nil {
-		respondJSONError(w, http.StatusInternalServerError, "Error getting data, svc.GetObject returned: %s", err.Error())
-		return
-	}
-	defer out.Body.Close()
-
-	w.Header().Set("Content-Disposition", "attachment; filename="+sageFilename)
-	//w.Header().Set("Content-Length", FileSize)
-
-	buffer := make([]byte, 1024*1024)
-	w.WriteHeader(http.StatusOK)
-	for {
-		n, err := out.Body.Read(buffer)
-		if err != nil {
-
-			if err == io.EOF {
-				w.Write(buffer[:n]) //should handle any remainding bytes.
-				fileDownloadByteSize.Add(float64(n))
-				break
-			}
-
-			respondJSONError(w, http.StatusInternalServerError, "Error getting data: %s", err.Error())
-			return
-		}
-		w.Write(buffer[0:n])
-		fileDownloadByteSize.Add(float64(n))
-	}
-
-	return
+	// a file download
+	downloadSageObject(w, r, sageBucketID, sagePath)
 }
 
 func listSageBucketRequest(w http.ResponseWriter, r *http.Request) {
@@ -276,7 +273,7 @@ func listSageBucketRequest(w http.ResponseWriter, r *http.Request) {
 
 	buckets, err := listSageBuckets(username, filter_owner, filter_name)
 	if err != nil {
-		respondJSONError(w, http.StatusInternalServerError, "error getting list of buckets: %s", err.Error())
+		respondJSONError(w, errorStatus(err, http.StatusInternalServerError), "error getting list of buckets: %s", err.Error())
 		return
 	}
 
@@ -357,13 +354,13 @@ func createBucketRequest(w http.ResponseWriter, r *http.Request) {
 
 	dataType, err := getQueryField(r, "type")
 	if err != nil {
-		respondJSONError(w, http.StatusInternalServerError, err.Error(), dataType)
+		respondJSONError(w, http.StatusUnprocessableEntity, err.Error())
 		return
 	}
 
 	_, ok := validDataTypes[dataType]
 	if !ok {
-		respondJSONError(w, http.StatusInternalServerError, "Data type %s not supported", dataType)
+		respondJSONError(w, http.StatusUnprocessableEntity, "Data type %s not supported", dataType)
 		return
 
 	}
@@ -374,7 +371,7 @@ func createBucketRequest(w http.ResponseWriter, r *http.Request) {
 
 	bucketObject, err := createSageBucket(username, dataType, bucketName, isPublic)
 	if err != nil {
-		respondJSONError(w, http.StatusInternalServerError, "bucket creation failed: %s", err.Error())
+		respondJSONError(w, errorStatus(err, http.StatusInternalServerError), "bucket creation failed: %s", err.Error())
 		return
 	}
 	// TODO store owner info in mysql
@@ -420,17 +417,21 @@ func patchBucket(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	username := vars["username"]
 
+	if !sageBucketExists(w, sageBucketID) {
+		return
+	}
+
 	//rawQuery := r.URL.RawQuery
 
 	// normal bucket metadata
 
-	allowed, err := userHasBucketPermission(username, sageBucketID, "FULL_CONTROL")
+	allowed, err := userIsAllowed(username, sageBucketID, actionPatchMetadata, "")
 	if err != nil {
-		respondJSONError(w, http.StatusBadRequest, err.Error())
+		respondError(w, err, http.StatusInternalServerError)
 		return
 	}
 	if !allowed {
-		respondJSONError(w, http.StatusUnauthorized, "Write access to bucket metadata denied (%s, %s)", username, sageBucketID)
+		respondJSONError(w, deniedStatus(username), "Write access to bucket metadata denied (%s, %s)", username, sageBucketID)
 		return
 	}
 
@@ -445,23 +446,18 @@ func patchBucket(w http.ResponseWriter, r *http.Request) {
 
 	log.Printf("got: %v", deltaBucket)
 
-	db, err := sql.Open("mysql", mysqlDSN)
-	if err != nil {
-		err = fmt.Errorf("Unable to connect to database: %v", err)
+	if _, ok := deltaBucket["owner"]; ok {
+		respondJSONError(w, http.StatusUnprocessableEntity, "The owner cannot be modified, use PUT /objects/{bucket}?transfer instead")
 		return
 	}
-	defer db.Close()
 
 	newBucketname, ok := deltaBucket["name"]
 	if ok {
-
-		insertQueryStr := "UPDATE Buckets SET name=? WHERE  id=UUID_TO_BIN(?) ;"
-		_, err = db.Exec(insertQueryStr, newBucketname, sageBucketID)
+		err = updateSageBucketName(sageBucketID, newBucketname)
 		if err != nil {
-			err = fmt.Errorf("Bucket creation in mysql failed: %s", err.Error())
+			respondError(w, err, http.StatusInternalServerError)
 			return
 		}
-
 	}
 
 	// return should return real bucket
@@ -469,13 +465,13 @@ func patchBucket(w http.ResponseWriter, r *http.Request) {
 	newBucket, err := GetSageBucket(sageBucketID)
 	if err != nil {
 		err = fmt.Errorf("GetSageBucket returned: %s", err.Error())
-		respondJSONError(w, http.StatusBadRequest, err.Error())
+		respondError(w, err, http.StatusInternalServerError)
 		return
 	}
 
 	respondJSON(w, http.StatusOK, newBucket)
 	//bucket fields:
-	//metadata , name , type, (owner, change requires permission change)
+	//metadata , name , type, (owner, see transfer.go)
 
 	//permission
 
@@ -491,22 +487,20 @@ func putBucket(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	username := vars["username"]
 
+	if !sageBucketExists(w, sageBucketID) {
+		return
+	}
+
 	rawQuery := r.URL.RawQuery
 
 	if strings.Contains(rawQuery, "permission") {
-		allowed, err := userHasBucketPermission(username, sageBucketID, "WRITE_ACP")
+		allowed, err := userIsAllowed(username, sageBucketID, actionWriteACL, "")
 		if err != nil {
-			respondJSONError(w, http.StatusBadRequest, err.Error())
+			respondError(w, err, http.StatusInternalServerError)
 			return
 		}
 		if !allowed {
-			respondJSONError(w, http.StatusUnauthorized, "Write access to bucket permissions denied (%s, %s)", username, sageBucketID)
-			return
-		}
-
-		bucketObject, err := GetSageBucket(sageBucketID)
-		if err != nil {
-			respondJSONError(w, http.StatusBadRequest, err.Error())
+			respondJSONError(w, deniedStatus(username), "Write access to bucket permissions denied (%s, %s)", username, sageBucketID)
 			return
 		}
 
@@ -519,42 +513,9 @@ func putBucket(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		if bucketObject.Owner == newPerm.Grantee {
-			respondJSONError(w, http.StatusBadRequest, "You cannot change your own permissons.")
-			return
-		}
-
-		if newPerm.GranteeType == "" {
-			respondJSONError(w, http.StatusBadRequest, "GranteeType missing")
-			return
-		}
-
-		if newPerm.GranteeType == "GROUP" && newPerm.Grantee == "AllUsers" && newPerm.Permission != "READ" {
-			respondJSONError(w, http.StatusBadRequest, "Buckets can be made public only for READ access.")
-			return
-		}
-
-		//do something
-		db, err := sql.Open("mysql", mysqlDSN)
+		statusCode, err := grantBucketPermission(sageBucketID, &newPerm)
 		if err != nil {
-			err = fmt.Errorf("Unable to connect to database: %v", err)
-			return
-		}
-		defer db.Close()
-
-		insertQueryStr := "INSERT INTO BucketPermissions (id, granteeType, grantee, permission) VALUES ( UUID_TO_BIN(?), ? , ?, ?) ;"
-		_, err = db.Exec(insertQueryStr, sageBucketID, newPerm.GranteeType, newPerm.Grantee, newPerm.Permission)
-		if err != nil {
-			me, ok := err.(*mysql.MySQLError)
-			if ok {
-				if me.Number == 1062 {
-					// entry already exists, quietly respond OK
-					respondJSON(w, http.StatusOK, newPerm)
-					return
-				}
-			}
-			err = fmt.Errorf("Adding bucket permissions failed: %s", err.Error())
-			respondJSONError(w, http.StatusUnauthorized, err.Error())
+			respondJSONError(w, statusCode, err.Error())
 			return
 		}
 
@@ -562,7 +523,17 @@ func putBucket(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	respondJSONError(w, http.StatusUnauthorized, "Only query ?permissions supported")
+	if strings.Contains(rawQuery, "policy") {
+		putBucketPolicyRequest(w, r, username, sageBucketID)
+		return
+	}
+
+	if strings.Contains(rawQuery, "transfer") {
+		putBucketTransferRequest(w, r, username, sageBucketID)
+		return
+	}
+
+	respondJSONError(w, http.StatusBadRequest, "Only query ?permissions, ?policy or ?transfer supported")
 	return
 	//respondJSON(w, http.StatusOK, newBucket)
 	//bucket fields:
@@ -572,6 +543,93 @@ func putBucket(w http.ResponseWriter, r *http.Request) {
 
 }
 
+// grantBucketPermission validates and adds a grant, the owner cannot change their own permissions
+func grantBucketPermission(sageBucketID string, newPerm *SAGEBucketPermission) (statusCode int, err error) {
+
+	bucketObject, err := GetSageBucket(sageBucketID)
+	if err != nil {
+		statusCode = errorStatus(err, http.StatusInternalServerError)
+		return
+	}
+
+	if bucketObject.Owner == newPerm.Grantee {
+		statusCode = http.StatusUnprocessableEntity
+		err = fmt.Errorf("You cannot change your own permissons.")
+		return
+	}
+
+	err = validateNewPermission(newPerm)
+	if err != nil {
+		statusCode = http.StatusUnprocessableEntity
+		return
+	}
+
+	err = addBucketPermission(sageBucketID, newPerm)
+	if err != nil {
+		statusCode = errorStatus(err, http.StatusInternalServerError)
+		return
+	}
+	return
+}
+
+// postObject handles the POST operations on files
+func postObject(w http.ResponseWriter, r *http.Request) {
+
+	vars := mux.Vars(r)
+	username := vars["username"]
+
+	sageBucketID := vars["bucket"]
+	if len(sageBucketID) != 36 {
+		respondJSONError(w, http.StatusNotFound, "bucket id (%s) invalid (%d)", sageBucketID, len(sageBucketID))
+		return
+	}
+
+	_, sagePath, err := getSagePath(r.URL.Path)
+	if err != nil {
+		respondJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	rawQuery := r.URL.RawQuery
+
+	if sagePath == "" && strings.Contains(rawQuery, "clone") {
+		cloneBucketRequest(w, r, username, sageBucketID)
+		return
+	}
+
+	if sagePath == "" && strings.Contains(rawQuery, "snapshot") {
+		createSnapshotRequest(w, r, username, sageBucketID)
+		return
+	}
+
+	if sagePath == "" && strings.Contains(rawQuery, "delete") {
+		bulkDeleteRequest(w, r, username, sageBucketID)
+		return
+	}
+
+	if strings.Contains(rawQuery, "uploadId=") {
+		completeMultipartUploadRequest(w, r, username, sageBucketID, sagePath)
+		return
+	}
+
+	if strings.Contains(rawQuery, "uploads") {
+		initiateMultipartUploadRequest(w, username, sageBucketID, sagePath)
+		return
+	}
+
+	if strings.Contains(rawQuery, "copy") {
+		copyObjectRequest(w, r, username, sageBucketID, sagePath, false)
+		return
+	}
+
+	if strings.Contains(rawQuery, "move") {
+		copyObjectRequest(w, r, username, sageBucketID, sagePath, true)
+		return
+	}
+
+	respondJSONError(w, http.StatusBadRequest, "Only query ?uploads, ?uploadId, ?copy, ?move, ?delete, ?snapshot or ?clone supported")
+}
+
 // deleteBucket deletes bucket, files, and bucket permissions
 func deleteBucket(w http.ResponseWriter, r *http.Request) {
 
@@ -583,8 +641,7 @@ func deleteBucket(w http.ResponseWriter, r *http.Request) {
 	username := vars["username"]
 
 	sageBucketID := vars["bucket"]
-	if len(sageBucketID) != 36 {
-		respondJSONError(w, http.StatusInternalServerError, "bucket id (%s) invalid (%d)", sageBucketID, len(sageBucketID))
+	if !sageBucketExists(w, sageBucketID) {
 		return
 	}
 
@@ -597,81 +654,66 @@ func deleteBucket(w http.ResponseWriter, r *http.Request) {
 
 	rawQuery := r.URL.RawQuery
 
+	if sagePath != "" && strings.Contains(rawQuery, "uploadId=") {
+		abortMultipartUploadRequest(w, r, username, sageBucketID, sagePath)
+		return
+	}
+
+	// as in listings, ?recursive is enabled unless it is recursive=false, which deletes a single file
+	if recursive, ok := r.URL.Query()["recursive"]; sagePath != "" && ok && recursive[0] != "false" {
+		deleteFolderRequest(w, r, username, sageBucketID, sagePath)
+		return
+	}
+
 	if (sagePath == "") && strings.Contains(rawQuery, "permission") {
-		allowed, err := userHasBucketPermission(username, sageBucketID, "WRITE_ACP")
+		allowed, err := userIsAllowed(username, sageBucketID, actionWriteACL, "")
 		if err != nil {
-			respondJSONError(w, http.StatusBadRequest, err.Error())
+			respondError(w, err, http.StatusInternalServerError)
 			return
 		}
 		if !allowed {
-			respondJSONError(w, http.StatusUnauthorized, "Write access to bucket permissions denied (%s, %s)", username, sageBucketID)
+			respondJSONError(w, deniedStatus(username), "Write access to bucket permissions denied (%s, %s)", username, sageBucketID)
 			return
 		}
 
 		bucketObject, err := GetSageBucket(sageBucketID)
 		if err != nil {
-			respondJSONError(w, http.StatusBadRequest, err.Error())
+			respondError(w, err, http.StatusInternalServerError)
 			return
 		}
 
 		values := r.URL.Query()
 		grantees, ok := values["grantee"]
 		if !ok {
-			respondJSONError(w, http.StatusBadRequest, "query field \"grantee\" missing")
+			respondJSONError(w, http.StatusUnprocessableEntity, "query field \"grantee\" missing")
 			return
 		}
 
 		if len(grantees) == 0 {
-			respondJSONError(w, http.StatusBadRequest, "query field \"grantee\" missing")
+			respondJSONError(w, http.StatusUnprocessableEntity, "query field \"grantee\" missing")
 			return
 		}
 
+		// optional, only delete grants for this key prefix
+		deletePrefix := ""
+		_, hasDeletePrefix := values["prefix"]
+		if hasDeletePrefix {
+			deletePrefix = aclKey(values.Get("prefix"))
+		}
+
 		dr := DeleteRespsonse{}
 		dr.Deleted = []string{}
 		for _, grantee := range grantees {
-			granteeType := "USER"
-			granteeArray := strings.SplitN(grantee, ":", 3)
-			deletePermission := ""
-			if len(granteeArray) >= 2 {
-				granteeType = granteeArray[0]
-				grantee = granteeArray[1]
-			}
-			if len(granteeArray) == 3 {
-				deletePermission = granteeArray[2]
-			}
+			granteeType, grantee, deletePermission := parseGranteeSpec(grantee)
 
 			if bucketObject.Owner == grantee {
-				respondJSONError(w, http.StatusBadRequest, "You cannot change your own permissons.")
+				respondJSONError(w, http.StatusUnprocessableEntity, "You cannot change your own permissons.")
 				return
 			}
 
-			//do something
-			db, err := sql.Open("mysql", mysqlDSN)
+			deletedNumber, err := removeBucketPermission(sageBucketID, granteeType, grantee, deletePermission, deletePrefix, hasDeletePrefix)
 			if err != nil {
-				err = fmt.Errorf("Unable to connect to database: %v", err)
-				return
-			}
-			defer db.Close()
-
-			insertQueryStr := ""
-			var result sql.Result
-			if deletePermission == "" {
-				insertQueryStr = "DELETE FROM BucketPermissions WHERE id=UUID_TO_BIN(?) AND granteeType=? AND grantee=? ;"
-				result, err = db.Exec(insertQueryStr, sageBucketID, granteeType, grantee)
-			} else {
-				insertQueryStr = "DELETE FROM BucketPermissions WHERE id=UUID_TO_BIN(?) AND granteeType=? AND grantee=? AND permission=?;"
-				result, err = db.Exec(insertQueryStr, sageBucketID, granteeType, grantee, deletePermission)
-			}
-			if err != nil {
-				err = fmt.Errorf("Removing bucket permissions failed: %s", err.Error())
-				respondJSONError(w, http.StatusUnauthorized, err.Error())
-				return
-			}
-
-			deletedNumber, err := result.RowsAffected()
-			if err != nil {
-				err = fmt.Errorf("result.RowsAffected returned: %s", err.Error())
-				respondJSONError(w, http.StatusUnauthorized, err.Error())
+				respondError(w, err, http.StatusInternalServerError)
 				return
 			}
 
@@ -688,15 +730,35 @@ func deleteBucket(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if (sagePath == "") && strings.Contains(rawQuery, "policy") {
+		deleteBucketPolicyRequest(w, username, sageBucketID)
+		return
+	}
+
+	if (sagePath == "") && strings.Contains(rawQuery, "transfer") {
+		deleteBucketTransferRequest(w, username, sageBucketID)
+		return
+	}
+
+	if (sagePath == "") && strings.Contains(rawQuery, "snapshot=") {
+		deleteSnapshotRequest(w, r, username, sageBucketID)
+		return
+	}
+
 	// delete bucket or file
 
-	allowed, err := userHasBucketPermission(username, sageBucketID, "WRITE")
+	deleteAction := actionDeleteObject
+	if sagePath == "" {
+		deleteAction = actionDeleteBucket
+	}
+
+	allowed, err := userIsAllowed(username, sageBucketID, deleteAction, aclKey(sagePath))
 	if err != nil {
-		respondJSONError(w, http.StatusBadRequest, err.Error())
+		respondError(w, err, http.StatusInternalServerError)
 		return
 	}
 	if !allowed {
-		respondJSONError(w, http.StatusUnauthorized, "Write access to bucket denied (%s, %s)", username, sageBucketID)
+		respondJSONError(w, deniedStatus(username), "Delete access to bucket denied (%s, %s)", username, sageBucketID)
 		return
 	}
 
@@ -707,34 +769,15 @@ func deleteBucket(w http.ResponseWriter, r *http.Request) {
 		// 1) check if bucket exists
 		sageBucket, err := GetSageBucket(sageBucketID)
 		if err != nil {
-			respondJSONError(w, http.StatusUnauthorized, err.Error())
+			respondError(w, err, http.StatusInternalServerError)
 			return
 		}
 		_ = sageBucket
 
-		// 2) delete files in bucket
-
-		totalDeleted, err := deleteAllFiles(sageBucketID)
-		if err != nil {
-			respondJSONError(w, http.StatusInternalServerError, err.Error())
-			return
-		}
-		_ = totalDeleted
-
-		db, err := sql.Open("mysql", mysqlDSN)
+		// 2) delete files, policy, snapshots, uploads and the bucket
+		err = deleteSageBucket(sageBucketID)
 		if err != nil {
-			err = fmt.Errorf("Unable to connect to database: %v", err)
-			respondJSONError(w, http.StatusInternalServerError, err.Error())
-			return
-		}
-		defer db.Close()
-
-		// 3) delete bucket
-		insertQueryStr := "DELETE FROM Buckets  WHERE  id=UUID_TO_BIN(?) ;"
-		_, err = db.Exec(insertQueryStr, sageBucketID)
-		if err != nil {
-			err = fmt.Errorf("Bucket creation in mysql failed: %s", err.Error())
-			respondJSONError(w, http.StatusInternalServerError, err.Error())
+			respondError(w, err, http.StatusInternalServerError)
 			return
 		}
 
@@ -750,7 +793,8 @@ func deleteBucket(w http.ResponseWriter, r *http.Request) {
 	deleted, err := deleteSAGEFiles(sageBucketID, []string{sagePath})
 	if err != nil {
 		err = fmt.Errorf("Deleting files failed: %s", err.Error())
-		respondJSONError(w, http.StatusInternalServerError, err.Error())
+		respondError(w, err, http.StatusInternalServerError)
+		return
 	}
 
 	data := DeleteRespsonse{}
@@ -765,6 +809,10 @@ func deleteBucket(w http.ResponseWriter, r *http.Request) {
 
 }
 
+// uploadFormatList selects a list response for multipart/form-data uploads also if the request contains
+// a single file, which otherwise returns a single object like earlier versions
+const uploadFormatList = "list"
+
 // PUT /objects/{bucket-id}/key... (woth or without filename in key)
 func uploadObject(w http.ResponseWriter, r *http.Request) {
 
@@ -775,16 +823,6 @@ func uploadObject(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	username := vars["username"]
 
-	allowed, err := userHasBucketPermission(username, sageBucketID, "WRITE")
-	if err != nil {
-		respondJSONError(w, http.StatusBadRequest, err.Error())
-		return
-	}
-	if !allowed {
-		respondJSONError(w, http.StatusUnauthorized, "Write access to bucket denied (%s, %s)", username, sageBucketID)
-		return
-	}
-
 	log.Printf("r.URL.Path: %s", r.URL.Path)
 	// example: /api/v1/objects/cbc2c709-2ef7-4852-8f5e-038fdc7f2304/test3/test3.jpg
 
@@ -794,18 +832,50 @@ func uploadObject(w http.ResponseWriter, r *http.Request) {
 		return
 
 	}
+	if strings.Contains(r.URL.RawQuery, "uploadId=") {
+		uploadPartRequest(w, r, username, sageBucketID, preliminarySageKey)
+		return
+	}
+
 	isDirectory := false
 	if preliminarySageKey == "" || strings.HasSuffix(preliminarySageKey, "/") {
 		isDirectory = true
 	}
 
-	log.Printf("preliminarySageKey: %s", preliminarySageKey)
+	if strings.Contains(r.URL.RawQuery, "extract=") {
+		if !isDirectory {
+			respondJSONError(w, http.StatusBadRequest, "archives can only be extracted into a folder, the key has to end with /")
+			return
+		}
+		extractArchiveRequest(w, r, username, sageBucketID, preliminarySageKey)
+		return
+	}
+
+	// for directories the permission is checked per file, once the filename is known
+	if !isDirectory {
+		allowed, err := userIsAllowed(username, sageBucketID, actionWriteObject, aclKey(preliminarySageKey))
+		if err != nil {
+			respondError(w, err, http.StatusInternalServerError)
+			return
+		}
+		if !allowed {
+			respondJSONError(w, deniedStatus(username), "Write access to bucket denied (%s, %s)", username, sageBucketID)
+			return
+		}
+	}
 
-	preliminaryS3Key := path.Join(sageBucketID, preliminarySageKey)
-	log.Printf("preliminaryS3Key: %s", preliminaryS3Key)
+	log.Printf("preliminarySageKey: %s", preliminarySageKey)
 
-	s3BucketName := getS3BucketID(sageBucketID) //s3BucketPrefix + sageBucketID[0:2] // first two characters of uuid
-	log.Printf("s3BucketName: %s", s3BucketName)
+	// without multipart encoding the request body is the file content
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if !strings.HasPrefix(mediaType, "multipart/") {
+		if isDirectory {
+			respondJSONError(w, http.StatusBadRequest, "uploads without multipart encoding need a file key, not a folder")
+			return
+		}
+		uploadRawObject(w, r, username, sageBucketID, preliminarySageKey)
+		return
+	}
 
 	mReader, err := r.MultipartReader()
 	if err != nil {
@@ -813,19 +883,40 @@ func uploadObject(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	//chunk := make([]byte, 4096)
+	// on_error=abort (default) stops at the first failed file, on_error=continue reports per-file failures
+	continueOnError := false
+	onError, _ := getQueryField(r, "on_error")
+	switch onError {
+	case "", "abort":
+	case "continue":
+		continueOnError = true
+	default:
+		respondJSONError(w, http.StatusUnprocessableEntity, "on_error must be \"abort\" or \"continue\"")
+		return
+	}
+
+	format, _ := getQueryField(r, "format")
+	if format != "" && format != uploadFormatList {
+		respondJSONError(w, http.StatusUnprocessableEntity, "format %q not supported, only %q", format, uploadFormatList)
+		return
+	}
+
+	results := []*SageFile{}
+	failed := 0
 
 	for {
 		part, err := mReader.NextPart()
+		if err == io.EOF {
+			log.Printf("Hit last part of multipart upload")
+			break
+		}
 		if err != nil {
-			if err != io.EOF {
+			respondJSONError(w, http.StatusBadRequest, "error reading part (%d files uploaded before): %s", len(results)-failed, err.Error())
+			return
+		}
 
-				respondJSONError(w, http.StatusInternalServerError, "error reading part: %s", err.Error())
-			} else {
-				log.Printf("Hit last part of multipart upload")
-				w.WriteHeader(200)
-				fmt.Fprintf(w, "Upload completed")
-			}
+		if !isDirectory && len(results) > 0 {
+			respondJSONError(w, http.StatusBadRequest, "multiple files can only be uploaded into a folder, the key has to end with /")
 			return
 		}
 
@@ -833,66 +924,187 @@ func uploadObject(w http.ResponseWriter, r *http.Request) {
 
 		//formName := part.FormName()
 
-		s3Key := ""
-
-		sageKey := ""
-		if isDirectory {
-			filename := part.FileName()
-			if filename == "" {
-				respondJSONError(w, http.StatusBadRequest, "part upload has no filename and no key was specified")
+		data := &SageFile{Bucket: sageBucketID}
+		statusCode, err := uploadPart(part, username, sageBucketID, preliminarySageKey, isDirectory, data)
+		if err != nil {
+			if !continueOnError {
+				respondJSONError(w, statusCode, "%s (%d files uploaded before)", err.Error(), len(results)-failed)
 				return
 			}
-			s3Key = path.Join(preliminaryS3Key, filename)
-			sageKey = path.Join(preliminarySageKey, filename)
-
-		} else {
-			s3Key = preliminaryS3Key
-			sageKey = preliminarySageKey
+			log.Printf("upload of %s failed: %s", data.Key, err.Error())
+			data.Error = err.Error()
+			data.Code = errorCodeForStatus(statusCode)
+			failed++
 		}
-		sageKey = strings.TrimPrefix(sageKey, "/")
-		log.Printf("s3Key: %s", s3Key)
-		log.Printf("sageKey: %s", sageKey)
-
-		bufferedPartReader := bufio.NewReaderSize(part, 32768)
-		var objectMetadata map[string]*string
-		objectMetadata = make(map[string]*string)
+		results = append(results, data)
+	}
 
-		data := SageFile{}
-		//data.Metadata = objectMetadata
+	if len(results) == 0 {
+		respondJSONError(w, http.StatusBadRequest, "multipart upload contains no files")
+		return
+	}
 
-		//key := filename // use filename unless key has been specified
+	// a single file keeps the response format of earlier versions
+	if format != uploadFormatList && len(results) == 1 && failed == 0 {
+		respondJSON(w, http.StatusOK, results[0])
+		return
+	}
 
-		objectMetadata["owner"] = &username
-		//objectMetadata["type"] = &dataType
+	statusCode := http.StatusOK
+	if failed > 0 {
+		statusCode = http.StatusMultiStatus
+	}
+	respondJSON(w, statusCode, results)
+	return
+}
 
-		data.Key = sageKey
+// uploadPart stores one part of a multipart upload, data.Key is set as soon as the key is known
+func uploadPart(part *multipart.Part, username string, sageBucketID string, preliminarySageKey string, isDirectory bool, data *SageFile) (statusCode int, err error) {
 
-		upParams := &s3manager.UploadInput{
-			Bucket:   aws.String(s3BucketName),
-			Key:      aws.String(s3Key),
-			Body:     bufferedPartReader,
-			Metadata: objectMetadata,
+	sageKey := ""
+	if isDirectory {
+		filename := part.FileName()
+		if filename == "" {
+			statusCode = http.StatusBadRequest
+			err = fmt.Errorf("part upload has no filename and no key was specified")
+			return
 		}
-		uploader := s3manager.NewUploader(newSession)
-		_, err = uploader.Upload(upParams)
+		// the filename must not leave the target folder
+		sageKey = path.Join(preliminarySageKey, path.Clean("/"+filename))
+
+	} else {
+		sageKey = preliminarySageKey
+	}
+	sageKey = strings.TrimPrefix(sageKey, "/")
+	data.Key = sageKey
+	log.Printf("sageKey: %s", sageKey)
+
+	if isDirectory {
+		var allowed bool
+		allowed, err = userIsAllowed(username, sageBucketID, actionWriteObject, sageKey)
 		if err != nil {
-			// Print the error and exit.
-			respondJSONError(w, http.StatusInternalServerError, "Upload to S3 backend failed: %s", err.Error())
+			statusCode = errorStatus(err, http.StatusInternalServerError)
 			return
 		}
+		if !allowed {
+			statusCode = deniedStatus(username)
+			err = fmt.Errorf("Write access to %s denied (%s, %s)", sageKey, username, sageBucketID)
+			return
+		}
+	}
 
-		data.Bucket = sageBucketID
-		//log.Printf("Upload - Bucket: %v and Object: %v\n", bucketName, objectName)
-		log.Printf("user upload successful")
-		fileUploadCounter.Inc()
-		respondJSON(w, http.StatusOK, data)
+	expected, err := parseExpectedChecksums(part.Header, -1)
+	if err != nil {
+		statusCode = http.StatusBadRequest
+		return
+	}
 
-		break // not doing multiple files yet
+	statusCode, err = putVerifiedSageObject(sageBucketID, sageKey, part, username, part.Header.Get("Content-Type"), expected)
+	if err != nil {
+		return
 	}
 
+	//log.Printf("Upload - Bucket: %v and Object: %v\n", bucketName, objectName)
+	log.Printf("user upload successful")
+	fileUploadCounter.Inc()
+	statusCode = http.StatusOK
 	return
 }
 
+// putVerifiedSageObject streams body to a staging key while computing its checksums. Only if they
+// match the expected values the staged upload is copied to the object, with the checksums as object
+// metadata, so an existing object is never replaced by a rejected upload.
+func putVerifiedSageObject(sageBucketID string, sageKey string, body io.Reader, username string, contentType string, expected *expectedChecksums) (statusCode int, err error) {
+
+	checksums := newUploadChecksums()
+	bodyReader := &errorRecordingReader{r: body}
+
+	stagingKey, err := stageSageUpload(sageBucketID, io.TeeReader(bodyReader, checksums))
+	if bodyReader.err != nil {
+		statusCode = http.StatusBadRequest
+		err = fmt.Errorf("Reading upload failed: %s", bodyReader.err.Error())
+		return
+	}
+	if err != nil {
+		statusCode = errorStatus(err, http.StatusInternalServerError)
+		err = fmt.Errorf("Upload to S3 backend failed: %s", err.Error())
+		return
+	}
+	defer func() {
+		if deleteErr := deleteStagedSageUpload(sageBucketID, stagingKey); deleteErr != nil {
+			log.Printf("could not delete staged upload %s: %s", stagingKey, deleteErr.Error())
+		}
+	}()
+
+	if mismatch := expected.verify(checksums); mismatch != "" {
+		statusCode = http.StatusBadRequest
+		err = fmt.Errorf("Upload rejected: %s", mismatch)
+		return
+	}
+
+	err = commitSageUpload(sageBucketID, stagingKey, sageKey, checksums.size, contentType, checksums.metadata(username))
+	if err != nil {
+		statusCode = errorStatus(err, http.StatusInternalServerError)
+		err = fmt.Errorf("Upload to S3 backend failed: %s", err.Error())
+		return
+	}
+	fileUploadByteSize.Add(float64(checksums.size))
+	return
+}
+
+// uploadRawObject stores the request body, Content-Length, Content-MD5 and X-Sage-Checksum-SHA256 are verified
+// before the object is stored, an existing object is only replaced by a verified upload
+func uploadRawObject(w http.ResponseWriter, r *http.Request, username string, sageBucketID string, sageKey string) {
+
+	sageKey = strings.TrimPrefix(sageKey, "/")
+
+	expected, err := parseExpectedChecksums(r.Header, r.ContentLength)
+	if err != nil {
+		respondJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	contentType := r.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	statusCode, err := putVerifiedSageObject(sageBucketID, sageKey, r.Body, username, contentType, expected)
+	if err != nil {
+		respondJSONError(w, statusCode, err.Error())
+		return
+	}
+
+	log.Printf("user upload successful")
+	fileUploadCounter.Inc()
+
+	respondJSON(w, http.StatusOK, &SageFile{Bucket: sageBucketID, Key: sageKey})
+}
+
+// errorRecordingReader keeps the first read error, to tell failed client reads from backend errors
+type errorRecordingReader struct {
+	r   io.Reader
+	err error
+}
+
+func (e *errorRecordingReader) Read(p []byte) (int, error) {
+	n, err := e.r.Read(p)
+	if err != nil && err != io.EOF && e.err == nil {
+		e.err = err
+	}
+	return n, err
+}
+
+// countingWriter counts the bytes written to it
+type countingWriter struct {
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
+
 /*
 func downloadObject(w http.ResponseWriter, r *http.Request) {
 	pathParams := mux.Vars(r)
@@ -922,7 +1134,7 @@ func respondJSON(w http.ResponseWriter, statusCode int, data interface{}) {
 func respondJSONError(w http.ResponseWriter, statusCode int, msg string, args ...interface{}) {
 	errorStr := fmt.Sprintf(msg, args...)
 	log.Printf("Reply to client: %s", errorStr)
-	respondJSON(w, statusCode, ErrorStruct{Error: errorStr})
+	respondJSON(w, statusCode, ErrorStruct{Error: errorStr, Code: errorCodeForStatus(statusCode)})
 }
 
 func authMW(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
@@ -939,12 +1151,12 @@ func authMW(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
 	log.Printf("authorization: %s", authorization)
 	authorizationArray := strings.Split(authorization, " ")
 	if len(authorizationArray) != 2 {
-		respondJSONError(w, http.StatusInternalServerError, "Authorization field must be of form \"sage <token>\"")
+		respondJSONError(w, http.StatusUnauthorized, "Authorization field must be of form \"sage <token>\"")
 		return
 	}
 
 	if strings.ToLower(authorizationArray[0]) != "sage" {
-		respondJSONError(w, http.StatusInternalServerError, "Only bearer \"sage\" supported")
+		respondJSONError(w, http.StatusUnauthorized, "Only bearer \"sage\" supported")
 		return
 	}
 
@@ -992,14 +1204,18 @@ func authMW(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
 	if err != nil {
 		log.Print(err)
 		//http.Error(w, err.Error(), http.StatusInternalServerError)
-		respondJSONError(w, http.StatusInternalServerError, err.Error())
+		respondJSONError(w, http.StatusServiceUnavailable, "token introspection failed: %s", err.Error())
 		return
 	}
 	defer res.Body.Close()
 	body, err := ioutil.ReadAll(res.Body)
 	if err != nil {
 		//http.Error(w, err.Error(), http.StatusInternalServerError)
-		respondJSONError(w, http.StatusInternalServerError, err.Error())
+		respondJSONError(w, http.StatusServiceUnavailable, "token introspection failed: %s", err.Error())
+		return
+	}
+	if res.StatusCode >= 500 {
+		respondJSONError(w, http.StatusServiceUnavailable, "token introspection failed (%d)", res.StatusCode)
 		return
 	}
 	if res.StatusCode != 200 {
@@ -1013,15 +1229,13 @@ func authMW(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
 	if err := json.Unmarshal(body, &dat); err != nil {
 		//fmt.Println(err)
 		//http.Error(w, err.Error(), http.StatusInternalServerError)
-		respondJSONError(w, http.StatusInternalServerError, err.Error())
+		respondJSONError(w, http.StatusServiceUnavailable, "token introspection returned invalid json: %s", err.Error())
 		return
 	}
 	val, ok := dat["error"]
 	if ok && val != nil {
-		fmt.Fprintf(w, val.(string)+"\n")
-
 		//http.Error(w, val.(string), http.StatusInternalServerError)
-		respondJSONError(w, http.StatusInternalServerError, val.(string))
+		respondJSONError(w, http.StatusUnauthorized, "%v", val)
 		return
 
 	}
@@ -1029,13 +1243,13 @@ func authMW(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
 	isActiveIf, ok := dat["active"]
 	if !ok {
 		//http.Error(w, "field active was misssing", http.StatusInternalServerError)
-		respondJSONError(w, http.StatusInternalServerError, "field active missing")
+		respondJSONError(w, http.StatusServiceUnavailable, "token introspection: field active missing")
 		return
 	}
 	isActive, ok := isActiveIf.(bool)
 	if !ok {
 		//http.Error(w, "field active is noty a boolean", http.StatusInternalServerError)
-		respondJSONError(w, http.StatusInternalServerError, "field active is not a boolean")
+		respondJSONError(w, http.StatusServiceUnavailable, "token introspection: field active is not a boolean")
 		return
 	}
 
@@ -1048,13 +1262,13 @@ func authMW(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
 	usernameIf, ok := dat["username"]
 	if !ok {
 		//respondJSONError(w, http.StatusInternalServerError, "username is missing")
-		respondJSONError(w, http.StatusInternalServerError, "username is missing")
+		respondJSONError(w, http.StatusServiceUnavailable, "token introspection: username is missing")
 		return
 	}
 
 	username, ok := usernameIf.(string)
 	if !ok {
-		respondJSONError(w, http.StatusInternalServerError, "username is not string")
+		respondJSONError(w, http.StatusServiceUnavailable, "token introspection: username is not string")
 		return
 	}
 
@@ -1068,6 +1282,6 @@ func authMW(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
 
 func defaultHandler(w http.ResponseWriter, r *http.Request) {
 
-	respondJSONError(w, http.StatusInternalServerError, "resource unknown")
+	respondJSONError(w, http.StatusNotFound, "resource unknown")
 	return
 }
@@ -2,6 +2,8 @@ package main
 
 import (
 	"bytes"
+	"crypto/md5"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -14,6 +16,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/s3"
 )
 
@@ -499,6 +502,192 @@ func TestFileUploadWithFilename(t *testing.T) {
 
 }
 
+// curl -X PUT "localhost:8080/api/v1/objects/${BUCKET_ID}/folder/?on_error=continue" -F 'file=@a.txt' -F 'file=@b.txt'
+func TestMultiFileUpload(t *testing.T) {
+
+	testuser := "testuser"
+	dataType := "training-data"
+	bucketName := "testing-bucket1"
+
+	newBucket, err := createSageBucket(testuser, dataType, bucketName, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bucketID := newBucket.ID
+
+	body := new(bytes.Buffer)
+	writer := multipart.NewWriter(body)
+	for _, filename := range []string{"a.txt", "b.txt", "sub/c.txt", ""} {
+		var part io.Writer
+		if filename == "" {
+			// part without filename cannot be stored in a folder
+			part, err = writer.CreateFormField("file")
+		} else {
+			part, err = writer.CreateFormFile("file", filename)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write([]byte("test-data"))
+	}
+	err = writer.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	url := fmt.Sprintf("/api/v1/objects/%s/multi/?on_error=continue", bucketID)
+	req, err := http.NewRequest("PUT", url, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	req.Header.Add("Authorization", "sage user:"+testuser)
+
+	rr := httptest.NewRecorder()
+	mainRouter.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusMultiStatus {
+		t.Fatalf("handler returned wrong status code: got %v want %v (%s)",
+			status, http.StatusMultiStatus, rr.Body.String())
+	}
+
+	results := []SageFile{}
+	err = json.Unmarshal(rr.Body.Bytes(), &results)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(results) != 4 {
+		t.Fatalf("expected 4 results, got %d", len(results))
+	}
+
+	expectedKeys := []string{"multi/a.txt", "multi/b.txt", "multi/c.txt"} // directories in filenames are dropped
+	for i, key := range expectedKeys {
+		if results[i].Key != key || results[i].Error != "" {
+			t.Fatalf("expected %s to be uploaded, got: %v", key, results[i])
+		}
+	}
+	if results[3].Error == "" {
+		t.Fatalf("expected error for part without filename")
+	}
+
+	listObject, err := listSageBucketContent(bucketID, "/multi/", true, 0, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listObject.Contents) != 3 {
+		t.Fatalf("expected 3 files in folder, have %d", len(listObject.Contents))
+	}
+
+	// format=list returns a list also for a single file
+	body = new(bytes.Buffer)
+	writer = multipart.NewWriter(body)
+	part, err := writer.CreateFormFile("file", "single.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write([]byte("test-data"))
+	writer.Close()
+
+	rr = testRequest(t, testuser, "PUT", fmt.Sprintf("/api/v1/objects/%s/multi/?format=list", bucketID), body, map[string]string{"Content-Type": writer.FormDataContentType()})
+	expectStatus(t, rr, http.StatusOK)
+	results = []SageFile{}
+	err = json.Unmarshal(rr.Body.Bytes(), &results)
+	if err != nil || len(results) != 1 || results[0].Key != "multi/single.txt" {
+		t.Fatalf("expected a list with multi/single.txt, got: %s", rr.Body.String())
+	}
+}
+
+func TestRawUpload(t *testing.T) {
+
+	testuser := "testuser"
+
+	newBucket, err := createSageBucket(testuser, "training-data", "testing-bucket1", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bucketID := newBucket.ID
+
+	content := []byte("raw test data")
+	digest := md5.Sum(content)
+
+	url := fmt.Sprintf("/api/v1/objects/%s/raw/test.txt", bucketID)
+	req, err := http.NewRequest("PUT", url, bytes.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "text/plain")
+	req.Header.Set("Content-MD5", base64.StdEncoding.EncodeToString(digest[:]))
+	req.Header.Add("Authorization", "sage user:"+testuser)
+
+	rr := httptest.NewRecorder()
+	mainRouter.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v (%s)", rr.Code, http.StatusOK, rr.Body.String())
+	}
+
+	head, err := svc.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(getS3BucketID(bucketID)),
+		Key:    aws.String(bucketID + "/raw/test.txt"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *head.ContentType != "text/plain" || *head.ContentLength != int64(len(content)) {
+		t.Fatalf("unexpected object: %s, %d bytes", *head.ContentType, *head.ContentLength)
+	}
+
+	// wrong digest, the object must not be stored
+	url = fmt.Sprintf("/api/v1/objects/%s/raw/corrupted.txt", bucketID)
+	req, err = http.NewRequest("PUT", url, bytes.NewReader([]byte("other data")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-MD5", base64.StdEncoding.EncodeToString(digest[:]))
+	req.Header.Add("Authorization", "sage user:"+testuser)
+
+	rr = httptest.NewRecorder()
+	mainRouter.ServeHTTP(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("handler returned wrong status code: got %v want %v (%s)", rr.Code, http.StatusBadRequest, rr.Body.String())
+	}
+
+	listObject, err := listSageBucketContent(bucketID, "/raw/", true, 0, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listObject.Contents) != 1 {
+		t.Fatalf("expected 1 file in folder, have %d", len(listObject.Contents))
+	}
+
+	// wrong digest for an existing key, the existing object must be kept
+	url = fmt.Sprintf("/api/v1/objects/%s/raw/test.txt", bucketID)
+	req, err = http.NewRequest("PUT", url, bytes.NewReader([]byte("other data")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-MD5", base64.StdEncoding.EncodeToString(digest[:]))
+	req.Header.Add("Authorization", "sage user:"+testuser)
+
+	rr = httptest.NewRecorder()
+	mainRouter.ServeHTTP(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("handler returned wrong status code: got %v want %v (%s)", rr.Code, http.StatusBadRequest, rr.Body.String())
+	}
+
+	head, err = svc.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(getS3BucketID(bucketID)),
+		Key:    aws.String(bucketID + "/raw/test.txt"),
+	})
+	if err != nil {
+		t.Fatalf("existing object was removed by a rejected upload: %s", err.Error())
+	}
+	if *head.ContentLength != int64(len(content)) {
+		t.Fatalf("existing object was replaced by a rejected upload (%d bytes)", *head.ContentLength)
+	}
+}
+
 func TestDeleteFile(t *testing.T) {
 
 	testuser := "testuser"
@@ -749,18 +938,21 @@ func TestListFilesSimple(t *testing.T) {
 			status, http.StatusOK)
 	}
 	log.Printf("response body: %s", rr.Body.String())
-	listObject := s3.ListObjectsV2Output{}
-	err = json.Unmarshal(rr.Body.Bytes(), &listObject)
+	listing := FolderListing{}
+	err = json.Unmarshal(rr.Body.Bytes(), &listing)
 	if err != nil {
 		t.Fatal(err)
 	}
 
 	fileArray := []string{}
-	for _, obj := range listObject.Contents {
-		fileArray = append(fileArray, *obj.Key)
+	for _, file := range listing.Files {
+		fileArray = append(fileArray, file.Key)
 	}
-	for _, obj := range listObject.CommonPrefixes {
-		fileArray = append(fileArray, *obj.Prefix)
+	fileArray = append(fileArray, listing.Folders...)
+	for _, file := range listing.Files {
+		if file.Size != int64(len("test-data")) || file.ETag == "" || file.LastModified.IsZero() {
+			t.Fatalf("error: incomplete file entry %+v", file)
+		}
 	}
 	//fmt.Printf("fileArray: %v", fileArray)
 	if len(fileArray) != 2 {
@@ -816,17 +1008,17 @@ func TestListFilesRecursive(t *testing.T) {
 	}
 	log.Printf("response body: %s", rr.Body.String())
 	//fileArray := []string{}
-	listObject := s3.ListObjectsV2Output{}
-	err = json.Unmarshal(rr.Body.Bytes(), &listObject)
+	listing := FolderListing{}
+	err = json.Unmarshal(rr.Body.Bytes(), &listing)
 	if err != nil {
 		t.Fatal(err)
 	}
 
 	fileArray := []string{}
-	for _, obj := range listObject.Contents {
-		fileArray = append(fileArray, *obj.Key)
+	for _, file := range listing.Files {
+		fileArray = append(fileArray, file.Key)
 	}
-	//t.Fatalf("got %v", listObject)
+	//t.Fatalf("got %v", listing)
 	//fmt.Printf("fileArray: %v", fileArray)
 	if len(fileArray) != 2 {
 		t.Fatalf("error: expected two files %v", fileArray)
@@ -894,8 +1086,8 @@ func TestListFilesMany(t *testing.T) {
 				status, http.StatusOK)
 		}
 		log.Printf("response body: %s", rr.Body.String())
-		listObject := s3.ListObjectsV2Output{}
-		err = json.Unmarshal(rr.Body.Bytes(), &listObject)
+		listing := FolderListing{}
+		err = json.Unmarshal(rr.Body.Bytes(), &listing)
 		if err != nil {
 			log.Print("--------------")
 			log.Print("body that could not be parsed: " + rr.Body.String())
@@ -903,18 +1095,16 @@ func TestListFilesMany(t *testing.T) {
 			t.Fatal(err)
 		}
 
-		for _, obj := range listObject.Contents {
-			fileArray = append(fileArray, *obj.Key)
-		}
-		for _, obj := range listObject.CommonPrefixes {
-			fileArray = append(fileArray, *obj.Prefix)
+		for _, file := range listing.Files {
+			fileArray = append(fileArray, file.Key)
 		}
+		fileArray = append(fileArray, listing.Folders...)
 
-		if !*listObject.IsTruncated {
+		if listing.NextToken == "" {
 			break
 		}
 
-		cToken = *listObject.NextContinuationToken
+		cToken = listing.NextToken
 	}
 
 	//fmt.Printf("fileArray: %v", fileArray)
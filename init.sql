@@ -15,8 +15,85 @@ CREATE TABLE IF NOT EXISTS SageStorage.BucketPermissions (
     granteeType         ENUM('USER', 'GROUP'),
     grantee             VARCHAR(64), 
     permission          ENUM('READ', 'WRITE', 'READ_ACP', 'WRITE_ACP', 'FULL_CONTROL'),
-    PRIMARY KEY (id, granteeType, grantee, permission)
+    prefix              VARCHAR(255) NOT NULL DEFAULT '',
+    expires             TIMESTAMP NULL DEFAULT NULL,
+    PRIMARY KEY (id, granteeType, grantee, permission, prefix)
 );
 # permissions similar to https://docs.aws.amazon.com/AmazonS3/latest/dev/acl-overview.html
 
+CREATE TABLE IF NOT EXISTS SageStorage.BucketPolicies (
+    id                  BINARY(16) NOT NULL PRIMARY KEY,
+    policy              JSON NOT NULL,
+    time_last_updated   TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
+);
+# policies similar to https://docs.aws.amazon.com/AmazonS3/latest/dev/using-iam-policies.html
+
+CREATE TABLE IF NOT EXISTS SageStorage.AdminActions (
+    id                  BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    time                TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    admin               VARCHAR(64) NOT NULL,
+    action              VARCHAR(64) NOT NULL,
+    bucket              BINARY(16),
+    details             TEXT,
+    INDEX (bucket)
+);
+
+CREATE TABLE IF NOT EXISTS SageStorage.BucketTransfers (
+    id                  BINARY(16) NOT NULL PRIMARY KEY,
+    previous_owner      VARCHAR(64) NOT NULL,
+    new_owner           VARCHAR(64) NOT NULL,
+    time_created        TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS SageStorage.TusUploads (
+    id                  VARCHAR(36) NOT NULL PRIMARY KEY,
+    bucket              BINARY(16) NOT NULL,
+    sage_key            VARCHAR(1024) NOT NULL,
+    owner               VARCHAR(64) NOT NULL,
+    upload_length       BIGINT NOT NULL,
+    upload_offset       BIGINT NOT NULL DEFAULT 0,
+    s3_upload_id        VARCHAR(1024) NOT NULL,
+    part_count          INT NOT NULL DEFAULT 0,
+    incomplete_size     BIGINT NOT NULL DEFAULT 0,
+    lock_time           TIMESTAMP NULL DEFAULT NULL,
+    time_created        TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    time_last_updated   TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
+);
 
+CREATE TABLE IF NOT EXISTS SageStorage.MultipartUploads (
+    upload_id           VARCHAR(255) NOT NULL PRIMARY KEY,
+    bucket              BINARY(16) NOT NULL,
+    sage_key            VARCHAR(1024) NOT NULL,
+    owner               VARCHAR(64) NOT NULL,
+    time_created        TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    INDEX (bucket)
+);
+
+CREATE TABLE IF NOT EXISTS SageStorage.Snapshots (
+    id                  VARCHAR(36) NOT NULL PRIMARY KEY,
+    bucket              BINARY(16) NOT NULL,
+    name                VARCHAR(64) NOT NULL DEFAULT '',
+    creator             VARCHAR(64) NOT NULL,
+    file_count          BIGINT NOT NULL DEFAULT 0,
+    total_size          BIGINT NOT NULL DEFAULT 0,
+    time_created        TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    INDEX (bucket)
+);
+
+CREATE TABLE IF NOT EXISTS SageStorage.SnapshotFiles (
+    id                  BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    snapshot            VARCHAR(36) NOT NULL,
+    sage_key            VARCHAR(1024) NOT NULL,
+    size                BIGINT NOT NULL,
+    etag                VARCHAR(128) NOT NULL,
+    sha256              VARCHAR(64) NOT NULL DEFAULT '',
+    INDEX (snapshot)
+);
+
+CREATE TABLE IF NOT EXISTS SageStorage.S3Credentials (
+    access_key          VARCHAR(32) NOT NULL PRIMARY KEY,
+    secret_key          VARCHAR(64) NOT NULL,
+    username            VARCHAR(64) NOT NULL,
+    time_created        TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    INDEX (username)
+);
@@ -0,0 +1,555 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// listingFormatLegacy selects the S3 ListObjectsV2 style response of folder listings, for old clients
+const listingFormatLegacy = "legacy"
+
+// listingContentTypeNDJSON requested with the Accept header, streams the complete listing with one JSON object per line
+const listingContentTypeNDJSON = "application/x-ndjson"
+
+const (
+	listingMaxKeys     = 1000  // page size limit of S3, default limit of listings
+	listingScanPages   = 10    // S3 requests per page of a listing with pattern, a page may have fewer entries than limit
+	listingSortMaxKeys = 10000 // sorting by size or modification time requires the complete listing
+)
+
+// listingOptions optional query fields of folder listings
+type listingOptions struct {
+	startAfter string         // only keys after this one, relative to the folder
+	pattern    *regexp.Regexp // nil matches all keys
+	sort       string         // key (default), size or modified
+}
+
+// getListingOptions parses start_after, pattern and sort. A pattern has to match the complete key relative
+// to the folder, "*" matches any sequence of characters (including "/") and "?" a single character.
+func getListingOptions(r *http.Request) (options *listingOptions, err error) {
+
+	query := r.URL.Query()
+	options = &listingOptions{startAfter: query.Get("start_after"), sort: query.Get("sort")}
+
+	switch options.sort {
+	case "":
+		options.sort = "key"
+	case "key", "size", "modified":
+	default:
+		err = newSageError(codeValidation, "sort %q not supported, use key, size or modified", options.sort)
+		return
+	}
+
+	if pattern := query.Get("pattern"); pattern != "" {
+		// globToRegexp treats patterns without wildcards as prefixes
+		re := globToRegexp(pattern)
+		if !strings.ContainsAny(pattern, "*?") {
+			re += "$"
+		}
+		options.pattern, err = regexp.Compile(re)
+		if err != nil {
+			err = newSageError(codeValidation, "invalid pattern %q: %s", pattern, err.Error())
+			return
+		}
+	}
+	return
+}
+
+// filterListing removes the files and folders that do not match the pattern
+func (options *listingOptions) filterListing(listObject *s3.ListObjectsV2Output) {
+
+	if options.pattern == nil {
+		return
+	}
+
+	contents := []*s3.Object{}
+	for _, object := range listObject.Contents {
+		if options.pattern.MatchString(aws.StringValue(object.Key)) {
+			contents = append(contents, object)
+		}
+	}
+	listObject.Contents = contents
+
+	commonPrefixes := []*s3.CommonPrefix{}
+	for _, cp := range listObject.CommonPrefixes {
+		if options.pattern.MatchString(aws.StringValue(cp.Prefix)) {
+			commonPrefixes = append(commonPrefixes, cp)
+		}
+	}
+	listObject.CommonPrefixes = commonPrefixes
+
+	listObject.KeyCount = aws.Int64(int64(len(contents) + len(commonPrefixes)))
+}
+
+// listFolderPage returns one page of the folder listing with the options applied. Without sort the
+// continuation token is the one of S3, pages of a listing with pattern are filled up to limit using
+// further S3 requests. Sorted listings use a token that encodes the last entry of the page.
+func listFolderPage(access *bucketAccess, sageBucketID string, folder string, recursive bool, limit int64, continuationToken string, options *listingOptions) (listObject *s3.ListObjectsV2Output, err error) {
+
+	if limit <= 0 || limit > listingMaxKeys {
+		limit = listingMaxKeys
+	}
+
+	if options.sort != "key" {
+		listObject, err = listSortedFolderPage(access, sageBucketID, folder, recursive, limit, continuationToken, options)
+		return
+	}
+
+	listObject, err = listAllowedContent(access, sageBucketID, folder, recursive, limit, options.startAfter, continuationToken)
+	if err != nil || options.pattern == nil {
+		return
+	}
+	options.filterListing(listObject)
+
+	// the limit of each request is what is missing on the page, the page never has more than limit
+	// entries and the continuation token of the last request is the position after the page
+	for i := 1; i < listingScanPages && aws.BoolValue(listObject.IsTruncated); i++ {
+		missing := limit - int64(len(listObject.Contents)+len(listObject.CommonPrefixes))
+		if missing <= 0 {
+			break
+		}
+
+		var next *s3.ListObjectsV2Output
+		next, err = listAllowedContent(access, sageBucketID, folder, recursive, missing, "", aws.StringValue(listObject.NextContinuationToken))
+		if err != nil {
+			return
+		}
+		options.filterListing(next)
+
+		listObject.Contents = append(listObject.Contents, next.Contents...)
+		listObject.CommonPrefixes = append(listObject.CommonPrefixes, next.CommonPrefixes...)
+		listObject.IsTruncated = next.IsTruncated
+		listObject.NextContinuationToken = next.NextContinuationToken
+	}
+	listObject.KeyCount = aws.Int64(int64(len(listObject.Contents) + len(listObject.CommonPrefixes)))
+	listObject.MaxKeys = aws.Int64(limit)
+	return
+}
+
+// listingCursor an entry of a sorted listing, the continuation token is the encoded last entry of the page
+type listingCursor struct {
+	Key      string `json:"k"`
+	Folder   bool   `json:"f,omitempty"`
+	Size     int64  `json:"s,omitempty"`
+	Modified int64  `json:"m,omitempty"` // UnixNano
+}
+
+// less orders folders by key before files by sort field, and files with equal values by key
+func (a *listingCursor) less(b *listingCursor, sortField string) bool {
+	if a.Folder != b.Folder {
+		return a.Folder
+	}
+	if !a.Folder {
+		switch {
+		case sortField == "size" && a.Size != b.Size:
+			return a.Size < b.Size
+		case sortField == "modified" && a.Modified != b.Modified:
+			return a.Modified < b.Modified
+		}
+	}
+	return a.Key < b.Key
+}
+
+func (a *listingCursor) token() string {
+	data, _ := json.Marshal(a)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func parseListingCursor(token string) (cursor *listingCursor, err error) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err == nil {
+		cursor = &listingCursor{}
+		err = json.Unmarshal(data, cursor)
+	}
+	if err != nil {
+		err = newSageError(codeBadRequest, "invalid continuation token for sort order")
+	}
+	return
+}
+
+// listSortedFolderPage lists all matching files of the folder, sorts them and returns the page after the cursor
+func listSortedFolderPage(access *bucketAccess, sageBucketID string, folder string, recursive bool, limit int64, continuationToken string, options *listingOptions) (listObject *s3.ListObjectsV2Output, err error) {
+
+	var after *listingCursor
+	if continuationToken != "" {
+		after, err = parseListingCursor(continuationToken)
+		if err != nil {
+			return
+		}
+	}
+
+	type entry struct {
+		cursor *listingCursor
+		object *s3.Object
+		prefix *s3.CommonPrefix
+	}
+	entries := []*entry{}
+
+	s3Token := ""
+	for {
+		var page *s3.ListObjectsV2Output
+		page, err = listAllowedContent(access, sageBucketID, folder, recursive, listingMaxKeys, options.startAfter, s3Token)
+		if err != nil {
+			return
+		}
+		options.filterListing(page)
+
+		for _, object := range page.Contents {
+			entries = append(entries, &entry{object: object, cursor: &listingCursor{
+				Key:      aws.StringValue(object.Key),
+				Size:     aws.Int64Value(object.Size),
+				Modified: aws.TimeValue(object.LastModified).UnixNano(),
+			}})
+		}
+		for _, cp := range page.CommonPrefixes {
+			entries = append(entries, &entry{prefix: cp, cursor: &listingCursor{Key: aws.StringValue(cp.Prefix), Folder: true}})
+		}
+		if len(entries) > listingSortMaxKeys {
+			err = newSageError(codeValidation, "sort by %s is limited to folders with at most %d matching files and folders, use pattern or start_after", options.sort, listingSortMaxKeys)
+			return
+		}
+
+		if listObject == nil {
+			listObject = page
+		}
+		if !aws.BoolValue(page.IsTruncated) {
+			break
+		}
+		s3Token = aws.StringValue(page.NextContinuationToken)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].cursor.less(entries[j].cursor, options.sort)
+	})
+
+	listObject.Contents = []*s3.Object{}
+	listObject.CommonPrefixes = []*s3.CommonPrefix{}
+	listObject.IsTruncated = aws.Bool(false)
+	listObject.NextContinuationToken = nil
+	listObject.ContinuationToken = nil
+	if continuationToken != "" {
+		listObject.ContinuationToken = aws.String(continuationToken)
+	}
+
+	count := int64(0)
+	for _, e := range entries {
+		if after != nil && !after.less(e.cursor, options.sort) {
+			continue
+		}
+		if count == limit {
+			listObject.IsTruncated = aws.Bool(true)
+			break
+		}
+		if e.object != nil {
+			listObject.Contents = append(listObject.Contents, e.object)
+		} else {
+			listObject.CommonPrefixes = append(listObject.CommonPrefixes, e.prefix)
+		}
+		after = e.cursor
+		count++
+	}
+	if aws.BoolValue(listObject.IsTruncated) {
+		listObject.NextContinuationToken = aws.String(after.token())
+	}
+	listObject.KeyCount = aws.Int64(count)
+	listObject.MaxKeys = aws.Int64(limit)
+	return
+}
+
+// FolderListing one page of a folder listing. Keys of files and folders are relative to the listed folder.
+type FolderListing struct {
+	Bucket    string        `json:"bucket"`
+	Folder    string        `json:"folder"` // empty for the top-level folder of the bucket
+	Files     []*ListedFile `json:"files"`
+	Folders   []string      `json:"folders"`              // end with /
+	NextToken string        `json:"next_token,omitempty"` // continuation token of the next page, empty on the last page
+}
+
+// ListedFile a file of a FolderListing
+type ListedFile struct {
+	Key          string    `json:"key"`
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"last_modified"`
+	ETag         string    `json:"etag"`
+	ContentType  string    `json:"content_type,omitempty"` // derived from the file extension
+	SHA256       string    `json:"sha256,omitempty"`       // only with ?checksums, and only for files uploaded with checksum
+}
+
+// ListedFolder a folder line of a streamed listing
+type ListedFolder struct {
+	Folder string `json:"folder"`
+}
+
+// newFolderListing converts a listing as returned by listSageBucketContent. The marker object of the
+// folder itself is skipped, markers of subfolders in recursive listings are returned as folders.
+func newFolderListing(sageBucketID string, folder string, listObject *s3.ListObjectsV2Output) (listing *FolderListing) {
+
+	listing = &FolderListing{
+		Bucket:    sageBucketID,
+		Folder:    aclKey(folder),
+		Files:     []*ListedFile{},
+		Folders:   []string{},
+		NextToken: aws.StringValue(listObject.NextContinuationToken),
+	}
+
+	for _, object := range listObject.Contents {
+		key := aws.StringValue(object.Key)
+		if key == "" {
+			continue
+		}
+		if strings.HasSuffix(key, "/") {
+			listing.Folders = append(listing.Folders, key)
+			continue
+		}
+		listing.Files = append(listing.Files, &ListedFile{
+			Key:          key,
+			Size:         aws.Int64Value(object.Size),
+			LastModified: aws.TimeValue(object.LastModified),
+			ETag:         strings.Trim(aws.StringValue(object.ETag), `"`),
+			ContentType:  mime.TypeByExtension(path.Ext(key)),
+		})
+	}
+
+	for _, cp := range listObject.CommonPrefixes {
+		listing.Folders = append(listing.Folders, aws.StringValue(cp.Prefix))
+	}
+	return
+}
+
+// addListingChecksums adds the checksums, which S3 listings do not contain, with a HEAD request per file.
+// Files deleted since they were listed are removed from the listing.
+func addListingChecksums(listing *FolderListing) (err error) {
+
+	keys := []string{}
+	for _, file := range listing.Files {
+		keys = append(keys, file.Key)
+	}
+	heads, err := headListedFiles(listing.Bucket, listing.Folder, keys)
+	if err != nil {
+		return
+	}
+
+	files := []*ListedFile{}
+	for _, file := range listing.Files {
+		head, ok := heads[file.Key]
+		if !ok {
+			continue
+		}
+		_, file.SHA256 = objectChecksums(head.Metadata)
+		files = append(files, file)
+	}
+	listing.Files = files
+	return
+}
+
+// headListedFiles gets the metadata of files of a folder listing, by key. Files that have been deleted
+// after the listing are missing from heads.
+func headListedFiles(sageBucketID string, folder string, keys []string) (heads map[string]*s3.HeadObjectOutput, err error) {
+
+	heads = map[string]*s3.HeadObjectOutput{}
+	s3BucketName := getS3BucketID(sageBucketID)
+	prefix := s3FolderPrefix(sageBucketID, folder)
+
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, 16)
+
+	for _, key := range keys {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(key string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			head, headErr := svc.HeadObject(&s3.HeadObjectInput{
+				Bucket: aws.String(s3BucketName),
+				Key:    aws.String(prefix + key),
+			})
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			if aerr, ok := headErr.(awserr.Error); ok && (aerr.Code() == "NotFound" || aerr.Code() == s3.ErrCodeNoSuchKey) {
+				return
+			}
+			if headErr != nil {
+				if err == nil {
+					err = fmt.Errorf("svc.HeadObject returned: %s", headErr.Error())
+				}
+				return
+			}
+			heads[key] = head
+		}(key)
+	}
+	wg.Wait()
+	return
+}
+
+// respondFolderListing responds with one page of a folder listing, see getListingOptions for the options.
+// ?format=legacy selects the S3 style response and ?checksums adds the SHA-256 checksums of the files.
+func respondFolderListing(w http.ResponseWriter, r *http.Request, access *bucketAccess, sageBucketID string, folder string, recursive bool, limit int64, continuationToken string) {
+
+	format := r.URL.Query().Get("format")
+	if format != "" && format != listingFormatLegacy {
+		respondJSONError(w, http.StatusUnprocessableEntity, "format %q not supported, only %q", format, listingFormatLegacy)
+		return
+	}
+	_, checksums := r.URL.Query()["checksums"]
+
+	options, err := getListingOptions(r)
+	if err != nil {
+		respondError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	if strings.Contains(r.Header.Get("Accept"), listingContentTypeNDJSON) {
+		if format == listingFormatLegacy || options.sort != "key" {
+			respondJSONError(w, http.StatusUnprocessableEntity, "streamed listings are sorted by key and do not support format=legacy")
+			return
+		}
+		streamFolderListing(w, r, access, sageBucketID, folder, recursive, continuationToken, options, checksums)
+		return
+	}
+
+	listObject, err := listFolderPage(access, sageBucketID, folder, recursive, limit, continuationToken, options)
+	if err != nil {
+		respondError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	if format == listingFormatLegacy {
+		if checksums {
+			checksumMap, err := listingChecksums(sageBucketID, folder, listObject)
+			if err != nil {
+				respondError(w, fmt.Errorf("error getting checksums: %w", err), http.StatusInternalServerError)
+				return
+			}
+			respondJSON(w, http.StatusOK, &listingWithChecksums{ListObjectsV2Output: listObject, Checksums: checksumMap})
+			return
+		}
+		respondJSON(w, http.StatusOK, listObject)
+		return
+	}
+
+	listing := newFolderListing(sageBucketID, folder, listObject)
+	if checksums {
+		err = addListingChecksums(listing)
+		if err != nil {
+			respondError(w, fmt.Errorf("error getting file metadata: %w", err), http.StatusInternalServerError)
+			return
+		}
+	}
+	respondJSON(w, http.StatusOK, listing)
+}
+
+// streamFolderListing writes all matching files and folders in key order as NDJSON, limit is ignored. Pages
+// are listed one ahead of the client, listing stops when the client disconnects. An error after the first
+// page is written as last line. The producer always sends exactly one result on errc before closing pages,
+// nil when all pages were listed.
+func streamFolderListing(w http.ResponseWriter, r *http.Request, access *bucketAccess, sageBucketID string, folder string, recursive bool, continuationToken string, options *listingOptions, checksums bool) {
+
+	// cancel stops the producer when the handler returns early
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	pages := make(chan *FolderListing, 1)
+	errc := make(chan error, 1)
+
+	go func() {
+		var err error
+		defer close(pages)
+		defer func() { errc <- err }()
+
+		startAfter := options.startAfter
+		for {
+			var listObject *s3.ListObjectsV2Output
+			listObject, err = listAllowedContent(access, sageBucketID, folder, recursive, listingMaxKeys, startAfter, continuationToken)
+			if err != nil {
+				return
+			}
+			options.filterListing(listObject)
+
+			listing := newFolderListing(sageBucketID, folder, listObject)
+			if checksums {
+				err = addListingChecksums(listing)
+				if err != nil {
+					err = fmt.Errorf("error getting file metadata: %w", err)
+					return
+				}
+			}
+
+			select {
+			case pages <- listing:
+			case <-ctx.Done():
+				err = ctx.Err()
+				return
+			}
+			if listing.NextToken == "" {
+				return
+			}
+			startAfter = ""
+			continuationToken = listing.NextToken
+		}
+	}()
+
+	listing, ok := <-pages
+	if !ok {
+		respondError(w, <-errc, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", listingContentTypeNDJSON)
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	encoder := json.NewEncoder(w)
+
+	count := 0
+	for ; ok; listing, ok = <-pages {
+		err := writeListingLines(encoder, listing)
+		if err != nil {
+			log.Printf("streaming listing of %s/%s stopped after %d entries: %s", sageBucketID, folder, count, err.Error())
+			return
+		}
+		count += len(listing.Files) + len(listing.Folders)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+
+	if err := <-errc; err != nil {
+		log.Printf("streaming listing of %s/%s failed after %d entries: %s", sageBucketID, folder, count, err.Error())
+		encoder.Encode(&ErrorStruct{Error: err.Error(), Code: errorCodeForStatus(errorStatus(err, http.StatusInternalServerError))})
+	}
+}
+
+// writeListingLines writes the files and folders of a page merged in key order
+func writeListingLines(encoder *json.Encoder, listing *FolderListing) (err error) {
+
+	files, folders := listing.Files, listing.Folders
+	for len(files) > 0 || len(folders) > 0 {
+		if len(folders) == 0 || (len(files) > 0 && files[0].Key < folders[0]) {
+			err = encoder.Encode(files[0])
+			files = files[1:]
+		} else {
+			err = encoder.Encode(&ListedFolder{Folder: folders[0]})
+			folders = folders[1:]
+		}
+		if err != nil {
+			return
+		}
+	}
+	return
+}
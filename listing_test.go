@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestListingOptions(t *testing.T) {
+
+	testuser := "testuser"
+
+	newBucket, err := createSageBucket(testuser, "training-data", "testing-bucket1", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bucketID := newBucket.ID
+
+	for key, content := range map[string]string{
+		"data/a.jpg":     "aaaaa",
+		"data/b.txt":     "bbb",
+		"data/c.jpg":     "c",
+		"data/d.jpg":     "ddd",
+		"data/sub/e.jpg": "e",
+	} {
+		err = putSageObject(bucketID, key, strings.NewReader(content), testuser, "image/jpeg")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// list follows all pages and returns the keys of files and folders in the order of the response
+	list := func(query string) (keys []string) {
+		token := ""
+		for page := 0; ; page++ {
+			url := fmt.Sprintf("/api/v1/objects/%s/data/?limit=1&%s", bucketID, query)
+			if token != "" {
+				url += "&ContinuationToken=" + token
+			}
+			rr := testRequest(t, testuser, "GET", url, nil, nil)
+			if rr.Code != http.StatusOK {
+				t.Fatalf("listing with %s returned %d: %s", query, rr.Code, rr.Body.String())
+			}
+
+			listing := FolderListing{}
+			err := json.Unmarshal(rr.Body.Bytes(), &listing)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(listing.Files)+len(listing.Folders) > 1 {
+				t.Fatalf("page with more than 1 entry: %s", rr.Body.String())
+			}
+			keys = append(keys, listing.Folders...)
+			for _, file := range listing.Files {
+				if file.ContentType != mime.TypeByExtension(path.Ext(file.Key)) {
+					t.Fatalf("unexpected content type: %s", rr.Body.String())
+				}
+				keys = append(keys, file.Key)
+			}
+
+			if listing.NextToken == "" {
+				return
+			}
+			if page > 10 {
+				t.Fatalf("listing with %s does not end", query)
+			}
+			token = listing.NextToken
+		}
+	}
+
+	for query, want := range map[string]string{
+		"start_after=b.txt":            "c.jpg,d.jpg,sub/",
+		"pattern=*.jpg":                "a.jpg,c.jpg,d.jpg",
+		"pattern=*.jpg&recursive=true": "a.jpg,c.jpg,d.jpg,sub/e.jpg",
+		"pattern=b.txt":                "b.txt",
+		"sort=size":                    "sub/,c.jpg,b.txt,d.jpg,a.jpg",
+		"sort=size&pattern=*.jpg&start_after=a.jpg": "c.jpg,d.jpg",
+	} {
+		if got := strings.Join(list(query), ","); got != want {
+			t.Errorf("listing with %s: got %s want %s", query, got, want)
+		}
+	}
+
+	expectStatus(t, testRequest(t, testuser, "GET", fmt.Sprintf("/api/v1/objects/%s/data/?sort=name", bucketID), nil, nil), http.StatusUnprocessableEntity)
+}
+
+func TestStreamedListing(t *testing.T) {
+
+	testuser := "testuser"
+
+	newBucket, err := createSageBucket(testuser, "training-data", "testing-bucket1", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bucketID := newBucket.ID
+
+	for _, key := range []string{"data/a.jpg", "data/b.txt", "data/sub/c.jpg"} {
+		err = putSageObject(bucketID, key, strings.NewReader("content"), testuser, "image/jpeg")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stream := func(query string) (rr *httptest.ResponseRecorder, lines []string) {
+		rr = testRequest(t, testuser, "GET", fmt.Sprintf("/api/v1/objects/%s/data/?%s", bucketID, query), nil, map[string]string{"Accept": listingContentTypeNDJSON})
+
+		scanner := bufio.NewScanner(bytes.NewReader(rr.Body.Bytes()))
+		for scanner.Scan() {
+			lines = append(lines, scanner.Text())
+		}
+		return
+	}
+
+	rr, lines := stream("")
+	if rr.Code != http.StatusOK || rr.Header().Get("Content-Type") != listingContentTypeNDJSON {
+		t.Fatalf("stream returned %d (%s): %s", rr.Code, rr.Header().Get("Content-Type"), rr.Body.String())
+	}
+	if len(lines) != 3 || !strings.HasPrefix(lines[0], `{"key":"a.jpg","size":7,`) || lines[2] != `{"folder":"sub/"}` {
+		t.Fatalf("unexpected lines: %v", lines)
+	}
+
+	_, lines = stream("recursive=true&pattern=*.jpg")
+	keys := []string{}
+	for _, line := range lines {
+		file := &ListedFile{}
+		err = json.Unmarshal([]byte(line), file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, file.Key)
+	}
+	if strings.Join(keys, ",") != "a.jpg,sub/c.jpg" {
+		t.Fatalf("unexpected keys: %v", keys)
+	}
+
+	rr, _ = stream("sort=size")
+	expectStatus(t, rr, http.StatusUnprocessableEntity)
+}
+
+func TestWriteListingLines(t *testing.T) {
+
+	listing := &FolderListing{
+		Files:   []*ListedFile{{Key: "a.txt"}, {Key: "c.txt"}},
+		Folders: []string{"b/", "d/"},
+	}
+
+	buffer := &bytes.Buffer{}
+	err := writeListingLines(json.NewEncoder(buffer), listing)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	order := []string{}
+	for _, line := range strings.Split(strings.TrimSpace(buffer.String()), "\n") {
+		entry := struct {
+			Key    string
+			Folder string
+		}{}
+		json.Unmarshal([]byte(line), &entry)
+		order = append(order, entry.Key+entry.Folder)
+	}
+	if strings.Join(order, ",") != "a.txt,b/,c.txt,d/" {
+		t.Fatalf("lines not in key order: %s", buffer.String())
+	}
+}
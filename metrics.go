@@ -31,6 +31,13 @@ var (
 			Help:"the number of bytes uploaded",
 		},
 	)
+	rateLimitRejections = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "rate_limit_rejections_total",
+			Help: "Number of requests rejected by the rate limiter",
+		},
+		[]string{"reason"},
+	)
 	fileDownloadByteSize = promauto.NewCounter(
 		prometheus.CounterOpts{
 			Name:"file_download_byte_size_total",
@@ -0,0 +1,638 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Client-driven multipart uploads, the endpoints map directly to S3 multipart uploads:
+//
+// POST   /objects/{bucket}/{key}?uploads                         initiate
+// PUT    /objects/{bucket}/{key}?uploadId=<id>&partNumber=<n>    upload part (raw body)
+// GET    /objects/{bucket}/{key}?uploadId=<id>                   list uploaded parts
+// POST   /objects/{bucket}/{key}?uploadId=<id>                   complete
+// DELETE /objects/{bucket}/{key}?uploadId=<id>                   abort
+// GET    /objects/{bucket}?uploads                               list in-progress uploads
+
+const (
+	multipartMaxPartSize = int64(5 << 30) // S3 limits
+	multipartMaxParts    = 10000
+)
+
+var (
+	uploadCleanupInterval = time.Hour      // how often stale uploads are aborted
+	uploadMaxAge          = 24 * time.Hour // multipart uploads (since initiation) and tus uploads (since last data) older than this are aborted
+)
+
+// MultipartUpload in-progress upload
+type MultipartUpload struct {
+	ErrorStruct `json:",inline"`
+	Bucket      string        `json:"bucket-id,omitempty"`
+	Key         string        `json:"key,omitempty"`
+	UploadID    string        `json:"upload_id,omitempty"`
+	Owner       string        `json:"owner,omitempty"`
+	TimeCreated *time.Time    `json:"time_created,omitempty"`
+	Parts       []*UploadPart `json:"parts,omitempty"`
+}
+
+// UploadPart uploaded part, also used to specify the parts when completing an upload
+type UploadPart struct {
+	ErrorStruct `json:",inline"`
+	PartNumber  int64      `json:"part_number"`
+	ETag        string     `json:"etag"`
+	Size        int64      `json:"size,omitempty"`
+	TimeCreated *time.Time `json:"time_created,omitempty"`
+}
+
+func getMultipartUpload(uploadID string) (upload *MultipartUpload, err error) {
+
+	db, err := sql.Open("mysql", mysqlDSN)
+	if err != nil {
+		err = fmt.Errorf("Unable to connect to database: %v", err)
+		return
+	}
+	defer db.Close()
+
+	u := &MultipartUpload{}
+	queryStr := "SELECT upload_id, BIN_TO_UUID(bucket), sage_key, owner, time_created FROM MultipartUploads WHERE upload_id=? ;"
+	err = db.QueryRow(queryStr, uploadID).Scan(&u.UploadID, &u.Bucket, &u.Key, &u.Owner, &u.TimeCreated)
+	switch {
+	case err == sql.ErrNoRows:
+		err = nil
+		return
+	case err != nil:
+		err = fmt.Errorf("(getMultipartUpload) Could not parse row: %s", err.Error())
+		return
+	}
+	upload = u
+	return
+}
+
+// listMultipartUploads returns the uploads of a bucket, only those of owner unless owner is empty
+func listMultipartUploads(bucketID string, owner string) (uploads []*MultipartUpload, err error) {
+
+	db, err := sql.Open("mysql", mysqlDSN)
+	if err != nil {
+		err = fmt.Errorf("Unable to connect to database: %v", err)
+		return
+	}
+	defer db.Close()
+
+	queryStr := "SELECT upload_id, BIN_TO_UUID(bucket), sage_key, owner, time_created FROM MultipartUploads WHERE bucket=UUID_TO_BIN(?)"
+	queryArgs := []interface{}{bucketID}
+	if owner != "" {
+		queryStr += " AND owner=?"
+		queryArgs = append(queryArgs, owner)
+	}
+	queryStr += " ORDER BY time_created ;"
+
+	rows, err := db.Query(queryStr, queryArgs...)
+	if err != nil {
+		err = fmt.Errorf("db.Query returned: %s (%s)", err.Error(), queryStr)
+		return
+	}
+	defer rows.Close()
+
+	uploads = []*MultipartUpload{}
+	for rows.Next() {
+		u := new(MultipartUpload)
+		err = rows.Scan(&u.UploadID, &u.Bucket, &u.Key, &u.Owner, &u.TimeCreated)
+		if err != nil {
+			err = fmt.Errorf("(listMultipartUploads) Could not parse row: %s", err.Error())
+			return
+		}
+		uploads = append(uploads, u)
+	}
+	return
+}
+
+func insertMultipartUpload(u *MultipartUpload) (err error) {
+
+	db, err := sql.Open("mysql", mysqlDSN)
+	if err != nil {
+		err = fmt.Errorf("Unable to connect to database: %v", err)
+		return
+	}
+	defer db.Close()
+
+	insertQueryStr := "INSERT INTO MultipartUploads (upload_id, bucket, sage_key, owner) VALUES ( ?, UUID_TO_BIN(?), ?, ? ) ;"
+	_, err = db.Exec(insertQueryStr, u.UploadID, u.Bucket, u.Key, u.Owner)
+	if err != nil {
+		err = fmt.Errorf("Storing multipart upload failed: %s", err.Error())
+		return
+	}
+	return
+}
+
+func deleteMultipartUploadRow(uploadID string) (err error) {
+
+	db, err := sql.Open("mysql", mysqlDSN)
+	if err != nil {
+		err = fmt.Errorf("Unable to connect to database: %v", err)
+		return
+	}
+	defer db.Close()
+
+	_, err = db.Exec("DELETE FROM MultipartUploads WHERE upload_id=? ;", uploadID)
+	if err != nil {
+		err = fmt.Errorf("Removing multipart upload failed: %s", err.Error())
+		return
+	}
+	return
+}
+
+// abortMultipartUpload aborts the S3 upload and forgets it
+func abortMultipartUpload(u *MultipartUpload) (err error) {
+
+	_, err = svc.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(getS3BucketID(u.Bucket)),
+		Key:      aws.String(path.Join(u.Bucket, u.Key)),
+		UploadId: aws.String(u.UploadID),
+	})
+	if err != nil && !strings.Contains(err.Error(), s3.ErrCodeNoSuchUpload) {
+		err = fmt.Errorf("svc.AbortMultipartUpload returned: %s", err.Error())
+		return
+	}
+
+	err = deleteMultipartUploadRow(u.UploadID)
+	return
+}
+
+// listUploadedParts returns all parts uploaded so far, ordered by part number
+func listUploadedParts(u *MultipartUpload) (parts []*UploadPart, err error) {
+
+	parts = []*UploadPart{}
+	err = svc.ListPartsPages(&s3.ListPartsInput{
+		Bucket:   aws.String(getS3BucketID(u.Bucket)),
+		Key:      aws.String(path.Join(u.Bucket, u.Key)),
+		UploadId: aws.String(u.UploadID),
+	}, func(page *s3.ListPartsOutput, lastPage bool) bool {
+		for _, p := range page.Parts {
+			parts = append(parts, &UploadPart{PartNumber: *p.PartNumber, ETag: *p.ETag, Size: *p.Size, TimeCreated: p.LastModified})
+		}
+		return true
+	})
+	if err != nil {
+		err = fmt.Errorf("svc.ListParts returned: %s", err.Error())
+		return
+	}
+	return
+}
+
+// deleteStaleUploads aborts client multipart uploads and tus uploads that have not been completed within uploadMaxAge
+func deleteStaleUploads(maxAge time.Duration) (aborted int, err error) {
+
+	db, err := sql.Open("mysql", mysqlDSN)
+	if err != nil {
+		err = fmt.Errorf("Unable to connect to database: %v", err)
+		return
+	}
+	defer db.Close()
+
+	maxAgeSeconds := int64(maxAge.Seconds())
+
+	stale := []*MultipartUpload{}
+	rows, err := db.Query("SELECT upload_id, BIN_TO_UUID(bucket), sage_key FROM MultipartUploads WHERE time_created < NOW() - INTERVAL ? SECOND ;", maxAgeSeconds)
+	if err != nil {
+		err = fmt.Errorf("db.Query returned: %s", err.Error())
+		return
+	}
+	for rows.Next() {
+		u := new(MultipartUpload)
+		err = rows.Scan(&u.UploadID, &u.Bucket, &u.Key)
+		if err != nil {
+			rows.Close()
+			err = fmt.Errorf("(deleteStaleUploads) Could not parse row: %s", err.Error())
+			return
+		}
+		stale = append(stale, u)
+	}
+	rows.Close()
+
+	staleTus := []string{}
+	rows, err = db.Query("SELECT id FROM TusUploads WHERE time_last_updated < NOW() - INTERVAL ? SECOND ;", maxAgeSeconds)
+	if err != nil {
+		err = fmt.Errorf("db.Query returned: %s", err.Error())
+		return
+	}
+	for rows.Next() {
+		var id string
+		err = rows.Scan(&id)
+		if err != nil {
+			rows.Close()
+			err = fmt.Errorf("(deleteStaleUploads) Could not parse row: %s", err.Error())
+			return
+		}
+		staleTus = append(staleTus, id)
+	}
+	rows.Close()
+
+	// a failing upload is logged and retried with the next run, it does not block the others
+	for _, u := range stale {
+		abortErr := abortMultipartUpload(u)
+		if abortErr != nil {
+			log.Printf("deleteStaleUploads: upload %s (%s/%s): %s", u.UploadID, u.Bucket, u.Key, abortErr.Error())
+			continue
+		}
+		aborted++
+	}
+
+	for _, id := range staleTus {
+		u, abortErr := getTusUpload(id)
+		if abortErr == nil && u != nil {
+			abortErr = abortTusUpload(u)
+		}
+		if abortErr != nil {
+			log.Printf("deleteStaleUploads: tus upload %s: %s", id, abortErr.Error())
+			continue
+		}
+		if u != nil {
+			aborted++
+		}
+	}
+	return
+}
+
+// staleUploadsCleanup runs deleteStaleUploads periodically, it never returns
+func staleUploadsCleanup(interval time.Duration, maxAge time.Duration) {
+	for {
+		aborted, err := deleteStaleUploads(maxAge)
+		if err != nil {
+			log.Printf("staleUploadsCleanup: %s", err.Error())
+		} else if aborted > 0 {
+			log.Printf("staleUploadsCleanup: aborted %d stale uploads", aborted)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// checkMultipartUpload loads an upload, it has to belong to the key and can only be used by its initiator
+func checkMultipartUpload(uploadID string, username string, sageBucketID string, sageKey string) (u *MultipartUpload, statusCode int, err error) {
+
+	u, err = getMultipartUpload(uploadID)
+	if err != nil {
+		statusCode = errorStatus(err, http.StatusInternalServerError)
+		return
+	}
+	if u == nil || u.Bucket != sageBucketID || u.Key != aclKey(sageKey) {
+		statusCode = http.StatusNotFound
+		err = fmt.Errorf("upload %s not found", uploadID)
+		return
+	}
+	if username == "" || u.Owner != username {
+		statusCode = deniedStatus(username)
+		err = fmt.Errorf("upload %s belongs to another user", uploadID)
+		return
+	}
+
+	// permissions may have changed since the upload was initiated
+	allowed, err := userIsAllowed(username, sageBucketID, actionWriteObject, u.Key)
+	if err != nil {
+		statusCode = errorStatus(err, http.StatusInternalServerError)
+		return
+	}
+	if !allowed {
+		statusCode = deniedStatus(username)
+		err = fmt.Errorf("Write access to %s denied (%s, %s)", u.Key, username, sageBucketID)
+		return
+	}
+	return
+}
+
+// checkMultipartUploadRequest loads the upload of the request, see checkMultipartUpload
+func checkMultipartUploadRequest(w http.ResponseWriter, r *http.Request, username string, sageBucketID string, sageKey string) (u *MultipartUpload, ok bool) {
+
+	u, statusCode, err := checkMultipartUpload(r.URL.Query().Get("uploadId"), username, sageBucketID, sageKey)
+	if err != nil {
+		respondJSONError(w, statusCode, err.Error())
+		return
+	}
+
+	ok = true
+	return
+}
+
+// initiateMultipartUpload creates the S3 multipart upload and records it
+func initiateMultipartUpload(username string, sageBucketID string, sageKey string) (u *MultipartUpload, statusCode int, err error) {
+
+	if sageKey == "" || strings.HasSuffix(sageKey, "/") {
+		statusCode = http.StatusBadRequest
+		err = fmt.Errorf("multipart uploads need a file key, not a folder")
+		return
+	}
+	key := aclKey(sageKey)
+
+	if username == "" {
+		statusCode = http.StatusUnauthorized
+		err = fmt.Errorf("multipart uploads require authentication")
+		return
+	}
+
+	allowed, err := userIsAllowed(username, sageBucketID, actionWriteObject, key)
+	if err != nil {
+		statusCode = errorStatus(err, http.StatusInternalServerError)
+		return
+	}
+	if !allowed {
+		statusCode = deniedStatus(username)
+		err = fmt.Errorf("Write access to %s denied (%s, %s)", key, username, sageBucketID)
+		return
+	}
+
+	out, err := svc.CreateMultipartUpload(&s3.CreateMultipartUploadInput{
+		Bucket:   aws.String(getS3BucketID(sageBucketID)),
+		Key:      aws.String(path.Join(sageBucketID, key)),
+		Metadata: map[string]*string{"owner": aws.String(username)},
+	})
+	if err != nil {
+		statusCode = errorStatus(err, http.StatusInternalServerError)
+		err = fmt.Errorf("svc.CreateMultipartUpload returned: %s", err.Error())
+		return
+	}
+
+	u = &MultipartUpload{Bucket: sageBucketID, Key: key, UploadID: *out.UploadId, Owner: username}
+	err = insertMultipartUpload(u)
+	if err != nil {
+		statusCode = errorStatus(err, http.StatusInternalServerError)
+		return
+	}
+	log.Printf("multipart upload initiated: %s/%s (%s)", sageBucketID, key, username)
+	return
+}
+
+// POST /objects/{bucket}/{key}?uploads
+func initiateMultipartUploadRequest(w http.ResponseWriter, username string, sageBucketID string, sageKey string) {
+
+	u, statusCode, err := initiateMultipartUpload(username, sageBucketID, sageKey)
+	if err != nil {
+		respondJSONError(w, statusCode, err.Error())
+		return
+	}
+
+	respondJSON(w, http.StatusOK, u)
+}
+
+// uploadMultipartPart stores one part, the body is limited to the maximum part size
+func uploadMultipartPart(u *MultipartUpload, partNumber int64, body io.Reader) (part *UploadPart, statusCode int, err error) {
+
+	if partNumber < 1 || partNumber > multipartMaxParts {
+		statusCode = http.StatusBadRequest
+		err = fmt.Errorf("partNumber must be between 1 and %d", multipartMaxParts)
+		return
+	}
+
+	// S3 needs a seekable body, the part is spooled to a temporary file
+	tmpFile, err := ioutil.TempFile("", "sage-part-")
+	if err != nil {
+		statusCode = errorStatus(err, http.StatusInternalServerError)
+		err = fmt.Errorf("ioutil.TempFile returned: %s", err.Error())
+		return
+	}
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+
+	size, err := io.Copy(tmpFile, io.LimitReader(body, multipartMaxPartSize+1))
+	if err != nil {
+		statusCode = http.StatusBadRequest
+		err = fmt.Errorf("Reading part failed: %s", err.Error())
+		return
+	}
+	if size > multipartMaxPartSize {
+		statusCode = http.StatusRequestEntityTooLarge
+		err = fmt.Errorf("parts can have at most %d bytes", multipartMaxPartSize)
+		return
+	}
+	_, err = tmpFile.Seek(0, io.SeekStart)
+	if err != nil {
+		statusCode = errorStatus(err, http.StatusInternalServerError)
+		return
+	}
+
+	out, err := svc.UploadPart(&s3.UploadPartInput{
+		Bucket:     aws.String(getS3BucketID(u.Bucket)),
+		Key:        aws.String(path.Join(u.Bucket, u.Key)),
+		UploadId:   aws.String(u.UploadID),
+		PartNumber: aws.Int64(partNumber),
+		Body:       tmpFile,
+	})
+	if err != nil {
+		statusCode = errorStatus(err, http.StatusInternalServerError)
+		err = fmt.Errorf("svc.UploadPart returned: %s", err.Error())
+		return
+	}
+	fileUploadByteSize.Add(float64(size))
+
+	part = &UploadPart{PartNumber: partNumber, ETag: *out.ETag, Size: size}
+	return
+}
+
+// PUT /objects/{bucket}/{key}?uploadId=<id>&partNumber=<n>
+func uploadPartRequest(w http.ResponseWriter, r *http.Request, username string, sageBucketID string, sageKey string) {
+
+	u, ok := checkMultipartUploadRequest(w, r, username, sageBucketID, sageKey)
+	if !ok {
+		return
+	}
+
+	partNumber, err := strconv.ParseInt(r.URL.Query().Get("partNumber"), 10, 64)
+	if err != nil {
+		respondJSONError(w, http.StatusBadRequest, "partNumber must be between 1 and %d", multipartMaxParts)
+		return
+	}
+
+	part, statusCode, err := uploadMultipartPart(u, partNumber, r.Body)
+	if err != nil {
+		respondJSONError(w, statusCode, err.Error())
+		return
+	}
+
+	w.Header().Set("ETag", part.ETag)
+	respondJSON(w, http.StatusOK, part)
+}
+
+// GET /objects/{bucket}/{key}?uploadId=<id>
+func listPartsRequest(w http.ResponseWriter, r *http.Request, username string, sageBucketID string, sageKey string) {
+
+	u, ok := checkMultipartUploadRequest(w, r, username, sageBucketID, sageKey)
+	if !ok {
+		return
+	}
+
+	parts, err := listUploadedParts(u)
+	if err != nil {
+		respondError(w, err, http.StatusInternalServerError)
+		return
+	}
+	u.Parts = parts
+
+	respondJSON(w, http.StatusOK, u)
+}
+
+// completeMultipartUpload assembles the parts, without parts all uploaded parts are used
+func completeMultipartUpload(u *MultipartUpload, parts []*UploadPart) (statusCode int, err error) {
+
+	if len(parts) == 0 {
+		parts, err = listUploadedParts(u)
+		if err != nil {
+			statusCode = errorStatus(err, http.StatusInternalServerError)
+			return
+		}
+	}
+	if len(parts) == 0 {
+		statusCode = http.StatusConflict
+		err = fmt.Errorf("upload %s has no parts", u.UploadID)
+		return
+	}
+	sort.Slice(parts, func(i, j int) bool { return parts[i].PartNumber < parts[j].PartNumber })
+
+	completed := []*s3.CompletedPart{}
+	for _, p := range parts {
+		completed = append(completed, &s3.CompletedPart{PartNumber: aws.Int64(p.PartNumber), ETag: aws.String(p.ETag)})
+	}
+
+	_, err = svc.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(getS3BucketID(u.Bucket)),
+		Key:             aws.String(path.Join(u.Bucket, u.Key)),
+		UploadId:        aws.String(u.UploadID),
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: completed},
+	})
+	if err != nil {
+		statusCode = http.StatusBadRequest
+		err = fmt.Errorf("svc.CompleteMultipartUpload returned: %s", err.Error())
+		return
+	}
+
+	err = deleteMultipartUploadRow(u.UploadID)
+	if err != nil {
+		statusCode = errorStatus(err, http.StatusInternalServerError)
+		return
+	}
+	fileUploadCounter.Inc()
+	log.Printf("multipart upload completed: %s/%s (%d parts)", u.Bucket, u.Key, len(completed))
+	return
+}
+
+// POST /objects/{bucket}/{key}?uploadId=<id>, optional body {"parts": [{"part_number": 1, "etag": "..."}, ...]},
+// without parts all uploaded parts are used
+func completeMultipartUploadRequest(w http.ResponseWriter, r *http.Request, username string, sageBucketID string, sageKey string) {
+
+	u, ok := checkMultipartUploadRequest(w, r, username, sageBucketID, sageKey)
+	if !ok {
+		return
+	}
+
+	request := &MultipartUpload{}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 2<<20))
+	if err != nil {
+		respondJSONError(w, http.StatusBadRequest, "Reading body failed: %s", err.Error())
+		return
+	}
+	if len(strings.TrimSpace(string(body))) > 0 {
+		err = json.Unmarshal(body, request)
+		if err != nil {
+			respondJSONError(w, http.StatusBadRequest, "Could not parse json: %s", err.Error())
+			return
+		}
+	}
+
+	statusCode, err := completeMultipartUpload(u, request.Parts)
+	if err != nil {
+		respondJSONError(w, statusCode, err.Error())
+		return
+	}
+
+	respondJSON(w, http.StatusOK, &SageFile{Bucket: sageBucketID, Key: u.Key})
+}
+
+// checkAbortMultipartUpload loads an upload that is to be aborted, the initiator or users that may delete the file can abort it
+func checkAbortMultipartUpload(uploadID string, username string, sageBucketID string, sageKey string) (u *MultipartUpload, statusCode int, err error) {
+
+	u, err = getMultipartUpload(uploadID)
+	if err != nil {
+		statusCode = errorStatus(err, http.StatusInternalServerError)
+		return
+	}
+	if u == nil || u.Bucket != sageBucketID || u.Key != aclKey(sageKey) {
+		statusCode = http.StatusNotFound
+		err = fmt.Errorf("upload %s not found", uploadID)
+		return
+	}
+
+	if username == "" || u.Owner != username {
+		var allowed bool
+		allowed, err = userIsAllowed(username, sageBucketID, actionDeleteObject, u.Key)
+		if err != nil {
+			statusCode = errorStatus(err, http.StatusInternalServerError)
+			return
+		}
+		if !allowed {
+			statusCode = deniedStatus(username)
+			err = fmt.Errorf("Delete access to %s denied (%s, %s)", u.Key, username, sageBucketID)
+			return
+		}
+	}
+	return
+}
+
+// DELETE /objects/{bucket}/{key}?uploadId=<id>
+func abortMultipartUploadRequest(w http.ResponseWriter, r *http.Request, username string, sageBucketID string, sageKey string) {
+
+	uploadID := r.URL.Query().Get("uploadId")
+
+	u, statusCode, err := checkAbortMultipartUpload(uploadID, username, sageBucketID, sageKey)
+	if err != nil {
+		respondJSONError(w, statusCode, err.Error())
+		return
+	}
+
+	err = abortMultipartUpload(u)
+	if err != nil {
+		respondError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	dr := DeleteRespsonse{}
+	dr.Deleted = []string{uploadID}
+	respondJSON(w, http.StatusOK, dr)
+}
+
+// GET /objects/{bucket}?uploads lists the uploads of the user, users with FULL_CONTROL see all uploads
+func listMultipartUploadsRequest(w http.ResponseWriter, username string, sageBucketID string) {
+
+	if username == "" {
+		respondJSONError(w, http.StatusUnauthorized, "listing uploads requires authentication")
+		return
+	}
+
+	owner := username
+	allowed, err := userIsAllowed(username, sageBucketID, actionListUploads, "")
+	if err != nil {
+		respondError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if allowed {
+		owner = ""
+	}
+
+	uploads, err := listMultipartUploads(sageBucketID, owner)
+	if err != nil {
+		respondError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, uploads)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestMultipartUpload(t *testing.T) {
+
+	testuser := "testuser"
+	otheruser := "otheruser"
+
+	newBucket, err := createSageBucket(testuser, "training-data", "testing-bucket1", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bucketID := newBucket.ID
+
+	objectURL := fmt.Sprintf("/api/v1/objects/%s/multipart/test.bin", bucketID)
+
+	rr := testRequest(t, otheruser, "POST", objectURL+"?uploads", nil, nil)
+	if rr.Code == http.StatusOK {
+		t.Fatalf("otheruser was able to initiate upload")
+	}
+
+	rr = testRequest(t, testuser, "POST", objectURL+"?uploads", nil, nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("initiate returned %d: %s", rr.Code, rr.Body.String())
+	}
+	upload := &MultipartUpload{}
+	err = json.Unmarshal(rr.Body.Bytes(), upload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if upload.UploadID == "" {
+		t.Fatalf("upload_id missing")
+	}
+	uploadURL := objectURL + "?uploadId=" + upload.UploadID
+
+	part1 := bytes.Repeat([]byte("a"), 5<<20)
+	part2 := []byte("the end")
+
+	// parts can be uploaded in any order
+	rr = testRequest(t, testuser, "PUT", uploadURL+"&partNumber=2", bytes.NewReader(part2), nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("upload part returned %d: %s", rr.Code, rr.Body.String())
+	}
+	rr = testRequest(t, testuser, "PUT", uploadURL+"&partNumber=1", bytes.NewReader(part1), nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("upload part returned %d: %s", rr.Code, rr.Body.String())
+	}
+
+	rr = testRequest(t, otheruser, "PUT", uploadURL+"&partNumber=3", bytes.NewReader(part2), nil)
+	if rr.Code == http.StatusOK {
+		t.Fatalf("otheruser was able to upload a part")
+	}
+
+	rr = testRequest(t, testuser, "GET", fmt.Sprintf("/api/v1/objects/%s?uploads", bucketID), nil, nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("list uploads returned %d: %s", rr.Code, rr.Body.String())
+	}
+	uploads := []*MultipartUpload{}
+	err = json.Unmarshal(rr.Body.Bytes(), &uploads)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(uploads) != 1 || uploads[0].UploadID != upload.UploadID {
+		t.Fatalf("expected one upload, got %s", rr.Body.String())
+	}
+
+	rr = testRequest(t, testuser, "GET", uploadURL, nil, nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("list parts returned %d: %s", rr.Code, rr.Body.String())
+	}
+	listed := &MultipartUpload{}
+	err = json.Unmarshal(rr.Body.Bytes(), listed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listed.Parts) != 2 {
+		t.Fatalf("expected 2 parts, got %d", len(listed.Parts))
+	}
+
+	rr = testRequest(t, testuser, "POST", uploadURL, nil, nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("complete returned %d: %s", rr.Code, rr.Body.String())
+	}
+	completed := &SageFile{}
+	json.Unmarshal(rr.Body.Bytes(), completed)
+	if completed.Key != "multipart/test.bin" {
+		t.Fatalf("unexpected key of the completed file: %s", rr.Body.String())
+	}
+
+	rr = testRequest(t, testuser, "GET", objectURL, nil, nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("download returned %d: %s", rr.Code, rr.Body.String())
+	}
+	if !bytes.Equal(rr.Body.Bytes(), append(part1, part2...)) {
+		t.Fatalf("downloaded file differs (%d bytes)", rr.Body.Len())
+	}
+
+	// abort
+	rr = testRequest(t, testuser, "POST", objectURL+"?uploads", nil, nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("initiate returned %d: %s", rr.Code, rr.Body.String())
+	}
+	err = json.Unmarshal(rr.Body.Bytes(), upload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = testRequest(t, testuser, "DELETE", objectURL+"?uploadId="+upload.UploadID, nil, nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("abort returned %d: %s", rr.Code, rr.Body.String())
+	}
+	rr = testRequest(t, testuser, "GET", objectURL+"?uploadId="+upload.UploadID, nil, nil)
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("aborted upload still exists (%d)", rr.Code)
+	}
+}
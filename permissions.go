@@ -0,0 +1,481 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// bucketAction identifies an operation a user wants to perform on a SAGE bucket
+type bucketAction string
+
+const (
+	actionReadObject    bucketAction = "read_object"
+	actionListObjects   bucketAction = "list_objects"
+	actionWriteObject   bucketAction = "write_object"
+	actionDeleteObject  bucketAction = "delete_object"
+	actionDeleteBucket  bucketAction = "delete_bucket"
+	actionReadACL       bucketAction = "read_acl"
+	actionWriteACL      bucketAction = "write_acl"
+	actionPatchMetadata bucketAction = "patch_metadata"
+	actionListUploads   bucketAction = "list_uploads" // in-progress multipart uploads of all users
+)
+
+// actionPermissions lists for each action the bucket permissions that allow it.
+// FULL_CONTROL allows everything. Deleting the bucket itself, changing its metadata
+// and listing the uploads of other users are reserved for FULL_CONTROL, WRITE only
+// covers objects.
+//
+//	action          READ  WRITE  READ_ACP  WRITE_ACP  FULL_CONTROL
+//	read_object      x                                 x
+//	list_objects     x                                 x
+//	write_object           x                           x
+//	delete_object          x                           x
+//	delete_bucket                                      x
+//	read_acl                      x                    x
+//	write_acl                               x          x
+//	patch_metadata                                     x
+//	list_uploads                                       x
+var actionPermissions = map[bucketAction][]string{
+	actionReadObject:    {"READ", "FULL_CONTROL"},
+	actionListObjects:   {"READ", "FULL_CONTROL"},
+	actionWriteObject:   {"WRITE", "FULL_CONTROL"},
+	actionDeleteObject:  {"WRITE", "FULL_CONTROL"},
+	actionDeleteBucket:  {"FULL_CONTROL"},
+	actionReadACL:       {"READ_ACP", "FULL_CONTROL"},
+	actionWriteACL:      {"WRITE_ACP", "FULL_CONTROL"},
+	actionPatchMetadata: {"FULL_CONTROL"},
+	actionListUploads:   {"FULL_CONTROL"},
+}
+
+// grantNotExpiredQuery is added to every BucketPermissions query that evaluates grants,
+// grants with an expiry in the past are ignored until the cleanup job removes them
+const grantNotExpiredQuery = "(expires IS NULL OR expires > NOW())"
+
+// publicActions are the only actions a GROUP:AllUsers grant can allow
+var publicActions = map[bucketAction]bool{
+	actionReadObject:  true,
+	actionListObjects: true,
+}
+
+// permissionAllowsAction evaluates a single granted permission against the action table
+func permissionAllowsAction(permission string, action bucketAction) bool {
+	for _, p := range actionPermissions[action] {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// grantAppliesToKey returns true if the grant covers the key. Grants without prefix
+// cover the whole bucket, grants with prefix only cover keys starting with it.
+// Bucket-level actions are evaluated with an empty key and thus need a bucket-wide grant.
+func grantAppliesToKey(grant *SAGEBucketPermission, key string) bool {
+	if grant.Prefix == "" {
+		return true
+	}
+	return key != "" && strings.HasPrefix(key, grant.Prefix)
+}
+
+// grantsAllowAction returns true if any of the grants allows the action on the key.
+// Grants of the group AllUsers are only considered for public actions.
+// Listing a folder is also allowed if a grant covers some prefix within that folder,
+// use filterListObject to hide everything else.
+func grantsAllowAction(grants []*SAGEBucketPermission, action bucketAction, key string) bool {
+	for _, g := range grants {
+		if g.GranteeType == "GROUP" && g.Grantee == "AllUsers" && !publicActions[action] {
+			continue
+		}
+		if !permissionAllowsAction(g.Permission, action) {
+			continue
+		}
+		if grantAppliesToKey(g, key) {
+			return true
+		}
+		if action == actionListObjects && strings.HasPrefix(g.Prefix, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// aclKey converts a SAGE path as returned by getSagePath into the form used for grant prefixes
+func aclKey(sagePath string) string {
+	return strings.TrimPrefix(sagePath, "/")
+}
+
+// validateNewPermission checks and normalizes a grant before it is added
+func validateNewPermission(p *SAGEBucketPermission) (err error) {
+
+	if p.GranteeType == "" {
+		err = fmt.Errorf("GranteeType missing")
+		return
+	}
+
+	if p.GranteeType == "GROUP" && p.Grantee == "AllUsers" && p.Permission != "READ" {
+		err = fmt.Errorf("Buckets can be made public only for READ access.")
+		return
+	}
+
+	p.Prefix = aclKey(p.Prefix)
+
+	if p.Expires != nil && !p.Expires.After(time.Now()) {
+		err = fmt.Errorf("Expiry time %s is not in the future", p.Expires.Format(time.RFC3339))
+		return
+	}
+	return
+}
+
+// parseGranteeSpec parses the grantee query field of the form [<granteeType>:]<grantee>[:<permission>]
+func parseGranteeSpec(spec string) (granteeType string, grantee string, permission string) {
+	granteeType = "USER"
+	grantee = spec
+	granteeArray := strings.SplitN(spec, ":", 3)
+	if len(granteeArray) >= 2 {
+		granteeType = granteeArray[0]
+		grantee = granteeArray[1]
+	}
+	if len(granteeArray) == 3 {
+		permission = granteeArray[2]
+	}
+	return
+}
+
+// getGrantsForUser returns all grants of a bucket that apply to the user, including public grants
+func getGrantsForUser(username string, bucketID string) (grants []*SAGEBucketPermission, err error) {
+
+	db, err := sql.Open("mysql", mysqlDSN)
+	if err != nil {
+		err = fmt.Errorf("Unable to connect to database: %v", err)
+		return
+	}
+	defer db.Close()
+
+	// TODO: infer group memberships
+
+	queryStr := "SELECT granteeType, grantee, permission, prefix FROM BucketPermissions WHERE id=UUID_TO_BIN(?) AND ( (granteeType='USER' AND grantee=?) OR (granteeType='GROUP' AND grantee='AllUsers') ) AND " + grantNotExpiredQuery + " ;"
+
+	rows, err := db.Query(queryStr, bucketID, username)
+	if err != nil {
+		err = fmt.Errorf("db.Query returned: %s (%s)", err.Error(), queryStr)
+		return
+	}
+	defer rows.Close()
+
+	grants = []*SAGEBucketPermission{}
+	for rows.Next() {
+		p := SAGEBucketPermission{}
+		err = rows.Scan(&p.GranteeType, &p.Grantee, &p.Permission, &p.Prefix)
+		if err != nil {
+			err = fmt.Errorf("(getGrantsForUser) Could not parse row: %s", err.Error())
+			return
+		}
+		if username == "" && p.GranteeType == "USER" {
+			continue
+		}
+		grants = append(grants, &p)
+	}
+
+	return
+}
+
+// bucketAccess holds the grants and the policy relevant for one user on one bucket
+type bucketAccess struct {
+	username string
+	isAdmin  bool // administrators bypass grants and policy
+	grants   []*SAGEBucketPermission
+	policy   *BucketPolicy
+}
+
+// getBucketAccess loads grants and policy of the bucket for the user
+func getBucketAccess(username string, bucketID string) (access *bucketAccess, err error) {
+
+	grants, err := getGrantsForUser(username, bucketID)
+	if err != nil {
+		return
+	}
+
+	policy, err := getBucketPolicy(bucketID)
+	if err != nil {
+		return
+	}
+
+	access = &bucketAccess{username: username, isAdmin: isAdmin(username), grants: grants, policy: policy}
+	return
+}
+
+// allows returns true for administrators, for everyone else see evaluate
+func (a *bucketAccess) allows(action bucketAction, key string) bool {
+	return a.isAdmin || a.evaluate(action, key)
+}
+
+// evaluate evaluates policy and grants, an explicit Deny in the policy always wins
+func (a *bucketAccess) evaluate(action bucketAction, key string) bool {
+	switch a.policy.evaluate(a.username, action, key) {
+	case policyDeny:
+		return false
+	case policyAllow:
+		return true
+	}
+	return grantsAllowAction(a.grants, action, key)
+}
+
+// userIsAllowed checks if the user may perform the action on the key within the bucket.
+// Use an empty key for actions on the bucket itself.
+func userIsAllowed(username string, bucketID string, action bucketAction, key string) (ok bool, err error) {
+
+	if _, known := actionPermissions[action]; !known {
+		err = fmt.Errorf("unknown bucket action %s", action)
+		return
+	}
+
+	access, err := getBucketAccess(username, bucketID)
+	if err != nil {
+		return
+	}
+
+	ok = access.evaluate(action, key)
+	if !ok && access.isAdmin {
+		// administrator acting on a bucket they have no permission for
+		err = recordAdminAction(username, "bypass:"+string(action), bucketID, key)
+		if err != nil {
+			return
+		}
+		ok = true
+	}
+	log.Printf("userIsAllowed (user: %s, bucket: %s, action: %s, key: %s): %t", username, bucketID, action, key, ok)
+	return
+}
+
+// filterListObject removes all files and folders from a listing of folder that the user is not allowed to read
+func filterListObject(access *bucketAccess, folder string, listObject *s3.ListObjectsV2Output) {
+
+	folder = aclKey(folder)
+
+	contents := []*s3.Object{}
+	for _, object := range listObject.Contents {
+		if object.Key == nil || access.allows(actionReadObject, folder+*object.Key) {
+			contents = append(contents, object)
+		}
+	}
+	listObject.Contents = contents
+
+	commonPrefixes := []*s3.CommonPrefix{}
+	for _, cp := range listObject.CommonPrefixes {
+		if cp.Prefix == nil || access.allows(actionListObjects, folder+*cp.Prefix) {
+			commonPrefixes = append(commonPrefixes, cp)
+		}
+	}
+	listObject.CommonPrefixes = commonPrefixes
+
+	listObject.KeyCount = aws.Int64(int64(len(contents) + len(commonPrefixes)))
+}
+
+// listAllowedContent returns one page of the folder listing, without the files and folders the user is not allowed to read
+func listAllowedContent(access *bucketAccess, sageBucketID string, folder string, recursive bool, limit int64, startAfter string, continuationToken string) (listObject *s3.ListObjectsV2Output, err error) {
+
+	listObject, err = listSageBucketContent(sageBucketID, folder, recursive, limit, startAfter, continuationToken)
+	if err != nil {
+		err = fmt.Errorf("error listing bucket contents (sageBucketID: %s, sagePath: %s): %s", sageBucketID, folder, err.Error())
+		return
+	}
+	filterListObject(access, folder, listObject)
+	return
+}
+
+// deleteExpiredGrants removes all grants whose expiry lies in the past
+func deleteExpiredGrants() (deleted int64, err error) {
+
+	db, err := sql.Open("mysql", mysqlDSN)
+	if err != nil {
+		err = fmt.Errorf("Unable to connect to database: %v", err)
+		return
+	}
+	defer db.Close()
+
+	result, err := db.Exec("DELETE FROM BucketPermissions WHERE expires IS NOT NULL AND expires <= NOW() ;")
+	if err != nil {
+		err = fmt.Errorf("Removing expired bucket permissions failed: %s", err.Error())
+		return
+	}
+
+	deleted, err = result.RowsAffected()
+	if err != nil {
+		err = fmt.Errorf("result.RowsAffected returned: %s", err.Error())
+		return
+	}
+	return
+}
+
+// expiredGrantsCleanup runs deleteExpiredGrants periodically, it never returns
+func expiredGrantsCleanup(interval time.Duration) {
+	for {
+		deleted, err := deleteExpiredGrants()
+		if err != nil {
+			log.Printf("expiredGrantsCleanup: %s", err.Error())
+		} else if deleted > 0 {
+			log.Printf("expiredGrantsCleanup: removed %d expired bucket permissions", deleted)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// missingTables are created on start, init.sql is only run by MySQL for a new data volume and existing
+// deployments would lack the tables of later versions. Keep the statements in sync with init.sql.
+var missingTables = []struct {
+	name      string
+	statement string
+}{
+	{"BucketPolicies", `CREATE TABLE IF NOT EXISTS BucketPolicies (
+    id                  BINARY(16) NOT NULL PRIMARY KEY,
+    policy              JSON NOT NULL,
+    time_last_updated   TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
+) ;`},
+	{"AdminActions", `CREATE TABLE IF NOT EXISTS AdminActions (
+    id                  BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    time                TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    admin               VARCHAR(64) NOT NULL,
+    action              VARCHAR(64) NOT NULL,
+    bucket              BINARY(16),
+    details             TEXT,
+    INDEX (bucket)
+) ;`},
+	{"BucketTransfers", `CREATE TABLE IF NOT EXISTS BucketTransfers (
+    id                  BINARY(16) NOT NULL PRIMARY KEY,
+    previous_owner      VARCHAR(64) NOT NULL,
+    new_owner           VARCHAR(64) NOT NULL,
+    time_created        TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+) ;`},
+	{"TusUploads", `CREATE TABLE IF NOT EXISTS TusUploads (
+    id                  VARCHAR(36) NOT NULL PRIMARY KEY,
+    bucket              BINARY(16) NOT NULL,
+    sage_key            VARCHAR(1024) NOT NULL,
+    owner               VARCHAR(64) NOT NULL,
+    upload_length       BIGINT NOT NULL,
+    upload_offset       BIGINT NOT NULL DEFAULT 0,
+    s3_upload_id        VARCHAR(1024) NOT NULL,
+    part_count          INT NOT NULL DEFAULT 0,
+    incomplete_size     BIGINT NOT NULL DEFAULT 0,
+    lock_time           TIMESTAMP NULL DEFAULT NULL,
+    time_created        TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    time_last_updated   TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
+) ;`},
+	{"MultipartUploads", `CREATE TABLE IF NOT EXISTS MultipartUploads (
+    upload_id           VARCHAR(255) NOT NULL PRIMARY KEY,
+    bucket              BINARY(16) NOT NULL,
+    sage_key            VARCHAR(1024) NOT NULL,
+    owner               VARCHAR(64) NOT NULL,
+    time_created        TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    INDEX (bucket)
+) ;`},
+	{"Snapshots", `CREATE TABLE IF NOT EXISTS Snapshots (
+    id                  VARCHAR(36) NOT NULL PRIMARY KEY,
+    bucket              BINARY(16) NOT NULL,
+    name                VARCHAR(64) NOT NULL DEFAULT '',
+    creator             VARCHAR(64) NOT NULL,
+    file_count          BIGINT NOT NULL DEFAULT 0,
+    total_size          BIGINT NOT NULL DEFAULT 0,
+    time_created        TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    INDEX (bucket)
+) ;`},
+	{"SnapshotFiles", `CREATE TABLE IF NOT EXISTS SnapshotFiles (
+    id                  BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    snapshot            VARCHAR(36) NOT NULL,
+    sage_key            VARCHAR(1024) NOT NULL,
+    size                BIGINT NOT NULL,
+    etag                VARCHAR(128) NOT NULL,
+    sha256              VARCHAR(64) NOT NULL DEFAULT '',
+    INDEX (snapshot)
+) ;`},
+	{"S3Credentials", `CREATE TABLE IF NOT EXISTS S3Credentials (
+    access_key          VARCHAR(32) NOT NULL PRIMARY KEY,
+    secret_key          VARCHAR(64) NOT NULL,
+    username            VARCHAR(64) NOT NULL,
+    time_created        TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    INDEX (username)
+) ;`},
+}
+
+// createMissingTables creates the tables of missingTables that do not exist yet
+func createMissingTables() (err error) {
+
+	db, err := sql.Open("mysql", mysqlDSN)
+	if err != nil {
+		err = fmt.Errorf("Unable to connect to database: %v", err)
+		return
+	}
+	defer db.Close()
+
+	for _, table := range missingTables {
+		_, err = db.Exec(table.statement)
+		if err != nil {
+			err = fmt.Errorf("Creating table %s failed: %s", table.name, err.Error())
+			return
+		}
+	}
+	return
+}
+
+// bucketPermissionsMigrations add the columns introduced after the first release, init.sql only
+// creates them for new databases
+var bucketPermissionsMigrations = []struct {
+	column    string
+	statement string
+}{
+	{"prefix", "ALTER TABLE BucketPermissions ADD COLUMN prefix VARCHAR(255) NOT NULL DEFAULT '' AFTER permission ;"},
+	{"expires", "ALTER TABLE BucketPermissions ADD COLUMN expires TIMESTAMP NULL DEFAULT NULL AFTER prefix ;"},
+}
+
+// migrateBucketPermissions brings an existing BucketPermissions table to the schema of init.sql,
+// every step checks information_schema first so it can run on each start
+func migrateBucketPermissions() (err error) {
+
+	db, err := sql.Open("mysql", mysqlDSN)
+	if err != nil {
+		err = fmt.Errorf("Unable to connect to database: %v", err)
+		return
+	}
+	defer db.Close()
+
+	for _, m := range bucketPermissionsMigrations {
+		var count int
+		err = db.QueryRow("SELECT COUNT(*) FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = 'BucketPermissions' AND COLUMN_NAME = ? ;", m.column).Scan(&count)
+		if err != nil {
+			err = fmt.Errorf("Looking up column %s failed: %s", m.column, err.Error())
+			return
+		}
+		if count > 0 {
+			continue
+		}
+		_, err = db.Exec(m.statement)
+		if err != nil {
+			err = fmt.Errorf("Adding column %s failed: %s", m.column, err.Error())
+			return
+		}
+		log.Printf("migrateBucketPermissions: added column %s", m.column)
+	}
+
+	// grants for different prefixes need prefix in the primary key
+	var count int
+	err = db.QueryRow("SELECT COUNT(*) FROM information_schema.KEY_COLUMN_USAGE WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = 'BucketPermissions' AND CONSTRAINT_NAME = 'PRIMARY' AND COLUMN_NAME = 'prefix' ;").Scan(&count)
+	if err != nil {
+		err = fmt.Errorf("Looking up primary key failed: %s", err.Error())
+		return
+	}
+	if count > 0 {
+		return
+	}
+	_, err = db.Exec("ALTER TABLE BucketPermissions DROP PRIMARY KEY, ADD PRIMARY KEY (id, granteeType, grantee, permission, prefix) ;")
+	if err != nil {
+		err = fmt.Errorf("Replacing primary key failed: %s", err.Error())
+		return
+	}
+	log.Printf("migrateBucketPermissions: added prefix to the primary key")
+	return
+}
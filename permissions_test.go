@@ -0,0 +1,300 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestActionPermissionMatrix(t *testing.T) {
+
+	allPermissions := []string{"READ", "WRITE", "READ_ACP", "WRITE_ACP", "FULL_CONTROL"}
+
+	// expected[action] lists the permissions that must allow the action, all others must deny it
+	expected := map[bucketAction][]string{
+		actionReadObject:    {"READ", "FULL_CONTROL"},
+		actionListObjects:   {"READ", "FULL_CONTROL"},
+		actionWriteObject:   {"WRITE", "FULL_CONTROL"},
+		actionDeleteObject:  {"WRITE", "FULL_CONTROL"},
+		actionDeleteBucket:  {"FULL_CONTROL"},
+		actionReadACL:       {"READ_ACP", "FULL_CONTROL"},
+		actionWriteACL:      {"WRITE_ACP", "FULL_CONTROL"},
+		actionPatchMetadata: {"FULL_CONTROL"},
+		actionListUploads:   {"FULL_CONTROL"},
+	}
+
+	if len(expected) != len(actionPermissions) {
+		t.Fatalf("action table has %d actions, test covers %d", len(actionPermissions), len(expected))
+	}
+
+	for action, allowedPerms := range expected {
+		for _, perm := range allPermissions {
+			want := contains(allowedPerms, perm)
+
+			grants := []*SAGEBucketPermission{{GranteeType: "USER", Grantee: "testuser", Permission: perm}}
+			got := grantsAllowAction(grants, action, "")
+			if got != want {
+				t.Errorf("USER %s, action %s: got %t, want %t", perm, action, got, want)
+			}
+		}
+	}
+}
+
+func TestActionPermissionPublic(t *testing.T) {
+
+	publicGrant := []*SAGEBucketPermission{{GranteeType: "GROUP", Grantee: "AllUsers", Permission: "READ"}}
+
+	for action := range actionPermissions {
+		want := action == actionReadObject || action == actionListObjects
+		got := grantsAllowAction(publicGrant, action, "")
+		if got != want {
+			t.Errorf("GROUP AllUsers READ, action %s: got %t, want %t", action, got, want)
+		}
+	}
+
+	// even a (invalid) FULL_CONTROL grant for AllUsers must not give write access
+	publicGrant[0].Permission = "FULL_CONTROL"
+	if grantsAllowAction(publicGrant, actionWriteObject, "") {
+		t.Errorf("GROUP AllUsers FULL_CONTROL must not allow %s", actionWriteObject)
+	}
+
+	if grantsAllowAction([]*SAGEBucketPermission{}, actionReadObject, "") {
+		t.Errorf("no grants must not allow %s", actionReadObject)
+	}
+}
+
+// WRITE permission must not be sufficient to delete the whole bucket
+func TestWriteCannotDeleteBucket(t *testing.T) {
+
+	testuser := "testuser"
+	otheruser := "otheruser"
+
+	newBucket, err := createSageBucket(testuser, "training-data", "testing-bucket1", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bucketID := newBucket.ID
+
+	err = addBucketPermissionForTest(bucketID, testuser, "USER", otheruser, "WRITE")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	url := fmt.Sprintf("/api/v1/objects/%s", bucketID)
+	req, err := http.NewRequest("DELETE", url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Add("Authorization", "sage user:"+otheruser)
+
+	rr := httptest.NewRecorder()
+	mainRouter.ServeHTTP(rr, req)
+
+	if rr.Code == http.StatusOK {
+		t.Fatalf("user with WRITE was able to delete bucket: %s", rr.Body.String())
+	}
+
+	_, err = GetSageBucket(bucketID)
+	if err != nil {
+		t.Fatalf("bucket should still exist: %s", err.Error())
+	}
+}
+
+func TestExpiringPermission(t *testing.T) {
+
+	testuser := "testuser"
+	otheruser := "otheruser"
+
+	newBucket, err := createSageBucket(testuser, "training-data", "testing-bucket1", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bucketID := newBucket.ID
+
+	expires := time.Now().Add(2 * time.Second).UTC().Format(time.RFC3339)
+	body := fmt.Sprintf(`{"granteeType": "USER", "grantee": "%s", "permission": "READ", "expires": "%s"}`, otheruser, expires)
+
+	url := fmt.Sprintf("/api/v1/objects/%s?permissions", bucketID)
+	req, err := http.NewRequest("PUT", url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Add("Authorization", "sage user:"+testuser)
+
+	rr := httptest.NewRecorder()
+	mainRouter.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v (%s)", rr.Code, http.StatusOK, rr.Body.String())
+	}
+
+	allowed, err := userIsAllowed(otheruser, bucketID, actionReadObject, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !allowed {
+		t.Fatal("grant should be valid before it expires")
+	}
+
+	time.Sleep(3 * time.Second)
+
+	allowed, err = userIsAllowed(otheruser, bucketID, actionReadObject, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if allowed {
+		t.Fatal("expired grant should be ignored")
+	}
+
+	permissions, err := ListBucketPermissions(bucketID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range permissions {
+		if p.Grantee == otheruser {
+			t.Fatal("expired grant should not be listed")
+		}
+	}
+
+	deleted, err := deleteExpiredGrants()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted < 1 {
+		t.Fatalf("expected expired grant to be removed, deleted: %d", deleted)
+	}
+
+	// an expiry in the past is rejected
+	body = fmt.Sprintf(`{"granteeType": "USER", "grantee": "%s", "permission": "READ", "expires": "2000-01-01T00:00:00Z"}`, otheruser)
+	req, err = http.NewRequest("PUT", url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Add("Authorization", "sage user:"+testuser)
+
+	rr = httptest.NewRecorder()
+	mainRouter.ServeHTTP(rr, req)
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusUnprocessableEntity)
+	}
+}
+
+func TestPrefixPermission(t *testing.T) {
+
+	grants := []*SAGEBucketPermission{{GranteeType: "USER", Grantee: "otheruser", Permission: "READ", Prefix: "images/validation/"}}
+
+	cases := []struct {
+		action bucketAction
+		key    string
+		want   bool
+	}{
+		{actionReadObject, "images/validation/1.jpg", true},
+		{actionReadObject, "images/validation/sub/2.jpg", true},
+		{actionReadObject, "images/training/1.jpg", false},
+		{actionReadObject, "", false},
+		{actionListObjects, "images/validation/", true},
+		{actionListObjects, "images/", true}, // parent folders can be listed, content is filtered
+		{actionListObjects, "", true},
+		{actionListObjects, "labels/", false},
+		{actionWriteObject, "images/validation/1.jpg", false},
+		{actionReadACL, "", false},
+	}
+
+	for _, c := range cases {
+		got := grantsAllowAction(grants, c.action, c.key)
+		if got != c.want {
+			t.Errorf("prefix grant, action %s, key \"%s\": got %t, want %t", c.action, c.key, got, c.want)
+		}
+	}
+
+	listObject := &s3.ListObjectsV2Output{
+		Contents: []*s3.Object{{Key: aws.String("readme.txt")}},
+		CommonPrefixes: []*s3.CommonPrefix{
+			{Prefix: aws.String("training/")},
+			{Prefix: aws.String("validation/")},
+		},
+	}
+	filterListObject(&bucketAccess{username: "otheruser", grants: grants}, "/images/", listObject)
+
+	if len(listObject.Contents) != 0 {
+		t.Errorf("expected no files, got %d", len(listObject.Contents))
+	}
+	if len(listObject.CommonPrefixes) != 1 || *listObject.CommonPrefixes[0].Prefix != "validation/" {
+		t.Errorf("expected only folder validation/, got %v", listObject.CommonPrefixes)
+	}
+}
+
+func TestPrefixPermissionDownload(t *testing.T) {
+
+	testuser := "testuser"
+	otheruser := "otheruser"
+
+	newBucket, err := createSageBucket(testuser, "training-data", "testing-bucket1", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bucketID := newBucket.ID
+
+	for _, key := range []string{"images/validation/1.jpg", "images/training/1.jpg"} {
+		err = CreateFile(t, bucketID, testuser, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	body := `{"granteeType": "USER", "grantee": "otheruser", "permission": "READ", "prefix": "images/validation/"}`
+	url := fmt.Sprintf("/api/v1/objects/%s?permissions", bucketID)
+	req, err := http.NewRequest("PUT", url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Add("Authorization", "sage user:"+testuser)
+	rr := httptest.NewRecorder()
+	mainRouter.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v (%s)", rr.Code, http.StatusOK, rr.Body.String())
+	}
+
+	expected := map[string]int{
+		"images/validation/1.jpg": http.StatusOK,
+		"images/training/1.jpg":   http.StatusForbidden,
+	}
+	for key, wantCode := range expected {
+		req, err = http.NewRequest("GET", fmt.Sprintf("/api/v1/objects/%s/%s", bucketID, key), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Add("Authorization", "sage user:"+otheruser)
+		rr = httptest.NewRecorder()
+		mainRouter.ServeHTTP(rr, req)
+		if rr.Code != wantCode {
+			t.Errorf("download of %s: got %v want %v", key, rr.Code, wantCode)
+		}
+	}
+
+	req, err = http.NewRequest("GET", fmt.Sprintf("/api/v1/objects/%s/images/", bucketID), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Add("Authorization", "sage user:"+otheruser)
+	rr = httptest.NewRecorder()
+	mainRouter.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v (%s)", rr.Code, http.StatusOK, rr.Body.String())
+	}
+
+	listing := FolderListing{}
+	err = json.Unmarshal(rr.Body.Bytes(), &listing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listing.Folders) != 1 || listing.Folders[0] != "validation/" {
+		t.Fatalf("expected only folder validation/, got: %s", rr.Body.String())
+	}
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// BucketPolicy is an optional S3-style policy document stored per bucket.
+// Policies are evaluated together with the grants in BucketPermissions:
+// an explicit Deny always wins, otherwise an Allow from either source is sufficient.
+type BucketPolicy struct {
+	ErrorStruct `json:",inline"`
+	Version     string             `json:"Version,omitempty"`
+	Statement   []*PolicyStatement `json:"Statement"`
+}
+
+// PolicyStatement _
+type PolicyStatement struct {
+	Sid       string       `json:"Sid,omitempty"`
+	Effect    string       `json:"Effect"`    // Allow or Deny
+	Principal stringOrList `json:"Principal"` // "*", "USER:<name>" or "GROUP:<name>"
+	Action    stringOrList `json:"Action"`    // bucket actions, e.g. "read_object", or "*"
+	Resource  stringOrList `json:"Resource"`  // key prefix, or glob if it contains * or ?
+}
+
+// stringOrList accepts a JSON string or a JSON array of strings
+type stringOrList []string
+
+// UnmarshalJSON _
+func (s *stringOrList) UnmarshalJSON(data []byte) (err error) {
+	var single string
+	if json.Unmarshal(data, &single) == nil {
+		*s = stringOrList{single}
+		return
+	}
+	var list []string
+	err = json.Unmarshal(data, &list)
+	if err != nil {
+		err = fmt.Errorf("expected string or list of strings")
+		return
+	}
+	*s = stringOrList(list)
+	return
+}
+
+type policyDecision int
+
+const (
+	policyNoMatch policyDecision = iota
+	policyAllow
+	policyDeny
+)
+
+// policyExcludedActions cannot be controlled by policies, so that a policy can never lock
+// the bucket owner out of the permissions and the policy itself
+var policyExcludedActions = map[bucketAction]bool{
+	actionReadACL:  true,
+	actionWriteACL: true,
+}
+
+// validate checks a policy document before it is stored
+func (p *BucketPolicy) validate() (err error) {
+
+	if len(p.Statement) == 0 {
+		err = fmt.Errorf("policy has no statements")
+		return
+	}
+
+	for i, st := range p.Statement {
+		if st.Effect != "Allow" && st.Effect != "Deny" {
+			err = fmt.Errorf("statement %d: Effect must be \"Allow\" or \"Deny\"", i)
+			return
+		}
+		if len(st.Principal) == 0 || len(st.Action) == 0 || len(st.Resource) == 0 {
+			err = fmt.Errorf("statement %d: Principal, Action and Resource are required", i)
+			return
+		}
+
+		isPublic := false
+		for _, principal := range st.Principal {
+			if principal == "*" || principal == "GROUP:AllUsers" {
+				isPublic = true
+				continue
+			}
+			if !strings.HasPrefix(principal, "USER:") && !strings.HasPrefix(principal, "GROUP:") {
+				err = fmt.Errorf("statement %d: Principal %s must be \"*\", \"USER:<name>\" or \"GROUP:<name>\"", i, principal)
+				return
+			}
+		}
+
+		for _, a := range st.Action {
+			if a == "*" {
+				if isPublic && st.Effect == "Allow" {
+					err = fmt.Errorf("statement %d: public principals can only be allowed %s and %s", i, actionReadObject, actionListObjects)
+					return
+				}
+				continue
+			}
+			action := bucketAction(a)
+			if _, known := actionPermissions[action]; !known {
+				err = fmt.Errorf("statement %d: unknown Action %s", i, a)
+				return
+			}
+			if policyExcludedActions[action] {
+				err = fmt.Errorf("statement %d: Action %s cannot be used in policies, use bucket permissions instead", i, a)
+				return
+			}
+			if isPublic && st.Effect == "Allow" && !publicActions[action] {
+				err = fmt.Errorf("statement %d: public principals can only be allowed %s and %s", i, actionReadObject, actionListObjects)
+				return
+			}
+		}
+
+		for _, resource := range st.Resource {
+			_, err = regexp.Compile(globToRegexp(resource))
+			if err != nil {
+				err = fmt.Errorf("statement %d: invalid Resource %s: %s", i, resource, err.Error())
+				return
+			}
+		}
+	}
+
+	return
+}
+
+// globToRegexp converts a resource pattern, "*" matches any sequence of characters (including "/")
+// and "?" a single character. Patterns without wildcards are prefixes.
+func globToRegexp(pattern string) string {
+	if !strings.ContainsAny(pattern, "*?") {
+		return "^" + regexp.QuoteMeta(pattern)
+	}
+	re := "^"
+	for _, c := range pattern {
+		switch c {
+		case '*':
+			re += ".*"
+		case '?':
+			re += "."
+		default:
+			re += regexp.QuoteMeta(string(c))
+		}
+	}
+	return re + "$"
+}
+
+// resourceMatches returns true if the resource pattern covers the key
+func resourceMatches(pattern string, key string) bool {
+	matched, err := regexp.MatchString(globToRegexp(pattern), key)
+	return err == nil && matched
+}
+
+// resourceMayMatchBelow returns true if the resource pattern could match keys within the folder
+func resourceMayMatchBelow(pattern string, folder string) bool {
+	literal := pattern
+	if i := strings.IndexAny(pattern, "*?"); i >= 0 {
+		literal = pattern[:i]
+	}
+	return strings.HasPrefix(literal, folder) || strings.HasPrefix(folder, literal)
+}
+
+func (st *PolicyStatement) matchesPrincipal(username string) bool {
+	for _, principal := range st.Principal {
+		switch {
+		case principal == "*", principal == "GROUP:AllUsers":
+			return true
+		case username != "" && principal == "USER:"+username:
+			return true
+		}
+		// TODO: infer group memberships
+	}
+	return false
+}
+
+func (st *PolicyStatement) matchesAction(action bucketAction) bool {
+	for _, a := range st.Action {
+		if a == "*" || bucketAction(a) == action {
+			return true
+		}
+	}
+	return false
+}
+
+// evaluate returns the decision of the policy for the action on the key.
+// Like grants, a list_objects Allow also applies to folders that contain matching keys.
+func (p *BucketPolicy) evaluate(username string, action bucketAction, key string) (decision policyDecision) {
+
+	decision = policyNoMatch
+	if p == nil || policyExcludedActions[action] {
+		return
+	}
+
+	for _, st := range p.Statement {
+		if !st.matchesPrincipal(username) || !st.matchesAction(action) {
+			continue
+		}
+
+		matches := false
+		for _, resource := range st.Resource {
+			if resourceMatches(resource, key) {
+				matches = true
+				break
+			}
+			if st.Effect == "Allow" && action == actionListObjects && resourceMayMatchBelow(resource, key) {
+				matches = true
+				break
+			}
+		}
+		if !matches {
+			continue
+		}
+
+		if st.Effect == "Deny" {
+			decision = policyDeny
+			return
+		}
+		decision = policyAllow
+	}
+
+	return
+}
+
+// getBucketPolicy returns the policy of the bucket, or nil if it has none
+func getBucketPolicy(bucketID string) (policy *BucketPolicy, err error) {
+
+	db, err := sql.Open("mysql", mysqlDSN)
+	if err != nil {
+		err = fmt.Errorf("Unable to connect to database: %v", err)
+		return
+	}
+	defer db.Close()
+
+	var policyStr string
+	queryStr := "SELECT policy FROM BucketPolicies WHERE id=UUID_TO_BIN(?) ;"
+	err = db.QueryRow(queryStr, bucketID).Scan(&policyStr)
+	switch {
+	case err == sql.ErrNoRows:
+		err = nil
+		return
+	case err != nil:
+		err = fmt.Errorf("(getBucketPolicy) Could not parse row: %s", err.Error())
+		return
+	}
+
+	policy = &BucketPolicy{}
+	err = json.Unmarshal([]byte(policyStr), policy)
+	if err != nil {
+		err = fmt.Errorf("(getBucketPolicy) stored policy invalid: %s", err.Error())
+		return
+	}
+	return
+}
+
+// putBucketPolicy creates or replaces the policy of the bucket
+func putBucketPolicy(bucketID string, policy *BucketPolicy) (err error) {
+
+	policyBytes, err := json.Marshal(policy)
+	if err != nil {
+		return
+	}
+
+	db, err := sql.Open("mysql", mysqlDSN)
+	if err != nil {
+		err = fmt.Errorf("Unable to connect to database: %v", err)
+		return
+	}
+	defer db.Close()
+
+	insertQueryStr := "INSERT INTO BucketPolicies (id, policy) VALUES ( UUID_TO_BIN(?), ? ) ON DUPLICATE KEY UPDATE policy=VALUES(policy) ;"
+	_, err = db.Exec(insertQueryStr, bucketID, string(policyBytes))
+	if err != nil {
+		err = fmt.Errorf("Storing bucket policy failed: %s", err.Error())
+		return
+	}
+	return
+}
+
+// deleteBucketPolicy removes the policy of the bucket, deleted is false if there was none
+func deleteBucketPolicy(bucketID string) (deleted bool, err error) {
+
+	db, err := sql.Open("mysql", mysqlDSN)
+	if err != nil {
+		err = fmt.Errorf("Unable to connect to database: %v", err)
+		return
+	}
+	defer db.Close()
+
+	result, err := db.Exec("DELETE FROM BucketPolicies WHERE id=UUID_TO_BIN(?) ;", bucketID)
+	if err != nil {
+		err = fmt.Errorf("Removing bucket policy failed: %s", err.Error())
+		return
+	}
+
+	deletedNumber, err := result.RowsAffected()
+	if err != nil {
+		err = fmt.Errorf("result.RowsAffected returned: %s", err.Error())
+		return
+	}
+	deleted = deletedNumber > 0
+	return
+}
+
+// GET /objects/{bucket}?policy
+func getBucketPolicyRequest(w http.ResponseWriter, username string, sageBucketID string) {
+
+	allowed, err := userIsAllowed(username, sageBucketID, actionReadACL, "")
+	if err != nil {
+		respondError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if !allowed {
+		respondJSONError(w, deniedStatus(username), "Access to bucket policy denied (%s, %s)", username, sageBucketID)
+		return
+	}
+
+	policy, err := getBucketPolicy(sageBucketID)
+	if err != nil {
+		respondError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if policy == nil {
+		respondJSONError(w, http.StatusNotFound, "Bucket %s has no policy", sageBucketID)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, policy)
+}
+
+// PUT /objects/{bucket}?policy
+func putBucketPolicyRequest(w http.ResponseWriter, r *http.Request, username string, sageBucketID string) {
+
+	allowed, err := userIsAllowed(username, sageBucketID, actionWriteACL, "")
+	if err != nil {
+		respondError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if !allowed {
+		respondJSONError(w, deniedStatus(username), "Write access to bucket policy denied (%s, %s)", username, sageBucketID)
+		return
+	}
+
+	policy := &BucketPolicy{}
+	err = json.NewDecoder(r.Body).Decode(policy)
+	if err != nil {
+		respondJSONError(w, http.StatusBadRequest, "Could not parse json: %s", err.Error())
+		return
+	}
+
+	err = policy.validate()
+	if err != nil {
+		respondJSONError(w, http.StatusUnprocessableEntity, "Invalid policy: %s", err.Error())
+		return
+	}
+
+	err = putBucketPolicy(sageBucketID, policy)
+	if err != nil {
+		respondError(w, err, http.StatusInternalServerError)
+		return
+	}
+	log.Printf("bucket policy of %s updated by %s", sageBucketID, username)
+
+	respondJSON(w, http.StatusOK, policy)
+}
+
+// DELETE /objects/{bucket}?policy
+func deleteBucketPolicyRequest(w http.ResponseWriter, username string, sageBucketID string) {
+
+	allowed, err := userIsAllowed(username, sageBucketID, actionWriteACL, "")
+	if err != nil {
+		respondError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if !allowed {
+		respondJSONError(w, deniedStatus(username), "Write access to bucket policy denied (%s, %s)", username, sageBucketID)
+		return
+	}
+
+	deleted, err := deleteBucketPolicy(sageBucketID)
+	if err != nil {
+		respondError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	dr := DeleteRespsonse{}
+	dr.Deleted = []string{}
+	if deleted {
+		dr.Deleted = append(dr.Deleted, "policy")
+	}
+	respondJSON(w, http.StatusOK, dr)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPolicyEvaluation(t *testing.T) {
+
+	policyStr := `{
+		"Statement": [
+			{"Effect": "Allow", "Principal": "*", "Action": ["read_object", "list_objects"], "Resource": "*.json"},
+			{"Effect": "Allow", "Principal": "USER:groupmember", "Action": "write_object", "Resource": "*"},
+			{"Effect": "Deny", "Principal": "USER:groupmember", "Action": "delete_object", "Resource": "*"},
+			{"Effect": "Deny", "Principal": "*", "Action": "*", "Resource": "secret/"}
+		]
+	}`
+
+	policy := &BucketPolicy{}
+	err := json.Unmarshal([]byte(policyStr), policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = policy.validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		username string
+		action   bucketAction
+		key      string
+		want     policyDecision
+	}{
+		{"", actionReadObject, "data/a.json", policyAllow},
+		{"", actionReadObject, "data/a.jpg", policyNoMatch},
+		{"", actionListObjects, "data/", policyAllow},
+		{"", actionWriteObject, "data/a.json", policyNoMatch},
+		{"groupmember", actionWriteObject, "data/a.jpg", policyAllow},
+		{"groupmember", actionDeleteObject, "data/a.jpg", policyDeny},
+		{"groupmember", actionReadObject, "secret/a.json", policyDeny},
+		{"groupmember", actionReadACL, "", policyNoMatch},
+	}
+
+	for _, c := range cases {
+		got := policy.evaluate(c.username, c.action, c.key)
+		if got != c.want {
+			t.Errorf("user \"%s\", action %s, key \"%s\": got %d, want %d", c.username, c.action, c.key, got, c.want)
+		}
+	}
+
+	// Deny wins over grants
+	access := &bucketAccess{
+		username: "groupmember",
+		grants:   []*SAGEBucketPermission{{GranteeType: "USER", Grantee: "groupmember", Permission: "FULL_CONTROL"}},
+		policy:   policy,
+	}
+	if access.allows(actionDeleteObject, "data/a.jpg") {
+		t.Error("policy Deny should override FULL_CONTROL grant")
+	}
+	if !access.allows(actionDeleteBucket, "") {
+		t.Error("FULL_CONTROL grant should still allow actions not denied by policy")
+	}
+}
+
+func TestPolicyValidation(t *testing.T) {
+
+	invalid := []string{
+		`{"Statement": []}`,
+		`{"Statement": [{"Effect": "Maybe", "Principal": "*", "Action": "read_object", "Resource": "*"}]}`,
+		`{"Statement": [{"Effect": "Allow", "Principal": "*", "Action": "write_object", "Resource": "*"}]}`,
+		`{"Statement": [{"Effect": "Allow", "Principal": "GROUP:AllUsers", "Action": "*", "Resource": "*"}]}`,
+		`{"Statement": [{"Effect": "Allow", "Principal": "USER:x", "Action": "write_acl", "Resource": "*"}]}`,
+		`{"Statement": [{"Effect": "Allow", "Principal": "USER:x", "Action": "fly", "Resource": "*"}]}`,
+		`{"Statement": [{"Effect": "Allow", "Principal": "x", "Action": "read_object", "Resource": "*"}]}`,
+	}
+
+	for _, policyStr := range invalid {
+		policy := &BucketPolicy{}
+		err := json.Unmarshal([]byte(policyStr), policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if policy.validate() == nil {
+			t.Errorf("policy should be invalid: %s", policyStr)
+		}
+	}
+}
+
+// curl -X PUT "localhost:8080/api/v1/objects/${BUCKET_ID}?policy" -d '{"Statement": [...]}'
+func TestBucketPolicyRequests(t *testing.T) {
+
+	testuser := "testuser"
+
+	newBucket, err := createSageBucket(testuser, "training-data", "testing-bucket1", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bucketID := newBucket.ID
+
+	err = CreateFile(t, bucketID, testuser, "data/a.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	url := fmt.Sprintf("/api/v1/objects/%s?policy", bucketID)
+
+	body := `{"Statement": [{"Effect": "Allow", "Principal": "*", "Action": "read_object", "Resource": "*.json"}]}`
+	req, err := http.NewRequest("PUT", url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Add("Authorization", "sage user:"+testuser)
+	rr := httptest.NewRecorder()
+	mainRouter.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v (%s)", rr.Code, http.StatusOK, rr.Body.String())
+	}
+
+	// anonymous download allowed by policy
+	req, err = http.NewRequest("GET", fmt.Sprintf("/api/v1/objects/%s/data/a.json", bucketID), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	mainRouter.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v (%s)", rr.Code, http.StatusOK, rr.Body.String())
+	}
+
+	req, err = http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Add("Authorization", "sage user:"+testuser)
+	rr = httptest.NewRecorder()
+	mainRouter.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v (%s)", rr.Code, http.StatusOK, rr.Body.String())
+	}
+
+	req, err = http.NewRequest("DELETE", url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Add("Authorization", "sage user:"+testuser)
+	rr = httptest.NewRecorder()
+	mainRouter.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v (%s)", rr.Code, http.StatusOK, rr.Body.String())
+	}
+
+	policy, err := getBucketPolicy(bucketID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if policy != nil {
+		t.Fatal("policy should have been deleted")
+	}
+}
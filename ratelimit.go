@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	rateLimitRequestsPerSecond   float64 // 0: no request rate limit
+	rateLimitBurst               = 20
+	rateLimitConcurrentUploads   = 0 // 0: unlimited
+	rateLimitConcurrentDownloads = 0 // 0: unlimited
+
+	limiters = &identityLimiters{entries: map[string]*identityLimiter{}}
+)
+
+// identityLimiter token bucket and concurrency counters of one identity (user or anonymous client IP)
+type identityLimiter struct {
+	tokens          float64
+	lastRefill      time.Time
+	activeUploads   int
+	activeDownloads int
+}
+
+type identityLimiters struct {
+	sync.Mutex
+	entries   map[string]*identityLimiter
+	lastSweep time.Time
+}
+
+// get returns the limiter of the identity, the caller has to hold the lock
+func (l *identityLimiters) get(identity string, now time.Time) *identityLimiter {
+
+	// forget idle identities from time to time, a new limiter starts with a full bucket anyway
+	if now.Sub(l.lastSweep) > 10*time.Minute {
+		for id, e := range l.entries {
+			if e.activeUploads == 0 && e.activeDownloads == 0 && now.Sub(e.lastRefill) > 10*time.Minute {
+				delete(l.entries, id)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	e, ok := l.entries[identity]
+	if !ok {
+		e = &identityLimiter{tokens: float64(rateLimitBurst), lastRefill: now}
+		l.entries[identity] = e
+	}
+	return e
+}
+
+// takeToken returns false and the time to wait if the identity exceeded its request rate
+func (e *identityLimiter) takeToken(now time.Time) (ok bool, retryAfter time.Duration) {
+
+	if rateLimitRequestsPerSecond <= 0 {
+		return true, 0
+	}
+
+	e.tokens += now.Sub(e.lastRefill).Seconds() * rateLimitRequestsPerSecond
+	if e.tokens > float64(rateLimitBurst) {
+		e.tokens = float64(rateLimitBurst)
+	}
+	e.lastRefill = now
+
+	if e.tokens < 1 {
+		retryAfter = time.Duration((1 - e.tokens) / rateLimitRequestsPerSecond * float64(time.Second))
+		return false, retryAfter
+	}
+	e.tokens--
+	return true, 0
+}
+
+// transferKind classifies requests that are subject to the concurrency limits: "upload", "download" or ""
+func transferKind(r *http.Request) string {
+
+	if r.Method == http.MethodPatch && strings.HasPrefix(r.URL.Path, "/api/v1/tus/") {
+		return "upload"
+	}
+
+	// S3-compatible endpoint
+	if s3Key := mux.Vars(r)["key"]; s3Key != "" {
+		switch r.Method {
+		case http.MethodPut:
+			return "upload"
+		case http.MethodGet:
+			if !strings.Contains(r.URL.RawQuery, "uploadId") {
+				return "download"
+			}
+		}
+		return ""
+	}
+
+	if strings.HasPrefix(r.URL.Path, webdavPrefix+"/") || strings.HasPrefix(r.URL.Path, apiV2Prefix+"/files/") {
+		switch r.Method {
+		case http.MethodPut:
+			return "upload"
+		case http.MethodGet:
+			return "download"
+		}
+		return ""
+	}
+
+	_, sagePath, err := getSagePath(r.URL.Path)
+	if err != nil || sagePath == "" {
+		return ""
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		return "upload"
+	case http.MethodGet:
+		if !strings.HasSuffix(sagePath, "/") || strings.Contains(r.URL.RawQuery, "archive=") {
+			return "download"
+		}
+	}
+	return ""
+}
+
+// rateLimitIdentity is the username, or the client address for anonymous requests
+func rateLimitIdentity(r *http.Request) string {
+	username := mux.Vars(r)["username"]
+	if username != "" {
+		return "user:" + username
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+func rejectRateLimited(w http.ResponseWriter, reason string, retryAfter time.Duration, msg string) {
+	rateLimitRejections.With(prometheus.Labels{"reason": reason}).Inc()
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	respondJSONError(w, http.StatusTooManyRequests, msg)
+}
+
+// rateLimitMW has to run after authMW, it enforces per-identity request rate and concurrent transfer limits
+func rateLimitMW(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+
+	identity := rateLimitIdentity(r)
+	kind := transferKind(r)
+	now := time.Now()
+
+	limiters.Lock()
+	e := limiters.get(identity, now)
+
+	ok, retryAfter := e.takeToken(now)
+	remaining := int(e.tokens)
+
+	header := w.Header()
+	if rateLimitRequestsPerSecond > 0 {
+		header.Set("X-RateLimit-Limit", strconv.FormatFloat(rateLimitRequestsPerSecond, 'f', -1, 64))
+		header.Set("X-RateLimit-Burst", strconv.Itoa(rateLimitBurst))
+		header.Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+	}
+	if rateLimitConcurrentUploads > 0 {
+		header.Set("X-RateLimit-Concurrent-Uploads", strconv.Itoa(rateLimitConcurrentUploads))
+	}
+	if rateLimitConcurrentDownloads > 0 {
+		header.Set("X-RateLimit-Concurrent-Downloads", strconv.Itoa(rateLimitConcurrentDownloads))
+	}
+
+	if !ok {
+		limiters.Unlock()
+		rejectRateLimited(w, "rate", retryAfter, fmt.Sprintf("Request rate limit of %g requests per second exceeded", rateLimitRequestsPerSecond))
+		return
+	}
+
+	switch {
+	case kind == "upload" && rateLimitConcurrentUploads > 0:
+		if e.activeUploads >= rateLimitConcurrentUploads {
+			limiters.Unlock()
+			rejectRateLimited(w, "concurrent_uploads", time.Second, fmt.Sprintf("Limit of %d concurrent uploads reached", rateLimitConcurrentUploads))
+			return
+		}
+		e.activeUploads++
+		defer func() {
+			limiters.Lock()
+			e.activeUploads--
+			limiters.Unlock()
+		}()
+	case kind == "download" && rateLimitConcurrentDownloads > 0:
+		if e.activeDownloads >= rateLimitConcurrentDownloads {
+			limiters.Unlock()
+			rejectRateLimited(w, "concurrent_downloads", time.Second, fmt.Sprintf("Limit of %d concurrent downloads reached", rateLimitConcurrentDownloads))
+			return
+		}
+		e.activeDownloads++
+		defer func() {
+			limiters.Lock()
+			e.activeDownloads--
+			limiters.Unlock()
+		}()
+	}
+	limiters.Unlock()
+
+	next(w, r)
+}
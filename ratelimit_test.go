@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRateLimitRequests(t *testing.T) {
+
+	rateLimitRequestsPerSecond = 0.001
+	rateLimitBurst = 2
+	defer func() {
+		rateLimitRequestsPerSecond = 0
+		rateLimitBurst = 20
+	}()
+
+	next := func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	expected := []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests}
+	for i, want := range expected {
+		req, err := http.NewRequest("GET", "/api/v1/objects", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.RemoteAddr = "192.0.2.1:1234"
+
+		rr := httptest.NewRecorder()
+		rateLimitMW(rr, req, next)
+
+		if rr.Code != want {
+			t.Fatalf("request %d: got %d, want %d", i, rr.Code, want)
+		}
+		if rr.Header().Get("X-RateLimit-Limit") == "" {
+			t.Fatalf("request %d: X-RateLimit-Limit header missing", i)
+		}
+		if want == http.StatusTooManyRequests && rr.Header().Get("Retry-After") == "" {
+			t.Fatalf("request %d: Retry-After header missing", i)
+		}
+	}
+
+	// other identities are not affected
+	req, err := http.NewRequest("GET", "/api/v1/objects", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.RemoteAddr = "192.0.2.2:1234"
+	rr := httptest.NewRecorder()
+	rateLimitMW(rr, req, next)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("other client: got %d, want %d", rr.Code, http.StatusOK)
+	}
+}
+
+func TestRateLimitConcurrentDownloads(t *testing.T) {
+
+	rateLimitConcurrentDownloads = 1
+	defer func() {
+		rateLimitConcurrentDownloads = 0
+	}()
+
+	url := "/api/v1/objects/6dd46856-c871-4089-b1bc-a12b44e92c81/file.txt"
+
+	var innerCode int
+	next := func(w http.ResponseWriter, r *http.Request) {
+		// second download while the first one is still running
+		req, _ := http.NewRequest("GET", url, nil)
+		req.RemoteAddr = "192.0.2.3:1234"
+		rr := httptest.NewRecorder()
+		rateLimitMW(rr, req, func(w http.ResponseWriter, r *http.Request) {})
+		innerCode = rr.Code
+		w.WriteHeader(http.StatusOK)
+	}
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.RemoteAddr = "192.0.2.3:1234"
+	rr := httptest.NewRecorder()
+	rateLimitMW(rr, req, next)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("first download: got %d, want %d", rr.Code, http.StatusOK)
+	}
+	if innerCode != http.StatusTooManyRequests {
+		t.Fatalf("concurrent download: got %d, want %d", innerCode, http.StatusTooManyRequests)
+	}
+}
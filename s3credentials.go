@@ -0,0 +1,236 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// maxS3CredentialsPerUser limits the number of access keys a user can create
+const maxS3CredentialsPerUser = 10
+
+// S3Credential access key pair for the S3-compatible endpoint, the secret is only returned on creation
+type S3Credential struct {
+	ErrorStruct     `json:",inline"`
+	AccessKeyID     string     `json:"access_key_id,omitempty"`
+	SecretAccessKey string     `json:"secret_access_key,omitempty"`
+	Username        string     `json:"username,omitempty"`
+	TimeCreated     *time.Time `json:"time_created,omitempty"`
+}
+
+// randomString returns n characters of the alphabet, chosen with crypto/rand
+func randomString(alphabet string, n int) (s string, err error) {
+	b := make([]byte, n)
+	max := big.NewInt(int64(len(alphabet)))
+	for i := range b {
+		var index *big.Int
+		index, err = rand.Int(rand.Reader, max)
+		if err != nil {
+			return
+		}
+		b[i] = alphabet[index.Int64()]
+	}
+	s = string(b)
+	return
+}
+
+// newS3Credential generates a key pair in the format of AWS access keys
+func newS3Credential(username string) (c *S3Credential, err error) {
+
+	accessKey, err := randomString("ABCDEFGHIJKLMNOPQRSTUVWXYZ234567", 16)
+	if err != nil {
+		return
+	}
+	secretKey, err := randomString("ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/", 40)
+	if err != nil {
+		return
+	}
+
+	c = &S3Credential{AccessKeyID: "SAGE" + accessKey, SecretAccessKey: secretKey, Username: username}
+	return
+}
+
+// getS3Credential returns the key pair of an access key, or nil if it does not exist
+func getS3Credential(accessKey string) (credential *S3Credential, err error) {
+
+	db, err := sql.Open("mysql", mysqlDSN)
+	if err != nil {
+		err = fmt.Errorf("Unable to connect to database: %v", err)
+		return
+	}
+	defer db.Close()
+
+	c := &S3Credential{}
+	queryStr := "SELECT access_key, secret_key, username, time_created FROM S3Credentials WHERE access_key=? ;"
+	err = db.QueryRow(queryStr, accessKey).Scan(&c.AccessKeyID, &c.SecretAccessKey, &c.Username, &c.TimeCreated)
+	switch {
+	case err == sql.ErrNoRows:
+		err = nil
+		return
+	case err != nil:
+		err = fmt.Errorf("(getS3Credential) Could not parse row: %s", err.Error())
+		return
+	}
+	credential = c
+	return
+}
+
+// listS3Credentials returns the access keys of a user without secrets
+func listS3Credentials(username string) (credentials []*S3Credential, err error) {
+
+	db, err := sql.Open("mysql", mysqlDSN)
+	if err != nil {
+		err = fmt.Errorf("Unable to connect to database: %v", err)
+		return
+	}
+	defer db.Close()
+
+	queryStr := "SELECT access_key, username, time_created FROM S3Credentials WHERE username=? ORDER BY time_created ;"
+	rows, err := db.Query(queryStr, username)
+	if err != nil {
+		err = fmt.Errorf("db.Query returned: %s (%s)", err.Error(), queryStr)
+		return
+	}
+	defer rows.Close()
+
+	credentials = []*S3Credential{}
+	for rows.Next() {
+		c := &S3Credential{}
+		err = rows.Scan(&c.AccessKeyID, &c.Username, &c.TimeCreated)
+		if err != nil {
+			err = fmt.Errorf("(listS3Credentials) Could not parse row: %s", err.Error())
+			return
+		}
+		credentials = append(credentials, c)
+	}
+	return
+}
+
+func insertS3Credential(c *S3Credential) (err error) {
+
+	db, err := sql.Open("mysql", mysqlDSN)
+	if err != nil {
+		err = fmt.Errorf("Unable to connect to database: %v", err)
+		return
+	}
+	defer db.Close()
+
+	insertQueryStr := "INSERT INTO S3Credentials (access_key, secret_key, username) VALUES ( ?, ?, ? ) ;"
+	_, err = db.Exec(insertQueryStr, c.AccessKeyID, c.SecretAccessKey, c.Username)
+	if err != nil {
+		err = fmt.Errorf("Storing S3 credential failed: %s", err.Error())
+		return
+	}
+	return
+}
+
+// deleteS3Credential removes an access key of the user, deleted is false if the user has no such key
+func deleteS3Credential(username string, accessKey string) (deleted bool, err error) {
+
+	db, err := sql.Open("mysql", mysqlDSN)
+	if err != nil {
+		err = fmt.Errorf("Unable to connect to database: %v", err)
+		return
+	}
+	defer db.Close()
+
+	result, err := db.Exec("DELETE FROM S3Credentials WHERE access_key=? AND username=? ;", accessKey, username)
+	if err != nil {
+		err = fmt.Errorf("Removing S3 credential failed: %s", err.Error())
+		return
+	}
+
+	deletedNumber, err := result.RowsAffected()
+	if err != nil {
+		err = fmt.Errorf("result.RowsAffected returned: %s", err.Error())
+		return
+	}
+	deleted = deletedNumber > 0
+	return
+}
+
+// POST /s3credentials creates a key pair for the S3-compatible endpoint
+func createS3CredentialRequest(w http.ResponseWriter, r *http.Request) {
+
+	username := mux.Vars(r)["username"]
+	if username == "" {
+		respondJSONError(w, http.StatusUnauthorized, "S3 credentials require authentication")
+		return
+	}
+
+	existing, err := listS3Credentials(username)
+	if err != nil {
+		respondError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if len(existing) >= maxS3CredentialsPerUser {
+		respondJSONError(w, http.StatusConflict, "At most %d S3 credentials per user, delete one first", maxS3CredentialsPerUser)
+		return
+	}
+
+	c, err := newS3Credential(username)
+	if err != nil {
+		respondJSONError(w, http.StatusInternalServerError, "Generating S3 credential failed: %s", err.Error())
+		return
+	}
+
+	err = insertS3Credential(c)
+	if err != nil {
+		respondError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("S3 credential %s created for %s", c.AccessKeyID, username)
+	respondJSON(w, http.StatusOK, c)
+}
+
+// GET /s3credentials lists the access keys of the user
+func listS3CredentialsRequest(w http.ResponseWriter, r *http.Request) {
+
+	username := mux.Vars(r)["username"]
+	if username == "" {
+		respondJSONError(w, http.StatusUnauthorized, "S3 credentials require authentication")
+		return
+	}
+
+	credentials, err := listS3Credentials(username)
+	if err != nil {
+		respondError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, credentials)
+}
+
+// DELETE /s3credentials/{access_key}
+func deleteS3CredentialRequest(w http.ResponseWriter, r *http.Request) {
+
+	vars := mux.Vars(r)
+	username := vars["username"]
+	if username == "" {
+		respondJSONError(w, http.StatusUnauthorized, "S3 credentials require authentication")
+		return
+	}
+
+	accessKey := vars["access_key"]
+	deleted, err := deleteS3Credential(username, accessKey)
+	if err != nil {
+		respondError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if !deleted {
+		respondJSONError(w, http.StatusNotFound, "S3 credential %s not found", accessKey)
+		return
+	}
+
+	log.Printf("S3 credential %s of %s deleted", accessKey, username)
+	dr := DeleteRespsonse{}
+	dr.Deleted = []string{accessKey}
+	respondJSON(w, http.StatusOK, dr)
+}
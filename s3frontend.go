@@ -0,0 +1,1157 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/gorilla/mux"
+	"github.com/urfave/negroni"
+)
+
+// S3-compatible endpoint, path-style requests only:
+//
+// GET    /                                  ListBuckets
+// HEAD   /{bucket}                          HeadBucket
+// GET    /{bucket}?location                 GetBucketLocation
+// GET    /{bucket}?list-type=2              ListObjectsV2 (ListObjects without list-type)
+// GET    /{bucket}?uploads                  ListMultipartUploads
+// POST   /{bucket}?delete                   DeleteObjects
+// GET    /{bucket}/{key}                    GetObject
+// HEAD   /{bucket}/{key}                    HeadObject
+// PUT    /{bucket}/{key}                    PutObject, CopyObject with x-amz-copy-source
+// DELETE /{bucket}/{key}                    DeleteObject
+// POST   /{bucket}/{key}?uploads            CreateMultipartUpload
+// PUT    /{bucket}/{key}?partNumber&uploadId  UploadPart
+// GET    /{bucket}/{key}?uploadId           ListParts
+// POST   /{bucket}/{key}?uploadId           CompleteMultipartUpload
+// DELETE /{bucket}/{key}?uploadId           AbortMultipartUpload
+//
+// Bucket names are the SAGE bucket IDs. Requests are signed with SigV4 using access keys
+// created with POST /api/v1/s3credentials, unsigned requests are anonymous.
+
+var (
+	s3FrontendAddress = "" // e.g. ":9000", empty disables the S3-compatible endpoint
+)
+
+const (
+	s3XMLNamespace  = "http://s3.amazonaws.com/doc/2006-03-01/"
+	s3MaxListKeys   = 1000
+	s3TimeFormatISO = "2006-01-02T15:04:05.000Z"
+)
+
+// s3UnsupportedSubresources bucket and object configuration that has no SAGE equivalent
+var s3UnsupportedSubresources = []string{"acl", "policy", "versioning", "versions", "lifecycle", "cors", "tagging", "website", "replication", "encryption", "object-lock", "retention", "legal-hold", "notification", "logging", "accelerate", "requestPayment", "torrent", "restore", "select"}
+
+// s3APIError error with S3 error code
+type s3APIError struct {
+	statusCode int
+	code       string
+	message    string
+}
+
+func (e *s3APIError) Error() string {
+	return e.code + ": " + e.message
+}
+
+func newS3Error(statusCode int, code string, msg string, args ...interface{}) error {
+	return &s3APIError{statusCode: statusCode, code: code, message: fmt.Sprintf(msg, args...)}
+}
+
+// s3StatusError converts the status code of the shared SAGE functions into an S3 error,
+// permission errors (401 or 403 in the SAGE API) are AccessDenied (403)
+func s3StatusError(statusCode int, notFoundCode string, err error) error {
+	if e, ok := err.(*s3APIError); ok {
+		return e
+	}
+	code := "InternalError"
+	switch statusCode {
+	case http.StatusBadRequest:
+		code = "InvalidRequest"
+	case http.StatusUnprocessableEntity:
+		statusCode = http.StatusBadRequest
+		code = "InvalidArgument"
+	case http.StatusUnauthorized, http.StatusForbidden:
+		statusCode = http.StatusForbidden
+		code = "AccessDenied"
+	case http.StatusNotFound:
+		code = notFoundCode
+	case http.StatusRequestEntityTooLarge:
+		code = "EntityTooLarge"
+	case http.StatusRequestedRangeNotSatisfiable:
+		code = "InvalidRange"
+	case http.StatusTooManyRequests:
+		statusCode = http.StatusServiceUnavailable
+		code = "SlowDown"
+	case http.StatusNotImplemented:
+		code = "NotImplemented"
+	case http.StatusServiceUnavailable:
+		code = "ServiceUnavailable"
+	default:
+		statusCode = http.StatusInternalServerError
+	}
+	return &s3APIError{statusCode: statusCode, code: code, message: err.Error()}
+}
+
+// S3ErrorResponse _
+type S3ErrorResponse struct {
+	XMLName  xml.Name `xml:"Error"`
+	Code     string   `xml:"Code"`
+	Message  string   `xml:"Message"`
+	Resource string   `xml:"Resource,omitempty"`
+}
+
+func respondXML(w http.ResponseWriter, statusCode int, data interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(statusCode)
+
+	s, err := xml.Marshal(data)
+	if err == nil {
+		w.Write([]byte(xml.Header))
+		w.Write(s)
+	}
+}
+
+// respondS3Error errors that are not an s3APIError are reported as InternalError
+func respondS3Error(w http.ResponseWriter, r *http.Request, err error) {
+	e, ok := err.(*s3APIError)
+	if !ok {
+		e = &s3APIError{statusCode: http.StatusInternalServerError, code: "InternalError", message: err.Error()}
+	}
+	log.Printf("Reply to S3 client: %d %s", e.statusCode, e.Error())
+	w.Header().Del("Content-Length")
+	if r.Method == http.MethodHead {
+		w.WriteHeader(e.statusCode)
+		return
+	}
+	respondXML(w, e.statusCode, &S3ErrorResponse{Code: e.code, Message: e.message, Resource: r.URL.Path})
+}
+
+// s3ErrorWriter replaces the JSON errors of the shared SAGE handlers (downloads, rate limits) with S3 XML errors
+type s3ErrorWriter struct {
+	http.ResponseWriter
+	r          *http.Request
+	statusCode int
+	buffer     bytes.Buffer
+}
+
+func (e *s3ErrorWriter) WriteHeader(statusCode int) {
+	if statusCode >= 400 && e.Header().Get("Content-Type") == "application/json" {
+		e.statusCode = statusCode
+		return
+	}
+	e.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (e *s3ErrorWriter) Write(p []byte) (int, error) {
+	if e.statusCode != 0 {
+		return e.buffer.Write(p)
+	}
+	return e.ResponseWriter.Write(p)
+}
+
+func (e *s3ErrorWriter) finish() {
+	if e.statusCode == 0 {
+		return
+	}
+	errorStruct := &ErrorStruct{}
+	json.Unmarshal(e.buffer.Bytes(), errorStruct)
+	respondS3Error(e.ResponseWriter, e.r, s3StatusError(e.statusCode, "NoSuchKey", fmt.Errorf("%s", errorStruct.Error)))
+}
+
+func s3ErrorMW(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	ew := &s3ErrorWriter{ResponseWriter: w, r: r}
+	next(ew, r)
+	ew.finish()
+}
+
+// s3PayloadBody records the first S3 error of the payload verification, the upload functions only see a failed read
+type s3PayloadBody struct {
+	io.Reader
+	io.Closer
+	err error
+}
+
+func (b *s3PayloadBody) Read(p []byte) (n int, err error) {
+	n, err = b.Reader.Read(p)
+	if _, ok := err.(*s3APIError); ok && b.err == nil {
+		b.err = err
+	}
+	return
+}
+
+// s3PayloadError returns the payload verification error if there was one, otherwise err
+func s3PayloadError(r *http.Request, err error) error {
+	if b, ok := r.Body.(*s3PayloadBody); ok && b.err != nil {
+		return b.err
+	}
+	return err
+}
+
+// s3AuthMW verifies SigV4 signatures and sets the username of the access key, unsigned requests are anonymous
+func s3AuthMW(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+
+	vars := mux.Vars(r)
+	vars["username"] = ""
+
+	auth, err := parseSigV4(r)
+	if err != nil {
+		respondS3Error(w, r, err)
+		return
+	}
+	if auth == nil {
+		next(w, r)
+		return
+	}
+
+	credential, err := getS3Credential(auth.accessKey)
+	if err != nil {
+		respondS3Error(w, r, err)
+		return
+	}
+	if credential == nil {
+		respondS3Error(w, r, newS3Error(http.StatusForbidden, "InvalidAccessKeyId", "The AWS Access Key Id you provided does not exist in our records"))
+		return
+	}
+
+	err = auth.verify(r, credential.SecretAccessKey, time.Now())
+	if err != nil {
+		respondS3Error(w, r, err)
+		return
+	}
+
+	body, err := auth.payloadReader(r, credential.SecretAccessKey)
+	if err != nil {
+		respondS3Error(w, r, err)
+		return
+	}
+	r.Body = &s3PayloadBody{Reader: body, Closer: r.Body}
+
+	vars["username"] = credential.Username
+	next(w, r)
+}
+
+// s3SageKey maps an S3 key to a SAGE path, keys that would leave the bucket are rejected
+func s3SageKey(key string) (sagePath string, err error) {
+	sagePath = "/" + key
+	cleaned := path.Clean(sagePath)
+	if key == "" || strings.ContainsRune(key, 0) || cleaned != strings.TrimSuffix(sagePath, "/") {
+		err = newS3Error(http.StatusBadRequest, "InvalidArgument", "invalid key %q", key)
+		return
+	}
+	return
+}
+
+// s3CheckBucket the bucket name has to be the ID of an existing SAGE bucket
+func s3CheckBucket(sageBucketID string) (err error) {
+	if len(sageBucketID) != 36 {
+		err = newS3Error(http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist")
+		return
+	}
+	_, err = GetSageBucket(sageBucketID)
+	if err != nil {
+		if errorStatus(err, http.StatusInternalServerError) == http.StatusNotFound {
+			err = newS3Error(http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist")
+		}
+		return
+	}
+	return
+}
+
+// s3CheckAccess returns AccessDenied if the user may not perform the action
+func s3CheckAccess(username string, sageBucketID string, action bucketAction, key string) (err error) {
+	allowed, err := userIsAllowed(username, sageBucketID, action, key)
+	if err != nil {
+		return
+	}
+	if !allowed {
+		err = newS3Error(http.StatusForbidden, "AccessDenied", "Access denied (%s, %s)", action, key)
+		return
+	}
+	return
+}
+
+func s3HasSubresource(query url.Values, names ...string) string {
+	for _, name := range names {
+		if _, ok := query[name]; ok {
+			return name
+		}
+	}
+	return ""
+}
+
+// headSageObject returns the S3 metadata of a SAGE file
+func headSageObject(sageBucketID string, sagePath string) (head *s3.HeadObjectOutput, err error) {
+	s3Key := path.Join(sageBucketID, sagePath)
+	if strings.HasSuffix(sagePath, "/") {
+		s3Key += "/"
+	}
+	head, err = svc.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(getS3BucketID(sageBucketID)),
+		Key:    aws.String(s3Key),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && (aerr.Code() == "NotFound" || aerr.Code() == s3.ErrCodeNoSuchKey) {
+			err = newS3Error(http.StatusNotFound, "NoSuchKey", "The specified key does not exist")
+		}
+		return
+	}
+	return
+}
+
+// ---------- XML documents ----------
+
+// S3Owner _
+type S3Owner struct {
+	ID          string `xml:"ID"`
+	DisplayName string `xml:"DisplayName"`
+}
+
+// S3ListAllMyBucketsResult _
+type S3ListAllMyBucketsResult struct {
+	XMLName xml.Name   `xml:"ListAllMyBucketsResult"`
+	Xmlns   string     `xml:"xmlns,attr"`
+	Owner   S3Owner    `xml:"Owner"`
+	Buckets []S3Bucket `xml:"Buckets>Bucket"`
+}
+
+// S3Bucket _
+type S3Bucket struct {
+	Name         string `xml:"Name"`
+	CreationDate string `xml:"CreationDate,omitempty"`
+}
+
+// S3Object entry of an object listing
+type S3Object struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int64  `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+// S3CommonPrefix _
+type S3CommonPrefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+// S3ListBucketResult response of ListObjects and ListObjectsV2, the fields of the other version are omitted
+type S3ListBucketResult struct {
+	XMLName               xml.Name         `xml:"ListBucketResult"`
+	Xmlns                 string           `xml:"xmlns,attr"`
+	Name                  string           `xml:"Name"`
+	Prefix                string           `xml:"Prefix"`
+	Marker                *string          `xml:"Marker"`
+	NextMarker            string           `xml:"NextMarker,omitempty"`
+	StartAfter            string           `xml:"StartAfter,omitempty"`
+	ContinuationToken     string           `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string           `xml:"NextContinuationToken,omitempty"`
+	KeyCount              *int64           `xml:"KeyCount"`
+	MaxKeys               int64            `xml:"MaxKeys"`
+	Delimiter             string           `xml:"Delimiter,omitempty"`
+	EncodingType          string           `xml:"EncodingType,omitempty"`
+	IsTruncated           bool             `xml:"IsTruncated"`
+	Contents              []S3Object       `xml:"Contents"`
+	CommonPrefixes        []S3CommonPrefix `xml:"CommonPrefixes"`
+}
+
+// S3Delete request of DeleteObjects
+type S3Delete struct {
+	Quiet   bool `xml:"Quiet"`
+	Objects []struct {
+		Key string `xml:"Key"`
+	} `xml:"Object"`
+}
+
+// S3DeleteResult _
+type S3DeleteResult struct {
+	XMLName xml.Name        `xml:"DeleteResult"`
+	Xmlns   string          `xml:"xmlns,attr"`
+	Deleted []S3DeletedKey  `xml:"Deleted"`
+	Errors  []S3DeleteError `xml:"Error"`
+}
+
+// S3DeletedKey _
+type S3DeletedKey struct {
+	Key string `xml:"Key"`
+}
+
+// S3DeleteError _
+type S3DeleteError struct {
+	Key     string `xml:"Key"`
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+// S3CopyObjectResult _
+type S3CopyObjectResult struct {
+	XMLName      xml.Name `xml:"CopyObjectResult"`
+	Xmlns        string   `xml:"xmlns,attr"`
+	LastModified string   `xml:"LastModified"`
+	ETag         string   `xml:"ETag"`
+}
+
+// S3InitiateMultipartUploadResult _
+type S3InitiateMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	UploadID string   `xml:"UploadId"`
+}
+
+// S3CompleteMultipartUpload request of CompleteMultipartUpload
+type S3CompleteMultipartUpload struct {
+	Parts []struct {
+		PartNumber int64  `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	} `xml:"Part"`
+}
+
+// S3CompleteMultipartUploadResult _
+type S3CompleteMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"CompleteMultipartUploadResult"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Location string   `xml:"Location"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	ETag     string   `xml:"ETag"`
+}
+
+// S3Part _
+type S3Part struct {
+	PartNumber   int64  `xml:"PartNumber"`
+	LastModified string `xml:"LastModified,omitempty"`
+	ETag         string `xml:"ETag"`
+	Size         int64  `xml:"Size"`
+}
+
+// S3ListPartsResult _
+type S3ListPartsResult struct {
+	XMLName     xml.Name `xml:"ListPartsResult"`
+	Xmlns       string   `xml:"xmlns,attr"`
+	Bucket      string   `xml:"Bucket"`
+	Key         string   `xml:"Key"`
+	UploadID    string   `xml:"UploadId"`
+	IsTruncated bool     `xml:"IsTruncated"`
+	Parts       []S3Part `xml:"Part"`
+}
+
+// S3Upload _
+type S3Upload struct {
+	Key       string  `xml:"Key"`
+	UploadID  string  `xml:"UploadId"`
+	Initiator S3Owner `xml:"Initiator"`
+	Owner     S3Owner `xml:"Owner"`
+	Initiated string  `xml:"Initiated,omitempty"`
+}
+
+// S3ListMultipartUploadsResult _
+type S3ListMultipartUploadsResult struct {
+	XMLName     xml.Name   `xml:"ListMultipartUploadsResult"`
+	Xmlns       string     `xml:"xmlns,attr"`
+	Bucket      string     `xml:"Bucket"`
+	IsTruncated bool       `xml:"IsTruncated"`
+	Uploads     []S3Upload `xml:"Upload"`
+}
+
+func s3Time(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.UTC().Format(s3TimeFormatISO)
+}
+
+// ---------- router ----------
+
+func s3Handler(handler http.HandlerFunc) http.Handler {
+	return negroni.New(
+		negroni.HandlerFunc(s3ErrorMW),
+		negroni.HandlerFunc(s3AuthMW),
+		negroni.HandlerFunc(rateLimitMW),
+		negroni.Wrap(handler),
+	)
+}
+
+// createS3Router keys are used as they are, the router must not clean the path
+func createS3Router() *mux.Router {
+
+	r := mux.NewRouter().SkipClean(true)
+
+	r.Handle("/", s3Handler(s3ListBucketsRequest)).Methods(http.MethodGet)
+	r.Handle("/{bucket}", s3Handler(s3BucketRequest))
+	r.Handle("/{bucket}/", s3Handler(s3BucketRequest))
+	r.Handle("/{bucket}/{key:.+}", s3Handler(s3ObjectRequest))
+
+	r.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		respondS3Error(w, r, newS3Error(http.StatusBadRequest, "InvalidRequest", "unsupported request"))
+	})
+	r.MethodNotAllowedHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		respondS3Error(w, r, newS3Error(http.StatusMethodNotAllowed, "MethodNotAllowed", "The specified method is not allowed against this resource"))
+	})
+	return r
+}
+
+func serveS3Frontend(address string) {
+	log.Printf("S3-compatible endpoint listening on %s", address)
+	log.Fatalln(http.ListenAndServe(address, createS3Router()))
+}
+
+// GET /
+func s3ListBucketsRequest(w http.ResponseWriter, r *http.Request) {
+
+	username := mux.Vars(r)["username"]
+	if username == "" {
+		respondS3Error(w, r, newS3Error(http.StatusForbidden, "AccessDenied", "listing buckets requires authentication"))
+		return
+	}
+
+	buckets, err := listSageBuckets(username, "", "")
+	if err != nil {
+		respondS3Error(w, r, err)
+		return
+	}
+
+	result := &S3ListAllMyBucketsResult{Xmlns: s3XMLNamespace, Owner: S3Owner{ID: username, DisplayName: username}, Buckets: []S3Bucket{}}
+	for _, b := range buckets {
+		result.Buckets = append(result.Buckets, S3Bucket{Name: b.ID})
+	}
+	respondXML(w, http.StatusOK, result)
+}
+
+// /{bucket}
+func s3BucketRequest(w http.ResponseWriter, r *http.Request) {
+
+	vars := mux.Vars(r)
+	username := vars["username"]
+	sageBucketID := vars["bucket"]
+	query := r.URL.Query()
+
+	if name := s3HasSubresource(query, s3UnsupportedSubresources...); name != "" {
+		respondS3Error(w, r, newS3Error(http.StatusNotImplemented, "NotImplemented", "?%s is not supported", name))
+		return
+	}
+
+	err := s3CheckBucket(sageBucketID)
+	if err != nil {
+		respondS3Error(w, r, err)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodHead:
+		err = s3CheckAccess(username, sageBucketID, actionListObjects, "")
+		if err != nil {
+			respondS3Error(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+
+	case http.MethodGet:
+		switch {
+		case s3HasSubresource(query, "location") != "":
+			respondXML(w, http.StatusOK, &struct {
+				XMLName xml.Name `xml:"LocationConstraint"`
+				Xmlns   string   `xml:"xmlns,attr"`
+			}{Xmlns: s3XMLNamespace})
+		case s3HasSubresource(query, "uploads") != "":
+			s3ListMultipartUploadsRequest(w, r, username, sageBucketID)
+		default:
+			s3ListObjectsRequest(w, r, username, sageBucketID)
+		}
+
+	case http.MethodPost:
+		if s3HasSubresource(query, "delete") == "" {
+			respondS3Error(w, r, newS3Error(http.StatusBadRequest, "InvalidRequest", "unsupported request"))
+			return
+		}
+		s3DeleteObjectsRequest(w, r, username, sageBucketID)
+
+	default:
+		// creating and deleting buckets needs the SAGE API, bucket IDs are assigned by the server
+		respondS3Error(w, r, newS3Error(http.StatusNotImplemented, "NotImplemented", "use the SAGE API to create and delete buckets"))
+	}
+}
+
+// GET /{bucket}?list-type=2 and GET /{bucket}
+func s3ListObjectsRequest(w http.ResponseWriter, r *http.Request, username string, sageBucketID string) {
+
+	query := r.URL.Query()
+	v2 := query.Get("list-type") == "2"
+	prefix := query.Get("prefix")
+	delimiter := query.Get("delimiter")
+	encodingType := query.Get("encoding-type")
+	if encodingType != "" && encodingType != "url" {
+		respondS3Error(w, r, newS3Error(http.StatusBadRequest, "InvalidArgument", "Invalid Encoding Method specified in Request"))
+		return
+	}
+
+	maxKeys := int64(s3MaxListKeys)
+	if query.Get("max-keys") != "" {
+		var err error
+		maxKeys, err = strconv.ParseInt(query.Get("max-keys"), 10, 64)
+		if err != nil || maxKeys < 0 {
+			respondS3Error(w, r, newS3Error(http.StatusBadRequest, "InvalidArgument", "max-keys must be a positive integer"))
+			return
+		}
+		if maxKeys > s3MaxListKeys {
+			maxKeys = s3MaxListKeys
+		}
+	}
+
+	// listing permission of the folder the prefix is in, files are filtered individually
+	folder := prefix[:strings.LastIndex(prefix, "/")+1]
+	access, err := getBucketAccess(username, sageBucketID)
+	if err != nil {
+		respondS3Error(w, r, err)
+		return
+	}
+	if !access.allows(actionListObjects, folder) {
+		respondS3Error(w, r, newS3Error(http.StatusForbidden, "AccessDenied", "List access to %q denied", folder))
+		return
+	}
+
+	s3Prefix := sageBucketID + "/"
+	result := &S3ListBucketResult{
+		Xmlns:        s3XMLNamespace,
+		Name:         sageBucketID,
+		Prefix:       prefix,
+		MaxKeys:      maxKeys,
+		Delimiter:    delimiter,
+		EncodingType: encodingType,
+	}
+
+	var listObject *s3.ListObjectsV2Output
+	if v2 {
+		result.StartAfter = query.Get("start-after")
+		result.ContinuationToken = query.Get("continuation-token")
+
+		loi := &s3.ListObjectsV2Input{
+			Bucket:  aws.String(getS3BucketID(sageBucketID)),
+			Prefix:  aws.String(s3Prefix + prefix),
+			MaxKeys: aws.Int64(maxKeys),
+		}
+		if delimiter != "" {
+			loi.Delimiter = aws.String(delimiter)
+		}
+		if result.StartAfter != "" {
+			loi.StartAfter = aws.String(s3Prefix + result.StartAfter)
+		}
+		if result.ContinuationToken != "" {
+			loi.ContinuationToken = aws.String(result.ContinuationToken)
+		}
+		listObject, err = svc.ListObjectsV2(loi)
+		if err != nil {
+			respondS3Error(w, r, fmt.Errorf("svc.ListObjectsV2 returned: %s", err.Error()))
+			return
+		}
+		result.NextContinuationToken = aws.StringValue(listObject.NextContinuationToken)
+	} else {
+		marker := query.Get("marker")
+		result.Marker = &marker
+
+		loi := &s3.ListObjectsInput{
+			Bucket:  aws.String(getS3BucketID(sageBucketID)),
+			Prefix:  aws.String(s3Prefix + prefix),
+			MaxKeys: aws.Int64(maxKeys),
+		}
+		if delimiter != "" {
+			loi.Delimiter = aws.String(delimiter)
+		}
+		if marker != "" {
+			loi.Marker = aws.String(s3Prefix + marker)
+		}
+		var v1 *s3.ListObjectsOutput
+		v1, err = svc.ListObjects(loi)
+		if err != nil {
+			respondS3Error(w, r, fmt.Errorf("svc.ListObjects returned: %s", err.Error()))
+			return
+		}
+		listObject = &s3.ListObjectsV2Output{Contents: v1.Contents, CommonPrefixes: v1.CommonPrefixes, IsTruncated: v1.IsTruncated}
+		result.NextMarker = strings.TrimPrefix(aws.StringValue(v1.NextMarker), s3Prefix)
+	}
+	result.IsTruncated = aws.BoolValue(listObject.IsTruncated)
+
+	// keys relative to the SAGE bucket, then the same filter as the SAGE listing
+	for _, object := range listObject.Contents {
+		object.Key = aws.String(strings.TrimPrefix(aws.StringValue(object.Key), s3Prefix))
+	}
+	for _, cp := range listObject.CommonPrefixes {
+		cp.Prefix = aws.String(strings.TrimPrefix(aws.StringValue(cp.Prefix), s3Prefix))
+	}
+	filterListObject(access, "", listObject)
+
+	encode := func(s string) string {
+		if encodingType == "url" {
+			return s3URIEncode(s, false)
+		}
+		return s
+	}
+	for _, object := range listObject.Contents {
+		result.Contents = append(result.Contents, S3Object{
+			Key:          encode(aws.StringValue(object.Key)),
+			LastModified: s3Time(object.LastModified),
+			ETag:         aws.StringValue(object.ETag),
+			Size:         aws.Int64Value(object.Size),
+			StorageClass: "STANDARD",
+		})
+	}
+	for _, cp := range listObject.CommonPrefixes {
+		result.CommonPrefixes = append(result.CommonPrefixes, S3CommonPrefix{Prefix: encode(aws.StringValue(cp.Prefix))})
+	}
+	if encodingType == "url" {
+		result.Prefix = encode(result.Prefix)
+		result.StartAfter = encode(result.StartAfter)
+		result.NextMarker = encode(result.NextMarker)
+		result.Delimiter = encode(result.Delimiter)
+	}
+	if v2 {
+		keyCount := int64(len(result.Contents) + len(result.CommonPrefixes))
+		result.KeyCount = &keyCount
+	}
+
+	respondXML(w, http.StatusOK, result)
+}
+
+// POST /{bucket}?delete
+func s3DeleteObjectsRequest(w http.ResponseWriter, r *http.Request, username string, sageBucketID string) {
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 2<<20))
+	if err != nil {
+		respondS3Error(w, r, s3PayloadError(r, newS3Error(http.StatusBadRequest, "IncompleteBody", err.Error())))
+		return
+	}
+	request := &S3Delete{}
+	err = xml.Unmarshal(body, request)
+	if err != nil || len(request.Objects) == 0 || len(request.Objects) > maxDeleteKeys {
+		respondS3Error(w, r, newS3Error(http.StatusBadRequest, "MalformedXML", "The XML you provided was not well-formed or did not validate against our published schema"))
+		return
+	}
+
+	result := &S3DeleteResult{Xmlns: s3XMLNamespace}
+	keys := []string{}
+	for _, object := range request.Objects {
+		sagePath, err := s3SageKey(object.Key)
+		if err != nil {
+			result.Errors = append(result.Errors, S3DeleteError{Key: object.Key, Code: "InvalidArgument", Message: err.Error()})
+			continue
+		}
+		keys = append(keys, aclKey(sagePath))
+	}
+
+	access, err := getBucketAccess(username, sageBucketID)
+	if err != nil {
+		respondS3Error(w, r, err)
+		return
+	}
+
+	response := &BulkDeleteResponse{}
+	err = deleteAllowedKeys(access, sageBucketID, keys, false, response)
+	if err != nil {
+		respondS3Error(w, r, err)
+		return
+	}
+
+	if !request.Quiet {
+		for _, key := range response.Deleted {
+			result.Deleted = append(result.Deleted, S3DeletedKey{Key: key})
+		}
+	}
+	for _, e := range response.Errors {
+		code := "InternalError"
+		if e.Code == codeForbidden {
+			code = "AccessDenied"
+		}
+		result.Errors = append(result.Errors, S3DeleteError{Key: e.Key, Code: code, Message: e.Error})
+	}
+
+	log.Printf("S3 DeleteObjects in %s: %d deleted, %d failed", sageBucketID, len(response.Deleted), len(result.Errors))
+	respondXML(w, http.StatusOK, result)
+}
+
+// GET /{bucket}?uploads, the own uploads, or all with FULL_CONTROL
+func s3ListMultipartUploadsRequest(w http.ResponseWriter, r *http.Request, username string, sageBucketID string) {
+
+	if username == "" {
+		respondS3Error(w, r, newS3Error(http.StatusForbidden, "AccessDenied", "listing uploads requires authentication"))
+		return
+	}
+
+	owner := username
+	allowed, err := userIsAllowed(username, sageBucketID, actionListUploads, "")
+	if err != nil {
+		respondS3Error(w, r, err)
+		return
+	}
+	if allowed {
+		owner = ""
+	}
+
+	uploads, err := listMultipartUploads(sageBucketID, owner)
+	if err != nil {
+		respondS3Error(w, r, err)
+		return
+	}
+
+	result := &S3ListMultipartUploadsResult{Xmlns: s3XMLNamespace, Bucket: sageBucketID}
+	for _, u := range uploads {
+		initiator := S3Owner{ID: u.Owner, DisplayName: u.Owner}
+		result.Uploads = append(result.Uploads, S3Upload{Key: u.Key, UploadID: u.UploadID, Initiator: initiator, Owner: initiator, Initiated: s3Time(u.TimeCreated)})
+	}
+	respondXML(w, http.StatusOK, result)
+}
+
+// /{bucket}/{key}
+func s3ObjectRequest(w http.ResponseWriter, r *http.Request) {
+
+	vars := mux.Vars(r)
+	username := vars["username"]
+	sageBucketID := vars["bucket"]
+	query := r.URL.Query()
+
+	if name := s3HasSubresource(query, s3UnsupportedSubresources...); name != "" {
+		respondS3Error(w, r, newS3Error(http.StatusNotImplemented, "NotImplemented", "?%s is not supported", name))
+		return
+	}
+
+	sagePath, err := s3SageKey(vars["key"])
+	if err != nil {
+		respondS3Error(w, r, err)
+		return
+	}
+
+	err = s3CheckBucket(sageBucketID)
+	if err != nil {
+		respondS3Error(w, r, err)
+		return
+	}
+
+	_, isMultipart := query["uploadId"]
+
+	switch {
+	case r.Method == http.MethodGet && isMultipart:
+		s3ListPartsRequest(w, r, username, sageBucketID, sagePath)
+	case r.Method == http.MethodGet, r.Method == http.MethodHead:
+		err = s3CheckAccess(username, sageBucketID, actionReadObject, aclKey(sagePath))
+		if err != nil {
+			respondS3Error(w, r, err)
+			return
+		}
+		downloadSageObject(w, r, sageBucketID, sagePath)
+	case r.Method == http.MethodPut && isMultipart:
+		s3UploadPartRequest(w, r, username, sageBucketID, sagePath)
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		s3CopyObjectRequest(w, r, username, sageBucketID, sagePath)
+	case r.Method == http.MethodPut:
+		s3PutObjectRequest(w, r, username, sageBucketID, sagePath)
+	case r.Method == http.MethodPost && s3HasSubresource(query, "uploads") != "":
+		s3CreateMultipartUploadRequest(w, r, username, sageBucketID, sagePath)
+	case r.Method == http.MethodPost && isMultipart:
+		s3CompleteMultipartUploadRequest(w, r, username, sageBucketID, sagePath)
+	case r.Method == http.MethodDelete && isMultipart:
+		s3AbortMultipartUploadRequest(w, r, username, sageBucketID, sagePath)
+	case r.Method == http.MethodDelete:
+		s3DeleteObjectRequest(w, r, username, sageBucketID, sagePath)
+	default:
+		respondS3Error(w, r, newS3Error(http.StatusMethodNotAllowed, "MethodNotAllowed", "The specified method is not allowed against this resource"))
+	}
+}
+
+// s3ContentLength is the length of the decoded content for aws-chunked uploads
+func s3ContentLength(r *http.Request) int64 {
+	if decoded := r.Header.Get("X-Amz-Decoded-Content-Length"); decoded != "" {
+		size, err := strconv.ParseInt(decoded, 10, 64)
+		if err == nil {
+			return size
+		}
+	}
+	return r.ContentLength
+}
+
+// PUT /{bucket}/{key}
+func s3PutObjectRequest(w http.ResponseWriter, r *http.Request, username string, sageBucketID string, sagePath string) {
+
+	key := aclKey(sagePath)
+	err := s3CheckAccess(username, sageBucketID, actionWriteObject, key)
+	if err != nil {
+		respondS3Error(w, r, err)
+		return
+	}
+
+	expected, err := parseExpectedChecksums(r.Header, s3ContentLength(r))
+	if err != nil {
+		respondS3Error(w, r, newS3Error(http.StatusBadRequest, "InvalidDigest", err.Error()))
+		return
+	}
+
+	contentType := r.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	if strings.HasSuffix(key, "/") {
+		s3PutFolderMarker(w, r, username, sageBucketID, sagePath)
+		return
+	}
+
+	statusCode, err := putVerifiedSageObject(sageBucketID, key, r.Body, username, contentType, expected)
+	if err != nil {
+		if strings.Contains(err.Error(), "Content-MD5") {
+			err = newS3Error(http.StatusBadRequest, "BadDigest", err.Error())
+		}
+		respondS3Error(w, r, s3PayloadError(r, s3StatusError(statusCode, "NoSuchKey", err)))
+		return
+	}
+	fileUploadCounter.Inc()
+
+	head, err := headSageObject(sageBucketID, sagePath)
+	if err != nil {
+		respondS3Error(w, r, err)
+		return
+	}
+
+	w.Header().Set("ETag", aws.StringValue(head.ETag))
+	w.WriteHeader(http.StatusOK)
+}
+
+// s3PutFolderMarker stores an empty object for a key ending with /, tools use them to create empty folders
+func s3PutFolderMarker(w http.ResponseWriter, r *http.Request, username string, sageBucketID string, sagePath string) {
+
+	if s3ContentLength(r) > 0 {
+		respondS3Error(w, r, newS3Error(http.StatusBadRequest, "InvalidArgument", "keys ending with / cannot have content"))
+		return
+	}
+
+	etag, err := putSageFolderMarker(sageBucketID, sagePath, username)
+	if err != nil {
+		respondS3Error(w, r, err)
+		return
+	}
+
+	w.Header().Set("ETag", etag)
+	w.WriteHeader(http.StatusOK)
+}
+
+// PUT /{bucket}/{key} with x-amz-copy-source: /{source bucket}/{source key}
+func s3CopyObjectRequest(w http.ResponseWriter, r *http.Request, username string, sageBucketID string, sagePath string) {
+
+	copySource, err := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+	if err != nil {
+		respondS3Error(w, r, newS3Error(http.StatusBadRequest, "InvalidArgument", "invalid x-amz-copy-source"))
+		return
+	}
+	if strings.Contains(copySource, "?versionId=") {
+		respondS3Error(w, r, newS3Error(http.StatusNotImplemented, "NotImplemented", "versions are not supported"))
+		return
+	}
+	fields := strings.SplitN(strings.TrimPrefix(copySource, "/"), "/", 2)
+	if len(fields) != 2 {
+		respondS3Error(w, r, newS3Error(http.StatusBadRequest, "InvalidArgument", "x-amz-copy-source must be of the form bucket/key"))
+		return
+	}
+	srcBucketID := fields[0]
+	srcPath, err := s3SageKey(fields[1])
+	if err != nil {
+		respondS3Error(w, r, err)
+		return
+	}
+	if srcBucketID != sageBucketID {
+		err = s3CheckBucket(srcBucketID)
+		if err != nil {
+			respondS3Error(w, r, err)
+			return
+		}
+	}
+
+	err = s3CheckAccess(username, srcBucketID, actionReadObject, aclKey(srcPath))
+	if err != nil {
+		respondS3Error(w, r, err)
+		return
+	}
+	err = s3CheckAccess(username, sageBucketID, actionWriteObject, aclKey(sagePath))
+	if err != nil {
+		respondS3Error(w, r, err)
+		return
+	}
+
+	_, err = copySageObject(srcBucketID, srcPath, sageBucketID, sagePath, username)
+	if err != nil {
+		if errorStatus(err, http.StatusInternalServerError) == http.StatusNotFound {
+			err = newS3Error(http.StatusNotFound, "NoSuchKey", err.Error())
+		}
+		respondS3Error(w, r, err)
+		return
+	}
+
+	head, err := headSageObject(sageBucketID, sagePath)
+	if err != nil {
+		respondS3Error(w, r, err)
+		return
+	}
+
+	respondXML(w, http.StatusOK, &S3CopyObjectResult{Xmlns: s3XMLNamespace, LastModified: s3Time(head.LastModified), ETag: aws.StringValue(head.ETag)})
+}
+
+// DELETE /{bucket}/{key}, like S3 deleting a missing key succeeds
+func s3DeleteObjectRequest(w http.ResponseWriter, r *http.Request, username string, sageBucketID string, sagePath string) {
+
+	key := aclKey(sagePath)
+	err := s3CheckAccess(username, sageBucketID, actionDeleteObject, key)
+	if err != nil {
+		respondS3Error(w, r, err)
+		return
+	}
+
+	_, err = deleteSAGEFiles(sageBucketID, []string{key})
+	if err != nil {
+		respondS3Error(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// POST /{bucket}/{key}?uploads
+func s3CreateMultipartUploadRequest(w http.ResponseWriter, r *http.Request, username string, sageBucketID string, sagePath string) {
+
+	u, statusCode, err := initiateMultipartUpload(username, sageBucketID, sagePath)
+	if err != nil {
+		respondS3Error(w, r, s3StatusError(statusCode, "NoSuchKey", err))
+		return
+	}
+
+	respondXML(w, http.StatusOK, &S3InitiateMultipartUploadResult{Xmlns: s3XMLNamespace, Bucket: sageBucketID, Key: u.Key, UploadID: u.UploadID})
+}
+
+// PUT /{bucket}/{key}?partNumber=<n>&uploadId=<id>
+func s3UploadPartRequest(w http.ResponseWriter, r *http.Request, username string, sageBucketID string, sagePath string) {
+
+	if r.Header.Get("X-Amz-Copy-Source") != "" {
+		respondS3Error(w, r, newS3Error(http.StatusNotImplemented, "NotImplemented", "UploadPartCopy is not supported"))
+		return
+	}
+
+	u, statusCode, err := checkMultipartUpload(r.URL.Query().Get("uploadId"), username, sageBucketID, sagePath)
+	if err != nil {
+		respondS3Error(w, r, s3StatusError(statusCode, "NoSuchUpload", err))
+		return
+	}
+
+	partNumber, err := strconv.ParseInt(r.URL.Query().Get("partNumber"), 10, 64)
+	if err != nil {
+		respondS3Error(w, r, newS3Error(http.StatusBadRequest, "InvalidArgument", "partNumber must be between 1 and %d", multipartMaxParts))
+		return
+	}
+
+	part, statusCode, err := uploadMultipartPart(u, partNumber, r.Body)
+	if err != nil {
+		respondS3Error(w, r, s3PayloadError(r, s3StatusError(statusCode, "NoSuchUpload", err)))
+		return
+	}
+
+	w.Header().Set("ETag", part.ETag)
+	w.WriteHeader(http.StatusOK)
+}
+
+// GET /{bucket}/{key}?uploadId=<id>
+func s3ListPartsRequest(w http.ResponseWriter, r *http.Request, username string, sageBucketID string, sagePath string) {
+
+	u, statusCode, err := checkMultipartUpload(r.URL.Query().Get("uploadId"), username, sageBucketID, sagePath)
+	if err != nil {
+		respondS3Error(w, r, s3StatusError(statusCode, "NoSuchUpload", err))
+		return
+	}
+
+	parts, err := listUploadedParts(u)
+	if err != nil {
+		respondS3Error(w, r, err)
+		return
+	}
+
+	result := &S3ListPartsResult{Xmlns: s3XMLNamespace, Bucket: sageBucketID, Key: u.Key, UploadID: u.UploadID}
+	for _, p := range parts {
+		result.Parts = append(result.Parts, S3Part{PartNumber: p.PartNumber, LastModified: s3Time(p.TimeCreated), ETag: p.ETag, Size: p.Size})
+	}
+	respondXML(w, http.StatusOK, result)
+}
+
+// POST /{bucket}/{key}?uploadId=<id>
+func s3CompleteMultipartUploadRequest(w http.ResponseWriter, r *http.Request, username string, sageBucketID string, sagePath string) {
+
+	u, statusCode, err := checkMultipartUpload(r.URL.Query().Get("uploadId"), username, sageBucketID, sagePath)
+	if err != nil {
+		respondS3Error(w, r, s3StatusError(statusCode, "NoSuchUpload", err))
+		return
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 2<<20))
+	if err != nil {
+		respondS3Error(w, r, s3PayloadError(r, newS3Error(http.StatusBadRequest, "IncompleteBody", err.Error())))
+		return
+	}
+	request := &S3CompleteMultipartUpload{}
+	err = xml.Unmarshal(body, request)
+	if err != nil || len(request.Parts) == 0 {
+		respondS3Error(w, r, newS3Error(http.StatusBadRequest, "MalformedXML", "The XML you provided was not well-formed or did not validate against our published schema"))
+		return
+	}
+
+	parts := []*UploadPart{}
+	for _, p := range request.Parts {
+		parts = append(parts, &UploadPart{PartNumber: p.PartNumber, ETag: p.ETag})
+	}
+
+	statusCode, err = completeMultipartUpload(u, parts)
+	if err != nil {
+		if statusCode == http.StatusBadRequest {
+			err = newS3Error(http.StatusBadRequest, "InvalidPart", err.Error())
+		}
+		respondS3Error(w, r, s3StatusError(statusCode, "NoSuchUpload", err))
+		return
+	}
+
+	head, err := headSageObject(sageBucketID, sagePath)
+	if err != nil {
+		respondS3Error(w, r, err)
+		return
+	}
+
+	respondXML(w, http.StatusOK, &S3CompleteMultipartUploadResult{
+		Xmlns:    s3XMLNamespace,
+		Location: r.URL.Path,
+		Bucket:   sageBucketID,
+		Key:      u.Key,
+		ETag:     aws.StringValue(head.ETag),
+	})
+}
+
+// DELETE /{bucket}/{key}?uploadId=<id>
+func s3AbortMultipartUploadRequest(w http.ResponseWriter, r *http.Request, username string, sageBucketID string, sagePath string) {
+
+	u, statusCode, err := checkAbortMultipartUpload(r.URL.Query().Get("uploadId"), username, sageBucketID, sagePath)
+	if err != nil {
+		respondS3Error(w, r, s3StatusError(statusCode, "NoSuchUpload", err))
+		return
+	}
+
+	err = abortMultipartUpload(u)
+	if err != nil {
+		respondS3Error(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
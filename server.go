@@ -6,6 +6,7 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strconv"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -44,6 +45,8 @@ var (
 
 	s3bucket       string
 	s3BucketPrefix = "sagedata-" // only used if data is spread over multiple S3 buckets
+
+	grantCleanupInterval = 10 * time.Minute // how often expired bucket permissions are removed
 )
 
 var validDataTypes = map[string]bool{
@@ -110,6 +113,83 @@ func init() {
 		time.Sleep(time.Second * 2)
 	}
 
+	if os.Getenv("grantCleanupInterval") != "" {
+		grantCleanupInterval, err = time.ParseDuration(os.Getenv("grantCleanupInterval"))
+		if err != nil {
+			log.Fatalf("grantCleanupInterval invalid: %s", err.Error())
+			return
+		}
+	}
+	log.Printf("grantCleanupInterval: %s", grantCleanupInterval)
+
+	for _, d := range []struct {
+		name  string
+		value *time.Duration
+	}{
+		{"uploadCleanupInterval", &uploadCleanupInterval},
+		{"uploadMaxAge", &uploadMaxAge},
+	} {
+		if os.Getenv(d.name) == "" {
+			continue
+		}
+		*d.value, err = time.ParseDuration(os.Getenv(d.name))
+		if err != nil {
+			log.Fatalf("%s invalid: %s", d.name, err.Error())
+			return
+		}
+	}
+	log.Printf("uploadCleanupInterval: %s, uploadMaxAge: %s", uploadCleanupInterval, uploadMaxAge)
+
+	adminUsers = parseAdminUsers(os.Getenv("adminUsers"))
+	log.Printf("adminUsers: %d configured", len(adminUsers))
+
+	if os.Getenv("rateLimitRequestsPerSecond") != "" {
+		rateLimitRequestsPerSecond, err = strconv.ParseFloat(os.Getenv("rateLimitRequestsPerSecond"), 64)
+		if err != nil {
+			log.Fatalf("rateLimitRequestsPerSecond invalid: %s", err.Error())
+			return
+		}
+	}
+	for _, limit := range []struct {
+		name  string
+		value *int
+	}{
+		{"rateLimitBurst", &rateLimitBurst},
+		{"rateLimitConcurrentUploads", &rateLimitConcurrentUploads},
+		{"rateLimitConcurrentDownloads", &rateLimitConcurrentDownloads},
+	} {
+		if os.Getenv(limit.name) == "" {
+			continue
+		}
+		*limit.value, err = strconv.Atoi(os.Getenv(limit.name))
+		if err != nil {
+			log.Fatalf("%s invalid: %s", limit.name, err.Error())
+			return
+		}
+	}
+	log.Printf("rate limits: %g requests/s (burst %d), %d concurrent uploads, %d concurrent downloads (0: unlimited)", rateLimitRequestsPerSecond, rateLimitBurst, rateLimitConcurrentUploads, rateLimitConcurrentDownloads)
+
+	if os.Getenv("extractMaxEntries") != "" {
+		extractMaxEntries, err = strconv.Atoi(os.Getenv("extractMaxEntries"))
+		if err != nil {
+			log.Fatalf("extractMaxEntries invalid: %s", err.Error())
+			return
+		}
+	}
+	if os.Getenv("extractMaxSize") != "" {
+		extractMaxSize, err = strconv.ParseInt(os.Getenv("extractMaxSize"), 10, 64)
+		if err != nil {
+			log.Fatalf("extractMaxSize invalid: %s", err.Error())
+			return
+		}
+	}
+	log.Printf("archive extraction limits: %d files, %d bytes", extractMaxEntries, extractMaxSize)
+
+	s3FrontendAddress = os.Getenv("s3FrontendAddress")
+	if s3FrontendAddress != "" {
+		log.Printf("s3FrontendAddress: %s", s3FrontendAddress)
+	}
+
 	mysqlHost = os.Getenv("MYSQL_HOST")
 	mysqlDatabase = os.Getenv("MYSQL_DATABASE")
 	mysqlUsername = os.Getenv("MYSQL_USER")
@@ -152,6 +232,18 @@ func init() {
 		break
 	}
 
+	err = createMissingTables()
+	if err != nil {
+		log.Fatalf("Database migration failed: %s", err.Error())
+		return
+	}
+
+	err = migrateBucketPermissions()
+	if err != nil {
+		log.Fatalf("Database migration failed: %s", err.Error())
+		return
+	}
+
 	region := "us-west-2"
 	//region := "us-east-1" // minio default
 	disableSSL := false
@@ -184,7 +276,7 @@ func createRouter() {
 	r := mainRouter
 
 	r.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		fmt.Fprintln(w, `{"id": "SAGE object store","available_resources":["api/v1/","metrics/"]}`)
+		fmt.Fprintln(w, `{"id": "SAGE object store","available_resources":["api/v1/","api/v2/","metrics/","webdav/"]}`)
 	})
 
 	log.Println("Sage REST API")
@@ -217,6 +309,7 @@ func createRouter() {
 	// POST /objects/
 	api.Handle("/objects", negroni.New(
 		negroni.HandlerFunc(authMW),
+		negroni.HandlerFunc(rateLimitMW),
 		negroni.Wrap(http.HandlerFunc(createBucketRequest)),
 	)).Methods(http.MethodPost)
 
@@ -224,29 +317,45 @@ func createRouter() {
 	// GET /objects/
 	api.Handle("/objects", negroni.New(
 		negroni.HandlerFunc(authMW),
+		negroni.HandlerFunc(rateLimitMW),
 		negroni.Wrap(http.HandlerFunc(listSageBucketRequest)),
 	)).Methods(http.MethodGet)
 
 	// - show bucket
 	// - list folder content
 	// - download file
-	// GET /objects/{bucket}/../
+	// GET|HEAD /objects/{bucket}/../
 	api.NewRoute().PathPrefix("/objects/{bucket}").Handler(negroni.New(
 		negroni.HandlerFunc(authMW),
+		negroni.HandlerFunc(rateLimitMW),
 		negroni.Wrap(http.HandlerFunc(getSageBucketGeneric)),
-	)).Methods(http.MethodGet)
+	)).Methods(http.MethodGet, http.MethodHead)
 
 	// - upload file
 	// PUT /objects/{bucket}/{key...}
 	api.NewRoute().PathPrefix("/objects/{bucket}/").Handler(negroni.New(
 		negroni.HandlerFunc(authMW),
+		negroni.HandlerFunc(rateLimitMW),
 		negroni.Wrap(http.HandlerFunc(uploadObject)),
 	)).Methods(http.MethodPut)
 
+	// - multipart upload: initiate, complete; server-side copy and move; bulk delete
+	// POST /objects/{bucket}/{key...}?uploads
+	// POST /objects/{bucket}/{key...}?uploadId=<id>
+	// POST /objects/{bucket}/{key...}?copy
+	// POST /objects/{bucket}/{key...}?move
+	// POST /objects/{bucket}?delete
+	api.NewRoute().PathPrefix("/objects/{bucket}").Handler(negroni.New(
+		negroni.HandlerFunc(authMW),
+		negroni.HandlerFunc(rateLimitMW),
+		negroni.Wrap(http.HandlerFunc(postObject)),
+	)).Methods(http.MethodPost)
+
 	// - modify bucket
 	// PATCH /objects/{bucket}
 	api.NewRoute().Path("/objects/{bucket}").Handler(negroni.New(
 		negroni.HandlerFunc(authMW),
+		negroni.HandlerFunc(rateLimitMW),
 		negroni.Wrap(http.HandlerFunc(patchBucket)),
 	)).Methods(http.MethodPatch)
 
@@ -254,6 +363,7 @@ func createRouter() {
 	// PUT /objects/{bucket}
 	api.NewRoute().Path("/objects/{bucket}").Handler(negroni.New(
 		negroni.HandlerFunc(authMW),
+		negroni.HandlerFunc(rateLimitMW),
 		negroni.Wrap(http.HandlerFunc(putBucket)),
 	)).Methods(http.MethodPut)
 
@@ -261,11 +371,197 @@ func createRouter() {
 	// - TODO: delete bucket
 	// DELETE /objects/{bucket}
 	// DELETE /objects/{bucket}/{key...}
+	// DELETE /objects/{bucket}/{folder...}/?recursive
 	api.NewRoute().PathPrefix("/objects/{bucket}").Handler(negroni.New(
 		negroni.HandlerFunc(authMW),
+		negroni.HandlerFunc(rateLimitMW),
 		negroni.Wrap(http.HandlerFunc(deleteBucket)),
 	)).Methods(http.MethodDelete)
 
+	// - resumable uploads (tus protocol)
+	// OPTIONS|POST /tus
+	// OPTIONS|HEAD|PATCH|DELETE /tus/{upload}
+	api.Handle("/tus", negroni.New(
+		negroni.HandlerFunc(authMW),
+		negroni.HandlerFunc(rateLimitMW),
+		negroni.Wrap(http.HandlerFunc(tusCreate)),
+	)).Methods(http.MethodPost)
+
+	api.HandleFunc("/tus", tusOptions).Methods(http.MethodOptions)
+	api.HandleFunc("/tus/{upload}", tusOptions).Methods(http.MethodOptions)
+
+	api.Handle("/tus/{upload}", negroni.New(
+		negroni.HandlerFunc(authMW),
+		negroni.HandlerFunc(rateLimitMW),
+		negroni.Wrap(http.HandlerFunc(tusHead)),
+	)).Methods(http.MethodHead)
+
+	api.Handle("/tus/{upload}", negroni.New(
+		negroni.HandlerFunc(authMW),
+		negroni.HandlerFunc(rateLimitMW),
+		negroni.Wrap(http.HandlerFunc(tusPatch)),
+	)).Methods(http.MethodPatch)
+
+	api.Handle("/tus/{upload}", negroni.New(
+		negroni.HandlerFunc(authMW),
+		negroni.HandlerFunc(rateLimitMW),
+		negroni.Wrap(http.HandlerFunc(tusDelete)),
+	)).Methods(http.MethodDelete)
+
+	// - access keys for the S3-compatible endpoint
+	// POST|GET /s3credentials
+	// DELETE /s3credentials/{access_key}
+	api.Handle("/s3credentials", negroni.New(
+		negroni.HandlerFunc(authMW),
+		negroni.HandlerFunc(rateLimitMW),
+		negroni.Wrap(http.HandlerFunc(createS3CredentialRequest)),
+	)).Methods(http.MethodPost)
+
+	api.Handle("/s3credentials", negroni.New(
+		negroni.HandlerFunc(authMW),
+		negroni.HandlerFunc(rateLimitMW),
+		negroni.Wrap(http.HandlerFunc(listS3CredentialsRequest)),
+	)).Methods(http.MethodGet)
+
+	api.Handle("/s3credentials/{access_key}", negroni.New(
+		negroni.HandlerFunc(authMW),
+		negroni.HandlerFunc(rateLimitMW),
+		negroni.Wrap(http.HandlerFunc(deleteS3CredentialRequest)),
+	)).Methods(http.MethodDelete)
+
+	// - admin: list all buckets with owner and size
+	// GET /admin/buckets
+	api.Handle("/admin/buckets", negroni.New(
+		negroni.HandlerFunc(authMW),
+		negroni.HandlerFunc(rateLimitMW),
+		negroni.HandlerFunc(adminMW),
+		negroni.Wrap(http.HandlerFunc(adminListBuckets)),
+	)).Methods(http.MethodGet)
+
+	// - admin: view/override bucket permissions
+	// GET|PUT|DELETE /admin/buckets/{bucket}/permissions
+	api.Handle("/admin/buckets/{bucket}/permissions", negroni.New(
+		negroni.HandlerFunc(authMW),
+		negroni.HandlerFunc(rateLimitMW),
+		negroni.HandlerFunc(adminMW),
+		negroni.Wrap(http.HandlerFunc(adminGetPermissions)),
+	)).Methods(http.MethodGet)
+
+	api.Handle("/admin/buckets/{bucket}/permissions", negroni.New(
+		negroni.HandlerFunc(authMW),
+		negroni.HandlerFunc(rateLimitMW),
+		negroni.HandlerFunc(adminMW),
+		negroni.Wrap(http.HandlerFunc(adminPutPermission)),
+	)).Methods(http.MethodPut)
+
+	api.Handle("/admin/buckets/{bucket}/permissions", negroni.New(
+		negroni.HandlerFunc(authMW),
+		negroni.HandlerFunc(rateLimitMW),
+		negroni.HandlerFunc(adminMW),
+		negroni.Wrap(http.HandlerFunc(adminDeletePermission)),
+	)).Methods(http.MethodDelete)
+
+	// - admin: audit log of admin actions
+	// GET /admin/audit
+	api.Handle("/admin/audit", negroni.New(
+		negroni.HandlerFunc(authMW),
+		negroni.HandlerFunc(rateLimitMW),
+		negroni.HandlerFunc(adminMW),
+		negroni.Wrap(http.HandlerFunc(adminListActions)),
+	)).Methods(http.MethodGet)
+
+	// restructured API, see apiv2.go
+	apiV2 := r.PathPrefix(apiV2Prefix).Subrouter()
+	apiV2.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"id": "SAGE object store","available_resources":["buckets","files"]}`)
+	})
+
+	// - list and create buckets
+	// GET|POST /buckets
+	apiV2.Handle("/buckets", negroni.New(
+		negroni.HandlerFunc(authMW),
+		negroni.HandlerFunc(rateLimitMW),
+		negroni.Wrap(http.HandlerFunc(v2ListBuckets)),
+	)).Methods(http.MethodGet)
+
+	apiV2.Handle("/buckets", negroni.New(
+		negroni.HandlerFunc(authMW),
+		negroni.HandlerFunc(rateLimitMW),
+		negroni.Wrap(http.HandlerFunc(v2CreateBucket)),
+	)).Methods(http.MethodPost)
+
+	// - delete bucket
+	// DELETE /buckets/{bucket}
+	apiV2.Handle("/buckets/{bucket}", negroni.New(
+		negroni.HandlerFunc(authMW),
+		negroni.HandlerFunc(rateLimitMW),
+		negroni.Wrap(http.HandlerFunc(v2DeleteBucket)),
+	)).Methods(http.MethodDelete)
+
+	// - bucket metadata
+	// GET|PATCH /buckets/{bucket}/metadata
+	apiV2.Handle("/buckets/{bucket}/metadata", negroni.New(
+		negroni.HandlerFunc(authMW),
+		negroni.HandlerFunc(rateLimitMW),
+		negroni.Wrap(http.HandlerFunc(v2GetBucketMetadata)),
+	)).Methods(http.MethodGet)
+
+	apiV2.Handle("/buckets/{bucket}/metadata", negroni.New(
+		negroni.HandlerFunc(authMW),
+		negroni.HandlerFunc(rateLimitMW),
+		negroni.Wrap(http.HandlerFunc(v2PatchBucketMetadata)),
+	)).Methods(http.MethodPatch)
+
+	// - bucket permissions
+	// GET|PUT|DELETE /buckets/{bucket}/permissions
+	apiV2.Handle("/buckets/{bucket}/permissions", negroni.New(
+		negroni.HandlerFunc(authMW),
+		negroni.HandlerFunc(rateLimitMW),
+		negroni.Wrap(http.HandlerFunc(v2GetPermissions)),
+	)).Methods(http.MethodGet)
+
+	apiV2.Handle("/buckets/{bucket}/permissions", negroni.New(
+		negroni.HandlerFunc(authMW),
+		negroni.HandlerFunc(rateLimitMW),
+		negroni.Wrap(http.HandlerFunc(v2PutPermission)),
+	)).Methods(http.MethodPut)
+
+	apiV2.Handle("/buckets/{bucket}/permissions", negroni.New(
+		negroni.HandlerFunc(authMW),
+		negroni.HandlerFunc(rateLimitMW),
+		negroni.Wrap(http.HandlerFunc(v2DeletePermission)),
+	)).Methods(http.MethodDelete)
+
+	// - files and folders
+	// GET|HEAD|PUT|DELETE /files/{bucket}/{path...}
+	apiV2.NewRoute().PathPrefix("/files/{bucket}").Handler(negroni.New(
+		negroni.HandlerFunc(authMW),
+		negroni.HandlerFunc(rateLimitMW),
+		negroni.Wrap(http.HandlerFunc(v2GetFile)),
+	)).Methods(http.MethodGet, http.MethodHead)
+
+	apiV2.NewRoute().PathPrefix("/files/{bucket}").Handler(negroni.New(
+		negroni.HandlerFunc(authMW),
+		negroni.HandlerFunc(rateLimitMW),
+		negroni.Wrap(http.HandlerFunc(v2PutFile)),
+	)).Methods(http.MethodPut)
+
+	apiV2.NewRoute().PathPrefix("/files/{bucket}").Handler(negroni.New(
+		negroni.HandlerFunc(authMW),
+		negroni.HandlerFunc(rateLimitMW),
+		negroni.Wrap(http.HandlerFunc(v2DeleteFile)),
+	)).Methods(http.MethodDelete)
+
+	apiV2.NewRoute().PathPrefix("/").HandlerFunc(defaultHandler)
+
+	// - WebDAV access to buckets, Basic auth with the token as password
+	// OPTIONS|PROPFIND|GET|HEAD|PUT|DELETE|MKCOL|COPY|MOVE /webdav/{bucket}/{path}
+	r.PathPrefix(webdavPrefix).Handler(negroni.New(
+		negroni.HandlerFunc(webdavAuthMW),
+		negroni.HandlerFunc(rateLimitMW),
+		negroni.Wrap(http.HandlerFunc(webdavHandler)),
+	))
+
 	// http.Handle("/metrics", promhttp.Handler())
 	r.Handle("/metrics", negroni.New(
 		negroni.HandlerFunc(authMW),
@@ -275,6 +571,13 @@ func createRouter() {
 	// match everything else...
 	api.NewRoute().PathPrefix("/").HandlerFunc(defaultHandler)
 
+	go expiredGrantsCleanup(grantCleanupInterval)
+	go staleUploadsCleanup(uploadCleanupInterval, uploadMaxAge)
+
+	if s3FrontendAddress != "" {
+		go serveS3Frontend(s3FrontendAddress)
+	}
+
 	log.Fatalln(http.ListenAndServe(":8080", r))
 
 	// similar to S3 "Path-Style Request"
@@ -305,11 +608,6 @@ func createRouter() {
 	// ** download file
 	// GET /objects/{bucket}/{path...}/{filename}
 
-	// idea for restructured api
-	// GET /buckets/{bucket}/metadata
-	// GET /buckets/{bucket}/permissions
-	// GET /files/{bucket}/{path...}/{filename}
-
 }
 
 func main() {
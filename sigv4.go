@@ -0,0 +1,452 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AWS Signature Version 4 verification for the S3-compatible endpoint, see
+// https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-authenticating-requests.html
+
+const (
+	sigV4Algorithm        = "AWS4-HMAC-SHA256"
+	sigV4TimeFormat       = "20060102T150405Z"
+	sigV4MaxClockSkew     = 15 * time.Minute
+	sigV4MaxPresignExpiry = 7 * 24 * time.Hour
+
+	unsignedPayload               = "UNSIGNED-PAYLOAD"
+	streamingPayload              = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	streamingUnsignedTrailer      = "STREAMING-UNSIGNED-PAYLOAD-TRAILER"
+	emptySHA256                   = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	maxChunkHeaderLength          = 4096
+	maxChunkSize                  = 16 << 20 // a signed chunk is held in memory until its signature is checked
+	streamingChunkSignaturePrefix = ";chunk-signature="
+)
+
+// sigV4Auth the signature parameters of a request, from the Authorization header or the query (presigned URLs)
+type sigV4Auth struct {
+	accessKey     string
+	scopeDate     string // YYYYMMDD
+	region        string
+	service       string
+	signedHeaders []string
+	signature     string
+	amzDate       string
+	time          time.Time
+	presigned     bool
+	expires       time.Duration
+}
+
+func (a *sigV4Auth) scope() string {
+	return strings.Join([]string{a.scopeDate, a.region, a.service, "aws4_request"}, "/")
+}
+
+// parseCredential parses <access key>/<date>/<region>/<service>/aws4_request
+func (a *sigV4Auth) parseCredential(credential string) (err error) {
+	fields := strings.Split(credential, "/")
+	if len(fields) != 5 || fields[4] != "aws4_request" {
+		err = newS3Error(http.StatusBadRequest, "AuthorizationHeaderMalformed", "invalid credential %q", credential)
+		return
+	}
+	a.accessKey, a.scopeDate, a.region, a.service = fields[0], fields[1], fields[2], fields[3]
+	if a.service != "s3" {
+		err = newS3Error(http.StatusBadRequest, "AuthorizationHeaderMalformed", "credential scope has to be for service s3, not %q", a.service)
+		return
+	}
+	return
+}
+
+// parseSigV4 returns nil for anonymous requests
+func parseSigV4(r *http.Request) (auth *sigV4Auth, err error) {
+
+	query := r.URL.Query()
+	authorization := r.Header.Get("Authorization")
+
+	switch {
+	case query.Get("X-Amz-Algorithm") != "":
+		auth = &sigV4Auth{presigned: true}
+		if query.Get("X-Amz-Algorithm") != sigV4Algorithm {
+			err = newS3Error(http.StatusBadRequest, "AuthorizationQueryParametersError", "X-Amz-Algorithm has to be %s", sigV4Algorithm)
+			return
+		}
+		err = auth.parseCredential(query.Get("X-Amz-Credential"))
+		if err != nil {
+			return
+		}
+		auth.signedHeaders = strings.Split(query.Get("X-Amz-SignedHeaders"), ";")
+		auth.signature = query.Get("X-Amz-Signature")
+		auth.amzDate = query.Get("X-Amz-Date")
+
+		seconds, parseErr := strconv.ParseInt(query.Get("X-Amz-Expires"), 10, 64)
+		auth.expires = time.Duration(seconds) * time.Second
+		if parseErr != nil || seconds < 1 || auth.expires > sigV4MaxPresignExpiry {
+			err = newS3Error(http.StatusBadRequest, "AuthorizationQueryParametersError", "X-Amz-Expires must be between 1 and %d seconds", int64(sigV4MaxPresignExpiry.Seconds()))
+			return
+		}
+
+	case authorization != "":
+		if !strings.HasPrefix(authorization, sigV4Algorithm+" ") {
+			err = newS3Error(http.StatusBadRequest, "AuthorizationHeaderMalformed", "only %s signatures are supported", sigV4Algorithm)
+			return
+		}
+		auth = &sigV4Auth{}
+		for _, field := range strings.Split(strings.TrimPrefix(authorization, sigV4Algorithm+" "), ",") {
+			field = strings.TrimSpace(field)
+			switch {
+			case strings.HasPrefix(field, "Credential="):
+				err = auth.parseCredential(strings.TrimPrefix(field, "Credential="))
+				if err != nil {
+					return
+				}
+			case strings.HasPrefix(field, "SignedHeaders="):
+				auth.signedHeaders = strings.Split(strings.TrimPrefix(field, "SignedHeaders="), ";")
+			case strings.HasPrefix(field, "Signature="):
+				auth.signature = strings.TrimPrefix(field, "Signature=")
+			}
+		}
+		auth.amzDate = r.Header.Get("X-Amz-Date")
+
+	default:
+		return
+	}
+
+	if auth.accessKey == "" || auth.signature == "" || len(auth.signedHeaders) == 0 || auth.signedHeaders[0] == "" {
+		err = newS3Error(http.StatusBadRequest, "AuthorizationHeaderMalformed", "Credential, SignedHeaders and Signature are required")
+		return
+	}
+
+	auth.time, err = time.Parse(sigV4TimeFormat, auth.amzDate)
+	if err != nil {
+		err = newS3Error(http.StatusForbidden, "AccessDenied", "X-Amz-Date missing or invalid")
+		return
+	}
+	if auth.time.Format("20060102") != auth.scopeDate {
+		err = newS3Error(http.StatusBadRequest, "AuthorizationHeaderMalformed", "credential date %s does not match X-Amz-Date", auth.scopeDate)
+		return
+	}
+	return
+}
+
+// s3URIEncode encodes everything except the unreserved characters, as required for the canonical request
+func s3URIEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// canonicalQueryString sorts the parameters by name and value, the signature itself is excluded
+func canonicalQueryString(rawQuery string) string {
+	query, _ := url.ParseQuery(rawQuery)
+	params := [][2]string{}
+	for name, values := range query {
+		if name == "X-Amz-Signature" {
+			continue
+		}
+		for _, value := range values {
+			params = append(params, [2]string{s3URIEncode(name, true), s3URIEncode(value, true)})
+		}
+	}
+	// sorted by encoded name, then value; sorting the joined "name=value" would put "a-b" before "a"
+	sort.Slice(params, func(i, j int) bool {
+		if params[i][0] != params[j][0] {
+			return params[i][0] < params[j][0]
+		}
+		return params[i][1] < params[j][1]
+	})
+	joined := make([]string, len(params))
+	for i, p := range params {
+		joined[i] = p[0] + "=" + p[1]
+	}
+	return strings.Join(joined, "&")
+}
+
+// canonicalHeaderValue the Go server removes Host from the header map and handles Content-Length separately
+func canonicalHeaderValue(r *http.Request, name string) string {
+	switch name {
+	case "host":
+		return r.Host
+	case "content-length":
+		if value := r.Header.Get("Content-Length"); value != "" {
+			return value
+		}
+		if r.ContentLength >= 0 {
+			return strconv.FormatInt(r.ContentLength, 10)
+		}
+		return ""
+	}
+	values := []string{}
+	for _, value := range r.Header[http.CanonicalHeaderKey(name)] {
+		values = append(values, strings.Join(strings.Fields(value), " "))
+	}
+	return strings.Join(values, ",")
+}
+
+func canonicalRequest(r *http.Request, signedHeaders []string, payloadHash string) string {
+	headers := ""
+	for _, name := range signedHeaders {
+		headers += name + ":" + canonicalHeaderValue(r, name) + "\n"
+	}
+	canonicalURI := s3URIEncode(r.URL.Path, false)
+	if canonicalURI == "" {
+		canonicalURI = "/"
+	}
+	return strings.Join([]string{
+		r.Method,
+		canonicalURI,
+		canonicalQueryString(r.URL.RawQuery),
+		headers,
+		strings.Join(signedHeaders, ";"),
+		payloadHash,
+	}, "\n")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func (a *sigV4Auth) signingKey(secretKey string) []byte {
+	key := hmacSHA256([]byte("AWS4"+secretKey), a.scopeDate)
+	key = hmacSHA256(key, a.region)
+	key = hmacSHA256(key, a.service)
+	return hmacSHA256(key, "aws4_request")
+}
+
+// payloadHash is the declared hash of the body, presigned URLs do not sign the payload
+func (a *sigV4Auth) payloadHash(r *http.Request) string {
+	if a.presigned {
+		return unsignedPayload
+	}
+	return r.Header.Get("X-Amz-Content-Sha256")
+}
+
+// computeSignature signs the request with the secret key of the access key
+func (a *sigV4Auth) computeSignature(r *http.Request, secretKey string) string {
+	stringToSign := strings.Join([]string{
+		sigV4Algorithm,
+		a.amzDate,
+		a.scope(),
+		sha256Hex([]byte(canonicalRequest(r, a.signedHeaders, a.payloadHash(r)))),
+	}, "\n")
+	return hex.EncodeToString(hmacSHA256(a.signingKey(secretKey), stringToSign))
+}
+
+// verify checks the signature and its validity period, now is passed in for tests
+func (a *sigV4Auth) verify(r *http.Request, secretKey string, now time.Time) (err error) {
+
+	if a.presigned {
+		if now.Before(a.time.Add(-sigV4MaxClockSkew)) || now.After(a.time.Add(a.expires)) {
+			err = newS3Error(http.StatusForbidden, "AccessDenied", "Request has expired")
+			return
+		}
+	} else {
+		if a.payloadHash(r) == "" {
+			err = newS3Error(http.StatusBadRequest, "InvalidRequest", "X-Amz-Content-Sha256 header missing")
+			return
+		}
+		if now.Sub(a.time) > sigV4MaxClockSkew || a.time.Sub(now) > sigV4MaxClockSkew {
+			err = newS3Error(http.StatusForbidden, "RequestTimeTooSkewed", "The difference between the request time and the server's time is too large")
+			return
+		}
+	}
+
+	hostSigned := false
+	for _, name := range a.signedHeaders {
+		if name == "host" {
+			hostSigned = true
+		}
+	}
+	if !hostSigned {
+		err = newS3Error(http.StatusBadRequest, "AuthorizationHeaderMalformed", "the host header has to be signed")
+		return
+	}
+
+	expected := a.computeSignature(r, secretKey)
+	if !hmac.Equal([]byte(expected), []byte(a.signature)) {
+		err = newS3Error(http.StatusForbidden, "SignatureDoesNotMatch", "The request signature we calculated does not match the signature you provided")
+		return
+	}
+	return
+}
+
+// payloadReader returns a reader of the request content that fails if the content does not match what was signed
+func (a *sigV4Auth) payloadReader(r *http.Request, secretKey string) (body io.Reader, err error) {
+
+	switch payloadHash := a.payloadHash(r); payloadHash {
+	case unsignedPayload:
+		body = r.Body
+	case streamingPayload, streamingUnsignedTrailer:
+		body = &chunkedPayloadReader{
+			auth:          a,
+			reader:        bufio.NewReader(r.Body),
+			signed:        payloadHash == streamingPayload,
+			signingKey:    a.signingKey(secretKey),
+			prevSignature: a.signature,
+		}
+	default:
+		if len(payloadHash) != 64 {
+			err = newS3Error(http.StatusBadRequest, "InvalidArgument", "X-Amz-Content-Sha256 %q is not supported", payloadHash)
+			return
+		}
+		body = &hashVerifyingReader{reader: r.Body, hash: sha256.New(), expected: strings.ToLower(payloadHash)}
+	}
+	return
+}
+
+// hashVerifyingReader returns an error instead of io.EOF if the SHA256 of the content is not the expected one
+type hashVerifyingReader struct {
+	reader   io.Reader
+	hash     hash.Hash
+	expected string
+}
+
+func (h *hashVerifyingReader) Read(p []byte) (n int, err error) {
+	n, err = h.reader.Read(p)
+	h.hash.Write(p[:n])
+	if err == io.EOF && hex.EncodeToString(h.hash.Sum(nil)) != h.expected {
+		err = newS3Error(http.StatusBadRequest, "XAmzContentSHA256Mismatch", "The provided 'x-amz-content-sha256' header does not match what was computed")
+	}
+	return
+}
+
+// chunkedPayloadReader decodes aws-chunked content. With signed chunks each chunk signature
+// covers the previous signature, the first one is chained to the request signature.
+// Trailers after the final chunk (e.g. additional checksums) are read and ignored.
+type chunkedPayloadReader struct {
+	auth          *sigV4Auth
+	reader        *bufio.Reader
+	signed        bool
+	signingKey    []byte
+	prevSignature string
+	chunk         []byte
+	done          bool
+}
+
+func (c *chunkedPayloadReader) Read(p []byte) (n int, err error) {
+	for len(c.chunk) == 0 {
+		if c.done {
+			err = io.EOF
+			return
+		}
+		err = c.nextChunk()
+		if err != nil {
+			return
+		}
+	}
+	n = copy(p, c.chunk)
+	c.chunk = c.chunk[n:]
+	return
+}
+
+func (c *chunkedPayloadReader) readLine() (line string, err error) {
+	var buffer bytes.Buffer
+	for {
+		fragment, isPrefix, readErr := c.reader.ReadLine()
+		if readErr != nil {
+			err = newS3Error(http.StatusBadRequest, "IncompleteBody", "aws-chunked content ends unexpectedly")
+			return
+		}
+		buffer.Write(fragment)
+		if buffer.Len() > maxChunkHeaderLength {
+			err = newS3Error(http.StatusBadRequest, "InvalidRequest", "aws-chunked header too long")
+			return
+		}
+		if !isPrefix {
+			line = buffer.String()
+			return
+		}
+	}
+}
+
+func (c *chunkedPayloadReader) nextChunk() (err error) {
+
+	header, err := c.readLine()
+	if err != nil {
+		return
+	}
+
+	sizeStr := header
+	signature := ""
+	if i := strings.Index(header, ";"); i >= 0 {
+		sizeStr = header[:i]
+		if strings.HasPrefix(header[i:], streamingChunkSignaturePrefix) {
+			signature = header[i+len(streamingChunkSignaturePrefix):]
+		}
+	}
+	size, err := strconv.ParseInt(sizeStr, 16, 64)
+	if err != nil || size < 0 || size > maxChunkSize {
+		err = newS3Error(http.StatusBadRequest, "InvalidRequest", "invalid aws-chunked chunk size %q", sizeStr)
+		return
+	}
+
+	data := make([]byte, size)
+	_, err = io.ReadFull(c.reader, data)
+	if err != nil {
+		err = newS3Error(http.StatusBadRequest, "IncompleteBody", "aws-chunked content ends unexpectedly")
+		return
+	}
+
+	if c.signed {
+		stringToSign := strings.Join([]string{
+			sigV4Algorithm + "-PAYLOAD",
+			c.auth.amzDate,
+			c.auth.scope(),
+			c.prevSignature,
+			emptySHA256,
+			sha256Hex(data),
+		}, "\n")
+		expected := hex.EncodeToString(hmacSHA256(c.signingKey, stringToSign))
+		if !hmac.Equal([]byte(expected), []byte(signature)) {
+			err = newS3Error(http.StatusForbidden, "SignatureDoesNotMatch", "chunk signature does not match")
+			return
+		}
+		c.prevSignature = signature
+	}
+
+	if size == 0 {
+		// optional trailers, terminated by an empty line, some clients end the body right after the final chunk
+		for {
+			line, readErr := c.readLine()
+			if readErr != nil || line == "" {
+				break
+			}
+		}
+		c.done = true
+		return
+	}
+
+	_, err = c.readLine()
+	if err != nil {
+		return
+	}
+	c.chunk = data
+	return
+}
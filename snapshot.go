@@ -0,0 +1,566 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/google/uuid"
+)
+
+// snapshotS3Prefix snapshot content is stored outside of the bucket prefixes, so it cannot be modified through the API
+const snapshotS3Prefix = "_snapshots/"
+
+// BucketSnapshot immutable copy of all files of a bucket at the time of its creation
+type BucketSnapshot struct {
+	ErrorStruct `json:",inline"`
+	ID          string          `json:"id,omitempty"`
+	Bucket      string          `json:"bucket-id,omitempty"`
+	Name        string          `json:"name,omitempty"`
+	Creator     string          `json:"creator,omitempty"`
+	FileCount   int64           `json:"file_count"`
+	TotalSize   int64           `json:"total_size"`
+	TimeCreated *time.Time      `json:"time_created,omitempty"`
+	Files       []*SnapshotFile `json:"files,omitempty"`
+}
+
+// SnapshotFile key and checksums of one file of a snapshot, SHA256 is empty for files uploaded without checksums
+type SnapshotFile struct {
+	Key    string `json:"key"`
+	Size   int64  `json:"size"`
+	ETag   string `json:"etag"`
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+func snapshotS3Key(snapshotID string, sageKey string) string {
+	return snapshotS3Prefix + snapshotID + "/" + sageKey
+}
+
+func insertSnapshot(snapshot *BucketSnapshot) (err error) {
+
+	db, err := sql.Open("mysql", mysqlDSN)
+	if err != nil {
+		err = fmt.Errorf("Unable to connect to database: %v", err)
+		return
+	}
+	defer db.Close()
+
+	insertQueryStr := "INSERT INTO Snapshots (id, bucket, name, creator, file_count, total_size) VALUES ( ?, UUID_TO_BIN(?), ?, ?, ?, ? ) ;"
+	_, err = db.Exec(insertQueryStr, snapshot.ID, snapshot.Bucket, snapshot.Name, snapshot.Creator, snapshot.FileCount, snapshot.TotalSize)
+	if err != nil {
+		err = fmt.Errorf("Storing snapshot failed: %s", err.Error())
+		return
+	}
+	return
+}
+
+func insertSnapshotFiles(snapshotID string, files []*SnapshotFile) (err error) {
+
+	if len(files) == 0 {
+		return
+	}
+
+	db, err := sql.Open("mysql", mysqlDSN)
+	if err != nil {
+		err = fmt.Errorf("Unable to connect to database: %v", err)
+		return
+	}
+	defer db.Close()
+
+	values := []string{}
+	args := []interface{}{}
+	for _, f := range files {
+		values = append(values, "( ?, ?, ?, ?, ? )")
+		args = append(args, snapshotID, f.Key, f.Size, f.ETag, f.SHA256)
+	}
+
+	insertQueryStr := "INSERT INTO SnapshotFiles (snapshot, sage_key, size, etag, sha256) VALUES " + strings.Join(values, ", ") + " ;"
+	_, err = db.Exec(insertQueryStr, args...)
+	if err != nil {
+		err = fmt.Errorf("Storing snapshot files failed: %s", err.Error())
+		return
+	}
+	return
+}
+
+// getSnapshot returns nil if the bucket has no snapshot with this id
+func getSnapshot(bucketID string, snapshotID string) (snapshot *BucketSnapshot, err error) {
+
+	db, err := sql.Open("mysql", mysqlDSN)
+	if err != nil {
+		err = fmt.Errorf("Unable to connect to database: %v", err)
+		return
+	}
+	defer db.Close()
+
+	s := &BucketSnapshot{}
+	queryStr := "SELECT id, BIN_TO_UUID(bucket), name, creator, file_count, total_size, time_created FROM Snapshots WHERE id=? AND bucket=UUID_TO_BIN(?) ;"
+	err = db.QueryRow(queryStr, snapshotID, bucketID).Scan(&s.ID, &s.Bucket, &s.Name, &s.Creator, &s.FileCount, &s.TotalSize, &s.TimeCreated)
+	switch {
+	case err == sql.ErrNoRows:
+		err = nil
+		return
+	case err != nil:
+		err = fmt.Errorf("(getSnapshot) Could not parse row: %s", err.Error())
+		return
+	}
+	snapshot = s
+	return
+}
+
+func listSnapshots(bucketID string) (snapshots []*BucketSnapshot, err error) {
+
+	db, err := sql.Open("mysql", mysqlDSN)
+	if err != nil {
+		err = fmt.Errorf("Unable to connect to database: %v", err)
+		return
+	}
+	defer db.Close()
+
+	queryStr := "SELECT id, BIN_TO_UUID(bucket), name, creator, file_count, total_size, time_created FROM Snapshots WHERE bucket=UUID_TO_BIN(?) ORDER BY time_created ;"
+	rows, err := db.Query(queryStr, bucketID)
+	if err != nil {
+		err = fmt.Errorf("db.Query returned: %s", err.Error())
+		return
+	}
+	defer rows.Close()
+
+	snapshots = []*BucketSnapshot{}
+	for rows.Next() {
+		s := &BucketSnapshot{}
+		err = rows.Scan(&s.ID, &s.Bucket, &s.Name, &s.Creator, &s.FileCount, &s.TotalSize, &s.TimeCreated)
+		if err != nil {
+			err = fmt.Errorf("(listSnapshots) Could not parse row: %s", err.Error())
+			return
+		}
+		snapshots = append(snapshots, s)
+	}
+	return
+}
+
+func listSnapshotFiles(snapshotID string) (files []*SnapshotFile, err error) {
+
+	db, err := sql.Open("mysql", mysqlDSN)
+	if err != nil {
+		err = fmt.Errorf("Unable to connect to database: %v", err)
+		return
+	}
+	defer db.Close()
+
+	rows, err := db.Query("SELECT sage_key, size, etag, sha256 FROM SnapshotFiles WHERE snapshot=? ORDER BY sage_key ;", snapshotID)
+	if err != nil {
+		err = fmt.Errorf("db.Query returned: %s", err.Error())
+		return
+	}
+	defer rows.Close()
+
+	files = []*SnapshotFile{}
+	for rows.Next() {
+		f := &SnapshotFile{}
+		err = rows.Scan(&f.Key, &f.Size, &f.ETag, &f.SHA256)
+		if err != nil {
+			err = fmt.Errorf("(listSnapshotFiles) Could not parse row: %s", err.Error())
+			return
+		}
+		files = append(files, f)
+	}
+	return
+}
+
+// deleteS3Prefix deletes all objects below the prefix
+func deleteS3Prefix(s3BucketName string, prefix string) (err error) {
+
+	var deleteErr error
+	err = svc.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(s3BucketName),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		if len(page.Contents) == 0 {
+			return true
+		}
+		objectIdentifiers := []*s3.ObjectIdentifier{}
+		for _, object := range page.Contents {
+			objectIdentifiers = append(objectIdentifiers, &s3.ObjectIdentifier{Key: object.Key})
+		}
+		_, deleteErr = svc.DeleteObjects(&s3.DeleteObjectsInput{
+			Bucket: aws.String(s3BucketName),
+			Delete: &s3.Delete{Objects: objectIdentifiers, Quiet: aws.Bool(true)},
+		})
+		return deleteErr == nil
+	})
+	if err == nil {
+		err = deleteErr
+	}
+	if err != nil {
+		err = fmt.Errorf("Deleting %s failed: %s", prefix, err.Error())
+		return
+	}
+	return
+}
+
+// deleteSnapshot removes content and records of a snapshot
+func deleteSnapshot(bucketID string, snapshotID string) (err error) {
+
+	err = deleteS3Prefix(getS3BucketID(bucketID), snapshotS3Prefix+snapshotID+"/")
+	if err != nil {
+		return
+	}
+
+	db, err := sql.Open("mysql", mysqlDSN)
+	if err != nil {
+		err = fmt.Errorf("Unable to connect to database: %v", err)
+		return
+	}
+	defer db.Close()
+
+	_, err = db.Exec("DELETE FROM SnapshotFiles WHERE snapshot=? ;", snapshotID)
+	if err != nil {
+		err = fmt.Errorf("Removing snapshot files failed: %s", err.Error())
+		return
+	}
+	_, err = db.Exec("DELETE FROM Snapshots WHERE id=? ;", snapshotID)
+	if err != nil {
+		err = fmt.Errorf("Removing snapshot failed: %s", err.Error())
+		return
+	}
+	return
+}
+
+// createSnapshot copies all files of the bucket into snapshot storage, one listing page at a time.
+// Files modified while the snapshot is created may or may not be included. The snapshot only becomes
+// visible once all files have been copied, a failed snapshot is removed again.
+func createSnapshot(bucketID string, name string, username string) (snapshot *BucketSnapshot, err error) {
+
+	newUUID, err := uuid.NewRandom()
+	if err != nil {
+		err = fmt.Errorf("error generating uuid %s", err.Error())
+		return
+	}
+	s := &BucketSnapshot{ID: newUUID.String(), Bucket: bucketID, Name: name, Creator: username}
+
+	defer func() {
+		if err != nil {
+			cleanupErr := deleteSnapshot(bucketID, s.ID)
+			if cleanupErr != nil {
+				log.Printf("could not remove failed snapshot %s: %s", s.ID, cleanupErr.Error())
+			}
+		}
+	}()
+
+	s3BucketName := getS3BucketID(bucketID)
+	continuationToken := ""
+	for {
+		var listObject *s3.ListObjectsV2Output
+		listObject, err = listSageBucketContent(bucketID, "/", true, 1000, "", continuationToken)
+		if err != nil {
+			return
+		}
+
+		files := []*SnapshotFile{}
+		for _, object := range listObject.Contents {
+			sageKey := aws.StringValue(object.Key)
+
+			var head *s3.HeadObjectOutput
+			head, err = copyS3ObjectWithMetadata(s3BucketName, bucketID+"/"+sageKey, s3BucketName, snapshotS3Key(s.ID, sageKey), "")
+			if err != nil {
+				err = fmt.Errorf("Copying %s failed: %s", sageKey, err.Error())
+				return
+			}
+			_, sha256Hex := objectChecksums(head.Metadata)
+			f := &SnapshotFile{Key: sageKey, Size: aws.Int64Value(head.ContentLength), ETag: aws.StringValue(head.ETag), SHA256: sha256Hex}
+			files = append(files, f)
+			s.FileCount++
+			s.TotalSize += f.Size
+		}
+
+		err = insertSnapshotFiles(s.ID, files)
+		if err != nil {
+			return
+		}
+
+		if !aws.BoolValue(listObject.IsTruncated) {
+			break
+		}
+		continuationToken = aws.StringValue(listObject.NextContinuationToken)
+	}
+
+	err = insertSnapshot(s)
+	if err != nil {
+		return
+	}
+
+	snapshot, err = getSnapshot(bucketID, s.ID)
+	return
+}
+
+// discardSageBucket removes a bucket that was only partially cloned
+func discardSageBucket(bucketID string) (err error) {
+
+	_, err = deleteAllFiles(bucketID)
+	if err != nil {
+		return
+	}
+
+	db, err := sql.Open("mysql", mysqlDSN)
+	if err != nil {
+		err = fmt.Errorf("Unable to connect to database: %v", err)
+		return
+	}
+	defer db.Close()
+
+	_, err = db.Exec("DELETE FROM BucketPermissions WHERE id=UUID_TO_BIN(?) ;", bucketID)
+	if err != nil {
+		err = fmt.Errorf("Removing bucket permissions failed: %s", err.Error())
+		return
+	}
+	_, err = db.Exec("DELETE FROM Buckets WHERE id=UUID_TO_BIN(?) ;", bucketID)
+	if err != nil {
+		err = fmt.Errorf("Removing bucket failed: %s", err.Error())
+		return
+	}
+	return
+}
+
+// cloneBucket creates a new bucket owned by username with the type of the source bucket and copies
+// the files of the bucket, or of the snapshot if not nil, that access allows to read. A failed clone
+// is removed again.
+func cloneBucket(source *SAGEBucket, snapshot *BucketSnapshot, access *bucketAccess, name string, username string) (clone SAGEBucket, err error) {
+
+	if name == "" {
+		name = source.Name
+	}
+
+	clone, err = createSageBucket(username, source.DataType, name, false)
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		if err != nil {
+			cleanupErr := discardSageBucket(clone.ID)
+			if cleanupErr != nil {
+				log.Printf("could not remove failed clone %s: %s", clone.ID, cleanupErr.Error())
+			}
+		}
+	}()
+
+	if snapshot != nil {
+		var files []*SnapshotFile
+		files, err = listSnapshotFiles(snapshot.ID)
+		if err != nil {
+			return
+		}
+		s3BucketName := getS3BucketID(source.ID)
+		for _, f := range files {
+			if !access.allows(actionReadObject, f.Key) {
+				continue
+			}
+			_, err = copyS3ObjectWithMetadata(s3BucketName, snapshotS3Key(snapshot.ID, f.Key), getS3BucketID(clone.ID), clone.ID+"/"+f.Key, username)
+			if err != nil {
+				err = fmt.Errorf("Copying %s failed: %s", f.Key, err.Error())
+				return
+			}
+		}
+		return
+	}
+
+	continuationToken := ""
+	for {
+		var listObject *s3.ListObjectsV2Output
+		listObject, err = listSageBucketContent(source.ID, "/", true, 1000, "", continuationToken)
+		if err != nil {
+			return
+		}
+
+		for _, object := range listObject.Contents {
+			if !access.allows(actionReadObject, aws.StringValue(object.Key)) {
+				continue
+			}
+			_, err = copySageObject(source.ID, aws.StringValue(object.Key), clone.ID, aws.StringValue(object.Key), username)
+			if err != nil {
+				return
+			}
+		}
+
+		if !aws.BoolValue(listObject.IsTruncated) {
+			return
+		}
+		continuationToken = aws.StringValue(listObject.NextContinuationToken)
+	}
+}
+
+// POST /objects/{bucket}?snapshot   optional body: {"name": "..."}
+func createSnapshotRequest(w http.ResponseWriter, r *http.Request, username string, sageBucketID string) {
+
+	allowed, err := userIsAllowed(username, sageBucketID, actionPatchMetadata, "")
+	if err != nil {
+		respondError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if !allowed {
+		respondJSONError(w, deniedStatus(username), "Creating snapshots of bucket denied (%s, %s)", username, sageBucketID)
+		return
+	}
+
+	request := &BucketSnapshot{}
+	err = json.NewDecoder(r.Body).Decode(request)
+	if err != nil && err != io.EOF {
+		respondJSONError(w, http.StatusBadRequest, "Could not parse json: %s", err.Error())
+		return
+	}
+
+	snapshot, err := createSnapshot(sageBucketID, request.Name, username)
+	if err != nil {
+		respondJSONError(w, errorStatus(err, http.StatusInternalServerError), "Creating snapshot failed: %s", err.Error())
+		return
+	}
+
+	log.Printf("snapshot %s of bucket %s created with %d files", snapshot.ID, sageBucketID, snapshot.FileCount)
+	respondJSON(w, http.StatusOK, snapshot)
+}
+
+// GET /objects/{bucket}?snapshots            list snapshots
+// GET /objects/{bucket}?snapshot=<id>        snapshot with all files
+func getSnapshotsRequest(w http.ResponseWriter, r *http.Request, username string, sageBucketID string) {
+
+	access, err := getBucketAccess(username, sageBucketID)
+	if err != nil {
+		respondError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if !access.allows(actionListObjects, "") {
+		respondJSONError(w, deniedStatus(username), "Access to snapshots denied (%s, %s)", username, sageBucketID)
+		return
+	}
+
+	snapshotID, err := getQueryField(r, "snapshot")
+	if err != nil {
+		snapshots, err := listSnapshots(sageBucketID)
+		if err != nil {
+			respondError(w, err, http.StatusInternalServerError)
+			return
+		}
+		respondJSON(w, http.StatusOK, snapshots)
+		return
+	}
+
+	snapshot, err := getSnapshot(sageBucketID, snapshotID)
+	if err != nil {
+		respondError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if snapshot == nil {
+		respondJSONError(w, http.StatusNotFound, "Snapshot %s not found", snapshotID)
+		return
+	}
+
+	files, err := listSnapshotFiles(snapshotID)
+	if err != nil {
+		respondError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	// like folder listings, only the files the user is allowed to read
+	snapshot.Files = []*SnapshotFile{}
+	for _, f := range files {
+		if access.allows(actionReadObject, f.Key) {
+			snapshot.Files = append(snapshot.Files, f)
+		}
+	}
+	respondJSON(w, http.StatusOK, snapshot)
+}
+
+// DELETE /objects/{bucket}?snapshot=<id>
+func deleteSnapshotRequest(w http.ResponseWriter, r *http.Request, username string, sageBucketID string) {
+
+	allowed, err := userIsAllowed(username, sageBucketID, actionPatchMetadata, "")
+	if err != nil {
+		respondError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if !allowed {
+		respondJSONError(w, deniedStatus(username), "Deleting snapshots of bucket denied (%s, %s)", username, sageBucketID)
+		return
+	}
+
+	snapshotID, err := getQueryField(r, "snapshot")
+	if err != nil {
+		respondJSONError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	snapshot, err := getSnapshot(sageBucketID, snapshotID)
+	if err != nil {
+		respondError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if snapshot == nil {
+		respondJSONError(w, http.StatusNotFound, "Snapshot %s not found", snapshotID)
+		return
+	}
+
+	err = deleteSnapshot(sageBucketID, snapshotID)
+	if err != nil {
+		respondError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, DeleteRespsonse{Deleted: []string{snapshotID}})
+}
+
+// POST /objects/{bucket}?clone[&snapshot=<id>]   optional body: {"name": "..."}
+// Cloning needs read access to the whole source bucket.
+func cloneBucketRequest(w http.ResponseWriter, r *http.Request, username string, sageBucketID string) {
+
+	access, err := getBucketAccess(username, sageBucketID)
+	if err != nil {
+		respondError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if !access.allows(actionReadObject, "") {
+		respondJSONError(w, deniedStatus(username), "Read access to bucket denied (%s, %s)", username, sageBucketID)
+		return
+	}
+
+	request := &SAGEBucket{}
+	err = json.NewDecoder(r.Body).Decode(request)
+	if err != nil && err != io.EOF {
+		respondJSONError(w, http.StatusBadRequest, "Could not parse json: %s", err.Error())
+		return
+	}
+
+	source, err := GetSageBucket(sageBucketID)
+	if err != nil {
+		respondError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	var snapshot *BucketSnapshot
+	if snapshotID, err := getQueryField(r, "snapshot"); err == nil {
+		snapshot, err = getSnapshot(sageBucketID, snapshotID)
+		if err != nil {
+			respondError(w, err, http.StatusInternalServerError)
+			return
+		}
+		if snapshot == nil {
+			respondJSONError(w, http.StatusNotFound, "Snapshot %s not found", snapshotID)
+			return
+		}
+	}
+
+	clone, err := cloneBucket(&source, snapshot, access, request.Name, username)
+	if err != nil {
+		respondJSONError(w, errorStatus(err, http.StatusInternalServerError), "Cloning bucket failed: %s", err.Error())
+		return
+	}
+
+	log.Printf("bucket %s cloned to %s by %s", sageBucketID, clone.ID, username)
+	respondJSON(w, http.StatusOK, clone)
+}
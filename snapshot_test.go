@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+func TestSnapshotAndClone(t *testing.T) {
+
+	testuser := "testuser"
+
+	newBucket, err := createSageBucket(testuser, "training-data", "testing-bucket1", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bucketID := newBucket.ID
+
+	err = putSageObject(bucketID, "data/a.txt", strings.NewReader("version 1"), testuser, "text/plain")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := testRequest(t, testuser, "POST", fmt.Sprintf("/api/v1/objects/%s?snapshot", bucketID), strings.NewReader(`{"name": "v1"}`), nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("snapshot returned %d: %s", rr.Code, rr.Body.String())
+	}
+	snapshot := &BucketSnapshot{}
+	err = json.Unmarshal(rr.Body.Bytes(), snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snapshot.FileCount != 1 || snapshot.TotalSize != int64(len("version 1")) {
+		t.Fatalf("unexpected snapshot %+v", snapshot)
+	}
+
+	// later changes do not affect the snapshot
+	err = putSageObject(bucketID, "data/a.txt", strings.NewReader("version 2"), testuser, "text/plain")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr = testRequest(t, testuser, "GET", fmt.Sprintf("/api/v1/objects/%s?snapshot=%s", bucketID, snapshot.ID), nil, nil)
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "data/a.txt") {
+		t.Fatalf("get snapshot returned %d: %s", rr.Code, rr.Body.String())
+	}
+
+	// clone from the snapshot
+	rr = testRequest(t, testuser, "POST", fmt.Sprintf("/api/v1/objects/%s?clone&snapshot=%s", bucketID, snapshot.ID), strings.NewReader(`{"name": "clone-v1"}`), nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("clone returned %d: %s", rr.Code, rr.Body.String())
+	}
+	clone := &SAGEBucket{}
+	err = json.Unmarshal(rr.Body.Bytes(), clone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if clone.ID == bucketID || clone.Owner != testuser || clone.DataType != "training-data" || clone.Name != "clone-v1" {
+		t.Fatalf("unexpected clone %+v", clone)
+	}
+
+	rr = testRequest(t, testuser, "GET", fmt.Sprintf("/api/v1/objects/%s/data/a.txt", clone.ID), nil, nil)
+	if rr.Code != http.StatusOK || rr.Body.String() != "version 1" {
+		t.Fatalf("clone has unexpected content (%d): %s", rr.Code, rr.Body.String())
+	}
+
+	// clone of the current bucket content
+	rr = testRequest(t, testuser, "POST", fmt.Sprintf("/api/v1/objects/%s?clone", bucketID), nil, nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("clone returned %d: %s", rr.Code, rr.Body.String())
+	}
+	clone = &SAGEBucket{}
+	json.Unmarshal(rr.Body.Bytes(), clone)
+	rr = testRequest(t, testuser, "GET", fmt.Sprintf("/api/v1/objects/%s/data/a.txt", clone.ID), nil, nil)
+	if rr.Code != http.StatusOK || rr.Body.String() != "version 2" {
+		t.Fatalf("clone has unexpected content (%d): %s", rr.Code, rr.Body.String())
+	}
+
+	rr = testRequest(t, testuser, "DELETE", fmt.Sprintf("/api/v1/objects/%s?snapshot=%s", bucketID, snapshot.ID), nil, nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("delete snapshot returned %d: %s", rr.Code, rr.Body.String())
+	}
+	rr = testRequest(t, testuser, "GET", fmt.Sprintf("/api/v1/objects/%s?snapshot=%s", bucketID, snapshot.ID), nil, nil)
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("deleted snapshot returned %d: %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestCloneAndSnapshotRespectDeny(t *testing.T) {
+
+	testuser := "testuser"
+	otheruser := "otheruser"
+
+	newBucket, err := createSageBucket(testuser, "training-data", "testing-bucket1", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bucketID := newBucket.ID
+
+	for _, key := range []string{"data/a.txt", "secret/b.txt"} {
+		err = putSageObject(bucketID, key, strings.NewReader("content"), testuser, "text/plain")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = addBucketPermissionForTest(bucketID, testuser, "USER", otheruser, "READ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy := `{"Statement": [{"Effect": "Deny", "Principal": "USER:otheruser", "Action": "read_object", "Resource": "secret/*"}]}`
+	rr := testRequest(t, testuser, "PUT", fmt.Sprintf("/api/v1/objects/%s?policy", bucketID), strings.NewReader(policy), nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("policy returned %d: %s", rr.Code, rr.Body.String())
+	}
+
+	rr = testRequest(t, testuser, "POST", fmt.Sprintf("/api/v1/objects/%s?snapshot", bucketID), nil, nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("snapshot returned %d: %s", rr.Code, rr.Body.String())
+	}
+	snapshot := &BucketSnapshot{}
+	json.Unmarshal(rr.Body.Bytes(), snapshot)
+
+	rr = testRequest(t, otheruser, "GET", fmt.Sprintf("/api/v1/objects/%s?snapshot=%s", bucketID, snapshot.ID), nil, nil)
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "data/a.txt") || strings.Contains(rr.Body.String(), "secret/") {
+		t.Fatalf("snapshot of otheruser returned %d: %s", rr.Code, rr.Body.String())
+	}
+
+	for _, query := range []string{"clone", "clone&snapshot=" + snapshot.ID} {
+		rr = testRequest(t, otheruser, "POST", fmt.Sprintf("/api/v1/objects/%s?%s", bucketID, query), nil, nil)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%s returned %d: %s", query, rr.Code, rr.Body.String())
+		}
+		clone := &SAGEBucket{}
+		json.Unmarshal(rr.Body.Bytes(), clone)
+
+		listObject, err := listSageBucketContent(clone.ID, "/", true, 0, "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(listObject.Contents) != 1 || aws.StringValue(listObject.Contents[0].Key) != "data/a.txt" {
+			t.Fatalf("%s copied denied files: %v", query, listObject.Contents)
+		}
+	}
+}
@@ -1,14 +1,19 @@
 package main
 
 import (
+	"bytes"
 	"database/sql"
 	"fmt"
+	"io"
 	"log"
+	"net/http"
+	"net/url"
 	"path"
 	"strings"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/google/uuid"
 	"github.com/prometheus/client_golang/prometheus"
 )
@@ -133,10 +138,8 @@ func createSageBucket(username string, dataType string, bucketName string, isPub
 	return
 }
 
-// userHasBucketPermission _
-// check on any of 'READ', 'WRITE', 'READ_ACP', 'WRITE_ACP', 'FULL_CONTROL'
-func userHasBucketPermission(granteeName string, bucketID string, requestPerm string) (ok bool, err error) {
-	ok = false
+// ListBucketPermissions _
+func ListBucketPermissions(bucketID string) (permissions []*SAGEBucketPermission, err error) {
 
 	db, err := sql.Open("mysql", mysqlDSN)
 	if err != nil {
@@ -145,48 +148,55 @@ func userHasBucketPermission(granteeName string, bucketID string, requestPerm st
 	}
 	defer db.Close()
 
-	granteeType := "USER"
+	queryStr := "SELECT granteeType, grantee, permission, prefix, expires FROM BucketPermissions WHERE id=UUID_TO_BIN(?) AND " + grantNotExpiredQuery + " ;"
 
-	// TODO: infer group memberships
+	log.Printf("ListBucketPermissions, queryStr: %s", queryStr)
 
-	matchCount := -1
+	rows, err := db.Query(queryStr, bucketID)
+	if err != nil {
+		err = fmt.Errorf("db.Query returned: %s (%s)", err.Error(), queryStr)
+		return
+	}
+	defer rows.Close()
 
-	queryStr := ""
-	var row *sql.Row
+	permissions = []*SAGEBucketPermission{}
 
-	injectPublicQuery := "FALSE"
-	if requestPerm == "READ" {
-		injectPublicQuery = "(granteeType='GROUP' AND grantee='AllUsers' AND permission='READ')"
-	}
+	for rows.Next() {
+		p := SAGEBucketPermission{}
 
-	granteeSearchQuery := "FALSE"
-	if granteeName != "" {
-		granteeSearchQuery = "( granteeType=? AND grantee=? AND (permission='FULL_CONTROL' OR permission=? ))"
+		err = rows.Scan(&p.GranteeType, &p.Grantee, &p.Permission, &p.Prefix, &p.Expires)
+		if err != nil {
+			err = fmt.Errorf("(ListBucketPermissions) Could not parse row: %s", err.Error())
+			return
+		}
+		//log.Printf("permission: %s", p.Permission)
+		permissions = append(permissions, &p)
 	}
 
-	queryStr = fmt.Sprintf("SELECT COUNT(*) FROM BucketPermissions WHERE id=UUID_TO_BIN(?) AND  ( %s OR %s ) ;", granteeSearchQuery, injectPublicQuery)
+	return
+}
 
-	log.Printf("requestPerm: %s", requestPerm)
-	log.Printf("queryStr: %s", queryStr)
+// addBucketPermission adds a grant, if the grant already exists only its expiry is updated
+func addBucketPermission(bucketID string, p *SAGEBucketPermission) (err error) {
 
-	if granteeName != "" {
-		row = db.QueryRow(queryStr, bucketID, granteeType, granteeName, requestPerm)
-	} else {
-		row = db.QueryRow(queryStr, bucketID)
-	}
-	err = row.Scan(&matchCount)
+	db, err := sql.Open("mysql", mysqlDSN)
 	if err != nil {
-		err = fmt.Errorf("db.QueryRow returned: %s (%s)", err.Error(), queryStr)
+		err = fmt.Errorf("Unable to connect to database: %v", err)
 		return
 	}
-	if matchCount >= 1 {
-		ok = true
+	defer db.Close()
+
+	insertQueryStr := "INSERT INTO BucketPermissions (id, granteeType, grantee, permission, prefix, expires) VALUES ( UUID_TO_BIN(?), ? , ?, ?, ?, ?) ON DUPLICATE KEY UPDATE expires=VALUES(expires) ;"
+	_, err = db.Exec(insertQueryStr, bucketID, p.GranteeType, p.Grantee, p.Permission, p.Prefix, p.Expires)
+	if err != nil {
+		err = fmt.Errorf("Adding bucket permissions failed: %s", err.Error())
+		return
 	}
 	return
 }
 
-// ListBucketPermissions _
-func ListBucketPermissions(bucketID string) (permissions []*SAGEBucketPermission, err error) {
+// removeBucketPermission deletes the grants of a grantee, optionally only for one permission and/or prefix
+func removeBucketPermission(bucketID string, granteeType string, grantee string, permission string, prefix string, matchPrefix bool) (deletedNumber int64, err error) {
 
 	db, err := sql.Open("mysql", mysqlDSN)
 	if err != nil {
@@ -195,31 +205,29 @@ func ListBucketPermissions(bucketID string) (permissions []*SAGEBucketPermission
 	}
 	defer db.Close()
 
-	queryStr := "SELECT granteeType, grantee, permission FROM BucketPermissions WHERE id=UUID_TO_BIN(?) ;"
-
-	log.Printf("ListBucketPermissions, queryStr: %s", queryStr)
+	deleteQueryStr := "DELETE FROM BucketPermissions WHERE id=UUID_TO_BIN(?) AND granteeType=? AND grantee=?"
+	queryArgs := []interface{}{bucketID, granteeType, grantee}
+	if permission != "" {
+		deleteQueryStr += " AND permission=?"
+		queryArgs = append(queryArgs, permission)
+	}
+	if matchPrefix {
+		deleteQueryStr += " AND prefix=?"
+		queryArgs = append(queryArgs, prefix)
+	}
+	deleteQueryStr += " ;"
 
-	rows, err := db.Query(queryStr, bucketID)
+	result, err := db.Exec(deleteQueryStr, queryArgs...)
 	if err != nil {
-		err = fmt.Errorf("db.Query returned: %s (%s)", err.Error(), queryStr)
+		err = fmt.Errorf("Removing bucket permissions failed: %s", err.Error())
 		return
 	}
-	defer rows.Close()
 
-	permissions = []*SAGEBucketPermission{}
-
-	for rows.Next() {
-		p := SAGEBucketPermission{}
-
-		err = rows.Scan(&p.GranteeType, &p.Grantee, &p.Permission)
-		if err != nil {
-			err = fmt.Errorf("(ListBucketPermissions) Could not parse row: %s", err.Error())
-			return
-		}
-		//log.Printf("permission: %s", p.Permission)
-		permissions = append(permissions, &p)
+	deletedNumber, err = result.RowsAffected()
+	if err != nil {
+		err = fmt.Errorf("result.RowsAffected returned: %s", err.Error())
+		return
 	}
-
 	return
 }
 
@@ -252,7 +260,7 @@ func listSageBuckets(username string, filter_owner string, filter_name string) (
 	}
 
 	// get list of bucket ID's for which user is owner OR bucket is public OR bucket is shared with user
-	queryStr := fmt.Sprintf("SELECT DISTINCT BIN_TO_UUID(Buckets.id), Buckets.name, Buckets.owner, Buckets.type FROM Buckets INNER JOIN BucketPermissions ON Buckets.id = BucketPermissions.id AND ( %s OR ( granteeType='GROUP'  AND grantee='AllUsers' AND permission='READ') ) %s %s ;", granteeSearchQuery, filter_owner_q, filter_name_q)
+	queryStr := fmt.Sprintf("SELECT DISTINCT BIN_TO_UUID(Buckets.id), Buckets.name, Buckets.owner, Buckets.type FROM Buckets INNER JOIN BucketPermissions ON Buckets.id = BucketPermissions.id AND ( %s OR ( granteeType='GROUP'  AND grantee='AllUsers' AND permission='READ') ) AND %s %s %s ;", granteeSearchQuery, grantNotExpiredQuery, filter_owner_q, filter_name_q)
 
 	log.Printf("listSageBuckets, (user: %s) queryStr: %s", username, queryStr)
 
@@ -288,6 +296,66 @@ func listSageBuckets(username string, filter_owner string, filter_name string) (
 	return
 }
 
+// listAllSageBuckets returns all buckets regardless of permissions, only for administrators
+func listAllSageBuckets() (buckets []*SAGEBucket, err error) {
+
+	db, err := sql.Open("mysql", mysqlDSN)
+	if err != nil {
+		err = fmt.Errorf("Unable to connect to database: %v", err)
+		return
+	}
+	defer db.Close()
+
+	queryStr := "SELECT BIN_TO_UUID(id), name, type, time_created, time_last_updated, owner FROM Buckets ORDER BY time_created ;"
+
+	rows, err := db.Query(queryStr)
+	if err != nil {
+		err = fmt.Errorf("db.Query returned: %s (%s)", err.Error(), queryStr)
+		return
+	}
+	defer rows.Close()
+
+	buckets = []*SAGEBucket{}
+	for rows.Next() {
+		b := new(SAGEBucket)
+		err = rows.Scan(&b.ID, &b.Name, &b.DataType, &b.TimeCreated, &b.TimeUpdated, &b.Owner)
+		if err != nil {
+			err = fmt.Errorf("(listAllSageBuckets) Could not parse row: %s", err.Error())
+			return
+		}
+		buckets = append(buckets, b)
+	}
+
+	return
+}
+
+// getSageBucketSize returns number of files and total size in bytes of a bucket
+func getSageBucketSize(sageBucketID string) (fileCount int64, totalSize int64, err error) {
+
+	continuationToken := ""
+	for {
+		var listObject *s3.ListObjectsV2Output
+		listObject, err = listSageBucketContent(sageBucketID, "/", true, 0, "", continuationToken)
+		if err != nil {
+			return
+		}
+
+		for _, object := range listObject.Contents {
+			fileCount++
+			if object.Size != nil {
+				totalSize += *object.Size
+			}
+		}
+
+		if listObject.NextContinuationToken == nil || *listObject.NextContinuationToken == "" {
+			break
+		}
+		continuationToken = *listObject.NextContinuationToken
+	}
+
+	return
+}
+
 // GetSageBucket _
 func GetSageBucket(bucketID string) (s SAGEBucket, err error) {
 
@@ -309,7 +377,7 @@ func GetSageBucket(bucketID string) (s SAGEBucket, err error) {
 	err = row.Scan(&s.ID, &s.Name, &s.DataType, &s.TimeCreated, &s.TimeUpdated, &s.Owner)
 	switch {
 	case err == sql.ErrNoRows:
-		err = fmt.Errorf("(GetSageBucket) Bucket not found")
+		err = newSageError(codeNotFound, "Bucket %s not found", bucketID)
 		return
 	case err != nil:
 		err = fmt.Errorf("(GetSageBucket) Could not parse row: %s", err.Error())
@@ -319,6 +387,307 @@ func GetSageBucket(bucketID string) (s SAGEBucket, err error) {
 	return
 }
 
+// updateSageBucketName renames a bucket
+func updateSageBucketName(bucketID string, name string) (err error) {
+
+	db, err := sql.Open("mysql", mysqlDSN)
+	if err != nil {
+		err = fmt.Errorf("Unable to connect to database: %v", err)
+		return
+	}
+	defer db.Close()
+
+	updateQueryStr := "UPDATE Buckets SET name=? WHERE id=UUID_TO_BIN(?) ;"
+	_, err = db.Exec(updateQueryStr, name, bucketID)
+	if err != nil {
+		err = fmt.Errorf("Bucket update in mysql failed: %s", err.Error())
+		return
+	}
+	return
+}
+
+// deleteSageBucket deletes all files of the bucket, its policy, pending transfer, snapshots,
+// multipart uploads and permissions, and finally the bucket itself
+func deleteSageBucket(sageBucketID string) (err error) {
+
+	_, err = deleteAllFiles(sageBucketID)
+	if err != nil {
+		return
+	}
+
+	_, err = deleteBucketPolicy(sageBucketID)
+	if err != nil {
+		return
+	}
+
+	_, err = deletePendingTransfer(sageBucketID)
+	if err != nil {
+		return
+	}
+
+	snapshots, err := listSnapshots(sageBucketID)
+	if err != nil {
+		return
+	}
+	for _, snapshot := range snapshots {
+		err = deleteSnapshot(sageBucketID, snapshot.ID)
+		if err != nil {
+			return
+		}
+	}
+
+	uploads, err := listMultipartUploads(sageBucketID, "")
+	if err != nil {
+		return
+	}
+	for _, u := range uploads {
+		err = abortMultipartUpload(u)
+		if err != nil {
+			return
+		}
+	}
+
+	db, err := sql.Open("mysql", mysqlDSN)
+	if err != nil {
+		err = fmt.Errorf("Unable to connect to database: %v", err)
+		return
+	}
+	defer db.Close()
+
+	_, err = db.Exec("DELETE FROM BucketPermissions WHERE id=UUID_TO_BIN(?) ;", sageBucketID)
+	if err != nil {
+		err = fmt.Errorf("Removing bucket permissions failed: %s", err.Error())
+		return
+	}
+
+	deleteQueryStr := "DELETE FROM Buckets WHERE id=UUID_TO_BIN(?) ;"
+	_, err = db.Exec(deleteQueryStr, sageBucketID)
+	if err != nil {
+		err = fmt.Errorf("Bucket deletion in mysql failed: %s", err.Error())
+		return
+	}
+	return
+}
+
+// sageResource a file or folder (sagePath ending with /) of a bucket
+type sageResource struct {
+	sageBucketID string
+	sagePath     string
+	head         *s3.HeadObjectOutput // files only
+}
+
+func (res *sageResource) isFolder() bool {
+	return strings.HasSuffix(res.sagePath, "/")
+}
+
+// resolveSageResource finds the file or folder of a path. Clients often omit the trailing / of folders,
+// a path without / is a file if it exists and otherwise a folder if there are files below it.
+// res is nil if neither exists.
+func resolveSageResource(sageBucketID string, sagePath string) (res *sageResource, err error) {
+
+	if sagePath == "" || sagePath == "/" {
+		res = &sageResource{sageBucketID: sageBucketID, sagePath: "/"}
+		return
+	}
+
+	trimmed := strings.TrimSuffix(sagePath, "/")
+	if !strings.HasSuffix(sagePath, "/") {
+		var head *s3.HeadObjectOutput
+		head, err = headSageObject(sageBucketID, trimmed)
+		if err == nil {
+			res = &sageResource{sageBucketID: sageBucketID, sagePath: trimmed, head: head}
+			return
+		}
+		if e, ok := err.(*s3APIError); !ok || e.statusCode != http.StatusNotFound {
+			return
+		}
+		err = nil
+	}
+
+	listObject, err := listSageBucketContent(sageBucketID, trimmed+"/", false, 1, "", "")
+	if err != nil {
+		return
+	}
+	if len(listObject.Contents) > 0 || len(listObject.CommonPrefixes) > 0 {
+		res = &sageResource{sageBucketID: sageBucketID, sagePath: trimmed + "/"}
+	}
+	return
+}
+
+// putSageObject uploads the content of body to the SAGE key, contentType may be empty
+func putSageObject(sageBucketID string, sageKey string, body io.Reader, username string, contentType string) (err error) {
+
+	objectMetadata := make(map[string]*string)
+	objectMetadata["owner"] = aws.String(username)
+	//objectMetadata["type"] = &dataType
+
+	return putSageObjectWithMetadata(sageBucketID, sageKey, body, contentType, objectMetadata)
+}
+
+// putSageObjectWithMetadata uploads body, objectMetadata has to contain the owner
+func putSageObjectWithMetadata(sageBucketID string, sageKey string, body io.Reader, contentType string, objectMetadata map[string]*string) (err error) {
+
+	s3BucketName := getS3BucketID(sageBucketID) //s3BucketPrefix + sageBucketID[0:2] // first two characters of uuid
+	s3Key := path.Join(sageBucketID, sageKey)
+	log.Printf("s3BucketName: %s s3Key: %s", s3BucketName, s3Key)
+
+	upParams := &s3manager.UploadInput{
+		Bucket:   aws.String(s3BucketName),
+		Key:      aws.String(s3Key),
+		Body:     body,
+		Metadata: objectMetadata,
+	}
+	if contentType != "" {
+		upParams.ContentType = aws.String(contentType)
+	}
+	uploader := s3manager.NewUploader(newSession)
+	_, err = uploader.Upload(upParams)
+	return
+}
+
+// uploadStagingS3Prefix verified uploads are stored here until their checksums are known, outside of all SAGE bucket prefixes
+const uploadStagingS3Prefix = "_uploads/"
+
+// stageSageUpload uploads body to a new staging key in the S3 bucket of the SAGE bucket
+func stageSageUpload(sageBucketID string, body io.Reader) (stagingKey string, err error) {
+
+	newUUID, err := uuid.NewRandom()
+	if err != nil {
+		err = fmt.Errorf("error generating uuid %s", err.Error())
+		return
+	}
+	stagingKey = uploadStagingS3Prefix + newUUID.String()
+
+	uploader := s3manager.NewUploader(newSession)
+	_, err = uploader.Upload(&s3manager.UploadInput{
+		Bucket: aws.String(getS3BucketID(sageBucketID)),
+		Key:    aws.String(stagingKey),
+		Body:   body,
+	})
+	return
+}
+
+// commitSageUpload copies a staged upload to the SAGE key, with contentType and objectMetadata
+func commitSageUpload(sageBucketID string, stagingKey string, sageKey string, size int64, contentType string, objectMetadata map[string]*string) (err error) {
+	s3BucketName := getS3BucketID(sageBucketID)
+	return copyS3Object(s3BucketName, stagingKey, s3BucketName, path.Join(sageBucketID, sageKey), size, contentType, objectMetadata)
+}
+
+// deleteStagedSageUpload removes a staged upload once it is committed or rejected
+func deleteStagedSageUpload(sageBucketID string, stagingKey string) (err error) {
+	_, err = svc.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(getS3BucketID(sageBucketID)),
+		Key:    aws.String(stagingKey),
+	})
+	if err != nil {
+		err = fmt.Errorf("svc.DeleteObject returned: %s", err.Error())
+	}
+	return
+}
+
+const (
+	maxSingleCopySize = int64(5 << 30) // larger objects have to be copied with a multipart upload
+	minCopyPartSize   = int64(512 << 20)
+)
+
+// putSageFolderMarker stores an empty object for the folder (key ending with /), e.g. to keep empty folders
+func putSageFolderMarker(sageBucketID string, folder string, username string) (etag string, err error) {
+
+	s3Key := path.Join(sageBucketID, folder) + "/"
+	out, err := svc.PutObject(&s3.PutObjectInput{
+		Bucket:   aws.String(getS3BucketID(sageBucketID)),
+		Key:      aws.String(s3Key),
+		Body:     bytes.NewReader(nil),
+		Metadata: map[string]*string{"owner": aws.String(username)},
+	})
+	if err != nil {
+		err = fmt.Errorf("svc.PutObject returned: %s", err.Error())
+		return
+	}
+	etag = aws.StringValue(out.ETag)
+	return
+}
+
+// copyS3Object copies an object within S3, the metadata and content type of the copy are replaced.
+// Source and destination may be identical to only update the metadata.
+func copyS3Object(srcS3Bucket string, srcKey string, s3BucketName string, dstKey string, size int64, contentType string, metadata map[string]*string) (err error) {
+
+	copySource := (&url.URL{Path: srcS3Bucket + "/" + srcKey}).EscapedPath()
+
+	if size <= maxSingleCopySize {
+		copyInput := &s3.CopyObjectInput{
+			Bucket:            aws.String(s3BucketName),
+			Key:               aws.String(dstKey),
+			CopySource:        aws.String(copySource),
+			Metadata:          metadata,
+			MetadataDirective: aws.String(s3.MetadataDirectiveReplace),
+		}
+		if contentType != "" {
+			copyInput.ContentType = aws.String(contentType)
+		}
+		_, err = svc.CopyObject(copyInput)
+		if err != nil {
+			err = fmt.Errorf("svc.CopyObject returned: %s", err.Error())
+		}
+		return
+	}
+
+	createInput := &s3.CreateMultipartUploadInput{
+		Bucket:   aws.String(s3BucketName),
+		Key:      aws.String(dstKey),
+		Metadata: metadata,
+	}
+	if contentType != "" {
+		createInput.ContentType = aws.String(contentType)
+	}
+	mu, err := svc.CreateMultipartUpload(createInput)
+	if err != nil {
+		err = fmt.Errorf("svc.CreateMultipartUpload returned: %s", err.Error())
+		return
+	}
+
+	partSize := size / 10000
+	if partSize < minCopyPartSize {
+		partSize = minCopyPartSize
+	}
+
+	completed := []*s3.CompletedPart{}
+	for start, partNumber := int64(0), int64(1); start < size; start, partNumber = start+partSize, partNumber+1 {
+		end := start + partSize - 1
+		if end >= size {
+			end = size - 1
+		}
+		var out *s3.UploadPartCopyOutput
+		out, err = svc.UploadPartCopy(&s3.UploadPartCopyInput{
+			Bucket:          aws.String(s3BucketName),
+			Key:             aws.String(dstKey),
+			UploadId:        mu.UploadId,
+			PartNumber:      aws.Int64(partNumber),
+			CopySource:      aws.String(copySource),
+			CopySourceRange: aws.String(fmt.Sprintf("bytes=%d-%d", start, end)),
+		})
+		if err != nil {
+			svc.AbortMultipartUpload(&s3.AbortMultipartUploadInput{Bucket: aws.String(s3BucketName), Key: aws.String(dstKey), UploadId: mu.UploadId})
+			err = fmt.Errorf("svc.UploadPartCopy returned: %s", err.Error())
+			return
+		}
+		completed = append(completed, &s3.CompletedPart{ETag: out.CopyPartResult.ETag, PartNumber: aws.Int64(partNumber)})
+	}
+
+	_, err = svc.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(s3BucketName),
+		Key:             aws.String(dstKey),
+		UploadId:        mu.UploadId,
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: completed},
+	})
+	if err != nil {
+		svc.AbortMultipartUpload(&s3.AbortMultipartUploadInput{Bucket: aws.String(s3BucketName), Key: aws.String(dstKey), UploadId: mu.UploadId})
+		err = fmt.Errorf("svc.CompleteMultipartUpload returned: %s", err.Error())
+		return
+	}
+	return
+}
+
 func deleteSAGEFiles(sageBucketID string, files []string) (deleted []string, err error) {
 
 	// convert list of  SAGE file into list of S3 files
@@ -465,13 +834,7 @@ func listSageBucketContentDepreccated(sageBucketID string, folder string, recurs
 	log.Printf("s3BucketName: %s", s3BucketName)
 	log.Printf("sageBucketID: %s", sageBucketID)
 
-	prefix := sageBucketID
-	if folder != "" && folder != "/" {
-		prefix = path.Join(sageBucketID, folder)
-	}
-	if !strings.HasSuffix(prefix, "/") {
-		prefix += "/"
-	}
+	prefix := s3FolderPrefix(sageBucketID, folder)
 
 	loi := &s3.ListObjectsV2Input{
 		Bucket: aws.String(s3BucketName),
@@ -534,6 +897,18 @@ func listSageBucketContentDepreccated(sageBucketID string, folder string, recurs
 	return
 }
 
+// s3FolderPrefix is the S3 prefix of a SAGE folder, listed keys are relative to it
+func s3FolderPrefix(sageBucketID string, folder string) (prefix string) {
+	prefix = sageBucketID
+	if folder != "" && folder != "/" {
+		prefix = path.Join(sageBucketID, folder)
+	}
+	if !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return
+}
+
 func listSageBucketContent(sageBucketID string, folder string, recursive bool, limit int64, sageStartAfter string, continuationToken string) (listObject *s3.ListObjectsV2Output, err error) {
 
 	s3BucketName := getS3BucketID(sageBucketID) //s3BucketPrefix + sageBucketID[0:2]
@@ -560,8 +935,9 @@ func listSageBucketContent(sageBucketID string, folder string, recursive bool, l
 
 	log.Printf("sageStartAfter: %s", sageStartAfter)
 
+	// sageStartAfter is relative to the folder, like the keys of the listing
 	if sageStartAfter != "" {
-		s3startAfter := sageBucketID + "/" + sageStartAfter
+		s3startAfter := prefix + sageStartAfter
 		loi.StartAfter = aws.String(s3startAfter)
 	}
 
@@ -3,10 +3,12 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"net/http/httptest"
 	"strings"
+	"testing"
 )
 
 // deletes a single bucket specified by its bucket ID
@@ -85,3 +87,55 @@ func contains(slice []string, item string) bool {
 func getNewTestingBucketSpecifications(bucketName string) (string, string, string) {
 	return "testuser", "training-data", bucketName
 }
+
+// adds a bucket permission via PUT /objects/{bucket}?permissions on behalf of username
+func addBucketPermissionForTest(bucketID string, username string, granteeType string, grantee string, permission string) (err error) {
+
+	body := fmt.Sprintf(`{"granteeType": "%s", "grantee": "%s", "permission": "%s"}`, granteeType, grantee, permission)
+
+	url := fmt.Sprintf("/api/v1/objects/%s?permissions", bucketID)
+	req, err := http.NewRequest("PUT", url, strings.NewReader(body))
+	if err != nil {
+		return
+	}
+	req.Header.Add("Authorization", "sage user:"+username)
+
+	rr := httptest.NewRecorder()
+	mainRouter.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		err = fmt.Errorf("adding permission failed (%d): %s", rr.Code, rr.Body.String())
+		return
+	}
+	return
+}
+
+// sends a request through mainRouter with the token of username (anonymous if empty) and the given headers
+// returns: response recorder
+func testRequest(t *testing.T, username string, method string, url string, body io.Reader, headers map[string]string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if username != "" {
+		req.Header.Add("Authorization", "sage user:"+username)
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	rr := httptest.NewRecorder()
+	mainRouter.ServeHTTP(rr, req)
+	return rr
+}
+
+// fails the test if the response does not have the expected status code
+func expectStatus(t *testing.T, rr *httptest.ResponseRecorder, statusCode int) {
+	t.Helper()
+
+	if rr.Code != statusCode {
+		t.Fatalf("expected status %d, got %d: %s", statusCode, rr.Code, rr.Body.String())
+	}
+}
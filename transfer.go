@@ -0,0 +1,323 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// BucketTransfer ownership transfer request and response
+type BucketTransfer struct {
+	ErrorStruct       `json:",inline"`
+	Bucket            string     `json:"bucket-id,omitempty"`
+	PreviousOwner     string     `json:"previous_owner,omitempty"`
+	NewOwner          string     `json:"new_owner,omitempty"`
+	RequireAcceptance bool       `json:"require_acceptance,omitempty"`
+	Status            string     `json:"status,omitempty"` // pending or completed
+	TimeCreated       *time.Time `json:"time_created,omitempty"`
+}
+
+// transferBucketOwnership changes the owner and moves the bucket-wide FULL_CONTROL grant
+// from the previous to the new owner, all in one transaction
+func transferBucketOwnership(bucketID string, previousOwner string, newOwner string) (err error) {
+
+	db, err := sql.Open("mysql", mysqlDSN)
+	if err != nil {
+		err = fmt.Errorf("Unable to connect to database: %v", err)
+		return
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		err = fmt.Errorf("db.Begin returned: %s", err.Error())
+		return
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	// owner must not have changed in the meantime
+	result, err := tx.Exec("UPDATE Buckets SET owner=? WHERE id=UUID_TO_BIN(?) AND owner=? ;", newOwner, bucketID, previousOwner)
+	if err != nil {
+		err = fmt.Errorf("Updating bucket owner failed: %s", err.Error())
+		return
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		err = fmt.Errorf("result.RowsAffected returned: %s", err.Error())
+		return
+	}
+	if updated != 1 {
+		err = fmt.Errorf("Bucket %s is not owned by %s", bucketID, previousOwner)
+		return
+	}
+
+	_, err = tx.Exec("DELETE FROM BucketPermissions WHERE id=UUID_TO_BIN(?) AND granteeType='USER' AND grantee=? AND permission='FULL_CONTROL' AND prefix='' ;", bucketID, previousOwner)
+	if err != nil {
+		err = fmt.Errorf("Removing FULL_CONTROL of previous owner failed: %s", err.Error())
+		return
+	}
+
+	_, err = tx.Exec("INSERT INTO BucketPermissions (id, granteeType, grantee, permission, prefix, expires) VALUES ( UUID_TO_BIN(?), 'USER', ?, 'FULL_CONTROL', '', NULL) ON DUPLICATE KEY UPDATE expires=NULL ;", bucketID, newOwner)
+	if err != nil {
+		err = fmt.Errorf("Adding FULL_CONTROL for new owner failed: %s", err.Error())
+		return
+	}
+
+	_, err = tx.Exec("DELETE FROM BucketTransfers WHERE id=UUID_TO_BIN(?) ;", bucketID)
+	if err != nil {
+		err = fmt.Errorf("Removing pending transfer failed: %s", err.Error())
+		return
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		err = fmt.Errorf("tx.Commit returned: %s", err.Error())
+		return
+	}
+	return
+}
+
+// getPendingTransfer returns the pending transfer of a bucket, or nil if there is none
+func getPendingTransfer(bucketID string) (transfer *BucketTransfer, err error) {
+
+	db, err := sql.Open("mysql", mysqlDSN)
+	if err != nil {
+		err = fmt.Errorf("Unable to connect to database: %v", err)
+		return
+	}
+	defer db.Close()
+
+	t := &BucketTransfer{Status: "pending", RequireAcceptance: true}
+	queryStr := "SELECT BIN_TO_UUID(id), previous_owner, new_owner, time_created FROM BucketTransfers WHERE id=UUID_TO_BIN(?) ;"
+	err = db.QueryRow(queryStr, bucketID).Scan(&t.Bucket, &t.PreviousOwner, &t.NewOwner, &t.TimeCreated)
+	switch {
+	case err == sql.ErrNoRows:
+		err = nil
+		return
+	case err != nil:
+		err = fmt.Errorf("(getPendingTransfer) Could not parse row: %s", err.Error())
+		return
+	}
+	transfer = t
+	return
+}
+
+// createPendingTransfer stores a transfer that has to be accepted by the new owner, it replaces any previous one
+func createPendingTransfer(bucketID string, previousOwner string, newOwner string) (err error) {
+
+	db, err := sql.Open("mysql", mysqlDSN)
+	if err != nil {
+		err = fmt.Errorf("Unable to connect to database: %v", err)
+		return
+	}
+	defer db.Close()
+
+	insertQueryStr := "REPLACE INTO BucketTransfers (id, previous_owner, new_owner) VALUES ( UUID_TO_BIN(?), ?, ? ) ;"
+	_, err = db.Exec(insertQueryStr, bucketID, previousOwner, newOwner)
+	if err != nil {
+		err = fmt.Errorf("Storing bucket transfer failed: %s", err.Error())
+		return
+	}
+	return
+}
+
+// deletePendingTransfer removes the pending transfer, deleted is false if there was none
+func deletePendingTransfer(bucketID string) (deleted bool, err error) {
+
+	db, err := sql.Open("mysql", mysqlDSN)
+	if err != nil {
+		err = fmt.Errorf("Unable to connect to database: %v", err)
+		return
+	}
+	defer db.Close()
+
+	result, err := db.Exec("DELETE FROM BucketTransfers WHERE id=UUID_TO_BIN(?) ;", bucketID)
+	if err != nil {
+		err = fmt.Errorf("Removing bucket transfer failed: %s", err.Error())
+		return
+	}
+
+	deletedNumber, err := result.RowsAffected()
+	if err != nil {
+		err = fmt.Errorf("result.RowsAffected returned: %s", err.Error())
+		return
+	}
+	deleted = deletedNumber > 0
+	return
+}
+
+// checkTransferInitiator only the current owner or an administrator can transfer a bucket
+func checkTransferInitiator(username string, bucket *SAGEBucket, action string) (err error) {
+	if username != "" && username == bucket.Owner {
+		return
+	}
+	if isAdmin(username) {
+		err = recordAdminAction(username, action, bucket.ID, fmt.Sprintf("owner=%s", bucket.Owner))
+		return
+	}
+	err = fmt.Errorf("Only the owner of bucket %s can transfer it (%s)", bucket.ID, username)
+	return
+}
+
+// PUT /objects/{bucket}?transfer         initiate transfer, body: {"new_owner": "...", "require_acceptance": true}
+// PUT /objects/{bucket}?transfer=accept  new owner accepts pending transfer
+func putBucketTransferRequest(w http.ResponseWriter, r *http.Request, username string, sageBucketID string) {
+
+	bucket, err := GetSageBucket(sageBucketID)
+	if err != nil {
+		respondError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	if strings.ToLower(r.URL.Query().Get("transfer")) == "accept" {
+
+		transfer, err := getPendingTransfer(sageBucketID)
+		if err != nil {
+			respondError(w, err, http.StatusInternalServerError)
+			return
+		}
+		if transfer == nil {
+			respondJSONError(w, http.StatusConflict, "Bucket %s has no pending transfer", sageBucketID)
+			return
+		}
+		if username == "" || transfer.NewOwner != username {
+			respondJSONError(w, deniedStatus(username), "Only %s can accept the transfer of bucket %s", transfer.NewOwner, sageBucketID)
+			return
+		}
+
+		err = transferBucketOwnership(sageBucketID, transfer.PreviousOwner, transfer.NewOwner)
+		if err != nil {
+			respondError(w, err, http.StatusInternalServerError)
+			return
+		}
+		log.Printf("bucket %s transferred from %s to %s", sageBucketID, transfer.PreviousOwner, transfer.NewOwner)
+
+		transfer.Status = "completed"
+		respondJSON(w, http.StatusOK, transfer)
+		return
+	}
+
+	err = checkTransferInitiator(username, &bucket, "transfer_bucket")
+	if err != nil {
+		respondJSONError(w, deniedStatus(username), err.Error())
+		return
+	}
+
+	transfer := &BucketTransfer{}
+	err = json.NewDecoder(r.Body).Decode(transfer)
+	if err != nil {
+		respondJSONError(w, http.StatusBadRequest, "Could not parse json: %s", err.Error())
+		return
+	}
+
+	if transfer.NewOwner == "" {
+		respondJSONError(w, http.StatusUnprocessableEntity, "new_owner missing")
+		return
+	}
+	if transfer.NewOwner == bucket.Owner {
+		respondJSONError(w, http.StatusUnprocessableEntity, "%s already owns bucket %s", transfer.NewOwner, sageBucketID)
+		return
+	}
+
+	transfer.Bucket = sageBucketID
+	transfer.PreviousOwner = bucket.Owner
+
+	if transfer.RequireAcceptance {
+		err = createPendingTransfer(sageBucketID, bucket.Owner, transfer.NewOwner)
+		if err != nil {
+			respondError(w, err, http.StatusInternalServerError)
+			return
+		}
+		transfer.Status = "pending"
+		respondJSON(w, http.StatusOK, transfer)
+		return
+	}
+
+	err = transferBucketOwnership(sageBucketID, bucket.Owner, transfer.NewOwner)
+	if err != nil {
+		respondError(w, err, http.StatusInternalServerError)
+		return
+	}
+	log.Printf("bucket %s transferred from %s to %s", sageBucketID, bucket.Owner, transfer.NewOwner)
+
+	transfer.Status = "completed"
+	respondJSON(w, http.StatusOK, transfer)
+}
+
+// GET /objects/{bucket}?transfer shows the pending transfer to owner, recipient and administrators
+func getBucketTransferRequest(w http.ResponseWriter, username string, sageBucketID string) {
+
+	bucket, err := GetSageBucket(sageBucketID)
+	if err != nil {
+		respondError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	transfer, err := getPendingTransfer(sageBucketID)
+	if err != nil {
+		respondError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	isRecipient := transfer != nil && username != "" && transfer.NewOwner == username
+	if !isRecipient {
+		err = checkTransferInitiator(username, &bucket, "get_transfer")
+		if err != nil {
+			respondJSONError(w, deniedStatus(username), err.Error())
+			return
+		}
+	}
+
+	if transfer == nil {
+		respondJSONError(w, http.StatusNotFound, "Bucket %s has no pending transfer", sageBucketID)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, transfer)
+}
+
+// DELETE /objects/{bucket}?transfer cancels (owner, administrator) or declines (recipient) a pending transfer
+func deleteBucketTransferRequest(w http.ResponseWriter, username string, sageBucketID string) {
+
+	bucket, err := GetSageBucket(sageBucketID)
+	if err != nil {
+		respondError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	transfer, err := getPendingTransfer(sageBucketID)
+	if err != nil {
+		respondError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	isRecipient := transfer != nil && username != "" && transfer.NewOwner == username
+	if !isRecipient {
+		err = checkTransferInitiator(username, &bucket, "cancel_transfer")
+		if err != nil {
+			respondJSONError(w, deniedStatus(username), err.Error())
+			return
+		}
+	}
+
+	deleted, err := deletePendingTransfer(sageBucketID)
+	if err != nil {
+		respondError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	dr := DeleteRespsonse{}
+	dr.Deleted = []string{}
+	if deleted {
+		dr.Deleted = append(dr.Deleted, "transfer")
+	}
+	respondJSON(w, http.StatusOK, dr)
+}
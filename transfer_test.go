@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestBucketTransfer(t *testing.T) {
+
+	testuser := "testuser"
+	otheruser := "otheruser"
+
+	newBucket, err := createSageBucket(testuser, "training-data", "testing-bucket1", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bucketID := newBucket.ID
+
+	url := fmt.Sprintf("/api/v1/objects/%s?transfer", bucketID)
+
+	// only the owner can initiate a transfer
+	req, err := http.NewRequest("PUT", url, strings.NewReader(`{"new_owner": "otheruser"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Add("Authorization", "sage user:"+otheruser)
+	rr := httptest.NewRecorder()
+	mainRouter.ServeHTTP(rr, req)
+	if rr.Code == http.StatusOK {
+		t.Fatalf("non-owner was able to transfer bucket")
+	}
+
+	req, err = http.NewRequest("PUT", url, strings.NewReader(`{"new_owner": "otheruser", "require_acceptance": true}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Add("Authorization", "sage user:"+testuser)
+	rr = httptest.NewRecorder()
+	mainRouter.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v (%s)", rr.Code, http.StatusOK, rr.Body.String())
+	}
+
+	transfer := BucketTransfer{}
+	err = json.Unmarshal(rr.Body.Bytes(), &transfer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if transfer.Status != "pending" {
+		t.Fatalf("expected pending transfer, got \"%s\"", transfer.Status)
+	}
+
+	bucket, err := GetSageBucket(bucketID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bucket.Owner != testuser {
+		t.Fatalf("owner changed before transfer was accepted")
+	}
+
+	req, err = http.NewRequest("PUT", url+"=accept", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Add("Authorization", "sage user:"+otheruser)
+	rr = httptest.NewRecorder()
+	mainRouter.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v (%s)", rr.Code, http.StatusOK, rr.Body.String())
+	}
+
+	bucket, err = GetSageBucket(bucketID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bucket.Owner != otheruser {
+		t.Fatalf("owner wrong, expected \"%s\", got \"%s\"", otheruser, bucket.Owner)
+	}
+
+	allowed, err := userIsAllowed(otheruser, bucketID, actionDeleteBucket, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !allowed {
+		t.Fatal("new owner should have FULL_CONTROL")
+	}
+
+	allowed, err = userIsAllowed(testuser, bucketID, actionDeleteBucket, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if allowed {
+		t.Fatal("previous owner should have lost FULL_CONTROL")
+	}
+}
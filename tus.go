@@ -0,0 +1,641 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// Resumable uploads following the tus protocol (https://tus.io/protocols/resumable-upload.html),
+// core protocol with the creation and termination extensions.
+//
+// The data is streamed into a S3 multipart upload of the final key. All parts except the last
+// have exactly tusPartSize bytes, data of a PATCH request that does not fill a whole part is kept
+// in a temporary S3 object and prepended to the next PATCH request.
+
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,termination"
+	tusPartSize   = int64(16 << 20) // 16MB, S3 requires at least 5MB
+	tusMaxSize    = tusPartSize * 10000
+	tusS3Prefix   = "_tus/" // outside of all SAGE bucket prefixes
+)
+
+// tusUpload state of a resumable upload as stored in mysql
+type tusUpload struct {
+	ID             string
+	BucketID       string
+	SageKey        string
+	Owner          string
+	Length         int64
+	Offset         int64
+	S3UploadID     string
+	PartCount      int64
+	IncompleteSize int64
+}
+
+func (u *tusUpload) incompleteS3Key() string {
+	return tusS3Prefix + u.ID + ".part"
+}
+
+func (u *tusUpload) s3Key() string {
+	return path.Join(u.BucketID, u.SageKey)
+}
+
+// parseTusMetadata parses the Upload-Metadata header, "key base64value,key2 base64value2"
+func parseTusMetadata(header string) (metadata map[string]string, err error) {
+	metadata = map[string]string{}
+	if header == "" {
+		return
+	}
+	for _, pair := range strings.Split(header, ",") {
+		fields := strings.Fields(pair)
+		if len(fields) == 0 || len(fields) > 2 {
+			err = fmt.Errorf("Upload-Metadata invalid")
+			return
+		}
+		value := ""
+		if len(fields) == 2 {
+			var decoded []byte
+			decoded, err = base64.StdEncoding.DecodeString(fields[1])
+			if err != nil {
+				err = fmt.Errorf("Upload-Metadata value of %s is not base64: %s", fields[0], err.Error())
+				return
+			}
+			value = string(decoded)
+		}
+		metadata[fields[0]] = value
+	}
+	return
+}
+
+func getTusUpload(uploadID string) (u *tusUpload, err error) {
+
+	db, err := sql.Open("mysql", mysqlDSN)
+	if err != nil {
+		err = fmt.Errorf("Unable to connect to database: %v", err)
+		return
+	}
+	defer db.Close()
+
+	t := &tusUpload{}
+	queryStr := "SELECT id, BIN_TO_UUID(bucket), sage_key, owner, upload_length, upload_offset, s3_upload_id, part_count, incomplete_size FROM TusUploads WHERE id=? ;"
+	err = db.QueryRow(queryStr, uploadID).Scan(&t.ID, &t.BucketID, &t.SageKey, &t.Owner, &t.Length, &t.Offset, &t.S3UploadID, &t.PartCount, &t.IncompleteSize)
+	switch {
+	case err == sql.ErrNoRows:
+		err = nil
+		return
+	case err != nil:
+		err = fmt.Errorf("(getTusUpload) Could not parse row: %s", err.Error())
+		return
+	}
+	u = t
+	return
+}
+
+func insertTusUpload(u *tusUpload) (err error) {
+
+	db, err := sql.Open("mysql", mysqlDSN)
+	if err != nil {
+		err = fmt.Errorf("Unable to connect to database: %v", err)
+		return
+	}
+	defer db.Close()
+
+	insertQueryStr := "INSERT INTO TusUploads (id, bucket, sage_key, owner, upload_length, upload_offset, s3_upload_id, part_count, incomplete_size) VALUES ( ?, UUID_TO_BIN(?), ?, ?, ?, ?, ?, ?, ? ) ;"
+	_, err = db.Exec(insertQueryStr, u.ID, u.BucketID, u.SageKey, u.Owner, u.Length, u.Offset, u.S3UploadID, u.PartCount, u.IncompleteSize)
+	if err != nil {
+		err = fmt.Errorf("Storing upload failed: %s", err.Error())
+		return
+	}
+	return
+}
+
+// updateTusUploadProgress persists offset, part count and size of the incomplete part
+func updateTusUploadProgress(u *tusUpload) (err error) {
+
+	db, err := sql.Open("mysql", mysqlDSN)
+	if err != nil {
+		err = fmt.Errorf("Unable to connect to database: %v", err)
+		return
+	}
+	defer db.Close()
+
+	_, err = db.Exec("UPDATE TusUploads SET upload_offset=?, part_count=?, incomplete_size=? WHERE id=? ;", u.Offset, u.PartCount, u.IncompleteSize, u.ID)
+	if err != nil {
+		err = fmt.Errorf("Updating upload failed: %s", err.Error())
+		return
+	}
+	return
+}
+
+func deleteTusUploadRow(uploadID string) (err error) {
+
+	db, err := sql.Open("mysql", mysqlDSN)
+	if err != nil {
+		err = fmt.Errorf("Unable to connect to database: %v", err)
+		return
+	}
+	defer db.Close()
+
+	_, err = db.Exec("DELETE FROM TusUploads WHERE id=? ;", uploadID)
+	if err != nil {
+		err = fmt.Errorf("Removing upload failed: %s", err.Error())
+		return
+	}
+	return
+}
+
+// lockTusUpload prevents concurrent PATCH requests on the same upload (also across several
+// API instances), locks of requests that did not finish are ignored after 15 minutes
+func lockTusUpload(uploadID string, lock bool) (ok bool, err error) {
+
+	db, err := sql.Open("mysql", mysqlDSN)
+	if err != nil {
+		err = fmt.Errorf("Unable to connect to database: %v", err)
+		return
+	}
+	defer db.Close()
+
+	if !lock {
+		_, err = db.Exec("UPDATE TusUploads SET lock_time=NULL WHERE id=? ;", uploadID)
+		ok = err == nil
+		return
+	}
+
+	result, err := db.Exec("UPDATE TusUploads SET lock_time=NOW() WHERE id=? AND (lock_time IS NULL OR lock_time < NOW() - INTERVAL 15 MINUTE) ;", uploadID)
+	if err != nil {
+		err = fmt.Errorf("Locking upload failed: %s", err.Error())
+		return
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return
+	}
+	ok = affected == 1
+	return
+}
+
+// uploadTusPart uploads the next part of the multipart upload
+func uploadTusPart(u *tusUpload, data []byte) (err error) {
+
+	_, err = svc.UploadPart(&s3.UploadPartInput{
+		Bucket:     aws.String(getS3BucketID(u.BucketID)),
+		Key:        aws.String(u.s3Key()),
+		UploadId:   aws.String(u.S3UploadID),
+		PartNumber: aws.Int64(u.PartCount + 1),
+		Body:       bytes.NewReader(data),
+	})
+	if err != nil {
+		err = fmt.Errorf("svc.UploadPart returned: %s", err.Error())
+		return
+	}
+	u.PartCount++
+	return
+}
+
+// completeTusUpload assembles the uploaded parts into the final object
+func completeTusUpload(u *tusUpload) (err error) {
+
+	s3BucketName := getS3BucketID(u.BucketID)
+
+	completed := []*s3.CompletedPart{}
+	err = svc.ListPartsPages(&s3.ListPartsInput{
+		Bucket:   aws.String(s3BucketName),
+		Key:      aws.String(u.s3Key()),
+		UploadId: aws.String(u.S3UploadID),
+	}, func(page *s3.ListPartsOutput, lastPage bool) bool {
+		for _, p := range page.Parts {
+			completed = append(completed, &s3.CompletedPart{ETag: p.ETag, PartNumber: p.PartNumber})
+		}
+		return true
+	})
+	if err != nil {
+		err = fmt.Errorf("svc.ListParts returned: %s", err.Error())
+		return
+	}
+
+	if len(completed) == 0 {
+		// zero-length upload, S3 does not allow completing a multipart upload without parts
+		_, err = svc.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(s3BucketName),
+			Key:      aws.String(u.s3Key()),
+			UploadId: aws.String(u.S3UploadID),
+		})
+		if err != nil {
+			err = fmt.Errorf("svc.AbortMultipartUpload returned: %s", err.Error())
+			return
+		}
+		err = putSageObject(u.BucketID, u.SageKey, bytes.NewReader([]byte{}), u.Owner, "")
+		if err != nil {
+			return
+		}
+	} else {
+		_, err = svc.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+			Bucket:          aws.String(s3BucketName),
+			Key:             aws.String(u.s3Key()),
+			UploadId:        aws.String(u.S3UploadID),
+			MultipartUpload: &s3.CompletedMultipartUpload{Parts: completed},
+		})
+		if err != nil {
+			err = fmt.Errorf("svc.CompleteMultipartUpload returned: %s", err.Error())
+			return
+		}
+	}
+
+	err = deleteTusUploadRow(u.ID)
+	if err != nil {
+		return
+	}
+
+	log.Printf("tus upload %s completed: %s/%s (%d bytes)", u.ID, u.BucketID, u.SageKey, u.Length)
+	fileUploadCounter.Inc()
+	return
+}
+
+// abortTusUpload removes all data of an unfinished upload, an S3 upload that is already gone
+// (e.g. removed by a bucket lifecycle rule) only leaves the row to delete
+func abortTusUpload(u *tusUpload) (err error) {
+
+	s3BucketName := getS3BucketID(u.BucketID)
+
+	_, err = svc.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(s3BucketName),
+		Key:      aws.String(u.s3Key()),
+		UploadId: aws.String(u.S3UploadID),
+	})
+	if err != nil && !strings.Contains(err.Error(), s3.ErrCodeNoSuchUpload) {
+		err = fmt.Errorf("svc.AbortMultipartUpload returned: %s", err.Error())
+		return
+	}
+
+	if u.IncompleteSize > 0 {
+		_, err = svc.DeleteObject(&s3.DeleteObjectInput{
+			Bucket: aws.String(s3BucketName),
+			Key:    aws.String(u.incompleteS3Key()),
+		})
+		if err != nil {
+			err = fmt.Errorf("svc.DeleteObject returned: %s", err.Error())
+			return
+		}
+	}
+
+	err = deleteTusUploadRow(u.ID)
+	return
+}
+
+func setTusHeaders(w http.ResponseWriter) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Cache-Control", "no-store")
+}
+
+// checkTusRequest verifies the protocol version and loads the upload of the request, only its creator can access it
+func checkTusRequest(w http.ResponseWriter, r *http.Request) (u *tusUpload, ok bool) {
+
+	setTusHeaders(w)
+
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		respondJSONError(w, http.StatusPreconditionFailed, "Tus-Resumable %s required", tusVersion)
+		return
+	}
+
+	vars := mux.Vars(r)
+	username := vars["username"]
+
+	u, err := getTusUpload(vars["upload"])
+	if err != nil {
+		respondError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if u == nil || u.Owner != username {
+		respondJSONError(w, http.StatusNotFound, "upload %s not found", vars["upload"])
+		return
+	}
+	ok = true
+	return
+}
+
+// OPTIONS /tus and /tus/{upload}
+func tusOptions(w http.ResponseWriter, r *http.Request) {
+	setTusHeaders(w)
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", tusExtensions)
+	w.Header().Set("Tus-Max-Size", strconv.FormatInt(tusMaxSize, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// POST /tus creates an upload. Required headers: Upload-Length and Upload-Metadata with "bucket",
+// and "key" and/or "filename". If key is empty or ends with / the filename is appended.
+func tusCreate(w http.ResponseWriter, r *http.Request) {
+
+	setTusHeaders(w)
+
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		respondJSONError(w, http.StatusPreconditionFailed, "Tus-Resumable %s required", tusVersion)
+		return
+	}
+
+	vars := mux.Vars(r)
+	username := vars["username"]
+	if username == "" {
+		respondJSONError(w, http.StatusUnauthorized, "resumable uploads require authentication")
+		return
+	}
+
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		respondJSONError(w, http.StatusBadRequest, "Upload-Length header missing or invalid")
+		return
+	}
+	if length > tusMaxSize {
+		respondJSONError(w, http.StatusRequestEntityTooLarge, "Upload-Length exceeds Tus-Max-Size %d", tusMaxSize)
+		return
+	}
+
+	metadata, err := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		respondJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	sageBucketID := metadata["bucket"]
+	if len(sageBucketID) != 36 {
+		respondJSONError(w, http.StatusUnprocessableEntity, "Upload-Metadata bucket missing or invalid")
+		return
+	}
+
+	sageKey := metadata["key"]
+	if sageKey == "" || strings.HasSuffix(sageKey, "/") {
+		filename := metadata["filename"]
+		if filename == "" {
+			respondJSONError(w, http.StatusUnprocessableEntity, "Upload-Metadata needs a key or a filename")
+			return
+		}
+		sageKey = path.Join(sageKey, path.Clean("/"+filename))
+	}
+	sageKey = strings.TrimPrefix(path.Clean("/"+sageKey), "/")
+
+	_, err = GetSageBucket(sageBucketID)
+	if err != nil {
+		respondError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	allowed, err := userIsAllowed(username, sageBucketID, actionWriteObject, sageKey)
+	if err != nil {
+		respondError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if !allowed {
+		respondJSONError(w, deniedStatus(username), "Write access to %s denied (%s, %s)", sageKey, username, sageBucketID)
+		return
+	}
+
+	newUUID, err := uuid.NewRandom()
+	if err != nil {
+		respondJSONError(w, http.StatusInternalServerError, "error generating uuid %s", err.Error())
+		return
+	}
+
+	u := &tusUpload{ID: newUUID.String(), BucketID: sageBucketID, SageKey: sageKey, Owner: username, Length: length}
+
+	mu, err := svc.CreateMultipartUpload(&s3.CreateMultipartUploadInput{
+		Bucket:   aws.String(getS3BucketID(sageBucketID)),
+		Key:      aws.String(u.s3Key()),
+		Metadata: map[string]*string{"owner": aws.String(username)},
+	})
+	if err != nil {
+		respondJSONError(w, errorStatus(err, http.StatusInternalServerError), "svc.CreateMultipartUpload returned: %s", err.Error())
+		return
+	}
+	u.S3UploadID = *mu.UploadId
+
+	err = insertTusUpload(u)
+	if err != nil {
+		respondError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	if length == 0 {
+		err = completeTusUpload(u)
+		if err != nil {
+			respondError(w, err, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	log.Printf("tus upload %s created: %s/%s (%d bytes)", u.ID, sageBucketID, sageKey, length)
+
+	w.Header().Set("Location", "/api/v1/tus/"+u.ID)
+	w.Header().Set("Upload-Offset", "0")
+	w.WriteHeader(http.StatusCreated)
+}
+
+// HEAD /tus/{upload} returns the current offset
+func tusHead(w http.ResponseWriter, r *http.Request) {
+
+	u, ok := checkTusRequest(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(u.Length, 10))
+	w.WriteHeader(http.StatusOK)
+}
+
+// PATCH /tus/{upload} appends data at Upload-Offset
+func tusPatch(w http.ResponseWriter, r *http.Request) {
+
+	u, ok := checkTusRequest(w, r)
+	if !ok {
+		return
+	}
+
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		respondJSONError(w, http.StatusUnsupportedMediaType, "Content-Type application/offset+octet-stream required")
+		return
+	}
+
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		respondJSONError(w, http.StatusBadRequest, "Upload-Offset header missing or invalid")
+		return
+	}
+	// permissions may have changed since the upload was created
+	allowed, err := userIsAllowed(u.Owner, u.BucketID, actionWriteObject, u.SageKey)
+	if err != nil {
+		respondError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if !allowed {
+		respondJSONError(w, http.StatusForbidden, "Write access to %s denied (%s, %s)", u.SageKey, u.Owner, u.BucketID)
+		return
+	}
+
+	locked, err := lockTusUpload(u.ID, true)
+	if err != nil {
+		respondError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if !locked {
+		respondJSONError(w, http.StatusLocked, "upload %s is busy with another request", u.ID)
+		return
+	}
+	defer lockTusUpload(u.ID, false)
+
+	// another request may have written data (or finished the upload) before the lock was taken
+	u, err = getTusUpload(u.ID)
+	if err != nil {
+		respondError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if u == nil {
+		respondJSONError(w, http.StatusNotFound, "upload %s not found", mux.Vars(r)["upload"])
+		return
+	}
+	if offset != u.Offset {
+		respondJSONError(w, http.StatusConflict, "Upload-Offset %d does not match current offset %d", offset, u.Offset)
+		return
+	}
+
+	s3BucketName := getS3BucketID(u.BucketID)
+
+	buffer := make([]byte, 0, tusPartSize)
+	hadIncomplete := u.IncompleteSize > 0
+	if hadIncomplete {
+		out, err := svc.GetObject(&s3.GetObjectInput{
+			Bucket: aws.String(s3BucketName),
+			Key:    aws.String(u.incompleteS3Key()),
+		})
+		if err != nil {
+			respondJSONError(w, errorStatus(err, http.StatusInternalServerError), "Error getting incomplete part: %s", err.Error())
+			return
+		}
+		buffer, err = ioutil.ReadAll(out.Body)
+		out.Body.Close()
+		if err != nil {
+			respondJSONError(w, errorStatus(err, http.StatusInternalServerError), "Error getting incomplete part: %s", err.Error())
+			return
+		}
+		if int64(len(buffer)) != u.IncompleteSize {
+			respondJSONError(w, http.StatusInternalServerError, "incomplete part has %d bytes, expected %d", len(buffer), u.IncompleteSize)
+			return
+		}
+	}
+
+	body := io.LimitReader(r.Body, u.Length-u.Offset)
+	var readErr error
+	for {
+		// fill the buffer up to one part
+		n := 0
+		n, readErr = io.ReadFull(body, buffer[len(buffer):tusPartSize])
+		buffer = buffer[:len(buffer)+n]
+		u.Offset += int64(n)
+		fileUploadByteSize.Add(float64(n))
+
+		if int64(len(buffer)) < tusPartSize {
+			break
+		}
+
+		err = uploadTusPart(u, buffer)
+		if err != nil {
+			respondError(w, err, http.StatusInternalServerError)
+			return
+		}
+		buffer = buffer[:0]
+		u.IncompleteSize = 0
+
+		err = updateTusUploadProgress(u)
+		if err != nil {
+			respondError(w, err, http.StatusInternalServerError)
+			return
+		}
+	}
+	if readErr == io.ErrUnexpectedEOF || readErr == io.EOF {
+		readErr = nil
+	}
+
+	// remaining data is either the last part or has to be kept for the next request
+	if u.Offset == u.Length && len(buffer) > 0 {
+		err = uploadTusPart(u, buffer)
+		if err != nil {
+			respondError(w, err, http.StatusInternalServerError)
+			return
+		}
+		u.IncompleteSize = 0
+	} else if int64(len(buffer)) != u.IncompleteSize {
+		_, err = svc.PutObject(&s3.PutObjectInput{
+			Bucket: aws.String(s3BucketName),
+			Key:    aws.String(u.incompleteS3Key()),
+			Body:   bytes.NewReader(buffer),
+		})
+		if err != nil {
+			respondJSONError(w, errorStatus(err, http.StatusInternalServerError), "Storing incomplete part failed: %s", err.Error())
+			return
+		}
+		u.IncompleteSize = int64(len(buffer))
+	}
+
+	if u.Offset == u.Length {
+		err = completeTusUpload(u)
+		if err != nil {
+			respondError(w, err, http.StatusInternalServerError)
+			return
+		}
+	} else {
+		err = updateTusUploadProgress(u)
+		if err != nil {
+			respondError(w, err, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if hadIncomplete && u.IncompleteSize == 0 {
+		// the stored incomplete part has been uploaded as part of a full one
+		svc.DeleteObject(&s3.DeleteObjectInput{
+			Bucket: aws.String(s3BucketName),
+			Key:    aws.String(u.incompleteS3Key()),
+		})
+	}
+
+	if readErr != nil {
+		// the client probably disconnected, the received data has been stored and can be resumed
+		log.Printf("tus upload %s interrupted at offset %d: %s", u.ID, u.Offset, readErr.Error())
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// DELETE /tus/{upload} terminates an upload
+func tusDelete(w http.ResponseWriter, r *http.Request) {
+
+	u, ok := checkTusRequest(w, r)
+	if !ok {
+		return
+	}
+
+	err := abortTusUpload(u)
+	if err != nil {
+		respondError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTusUpload(t *testing.T) {
+
+	testuser := "testuser"
+	otheruser := "otheruser"
+
+	newBucket, err := createSageBucket(testuser, "training-data", "testing-bucket1", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bucketID := newBucket.ID
+
+	content := "hello resumable world"
+	metadata := fmt.Sprintf("bucket %s,key %s", base64.StdEncoding.EncodeToString([]byte(bucketID)), base64.StdEncoding.EncodeToString([]byte("tus/test.txt")))
+
+	tusResumable := map[string]string{"Tus-Resumable": tusVersion}
+
+	// user without WRITE permission
+	rr := testRequest(t, otheruser, "POST", "/api/v1/tus", nil, map[string]string{"Tus-Resumable": tusVersion, "Upload-Length": fmt.Sprintf("%d", len(content)), "Upload-Metadata": metadata})
+	if rr.Code == http.StatusCreated {
+		t.Fatalf("otheruser was able to create upload")
+	}
+
+	rr = testRequest(t, testuser, "POST", "/api/v1/tus", nil, map[string]string{"Tus-Resumable": tusVersion, "Upload-Length": fmt.Sprintf("%d", len(content)), "Upload-Metadata": metadata})
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("create returned %d: %s", rr.Code, rr.Body.String())
+	}
+	uploadURL := rr.Header().Get("Location")
+	if uploadURL == "" {
+		t.Fatalf("Location header missing")
+	}
+
+	patchHeaders := func(offset int) map[string]string {
+		return map[string]string{"Tus-Resumable": tusVersion, "Content-Type": "application/offset+octet-stream", "Upload-Offset": fmt.Sprintf("%d", offset)}
+	}
+
+	// first chunk
+	rr = testRequest(t, testuser, "PATCH", uploadURL, strings.NewReader(content[:6]), patchHeaders(0))
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("patch returned %d: %s", rr.Code, rr.Body.String())
+	}
+
+	// only the creator can access the upload
+	rr = testRequest(t, otheruser, "HEAD", uploadURL, nil, tusResumable)
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("HEAD by otheruser returned %d", rr.Code)
+	}
+
+	rr = testRequest(t, testuser, "HEAD", uploadURL, nil, tusResumable)
+	if rr.Header().Get("Upload-Offset") != "6" {
+		t.Fatalf("expected offset 6, got %s", rr.Header().Get("Upload-Offset"))
+	}
+
+	// wrong offset
+	rr = testRequest(t, testuser, "PATCH", uploadURL, strings.NewReader(content[3:]), patchHeaders(3))
+	if rr.Code != http.StatusConflict {
+		t.Fatalf("patch with wrong offset returned %d", rr.Code)
+	}
+
+	rr = testRequest(t, testuser, "PATCH", uploadURL, strings.NewReader(content[6:]), patchHeaders(6))
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("patch returned %d: %s", rr.Code, rr.Body.String())
+	}
+
+	// upload is completed and the file is available
+	rr = testRequest(t, testuser, "HEAD", uploadURL, nil, tusResumable)
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("completed upload still exists (%d)", rr.Code)
+	}
+
+	req, err := http.NewRequest("GET", fmt.Sprintf("/api/v1/objects/%s/tus/test.txt", bucketID), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Add("Authorization", "sage user:"+testuser)
+	rr = httptest.NewRecorder()
+	mainRouter.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("download returned %d: %s", rr.Code, rr.Body.String())
+	}
+	body, err := ioutil.ReadAll(rr.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != content {
+		t.Fatalf("expected %q, got %q", content, string(body))
+	}
+
+	// termination
+	rr = testRequest(t, testuser, "POST", "/api/v1/tus", nil, map[string]string{"Tus-Resumable": tusVersion, "Upload-Length": "100", "Upload-Metadata": metadata})
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("create returned %d: %s", rr.Code, rr.Body.String())
+	}
+	uploadURL = rr.Header().Get("Location")
+	rr = testRequest(t, testuser, "DELETE", uploadURL, nil, tusResumable)
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("delete returned %d: %s", rr.Code, rr.Body.String())
+	}
+	rr = testRequest(t, testuser, "HEAD", uploadURL, nil, tusResumable)
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("terminated upload still exists (%d)", rr.Code)
+	}
+}
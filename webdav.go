@@ -0,0 +1,585 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/gorilla/mux"
+)
+
+// WebDAV access (class 1, no locks) below /webdav:
+//
+// /webdav/                          collection of the buckets the user can read
+// /webdav/{bucket}/                 bucket root
+// /webdav/{bucket}/{folder}/{file}  folders and files
+//
+// Clients authenticate with Basic auth, the password is the SAGE token (the username is ignored).
+// Requests without credentials are anonymous and are challenged once access is denied.
+
+const webdavPrefix = "/webdav"
+
+const webdavChallenge = `Basic realm="SAGE"`
+
+const webdavAllowedMethods = "OPTIONS, PROPFIND, GET, HEAD, PUT, DELETE, MKCOL, COPY, MOVE"
+
+// WebDAVMultistatus response of PROPFIND and of partially failed DELETE, COPY and MOVE
+type WebDAVMultistatus struct {
+	XMLName   xml.Name          `xml:"D:multistatus"`
+	XmlnsD    string            `xml:"xmlns:D,attr"`
+	Responses []*WebDAVResponse `xml:"D:response"`
+}
+
+// WebDAVResponse properties of one resource, or its status
+type WebDAVResponse struct {
+	Href     string          `xml:"D:href"`
+	Status   string          `xml:"D:status,omitempty"`
+	Propstat *WebDAVPropstat `xml:"D:propstat,omitempty"`
+}
+
+// WebDAVPropstat _
+type WebDAVPropstat struct {
+	Prop   WebDAVProp `xml:"D:prop"`
+	Status string     `xml:"D:status"`
+}
+
+// WebDAVProp live properties of files and collections
+type WebDAVProp struct {
+	DisplayName   string             `xml:"D:displayname,omitempty"`
+	ResourceType  WebDAVResourceType `xml:"D:resourcetype"`
+	ContentLength *int64             `xml:"D:getcontentlength,omitempty"`
+	ContentType   string             `xml:"D:getcontenttype,omitempty"`
+	LastModified  string             `xml:"D:getlastmodified,omitempty"`
+	ETag          string             `xml:"D:getetag,omitempty"`
+}
+
+// WebDAVResourceType is empty for files
+type WebDAVResourceType struct {
+	Collection *struct{} `xml:"D:collection,omitempty"`
+}
+
+func webdavHref(sageBucketID string, sagePath string) string {
+	if sageBucketID == "" {
+		return webdavPrefix + "/"
+	}
+	if sagePath == "" {
+		sagePath = "/"
+	}
+	return webdavPrefix + "/" + sageBucketID + s3URIEncode(sagePath, false)
+}
+
+func webdavStatus(statusCode int) string {
+	return fmt.Sprintf("HTTP/1.1 %d %s", statusCode, http.StatusText(statusCode))
+}
+
+// webdavAuthMW maps Basic auth to the SAGE token authentication
+func webdavAuthMW(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+
+	// a rejected token has to trigger a new password prompt
+	w.Header().Set("WWW-Authenticate", webdavChallenge)
+
+	if _, password, ok := r.BasicAuth(); ok {
+		r.Header.Set("Authorization", "sage "+password)
+	}
+	authMW(w, r, next)
+}
+
+// webdavDenied anonymous users are asked for credentials
+func webdavDenied(w http.ResponseWriter, username string, msg string, args ...interface{}) {
+	if username == "" {
+		w.Header().Set("WWW-Authenticate", webdavChallenge)
+		respondJSONError(w, http.StatusUnauthorized, msg, args...)
+		return
+	}
+	respondJSONError(w, http.StatusForbidden, msg, args...)
+}
+
+// parseWebDAVPath splits /webdav/{bucket}/{path} into bucket and SAGE path ("" for the bucket itself)
+func parseWebDAVPath(urlPath string) (sageBucketID string, sagePath string, err error) {
+
+	if urlPath != webdavPrefix && !strings.HasPrefix(urlPath, webdavPrefix+"/") {
+		err = fmt.Errorf("path has to start with %s/", webdavPrefix)
+		return
+	}
+	fields := strings.SplitN(strings.TrimPrefix(strings.TrimPrefix(urlPath, webdavPrefix), "/"), "/", 2)
+	sageBucketID = fields[0]
+	if len(fields) == 2 && fields[1] != "" {
+		sagePath = "/" + fields[1]
+		if path.Clean(sagePath) != strings.TrimSuffix(sagePath, "/") {
+			err = fmt.Errorf("invalid path %s", urlPath)
+			return
+		}
+	}
+	return
+}
+
+// webdavHandler dispatches all requests below /webdav
+func webdavHandler(w http.ResponseWriter, r *http.Request) {
+
+	username := mux.Vars(r)["username"]
+	w.Header().Del("WWW-Authenticate")
+
+	if r.Method == http.MethodOptions {
+		w.Header().Set("DAV", "1")
+		w.Header().Set("Allow", webdavAllowedMethods)
+		w.Header().Set("MS-Author-Via", "DAV")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	sageBucketID, sagePath, err := parseWebDAVPath(r.URL.Path)
+	if err != nil {
+		respondJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if sageBucketID == "" {
+		if r.Method != "PROPFIND" {
+			respondJSONError(w, http.StatusMethodNotAllowed, "buckets are created and deleted with the SAGE API")
+			return
+		}
+		webdavPropfindBuckets(w, r, username)
+		return
+	}
+
+	if len(sageBucketID) != 36 {
+		respondJSONError(w, http.StatusNotFound, "Bucket %s not found", sageBucketID)
+		return
+	}
+	_, err = GetSageBucket(sageBucketID)
+	if err != nil {
+		respondError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	access, err := getBucketAccess(username, sageBucketID)
+	if err != nil {
+		respondError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	switch r.Method {
+	case "PROPFIND":
+		webdavPropfind(w, r, username, access, sageBucketID, sagePath)
+	case http.MethodGet, http.MethodHead:
+		webdavGet(w, r, username, access, sageBucketID, sagePath)
+	case http.MethodPut:
+		webdavPut(w, r, username, access, sageBucketID, sagePath)
+	case http.MethodDelete:
+		webdavDelete(w, r, username, access, sageBucketID, sagePath)
+	case "MKCOL":
+		webdavMkcol(w, r, username, access, sageBucketID, sagePath)
+	case "COPY", "MOVE":
+		webdavCopy(w, r, username, access, sageBucketID, sagePath, r.Method == "MOVE")
+	default:
+		w.Header().Set("Allow", webdavAllowedMethods)
+		respondJSONError(w, http.StatusMethodNotAllowed, "method %s not supported", r.Method)
+	}
+}
+
+func respondMultistatus(w http.ResponseWriter, responses []*WebDAVResponse) {
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(http.StatusMultiStatus)
+
+	s, err := xml.Marshal(&WebDAVMultistatus{XmlnsD: "DAV:", Responses: responses})
+	if err == nil {
+		w.Write([]byte(xml.Header))
+		w.Write(s)
+	}
+}
+
+func collectionResponse(href string, name string, lastModified *time.Time) *WebDAVResponse {
+	prop := WebDAVProp{DisplayName: name, ResourceType: WebDAVResourceType{Collection: &struct{}{}}}
+	if lastModified != nil {
+		prop.LastModified = lastModified.UTC().Format(http.TimeFormat)
+	}
+	return &WebDAVResponse{Href: href, Propstat: &WebDAVPropstat{Prop: prop, Status: webdavStatus(http.StatusOK)}}
+}
+
+func fileResponse(href string, name string, size int64, contentType string, lastModified *time.Time, etag string) *WebDAVResponse {
+	prop := WebDAVProp{DisplayName: name, ContentLength: &size, ContentType: contentType, ETag: etag}
+	if lastModified != nil {
+		prop.LastModified = lastModified.UTC().Format(http.TimeFormat)
+	}
+	return &WebDAVResponse{Href: href, Propstat: &WebDAVPropstat{Prop: prop, Status: webdavStatus(http.StatusOK)}}
+}
+
+// webdavDepth infinity is not supported, it is treated like 1
+func webdavDepth(r *http.Request) string {
+	if r.Header.Get("Depth") == "0" {
+		return "0"
+	}
+	return "1"
+}
+
+// PROPFIND /webdav/ lists the buckets, the display name is the bucket name
+func webdavPropfindBuckets(w http.ResponseWriter, r *http.Request, username string) {
+
+	io.Copy(ioutil.Discard, r.Body)
+
+	responses := []*WebDAVResponse{collectionResponse(webdavHref("", ""), "SAGE", nil)}
+	if webdavDepth(r) == "1" {
+		buckets, err := listSageBuckets(username, "", "")
+		if err != nil {
+			respondError(w, err, http.StatusInternalServerError)
+			return
+		}
+		for _, b := range buckets {
+			name := b.Name
+			if name == "" {
+				name = b.ID
+			}
+			responses = append(responses, collectionResponse(webdavHref(b.ID, "/"), name, b.TimeCreated))
+		}
+	}
+
+	respondMultistatus(w, responses)
+}
+
+// PROPFIND /webdav/{bucket}/{path}, the requested properties are ignored, all live properties are returned
+func webdavPropfind(w http.ResponseWriter, r *http.Request, username string, access *bucketAccess, sageBucketID string, sagePath string) {
+
+	io.Copy(ioutil.Discard, r.Body)
+
+	if !allowsAnyOnPath(access, sagePath, actionReadObject, actionListObjects) {
+		webdavDenied(w, username, "Read access to %s denied", sagePath)
+		return
+	}
+
+	res, err := resolveSageResource(sageBucketID, sagePath)
+	if err != nil {
+		respondError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if res == nil {
+		respondJSONError(w, http.StatusNotFound, "%s not found", sagePath)
+		return
+	}
+
+	if !res.isFolder() {
+		if !access.allows(actionReadObject, aclKey(res.sagePath)) {
+			webdavDenied(w, username, "Read access to %s denied", res.sagePath)
+			return
+		}
+		head := res.head
+		respondMultistatus(w, []*WebDAVResponse{fileResponse(webdavHref(sageBucketID, res.sagePath), path.Base(res.sagePath), aws.Int64Value(head.ContentLength), aws.StringValue(head.ContentType), head.LastModified, aws.StringValue(head.ETag))})
+		return
+	}
+
+	folderKey := aclKey(res.sagePath)
+	if !access.allows(actionListObjects, folderKey) {
+		webdavDenied(w, username, "List access to %s denied", res.sagePath)
+		return
+	}
+
+	name := path.Base(res.sagePath)
+	if res.sagePath == "/" {
+		name = sageBucketID
+	}
+	responses := []*WebDAVResponse{collectionResponse(webdavHref(sageBucketID, res.sagePath), name, nil)}
+
+	if webdavDepth(r) == "1" {
+		continuationToken := ""
+		for {
+			listObject, err := listSageBucketContent(sageBucketID, res.sagePath, false, copyListLimit, "", continuationToken)
+			if err != nil {
+				respondError(w, err, http.StatusInternalServerError)
+				return
+			}
+			filterListObject(access, res.sagePath, listObject)
+
+			for _, cp := range listObject.CommonPrefixes {
+				relative := aws.StringValue(cp.Prefix)
+				responses = append(responses, collectionResponse(webdavHref(sageBucketID, res.sagePath+relative), strings.TrimSuffix(relative, "/"), nil))
+			}
+			for _, object := range listObject.Contents {
+				relative := aws.StringValue(object.Key)
+				if relative == "" {
+					// marker of the folder itself
+					continue
+				}
+				contentType := mime.TypeByExtension(path.Ext(relative))
+				responses = append(responses, fileResponse(webdavHref(sageBucketID, res.sagePath+relative), relative, aws.Int64Value(object.Size), contentType, object.LastModified, aws.StringValue(object.ETag)))
+			}
+
+			if !aws.BoolValue(listObject.IsTruncated) {
+				break
+			}
+			continuationToken = aws.StringValue(listObject.NextContinuationToken)
+		}
+	}
+
+	respondMultistatus(w, responses)
+}
+
+// GET|HEAD /webdav/{bucket}/{file}
+func webdavGet(w http.ResponseWriter, r *http.Request, username string, access *bucketAccess, sageBucketID string, sagePath string) {
+
+	if sagePath == "" || strings.HasSuffix(sagePath, "/") {
+		respondJSONError(w, http.StatusMethodNotAllowed, "use PROPFIND to list folders")
+		return
+	}
+	if !access.allows(actionReadObject, aclKey(sagePath)) {
+		webdavDenied(w, username, "Read access to %s denied", sagePath)
+		return
+	}
+
+	downloadSageObject(w, r, sageBucketID, sagePath)
+}
+
+// PUT /webdav/{bucket}/{file} creates or replaces a file
+func webdavPut(w http.ResponseWriter, r *http.Request, username string, access *bucketAccess, sageBucketID string, sagePath string) {
+
+	if sagePath == "" || strings.HasSuffix(sagePath, "/") {
+		respondJSONError(w, http.StatusMethodNotAllowed, "use MKCOL to create folders")
+		return
+	}
+	key := aclKey(sagePath)
+	if !access.allows(actionWriteObject, key) {
+		webdavDenied(w, username, "Write access to %s denied", sagePath)
+		return
+	}
+
+	_, err := headSageObject(sageBucketID, sagePath)
+	existed := err == nil
+
+	expected, err := parseExpectedChecksums(r.Header, r.ContentLength)
+	if err != nil {
+		respondJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	contentType := r.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = mime.TypeByExtension(path.Ext(key))
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	statusCode, err := putVerifiedSageObject(sageBucketID, key, r.Body, username, contentType, expected)
+	if err != nil {
+		respondJSONError(w, statusCode, err.Error())
+		return
+	}
+	fileUploadCounter.Inc()
+
+	if existed {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+// DELETE /webdav/{bucket}/{path}, folders are deleted with all files below them
+func webdavDelete(w http.ResponseWriter, r *http.Request, username string, access *bucketAccess, sageBucketID string, sagePath string) {
+
+	if sagePath == "" || sagePath == "/" {
+		respondJSONError(w, http.StatusForbidden, "buckets are deleted with the SAGE API")
+		return
+	}
+
+	if !allowsAnyOnPath(access, sagePath, actionDeleteObject, actionListObjects) {
+		webdavDenied(w, username, "Delete access to %s denied", sagePath)
+		return
+	}
+
+	res, err := resolveSageResource(sageBucketID, sagePath)
+	if err != nil {
+		respondError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if res == nil {
+		respondJSONError(w, http.StatusNotFound, "%s not found", sagePath)
+		return
+	}
+
+	if !res.isFolder() {
+		if !access.allows(actionDeleteObject, aclKey(res.sagePath)) {
+			webdavDenied(w, username, "Delete access to %s denied", res.sagePath)
+			return
+		}
+		_, err = deleteSAGEFiles(sageBucketID, []string{res.sagePath})
+		if err != nil {
+			respondError(w, err, http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	response := &BulkDeleteResponse{Bucket: sageBucketID, Deleted: []string{}}
+	statusCode, err := deleteFolder(access, sageBucketID, res.sagePath, response)
+	if err != nil {
+		respondJSONError(w, statusCode, err.Error())
+		return
+	}
+	log.Printf("WebDAV delete of %s/%s: %d deleted, %d failed", sageBucketID, res.sagePath, len(response.Deleted), len(response.Errors))
+
+	if len(response.Errors) > 0 {
+		if len(response.Deleted) == 0 && username == "" {
+			webdavDenied(w, username, "Delete access to %s denied", res.sagePath)
+			return
+		}
+		responses := []*WebDAVResponse{}
+		for _, e := range response.Errors {
+			responses = append(responses, &WebDAVResponse{Href: webdavHref(sageBucketID, "/"+e.Key), Status: webdavStatus(http.StatusForbidden)})
+		}
+		respondMultistatus(w, responses)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// MKCOL /webdav/{bucket}/{folder} creates an empty folder
+func webdavMkcol(w http.ResponseWriter, r *http.Request, username string, access *bucketAccess, sageBucketID string, sagePath string) {
+
+	if r.ContentLength > 0 {
+		respondJSONError(w, http.StatusUnsupportedMediaType, "MKCOL with body is not supported")
+		return
+	}
+	if sagePath == "" || sagePath == "/" {
+		respondJSONError(w, http.StatusMethodNotAllowed, "the bucket already exists")
+		return
+	}
+
+	folder := strings.TrimSuffix(sagePath, "/") + "/"
+	if !access.allows(actionWriteObject, aclKey(folder)) {
+		webdavDenied(w, username, "Write access to %s denied", folder)
+		return
+	}
+
+	res, err := resolveSageResource(sageBucketID, sagePath)
+	if err != nil {
+		respondError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if res != nil {
+		respondJSONError(w, http.StatusMethodNotAllowed, "%s already exists", sagePath)
+		return
+	}
+
+	_, err = putSageFolderMarker(sageBucketID, folder, username)
+	if err != nil {
+		respondError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+}
+
+// COPY|MOVE /webdav/{bucket}/{path} with Destination: <URL below /webdav/>, the destination can be in another bucket.
+// With Overwrite: F an existing destination is not replaced. Folders are merged into an existing destination folder.
+func webdavCopy(w http.ResponseWriter, r *http.Request, username string, access *bucketAccess, sageBucketID string, sagePath string, move bool) {
+
+	destinationURL, err := url.Parse(r.Header.Get("Destination"))
+	if err != nil || r.Header.Get("Destination") == "" {
+		respondJSONError(w, http.StatusBadRequest, "Destination header missing or invalid")
+		return
+	}
+	dstBucketID, dstPath, err := parseWebDAVPath(destinationURL.Path)
+	if err != nil || dstBucketID == "" || dstPath == "" || dstPath == "/" {
+		respondJSONError(w, http.StatusBadGateway, "Destination has to be a file or folder below %s/{bucket}/", webdavPrefix)
+		return
+	}
+	if dstBucketID != sageBucketID {
+		if len(dstBucketID) != 36 {
+			respondJSONError(w, http.StatusConflict, "Bucket %s not found", dstBucketID)
+			return
+		}
+		_, err = GetSageBucket(dstBucketID)
+		if err != nil {
+			// a missing destination bucket is a missing intermediate collection
+			statusCode := errorStatus(err, http.StatusInternalServerError)
+			if statusCode == http.StatusNotFound {
+				statusCode = http.StatusConflict
+			}
+			respondJSONError(w, statusCode, err.Error())
+			return
+		}
+	}
+
+	if sagePath == "" || sagePath == "/" {
+		respondJSONError(w, http.StatusForbidden, "buckets cannot be copied or moved, see ?clone")
+		return
+	}
+
+	// neither source nor destination are resolved before the user is known to have access to them
+	if !allowsAnyOnPath(access, sagePath, actionReadObject, actionListObjects) {
+		webdavDenied(w, username, "Read access to %s denied", sagePath)
+		return
+	}
+	dstAccess, err := getBucketAccess(username, dstBucketID)
+	if err != nil {
+		respondError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if !allowsAnyOnPath(dstAccess, dstPath, actionWriteObject) {
+		webdavDenied(w, username, "Write access to %s denied (%s)", dstPath, dstBucketID)
+		return
+	}
+
+	res, err := resolveSageResource(sageBucketID, sagePath)
+	if err != nil {
+		respondError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if res == nil {
+		respondJSONError(w, http.StatusNotFound, "%s not found", sagePath)
+		return
+	}
+
+	destination := strings.TrimSuffix(dstPath, "/")
+	if res.isFolder() {
+		destination += "/"
+	}
+	if dstBucketID == sageBucketID && strings.HasPrefix(destination, res.sagePath) {
+		respondJSONError(w, http.StatusForbidden, "Destination is the source or lies below it")
+		return
+	}
+
+	existing, err := resolveSageResource(dstBucketID, destination)
+	if err != nil {
+		respondError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if existing != nil && r.Header.Get("Overwrite") == "F" {
+		respondJSONError(w, http.StatusPreconditionFailed, "%s exists", destination)
+		return
+	}
+
+	result := &ObjectCopy{Bucket: sageBucketID, Key: aclKey(res.sagePath), DestinationBucket: dstBucketID, Destination: destination, Created: []string{}}
+	c, err := newCopier(username, sageBucketID, dstBucketID, move, result)
+	if err != nil {
+		respondError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	statusCode, err := c.run(res.sagePath, destination)
+	if err != nil {
+		log.Printf("WebDAV %s of %s/%s failed after %d files: %s", r.Method, sageBucketID, res.sagePath, len(result.Created), err.Error())
+		if statusCode == http.StatusUnauthorized {
+			webdavDenied(w, username, err.Error())
+			return
+		}
+		respondJSONError(w, statusCode, err.Error())
+		return
+	}
+
+	log.Printf("WebDAV %s of %s/%s to %s/%s: %d files", r.Method, sageBucketID, res.sagePath, dstBucketID, destination, len(result.Created))
+	if existing != nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestWebDAV(t *testing.T) {
+
+	testuser := "testuser"
+
+	newBucket, err := createSageBucket(testuser, "training-data", "testing-bucket1", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bucketID := newBucket.ID
+
+	// the bucket is listed in the top-level collection
+	rr := testRequest(t, testuser, "PROPFIND", "/webdav/", nil, map[string]string{"Depth": "1"})
+	expectStatus(t, rr, http.StatusMultiStatus)
+	if !strings.Contains(rr.Body.String(), fmt.Sprintf("<D:href>/webdav/%s/</D:href>", bucketID)) {
+		t.Fatalf("bucket missing in listing: %s", rr.Body.String())
+	}
+
+	expectStatus(t, testRequest(t, testuser, "MKCOL", "/webdav/"+bucketID+"/data", nil, nil), http.StatusCreated)
+	expectStatus(t, testRequest(t, testuser, "MKCOL", "/webdav/"+bucketID+"/data", nil, nil), http.StatusMethodNotAllowed)
+	expectStatus(t, testRequest(t, testuser, "PUT", "/webdav/"+bucketID+"/data/a.txt", strings.NewReader("file a"), nil), http.StatusCreated)
+	expectStatus(t, testRequest(t, testuser, "PUT", "/webdav/"+bucketID+"/data/a.txt", strings.NewReader("file a"), nil), http.StatusNoContent)
+
+	rr = testRequest(t, testuser, "PROPFIND", "/webdav/"+bucketID+"/data", nil, map[string]string{"Depth": "1"})
+	expectStatus(t, rr, http.StatusMultiStatus)
+	if !strings.Contains(rr.Body.String(), fmt.Sprintf("<D:href>/webdav/%s/data/a.txt</D:href>", bucketID)) {
+		t.Fatalf("file missing in listing: %s", rr.Body.String())
+	}
+
+	rr = testRequest(t, testuser, "GET", "/webdav/"+bucketID+"/data/a.txt", nil, nil)
+	expectStatus(t, rr, http.StatusOK)
+	if rr.Body.String() != "file a" {
+		t.Fatalf("unexpected content: %s", rr.Body.String())
+	}
+
+	// clients send the token as password of Basic auth
+	basicAuth := "Basic " + base64.StdEncoding.EncodeToString([]byte(testuser+":user:"+testuser))
+	expectStatus(t, testRequest(t, "", "GET", "/webdav/"+bucketID+"/data/a.txt", nil, map[string]string{"Authorization": basicAuth}), http.StatusOK)
+
+	// anonymous users are challenged, other users are denied
+	rr = testRequest(t, "", "GET", "/webdav/"+bucketID+"/data/a.txt", nil, nil)
+	expectStatus(t, rr, http.StatusUnauthorized)
+	if rr.Header().Get("WWW-Authenticate") == "" {
+		t.Fatalf("WWW-Authenticate header missing")
+	}
+	expectStatus(t, testRequest(t, "otheruser", "GET", "/webdav/"+bucketID+"/data/a.txt", nil, nil), http.StatusForbidden)
+
+	destination := func(resource string) map[string]string {
+		return map[string]string{"Destination": "http://localhost/webdav/" + bucketID + "/" + resource, "Overwrite": "F"}
+	}
+
+	// users without access get the same response for existing and missing paths
+	for _, resource := range []string{"data/a.txt", "data/missing.txt"} {
+		expectStatus(t, testRequest(t, "otheruser", "PROPFIND", "/webdav/"+bucketID+"/"+resource, nil, map[string]string{"Depth": "0"}), http.StatusForbidden)
+		expectStatus(t, testRequest(t, "otheruser", "DELETE", "/webdav/"+bucketID+"/"+resource, nil, nil), http.StatusForbidden)
+		expectStatus(t, testRequest(t, "otheruser", "COPY", "/webdav/"+bucketID+"/"+resource, nil, destination("copy.txt")), http.StatusForbidden)
+		expectStatus(t, testRequest(t, "", "PROPFIND", "/webdav/"+bucketID+"/"+resource, nil, map[string]string{"Depth": "0"}), http.StatusUnauthorized)
+	}
+	expectStatus(t, testRequest(t, "otheruser", "MKCOL", "/webdav/"+bucketID+"/data", nil, nil), http.StatusForbidden)
+
+	expectStatus(t, testRequest(t, testuser, "COPY", "/webdav/"+bucketID+"/data/a.txt", nil, destination("data/b.txt")), http.StatusCreated)
+	expectStatus(t, testRequest(t, testuser, "COPY", "/webdav/"+bucketID+"/data/a.txt", nil, destination("data/b.txt")), http.StatusPreconditionFailed)
+	expectStatus(t, testRequest(t, testuser, "COPY", "/webdav/"+bucketID+"/data", nil, destination("data/sub")), http.StatusForbidden)
+	expectStatus(t, testRequest(t, testuser, "MOVE", "/webdav/"+bucketID+"/data", nil, destination("moved")), http.StatusCreated)
+	expectStatus(t, testRequest(t, testuser, "GET", "/webdav/"+bucketID+"/data/a.txt", nil, nil), http.StatusNotFound)
+
+	rr = testRequest(t, testuser, "GET", "/webdav/"+bucketID+"/moved/b.txt", nil, nil)
+	expectStatus(t, rr, http.StatusOK)
+	if rr.Body.String() != "file a" {
+		t.Fatalf("unexpected content: %s", rr.Body.String())
+	}
+
+	expectStatus(t, testRequest(t, testuser, "DELETE", "/webdav/"+bucketID+"/moved", nil, nil), http.StatusNoContent)
+	expectStatus(t, testRequest(t, testuser, "PROPFIND", "/webdav/"+bucketID+"/moved", nil, map[string]string{"Depth": "0"}), http.StatusNotFound)
+}